@@ -5,7 +5,11 @@
 // Package apitype contains types for the Tailscale local API and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -30,3 +34,92 @@ type WaitingFile struct {
 	Name string
 	Size int64
 }
+
+// ControlHealthMessage is a health problem reported by the control
+// plane, and whether it's been acknowledged or snoozed on this node.
+type ControlHealthMessage struct {
+	// ID is the message's stable ID, used to acknowledge or snooze
+	// it. It stays the same for as long as the Text does.
+	ID   string
+	Text string
+
+	// Acked is whether the message has been acknowledged, and is
+	// thus omitted from the node's health state for as long as
+	// control reports it.
+	Acked bool `json:",omitempty"`
+
+	// SnoozedUntil, if non-zero, is when the message stops being
+	// snoozed and is again included in the node's health state.
+	SnoozedUntil time.Time `json:",omitempty"`
+}
+
+// CertInfo is a TLS certificate that tailscaled has obtained for the
+// node and keeps on local disk.
+type CertInfo struct {
+	Names     []string // DNS names the cert is for, the primary one first
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	CertPath string // PEM certificate chain
+	KeyPath  string // PEM private key
+}
+
+// CertEvent is a notification that tailscaled has obtained a cert.
+type CertEvent struct {
+	CertInfo
+
+	// Renewal is whether the cert replaced an earlier one for the
+	// same names, at the same paths.
+	Renewal bool
+}
+
+// SSHRecording is a Tailscale SSH session recorded to the node's local
+// disk, in asciinema v2 format.
+type SSHRecording struct {
+	// ID is the recording's file name in the recordings directory.
+	ID string
+
+	Start     time.Time
+	LastWrite time.Time // when the recording was last written; its end, if done
+	Size      int64     // in bytes
+
+	SSHUser   string // the requested SSH user
+	LocalUser string // the local user the session ran as
+	SrcNode   string // the connecting node's name
+	SrcUser   string // the connecting node's user's login name
+	SrcAddr   string // the connection's source Tailscale IP and port
+}
+
+// Notification is a user-facing event from tailscaled, for GUI clients
+// to show as a desktop notification.
+type Notification struct {
+	// ID identifies what the notification is about. It's stable:
+	// a later notification with the same ID (such as a health
+	// problem being resolved) replaces any earlier one.
+	ID string
+
+	Type     NotificationType
+	Severity NotificationSeverity
+	Title    string
+	Body     string
+	Time     time.Time
+}
+
+// NotificationType is the kind of event a Notification is about.
+type NotificationType string
+
+const (
+	NotificationHealth       = NotificationType("health")        // a health problem started or ended
+	NotificationKeyExpiry    = NotificationType("key-expiry")    // the node key expires soon
+	NotificationFileReceived = NotificationType("file-received") // a Taildrop file arrived
+	NotificationExitNode     = NotificationType("exit-node")     // the exit node changed
+)
+
+// NotificationSeverity is how prominently a Notification should be shown.
+type NotificationSeverity string
+
+const (
+	SeverityInfo    = NotificationSeverity("info")
+	SeverityWarning = NotificationSeverity("warning")
+	SeverityError   = NotificationSeverity("error")
+)
@@ -30,12 +30,14 @@
 
 	"go4.org/mem"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/tkatype"
 )
 
 // defaultLocalClient is the default LocalClient when using the legacy
@@ -255,6 +257,13 @@ func (lc *LocalClient) DaemonMetrics(ctx context.Context) ([]byte, error) {
 	return lc.get200(ctx, "/localapi/v0/metrics")
 }
 
+// SnapshotAndResetDaemonMetrics is like DaemonMetrics, but counters are
+// reported as their increase since the previous call, which resets
+// them. Metrics uploaded with logs are unaffected.
+func (lc *LocalClient) SnapshotAndResetDaemonMetrics(ctx context.Context) ([]byte, error) {
+	return lc.send(ctx, "POST", "/localapi/v0/metrics?reset=true", 200, nil)
+}
+
 // Profile returns a pprof profile of the Tailscale daemon.
 func (lc *LocalClient) Profile(ctx context.Context, pprofType string, sec int) ([]byte, error) {
 	var secArg string
@@ -333,6 +342,61 @@ func (lc *LocalClient) IDToken(ctx context.Context, aud string) (*tailcfg.TokenR
 	return tr, nil
 }
 
+// TKASign has tailscaled sign a serialized AUM with its network-lock
+// key, once it has checked the update, and returns the signatures. It
+// suits the Sign field of a tka.RemoteSigner.
+func (lc *LocalClient) TKASign(ctx context.Context, serializedAUM []byte) ([]tkatype.Signature, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/tka-sign", 200, bytes.NewReader(serializedAUM))
+	if err != nil {
+		return nil, err
+	}
+	var sigs []tkatype.Signature
+	if err := json.Unmarshal(body, &sigs); err != nil {
+		return nil, fmt.Errorf("invalid tka-sign json: %w", err)
+	}
+	return sigs, nil
+}
+
+// TKAStatus returns the tailnet key authority's head and trusted keys.
+func (lc *LocalClient) TKAStatus(ctx context.Context) (*ipnstate.TKAStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/tka-status")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.TKAStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, fmt.Errorf("invalid tka-status json: %w", err)
+	}
+	return st, nil
+}
+
+// TKALog returns up to limit of the tailnet key authority's most recent
+// updates, newest first.
+func (lc *LocalClient) TKALog(ctx context.Context, limit int) ([]ipnstate.TKAUpdate, error) {
+	body, err := lc.get200(ctx, fmt.Sprintf("/localapi/v0/tka-log?limit=%d", limit))
+	if err != nil {
+		return nil, err
+	}
+	var updates []ipnstate.TKAUpdate
+	if err := json.Unmarshal(body, &updates); err != nil {
+		return nil, fmt.Errorf("invalid tka-log json: %w", err)
+	}
+	return updates, nil
+}
+
+// TKANodeKeySignature returns tailscaled's node key signature, which it
+// replaces before it expires.
+func (lc *LocalClient) TKANodeKeySignature(ctx context.Context) (tkatype.MarshaledSignature, error) {
+	return lc.get200(ctx, "/localapi/v0/tka-node-key-signature")
+}
+
+// SetTKANodeKeySignature sets tailscaled's node key signature, which it
+// stores and sends to the control plane.
+func (lc *LocalClient) SetTKANodeKeySignature(ctx context.Context, sig tkatype.MarshaledSignature) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/tka-node-key-signature", http.StatusNoContent, bytes.NewReader(sig))
+	return err
+}
+
 func (lc *LocalClient) WaitingFiles(ctx context.Context) ([]apitype.WaitingFile, error) {
 	body, err := lc.get200(ctx, "/localapi/v0/files/")
 	if err != nil {
@@ -565,6 +629,147 @@ func (lc *LocalClient) CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, er
 	return &derpMap, nil
 }
 
+// DebugControl returns diagnostics about the local tailscaled's recent
+// attempts to connect to its control server.
+func (lc *LocalClient) DebugControl(ctx context.Context) (*ipnstate.ControlDiag, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/debug-control")
+	if err != nil {
+		return nil, err
+	}
+	diag := new(ipnstate.ControlDiag)
+	if err := json.Unmarshal(body, diag); err != nil {
+		return nil, fmt.Errorf("invalid control diagnostics json: %w", err)
+	}
+	return diag, nil
+}
+
+// AuditLog returns the entries in the local audit log of prefs and
+// policy changes at or after since (if non-zero), oldest first. If
+// limit is positive, only the most recent limit entries are returned.
+func (lc *LocalClient) AuditLog(ctx context.Context, since time.Time, limit int) ([]ipnstate.AuditLogEntry, error) {
+	v := url.Values{}
+	if !since.IsZero() {
+		v.Set("since", since.Format(time.RFC3339))
+	}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+	body, err := lc.get200(ctx, "/localapi/v0/audit-log?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var entries []ipnstate.AuditLogEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("invalid audit log json: %w", err)
+	}
+	return entries, nil
+}
+
+// LogLevels returns tailscaled's per-component log levels, keyed by
+// component name (such as "magicsock").
+func (lc *LocalClient) LogLevels(ctx context.Context) (map[string]string, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/log-levels")
+	if err != nil {
+		return nil, err
+	}
+	return decodeLogLevels(body)
+}
+
+// SetLogLevel sets the log level of the named tailscaled component.
+// The level is as accepted by logger.Level.UnmarshalText, such as
+// "DEBUG", "DEBUG-4" or "INFO". It returns the resulting levels of all
+// components.
+func (lc *LocalClient) SetLogLevel(ctx context.Context, component, level string) (map[string]string, error) {
+	v := url.Values{"component": {component}, "level": {level}}
+	body, err := lc.send(ctx, "POST", "/localapi/v0/log-levels?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLogLevels(body)
+}
+
+func decodeLogLevels(body []byte) (map[string]string, error) {
+	var levels map[string]string
+	if err := json.Unmarshal(body, &levels); err != nil {
+		return nil, fmt.Errorf("invalid log levels json: %w", err)
+	}
+	return levels, nil
+}
+
+// HealthState returns the node's health state: the state of each
+// subsystem, DERP region and control plane connection, and the
+// overall status.
+func (lc *LocalClient) HealthState(ctx context.Context) (*health.State, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/health")
+	if err != nil {
+		return nil, err
+	}
+	st := new(health.State)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, fmt.Errorf("invalid health json: %w", err)
+	}
+	return st, nil
+}
+
+// Doctor runs all of tailscaled's health checks now, including its
+// active probes, and returns the result.
+func (lc *LocalClient) Doctor(ctx context.Context) (*health.Report, error) {
+	body, err := lc.send(ctx, "POST", "/localapi/v0/doctor", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := new(health.Report)
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("invalid doctor json: %w", err)
+	}
+	return r, nil
+}
+
+// ControlHealth returns the health problems reported by the control
+// plane, with their IDs and whether each is acknowledged or snoozed.
+func (lc *LocalClient) ControlHealth(ctx context.Context) ([]apitype.ControlHealthMessage, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/control-health")
+	if err != nil {
+		return nil, err
+	}
+	var msgs []apitype.ControlHealthMessage
+	if err := json.Unmarshal(body, &msgs); err != nil {
+		return nil, fmt.Errorf("invalid control health json: %w", err)
+	}
+	return msgs, nil
+}
+
+// SSHRecordings returns the Tailscale SSH sessions recorded to the
+// node's local disk, newest first.
+func (lc *LocalClient) SSHRecordings(ctx context.Context) ([]apitype.SSHRecording, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh-recordings")
+	if err != nil {
+		return nil, err
+	}
+	var recs []apitype.SSHRecording
+	if err := json.Unmarshal(body, &recs); err != nil {
+		return nil, fmt.Errorf("invalid ssh recordings json: %w", err)
+	}
+	return recs, nil
+}
+
+// AckControlHealth acknowledges the control plane health message with
+// the given ID, so it's no longer part of the node's health state for
+// as long as control reports it.
+func (lc *LocalClient) AckControlHealth(ctx context.Context, id string) error {
+	v := url.Values{"id": {id}}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/control-health-ack?"+v.Encode(), 200, nil)
+	return err
+}
+
+// SnoozeControlHealth is like AckControlHealth, but only omits the
+// message from the node's health state for the duration d.
+func (lc *LocalClient) SnoozeControlHealth(ctx context.Context, id string, d time.Duration) error {
+	v := url.Values{"id": {id}, "snooze": {d.String()}}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/control-health-ack?"+v.Encode(), 200, nil)
+	return err
+}
+
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
@@ -580,7 +785,20 @@ func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err e
 //
 // API maturity: this is considered a stable API.
 func (lc *LocalClient) CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
-	res, err := lc.send(ctx, "GET", "/localapi/v0/cert/"+domain+"?type=pair", 200, nil)
+	return lc.CertPairWithSANs(ctx, domain, nil)
+}
+
+// CertPairWithSANs returns a cert and private key for the provided DNS
+// domain that also covers the extra DNS names sans. The domain and sans may
+// include wildcards for the node's domains, such as "*.foo.bar.ts.net".
+//
+// It returns a cached certificate from disk if it's still valid.
+func (lc *LocalClient) CertPairWithSANs(ctx context.Context, domain string, sans []string) (certPEM, keyPEM []byte, err error) {
+	q := url.Values{"type": {"pair"}}
+	if len(sans) > 0 {
+		q["san"] = sans
+	}
+	res, err := lc.send(ctx, "GET", "/localapi/v0/cert/"+domain+"?"+q.Encode(), 200, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -598,6 +816,92 @@ func (lc *LocalClient) CertPair(ctx context.Context, domain string) (certPEM, ke
 	return certPEM, keyPEM, nil
 }
 
+// Certs returns the TLS certs that tailscaled has obtained and keeps on
+// local disk.
+func (lc *LocalClient) Certs(ctx context.Context) ([]apitype.CertInfo, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/certs")
+	if err != nil {
+		return nil, err
+	}
+	var certs []apitype.CertInfo
+	if err := json.Unmarshal(body, &certs); err != nil {
+		return nil, fmt.Errorf("invalid certs json: %w", err)
+	}
+	return certs, nil
+}
+
+// RenewCert gets a new cert for the provided DNS domain and extra names
+// sans, even if the cached one is still valid.
+func (lc *LocalClient) RenewCert(ctx context.Context, domain string, sans []string) error {
+	q := url.Values{"renew": {"true"}}
+	if len(sans) > 0 {
+		q["san"] = sans
+	}
+	_, err := lc.send(ctx, "POST", "/localapi/v0/cert/"+domain+"?"+q.Encode(), 200, nil)
+	return err
+}
+
+// WatchCertEvents calls fn for each cert that tailscaled obtains or
+// renews, until ctx is done or the connection to tailscaled fails.
+// Programs using a cert's files can reload them when it's called.
+func (lc *LocalClient) WatchCertEvents(ctx context.Context, fn func(apitype.CertEvent)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/cert-events", nil)
+	if err != nil {
+		return err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bestError(fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(body)), body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var ev apitype.CertEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(ev)
+	}
+}
+
+// WatchNotifications calls fn with each user-facing notification from
+// tailscaled, such as health problems and received files, until ctx is
+// done or the connection fails. Notifications with the same ID replace
+// earlier ones.
+func (lc *LocalClient) WatchNotifications(ctx context.Context, fn func(apitype.Notification)) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/notifications", nil)
+	if err != nil {
+		return err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return bestError(fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(body)), body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		var n apitype.Notification
+		if err := dec.Decode(&n); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(n)
+	}
+}
+
 // GetCertificate fetches a TLS certificate for the TLS ClientHello in hi.
 //
 // It returns a cached certificate from disk if it's still valid.
@@ -9,9 +9,13 @@
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -53,29 +57,92 @@ func certProviderByCertMode(mode, dir, hostname string) (certProvider, error) {
 	}
 }
 
+// certReloadInterval is how often manualCertManager checks whether
+// its certificate files have changed.
+const certReloadInterval = 30 * time.Second
+
 type manualCertManager struct {
-	cert     *tls.Certificate
+	cert     atomic.Pointer[tls.Certificate]
 	hostname string
+	crtPath  string
+	keyPath  string
+
+	// Owned by reloadLoop.
+	lastMod time.Time // latest modification time of the cert files
 }
 
 // NewManualCertManager returns a cert provider which read certificate by given hostname on create.
+// It reloads the certificate whenever its files in certdir change.
 func NewManualCertManager(certdir, hostname string) (certProvider, error) {
 	keyname := unsafeHostnameCharacters.ReplaceAllString(hostname, "")
-	crtPath := filepath.Join(certdir, keyname+".crt")
-	keyPath := filepath.Join(certdir, keyname+".key")
-	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	m := &manualCertManager{
+		hostname: hostname,
+		crtPath:  filepath.Join(certdir, keyname+".crt"),
+		keyPath:  filepath.Join(certdir, keyname+".key"),
+	}
+	m.lastMod = m.modTime()
+	cert, err := m.loadCert()
+	if err != nil {
+		return nil, err
+	}
+	m.cert.Store(cert)
+	go m.reloadLoop()
+	return m, nil
+}
+
+// loadCert loads and checks the certificate and key from disk.
+func (m *manualCertManager) loadCert() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(m.crtPath, m.keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("can not load x509 key pair for hostname %q: %w", keyname, err)
+		return nil, fmt.Errorf("can not load x509 key pair for hostname %q: %w", m.hostname, err)
 	}
 	// ensure hostname matches with the certificate
 	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
 		return nil, fmt.Errorf("can not load cert: %w", err)
 	}
-	if err := x509Cert.VerifyHostname(hostname); err != nil {
-		return nil, fmt.Errorf("cert invalid for hostname %q: %w", hostname, err)
+	if err := x509Cert.VerifyHostname(m.hostname); err != nil {
+		return nil, fmt.Errorf("cert invalid for hostname %q: %w", m.hostname, err)
+	}
+	return &cert, nil
+}
+
+// modTime returns the latest modification time of the certificate
+// and key files, or the zero time if neither can be read.
+func (m *manualCertManager) modTime() time.Time {
+	var t time.Time
+	for _, path := range []string{m.crtPath, m.keyPath} {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// reloadLoop periodically reloads the certificate if its files have
+// changed. New TLS handshakes use the new certificate; existing
+// connections are unaffected. If the new files are invalid (say,
+// because they're partially written), the old certificate is kept
+// and loading is retried next time.
+func (m *manualCertManager) reloadLoop() {
+	for range time.Tick(certReloadInterval) {
+		m.maybeReload()
+	}
+}
+
+func (m *manualCertManager) maybeReload() {
+	mod := m.modTime()
+	if mod.IsZero() || mod.Equal(m.lastMod) {
+		return
+	}
+	cert, err := m.loadCert()
+	if err != nil {
+		log.Printf("derper: not reloading changed certificate: %v", err)
+		return
 	}
-	return &manualCertManager{cert: &cert, hostname: hostname}, nil
+	m.lastMod = mod
+	m.cert.Store(cert)
+	log.Printf("derper: reloaded certificate for %q", m.hostname)
 }
 
 func (m *manualCertManager) TLSConfig() *tls.Config {
@@ -96,7 +163,7 @@ func (m *manualCertManager) getCertificate(hi *tls.ClientHelloInfo) (*tls.Certif
 	// Return a shallow copy of the cert so the caller can append to its
 	// Certificate field.
 	certCopy := new(tls.Certificate)
-	*certCopy = *m.cert
+	*certCopy = *m.cert.Load()
 	certCopy.Certificate = certCopy.Certificate[:len(certCopy.Certificate):len(certCopy.Certificate)]
 	return certCopy, nil
 }
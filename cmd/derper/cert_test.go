@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a new self-signed certificate for hostname,
+// and its key, to dir, with the given modification time.
+func writeTestCert(t *testing.T, dir, hostname string, mod time.Time) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(mod.UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		hostname + ".crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		hostname + ".key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, b := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return der
+}
+
+func TestManualCertReload(t *testing.T) {
+	const hostname = "derp.example.com"
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+	der1 := writeTestCert(t, dir, hostname, start)
+
+	cp, err := NewManualCertManager(dir, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cp.(*manualCertManager)
+	checkCert := func(want []byte) {
+		t.Helper()
+		cert, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: hostname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cert.Certificate[0], want) {
+			t.Error("served the wrong certificate")
+		}
+	}
+	checkCert(der1)
+
+	der2 := writeTestCert(t, dir, hostname, start.Add(time.Second))
+	m.maybeReload()
+	checkCert(der2)
+
+	// A broken certificate isn't loaded.
+	crtPath := filepath.Join(dir, hostname+".crt")
+	if err := os.WriteFile(crtPath, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(crtPath, start.Add(2*time.Second), start.Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	m.maybeReload()
+	checkCert(der2)
+}
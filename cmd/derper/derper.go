@@ -21,15 +21,17 @@
 	"net/http"
 	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/time/rate"
 	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
-	"tailscale.com/derp/derphttp"
+	"tailscale.com/derp/derpserver"
 	"tailscale.com/metrics"
 	"tailscale.com/net/stun"
 	"tailscale.com/tsweb"
@@ -43,17 +45,36 @@
 	stunPort   = flag.Int("stun-port", 3478, "The UDP port on which to serve STUN. The listener is bound to the same IP (if any) as specified in the -a flag.")
 	configPath = flag.String("c", "", "config file path")
 	certMode   = flag.String("certmode", "letsencrypt", "mode for getting a cert. possible options: manual, letsencrypt")
-	certDir    = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
+	certDir    = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443; with --certmode=manual, the directory of the hostname's .crt and .key files, which are reloaded when they change")
 	hostname   = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
 	runSTUN    = flag.Bool("stun", true, "whether to run a STUN server. It will bind to the same IP (if any) as the --addr flag value.")
+	stunOnly   = flag.Bool("stun-only", false, "run just the STUN server, without the DERP relay. The -a address then serves only /debug/ and /metrics, over plain HTTP.")
+
+	bindIPv4        = flag.String("bind-ipv4", "", "optional IPv4 address to bind to. If this or --bind-ipv6 is set, the HTTPS, HTTP and STUN listeners bind to just those addresses, by address family, instead of the IP (if any) in the -a flag.")
+	bindIPv6        = flag.String("bind-ipv6", "", "optional IPv6 address to bind to; see --bind-ipv4.")
+	extraHTTPSPorts = flag.String("extra-https-ports", "", "optional comma-separated list of ports on which to also serve HTTPS (or HTTP, when the -a port doesn't use TLS), such as 8443")
+	extraSTUNPorts  = flag.String("extra-stun-ports", "", "optional comma-separated list of UDP ports on which to also serve STUN")
 
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshDNS       = flag.String("mesh-dns", "", "optional DNS name listing the mesh peers, by SRV records or else A/AAAA records (reached by IP, with TLS certs for the name); it's re-resolved every minute. The server itself can be listed")
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	verifyClients = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
+	verifyTags    = flag.String("verify-client-tags", "", "optional comma-separated list of ACL tags; if non-empty, verified clients must have one of them (or --verify-client-cap). Implies --verify-clients.")
+	verifyCap     = flag.String("verify-client-cap", "", "optional capability that the tailnet's ACLs grant to the clients allowed to use this DERP server (or --verify-client-tags). Implies --verify-clients.")
 
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientBytesLimit   = flag.Float64("client-bytes-limit", 0, "if non-zero, the rate limit in bytes per second of packets each client (other than mesh peers) may send; excess packets are dropped")
+	clientBytesBurst   = flag.Int("client-bytes-burst", 0, "burst limit in bytes for --client-bytes-limit; if zero, one second's worth")
+	clientPacketsLimit = flag.Float64("client-packets-limit", 0, "if non-zero, the rate limit in packets per second that each client (other than mesh peers) may send; excess packets are dropped")
+	clientPacketsBurst = flag.Int("client-packets-burst", 0, "burst limit in packets for --client-packets-limit; if zero, one second's worth")
+
+	drainOnSIGTERM = flag.Bool("drain-on-sigterm", false, "drain clients on SIGTERM before exiting, rather than exiting immediately; the service manager's stop timeout must allow for --drain-spread and --drain-timeout")
+	drainSpread    = flag.Duration("drain-spread", time.Minute, "when draining (on a POST to /debug/drain, or SIGTERM with --drain-on-sigterm), the period over which connected clients are told to reconnect elsewhere and disconnected")
+	drainThreshold = flag.Int("drain-threshold", 0, "when draining, exit once at most this many clients (other than mesh peers) remain connected")
+	drainTimeout   = flag.Duration("drain-timeout", 2*time.Minute, "when draining, the maximum time to wait for clients to disconnect before exiting")
 )
 
 var (
@@ -70,11 +91,14 @@
 
 	stunIPv4 = stunAddrFamily.Get("ipv4")
 	stunIPv6 = stunAddrFamily.Get("ipv6")
+
+	stunListeners expvar.Int
 )
 
 func init() {
 	stats.Set("counter_requests", stunDisposition)
 	stats.Set("counter_addrfamily", stunAddrFamily)
+	stats.Set("gauge_listeners", &stunListeners)
 	expvar.Publish("stun", stats)
 	expvar.Publish("derper_tls_request_version", tlsRequestVersion)
 	expvar.Publish("gauge_derper_tls_active_version", tlsActiveVersion)
@@ -139,18 +163,60 @@ func main() {
 		tsweb.DevMode = true
 	}
 
-	listenHost, _, err := net.SplitHostPort(*addr)
+	listenHost, listenPort, err := net.SplitHostPort(*addr)
 	if err != nil {
 		log.Fatalf("invalid server address: %v", err)
 	}
+	if err := checkBindFlags(); err != nil {
+		log.Fatalf("derper: %v", err)
+	}
+	httpsPorts := []string{listenPort}
+	extraPorts, err := parsePorts(*extraHTTPSPorts)
+	if err != nil {
+		log.Fatalf("derper: --extra-https-ports: %v", err)
+	}
+	for _, port := range extraPorts {
+		httpsPorts = append(httpsPorts, fmt.Sprint(port))
+	}
+	stunPorts, err := parsePorts(*extraSTUNPorts)
+	if err != nil {
+		log.Fatalf("derper: --extra-stun-ports: %v", err)
+	}
+	stunPorts = append([]int{*stunPort}, stunPorts...)
+
+	if *stunOnly && !*runSTUN {
+		log.Fatalf("derper: --stun-only requires --stun")
+	}
+	if *runSTUN {
+		startSTUN(listenHost, stunPorts)
+	}
+	if *stunOnly {
+		serveSTUNOnly(listenHost, httpsPorts)
+		return
+	}
 
 	cfg := loadConfig()
 
 	serveTLS := tsweb.IsProd443(*addr) || *certMode == "manual"
 
-	s := derp.NewServer(cfg.PrivateKey, log.Printf)
-	s.SetVerifyClient(*verifyClients)
-
+	opts := derpserver.Options{
+		PrivateKey:      cfg.PrivateKey,
+		VerifyClients:   *verifyClients || *verifyTags != "" || *verifyCap != "",
+		VerifyClientCap: *verifyCap,
+		MeshDNS:         *meshDNS,
+		ClientRateLimit: derp.ClientRateLimit{
+			BytesPerSecond:   *clientBytesLimit,
+			BytesBurst:       *clientBytesBurst,
+			PacketsPerSecond: *clientPacketsLimit,
+			PacketsBurst:     *clientPacketsBurst,
+		},
+	}
+	if *verifyTags != "" {
+		opts.VerifyClientTags = strings.Split(*verifyTags, ",")
+	}
+	if *meshWith != "" {
+		opts.MeshWith = strings.Split(*meshWith, ",")
+	}
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
 		if err != nil {
@@ -160,19 +226,19 @@ func main() {
 		if matched, _ := regexp.MatchString(`(?i)^[0-9a-f]{64,}$`, key); !matched {
 			log.Fatalf("key in %s must contain 64+ hex digits", *meshPSKFile)
 		}
-		s.SetMeshKey(key)
+		opts.MeshKey = key
 		log.Printf("DERP mesh key configured")
 	}
-	if err := startMesh(s); err != nil {
-		log.Fatalf("startMesh: %v", err)
+	ds, err := derpserver.New(opts)
+	if err != nil {
+		log.Fatalf("derper: %v", err)
 	}
-	expvar.Publish("derp", s.ExpVar())
+	s := ds.DERP()
+	expvar.Publish("derp", ds.ExpVar())
 
 	mux := http.NewServeMux()
-	derpHandler := derphttp.Handler(s)
-	derpHandler = addWebSocketSupport(s, derpHandler)
-	mux.Handle("/derp", derpHandler)
-	mux.HandleFunc("/derp/probe", probeHandler)
+	mux.Handle("/derp", ds.Handler())
+	mux.Handle("/derp/probe", ds.Handler())
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", handleBootstrapDNS)
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -203,11 +269,34 @@ func main() {
 		}
 	}))
 	debug.Handle("traffic", "Traffic check", http.HandlerFunc(s.ServeDebugTraffic))
-
-	if *runSTUN {
-		go serveSTUN(listenHost, *stunPort)
+	debug.Handle("clients", "Connected clients (POST key= to disconnect one)", http.HandlerFunc(s.ServeDebugClients))
+	debug.Handle("drain", "Drain clients and exit (POST)", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fmt.Fprintf(w, "%d clients connected; POST to drain them and exit\n", s.NumClients())
+			return
+		}
+		go drainAndExit(ds)
+		io.WriteString(w, "draining\n")
+	}))
+	if *drainOnSIGTERM {
+		go func() {
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, syscall.SIGTERM)
+			<-sigCh
+			go drainAndExit(ds)
+			<-sigCh
+			log.Printf("derper: second SIGTERM; exiting without waiting for drain")
+			os.Exit(1)
+		}()
 	}
 
+	// Like /debug/varz, but at the path Prometheus scrapes by
+	// default, and with per-client byte counts.
+	mux.Handle("/metrics", tsweb.Protected(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tsweb.VarzHandler(w, r)
+		s.WriteClientMetrics(w)
+	})))
+
 	httpsrv := &http.Server{
 		Addr:    *addr,
 		Handler: mux,
@@ -277,7 +366,6 @@ func main() {
 		if *httpPort > -1 {
 			go func() {
 				port80srv := &http.Server{
-					Addr:        net.JoinHostPort(listenHost, fmt.Sprintf("%d", *httpPort)),
 					Handler:     certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}),
 					ReadTimeout: 30 * time.Second,
 					// Crank up WriteTimeout a bit more than usually
@@ -286,7 +374,11 @@ func main() {
 					// duration exceeds server's WriteTimeout".
 					WriteTimeout: 5 * time.Minute,
 				}
-				err := port80srv.ListenAndServe()
+				ln, err := listenAll(bindAddrs("tcp", listenHost), []string{fmt.Sprint(*httpPort)})
+				if err != nil {
+					log.Fatal(err)
+				}
+				err = port80srv.Serve(ln)
 				if err != nil {
 					if err != http.ErrServerClosed {
 						log.Fatal(err)
@@ -294,34 +386,74 @@ func main() {
 				}
 			}()
 		}
-		err = rateLimitedListenAndServeTLS(httpsrv)
+		err = rateLimitedListenAndServeTLS(httpsrv, bindAddrs("tcp", listenHost), httpsPorts)
 	} else {
 		log.Printf("derper: serving on %s", *addr)
-		err = httpsrv.ListenAndServe()
+		var ln net.Listener
+		ln, err = listenAll(bindAddrs("tcp", listenHost), httpsPorts)
+		if err == nil {
+			err = httpsrv.Serve(ln)
+		}
 	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("derper: %v", err)
 	}
 }
 
-// probeHandler is the endpoint that js/wasm clients hit to measure
-// DERP latency, since they can't do UDP STUN queries.
-func probeHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "HEAD", "GET":
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-	default:
-		http.Error(w, "bogus probe method", http.StatusMethodNotAllowed)
+// drainAndExit drains ds and exits the process once at most
+// --drain-threshold clients remain connected, or --drain-timeout
+// elapses. It does nothing if ds is already draining.
+func drainAndExit(ds *derpserver.Server) {
+	s := ds.DERP()
+	if !s.Drain(*drainSpread) {
+		return
+	}
+	log.Printf("derper: draining %d clients", s.NumClients())
+	deadline := time.Now().Add(*drainTimeout)
+	for s.NumClients() > *drainThreshold && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
 	}
+	log.Printf("derper: drained; exiting with %d clients connected", s.NumClients())
+	ds.Close()
+	os.Exit(0)
 }
 
-func serveSTUN(host string, port int) {
-	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, fmt.Sprint(port)))
+// startSTUN starts STUN servers on each of ports, on each of the
+// addresses to bind to.
+func startSTUN(listenHost string, ports []int) {
+	for _, a := range bindAddrs("udp", listenHost) {
+		for _, port := range ports {
+			pc, err := net.ListenPacket(a.network, net.JoinHostPort(a.host, fmt.Sprint(port)))
+			if err != nil {
+				log.Fatalf("failed to open STUN listener: %v", err)
+			}
+			log.Printf("running STUN server on %v", pc.LocalAddr())
+			stunListeners.Add(1)
+			go serverSTUNListener(context.Background(), pc.(*net.UDPConn))
+		}
+	}
+}
+
+// serveSTUNOnly serves, for --stun-only, the debug handlers and
+// metrics (including the STUN server's) over plain HTTP on ports.
+func serveSTUNOnly(listenHost string, ports []string) {
+	mux := http.NewServeMux()
+	debug := tsweb.Debugger(mux)
+	debug.KV("Mode", "STUN only")
+	mux.Handle("/metrics", tsweb.Protected(http.HandlerFunc(tsweb.VarzHandler)))
+	ln, err := listenAll(bindAddrs("tcp", listenHost), ports)
 	if err != nil {
-		log.Fatalf("failed to open STUN listener: %v", err)
+		log.Fatalf("derper: %v", err)
+	}
+	log.Printf("derper: serving debug handlers for STUN only on %v", ln.Addr())
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("derper: %v", err)
 	}
-	log.Printf("running STUN server on %v", pc.LocalAddr())
-	serverSTUNListener(context.Background(), pc.(*net.UDPConn))
 }
 
 func serverSTUNListener(ctx context.Context, pc *net.UDPConn) {
@@ -390,12 +522,8 @@ func defaultMeshPSKFile() string {
 	return ""
 }
 
-func rateLimitedListenAndServeTLS(srv *http.Server) error {
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":https"
-	}
-	ln, err := net.Listen("tcp", addr)
+func rateLimitedListenAndServeTLS(srv *http.Server, addrs []bindAddr, ports []string) error {
+	ln, err := listenAll(addrs, ports)
 	if err != nil {
 		return err
 	}
@@ -6,6 +6,7 @@
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
 
@@ -67,3 +68,43 @@ func BenchmarkServerSTUN(b *testing.B) {
 	}
 
 }
+
+func TestListenAll(t *testing.T) {
+	if _, err := parsePorts("443, 8443,"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"0", "65536", "https"} {
+		if _, err := parsePorts(bad); err == nil {
+			t.Errorf("parsePorts(%q) succeeded; want error", bad)
+		}
+	}
+
+	ln, err := listenAll([]bindAddr{{"tcp4", "127.0.0.1"}}, []string{"0", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ml, ok := ln.(*multiListener)
+	if !ok {
+		t.Fatalf("listener is %T; want *multiListener", ln)
+	}
+	for _, sub := range ml.lns {
+		c, err := net.Dial("tcp", sub.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ac, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ac.LocalAddr().String() != sub.Addr().String() {
+			t.Errorf("accepted conn on %v; want %v", ac.LocalAddr(), sub.Addr())
+		}
+		ac.Close()
+	}
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v; want net.ErrClosed", err)
+	}
+}
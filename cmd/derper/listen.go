@@ -0,0 +1,165 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bindAddr is a host to listen on, and the network to listen with.
+type bindAddr struct {
+	network string // "tcp", "tcp4", "udp6", etc
+	host    string // IP address, or empty for all interfaces
+}
+
+// bindAddrs returns the addresses to listen on for proto ("tcp" or
+// "udp"): those from the --bind-ipv4 and --bind-ipv6 flags if either
+// is set, else listenHost (the host of the -a flag).
+func bindAddrs(proto, listenHost string) []bindAddr {
+	if *bindIPv4 == "" && *bindIPv6 == "" {
+		return []bindAddr{{proto, listenHost}}
+	}
+	var ret []bindAddr
+	if *bindIPv4 != "" {
+		ret = append(ret, bindAddr{proto + "4", *bindIPv4})
+	}
+	if *bindIPv6 != "" {
+		ret = append(ret, bindAddr{proto + "6", *bindIPv6})
+	}
+	return ret
+}
+
+// checkBindFlags validates the --bind-ipv4 and --bind-ipv6 flags.
+func checkBindFlags() error {
+	if *bindIPv4 != "" {
+		if ip, err := netip.ParseAddr(*bindIPv4); err != nil || !ip.Is4() {
+			return fmt.Errorf("invalid --bind-ipv4 address %q", *bindIPv4)
+		}
+	}
+	if *bindIPv6 != "" {
+		if ip, err := netip.ParseAddr(*bindIPv6); err != nil || !ip.Is6() || ip.Is4In6() {
+			return fmt.Errorf("invalid --bind-ipv6 address %q", *bindIPv6)
+		}
+	}
+	return nil
+}
+
+// parsePorts parses a comma-separated list of ports, as used by the
+// --extra-https-ports and --extra-stun-ports flags.
+func parsePorts(s string) ([]int, error) {
+	var ret []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(f, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", f)
+		}
+		ret = append(ret, int(port))
+	}
+	return ret, nil
+}
+
+// listenAll listens on each of ports on each of addrs, and returns a
+// listener that accepts connections from all of them.
+func listenAll(addrs []bindAddr, ports []string) (net.Listener, error) {
+	var lns []net.Listener
+	for _, a := range addrs {
+		for _, port := range ports {
+			ln, err := net.Listen(a.network, net.JoinHostPort(a.host, port))
+			if err != nil {
+				for _, ln := range lns {
+					ln.Close()
+				}
+				return nil, err
+			}
+			lns = append(lns, ln)
+		}
+	}
+	if len(lns) == 1 {
+		return lns[0], nil
+	}
+	for _, ln := range lns[1:] {
+		log.Printf("derper: also listening on %v", ln.Addr())
+	}
+	return newMultiListener(lns), nil
+}
+
+// multiListener is a net.Listener that accepts connections from
+// several listeners. Its Addr is that of the first.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan acceptResult
+
+	closeOnce sync.Once
+	done      chan struct{} // closed on Close
+}
+
+type acceptResult struct {
+	c   net.Conn
+	err error
+}
+
+func newMultiListener(lns []net.Listener) *multiListener {
+	ml := &multiListener{
+		lns:   lns,
+		conns: make(chan acceptResult),
+		done:  make(chan struct{}),
+	}
+	for _, ln := range lns {
+		go ml.acceptLoop(ln)
+	}
+	return ml
+}
+
+func (ml *multiListener) acceptLoop(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		select {
+		case ml.conns <- acceptResult{c, err}:
+		case <-ml.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Temporary()) {
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.conns:
+		return r.c, r.err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	err := net.ErrClosed
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		err = nil
+		for _, ln := range ml.lns {
+			if cerr := ln.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (ml *multiListener) Addr() net.Addr { return ml.lns[0].Addr() }
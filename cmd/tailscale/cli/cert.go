@@ -25,7 +25,12 @@
 	Name:       "cert",
 	Exec:       runCert,
 	ShortHelp:  "get TLS certs",
-	ShortUsage: "cert [flags] <domain>",
+	ShortUsage: "cert [flags] <domain> [<extra-domain>...]",
+	LongHelp: strings.TrimSpace(`
+Get a TLS certificate for <domain>, one of the node's domains or a
+wildcard under one (such as "*.foo.bar.ts.net"). Any extra domains of
+the same kinds are also included in the certificate.
+`),
 	FlagSet: (func() *flag.FlagSet {
 		fs := newFlagSet("cert")
 		fs.StringVar(&certArgs.certFile, "cert-file", "", "output cert file or \"-\" for stdout; defaults to DOMAIN.crt if --cert-file and --key-file are both unset")
@@ -61,7 +66,7 @@ func runCert(ctx context.Context, args []string) error {
 		return s.ListenAndServeTLS("", "")
 	}
 
-	if len(args) != 1 {
+	if len(args) == 0 {
 		var hint bytes.Buffer
 		if st, err := localClient.Status(ctx); err == nil {
 			if st.BackendState != ipn.Running.String() {
@@ -74,7 +79,7 @@ func runCert(ctx context.Context, args []string) error {
 				fmt.Fprintf(&hint, "\nValid domain options: %q.\n", st.CertDomains)
 			}
 		}
-		return fmt.Errorf("Usage: tailscale cert [flags] <domain>%s", hint.Bytes())
+		return fmt.Errorf("Usage: tailscale cert [flags] <domain> [<extra-domain>...]%s", hint.Bytes())
 	}
 	domain := args[0]
 
@@ -86,10 +91,11 @@ func runCert(ctx context.Context, args []string) error {
 		log.SetFlags(0)
 	}
 	if certArgs.certFile == "" && certArgs.keyFile == "" {
-		certArgs.certFile = domain + ".crt"
-		certArgs.keyFile = domain + ".key"
+		base := strings.Replace(domain, "*", "wildcard", 1)
+		certArgs.certFile = base + ".crt"
+		certArgs.keyFile = base + ".key"
 	}
-	certPEM, keyPEM, err := localClient.CertPair(ctx, domain)
+	certPEM, keyPEM, err := localClient.CertPairWithSANs(ctx, domain, args[1:])
 	if err != nil {
 		return err
 	}
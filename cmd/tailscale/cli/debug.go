@@ -20,8 +20,10 @@
 	"net/netip"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
@@ -53,6 +55,46 @@
 			Exec:      runDERPMap,
 			ShortHelp: "print DERP map",
 		},
+		{
+			Name:      "derp-health",
+			Exec:      runDebugDERPHealth,
+			ShortHelp: "print the health of the connection to each DERP region",
+		},
+		{
+			Name:      "doctor",
+			Exec:      runDebugDoctor,
+			ShortHelp: "run all of tailscaled's health checks now and print the results",
+		},
+		{
+			Name:      "audit-log",
+			Exec:      runDebugAuditLog,
+			ShortHelp: "print the local audit log of prefs and policy changes",
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("audit-log")
+				fs.DurationVar(&auditLogArgs.since, "since", 0, "if non-zero, only print entries from this long ago or newer")
+				fs.IntVar(&auditLogArgs.limit, "limit", 0, "if positive, only print this many of the most recent entries")
+				return fs
+			})(),
+		},
+		{
+			Name:       "log-level",
+			Exec:       runDebugLogLevel,
+			ShortUsage: "log-level [<component> <level>]",
+			ShortHelp:  "print or set tailscaled's per-component log levels",
+			LongHelp: strings.TrimSpace(`
+With no arguments, print the log level of each tailscaled component.
+
+With a component name (such as "magicsock") and a level (such as
+"DEBUG", "DEBUG-4" or "INFO"), set that component's level. Verbose
+logs from the component at or above its level are then shown without
+needing to restart tailscaled with --verbose.
+`),
+		},
+		{
+			Name:      "control",
+			Exec:      runDebugControl,
+			ShortHelp: "print diagnostics about recent control server connection attempts",
+		},
 		{
 			Name:      "daemon-goroutines",
 			Exec:      runDaemonGoroutines,
@@ -65,6 +107,7 @@
 			FlagSet: (func() *flag.FlagSet {
 				fs := newFlagSet("metrics")
 				fs.BoolVar(&metricsArgs.watch, "watch", false, "print JSON dump of delta values")
+				fs.BoolVar(&metricsArgs.reset, "reset", false, "print counters as their increase since the previous --reset, then reset them")
 				return fs
 			})(),
 		},
@@ -288,6 +331,159 @@ func runDERPMap(ctx context.Context, args []string) error {
 	return nil
 }
 
+func runDebugDERPHealth(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	st, err := localClient.HealthState(ctx)
+	if err != nil {
+		return err
+	}
+	if len(st.DERPRegions) == 0 {
+		outln("no DERP regions")
+		return nil
+	}
+	tw := tabwriter.NewWriter(Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "REGION\tCONNECTED\tLAST FRAME\tLATENCY\tPROBLEM")
+	for _, r := range st.DERPRegions {
+		region := fmt.Sprint(r.RegionID)
+		if r.RegionID == st.DERPHomeRegion {
+			region += " (home)"
+		}
+		lastFrame, latency := "-", "-"
+		if r.LastFrameAge > 0 {
+			lastFrame = r.LastFrameAge.Round(time.Second).String() + " ago"
+		}
+		if r.Latency > 0 {
+			latency = r.Latency.Round(time.Millisecond).String()
+		}
+		problem := r.Problem
+		if problem == "" {
+			problem = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\t%s\t%s\n", region, r.Connected, lastFrame, latency, problem)
+	}
+	return tw.Flush()
+}
+
+func runDebugDoctor(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	r, err := localClient.Doctor(ctx)
+	if err != nil {
+		return err
+	}
+	st := r.State
+	printf("health: %v (checked in %v)\n", st.Status, r.Duration.Round(time.Millisecond))
+	tw := tabwriter.NewWriter(Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nSUBSYSTEM\tSEVERITY\tPROBLEM")
+	for _, ss := range st.Subsystems {
+		sev, problem := "-", "ok"
+		if ss.Error != "" {
+			sev, problem = ss.Severity.String(), ss.Error
+			if ss.CausedBy != "" {
+				problem += fmt.Sprintf(" (caused by %s)", ss.CausedBy)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", ss.Name, sev, problem)
+	}
+	if len(r.Probes) > 0 {
+		fmt.Fprintln(tw, "\nPROBE\tTOOK\tRESULT")
+		for _, p := range r.Probes {
+			result := "ok"
+			if p.Error != "" {
+				result = p.Error
+			}
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", p.Name, p.LastDuration.Round(time.Millisecond), result)
+		}
+	}
+	if len(st.ReceiveFuncs) > 0 {
+		fmt.Fprintln(tw, "\nRECEIVE FUNC\tCALLS\tRUNNING")
+		for _, rf := range st.ReceiveFuncs {
+			fmt.Fprintf(tw, "%s\t%d\t%v\n", rf.Name, rf.Calls, !rf.Missing)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, p := range st.Problems {
+		if p.Hint != nil && p.Hint.Text != "" {
+			printf("\nhint: %s\n", p.Hint.Text)
+			if p.Hint.URL != "" {
+				printf("  see %s\n", p.Hint.URL)
+			}
+		}
+	}
+	return nil
+}
+
+func runDebugControl(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	diag, err := localClient.DebugControl(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(Stdout)
+	enc.SetIndent("", "\t")
+	enc.Encode(diag)
+	return nil
+}
+
+var auditLogArgs struct {
+	since time.Duration
+	limit int
+}
+
+func runDebugAuditLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	var since time.Time
+	if auditLogArgs.since > 0 {
+		since = time.Now().Add(-auditLogArgs.since)
+	}
+	entries, err := localClient.AuditLog(ctx, since, auditLogArgs.limit)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		actor := e.Actor
+		if actor == "" {
+			actor = "-"
+		}
+		fmt.Fprintf(Stdout, "%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Kind, e.Source, actor, e.Change)
+	}
+	return nil
+}
+
+func runDebugLogLevel(ctx context.Context, args []string) error {
+	var levels map[string]string
+	var err error
+	switch len(args) {
+	case 0:
+		levels, err = localClient.LogLevels(ctx)
+	case 2:
+		levels, err = localClient.SetLogLevel(ctx, args[0], args[1])
+	default:
+		return errors.New("usage: log-level [<component> <level>]")
+	}
+	if err != nil {
+		return err
+	}
+	components := make([]string, 0, len(levels))
+	for c := range levels {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	for _, c := range components {
+		fmt.Fprintf(Stdout, "%s\t%s\n", c, levels[c])
+	}
+	return nil
+}
+
 func localAPIAction(action string) func(context.Context, []string) error {
 	return func(ctx context.Context, args []string) error {
 		if len(args) > 0 {
@@ -344,9 +540,21 @@ func runDaemonGoroutines(ctx context.Context, args []string) error {
 
 var metricsArgs struct {
 	watch bool
+	reset bool
 }
 
 func runDaemonMetrics(ctx context.Context, args []string) error {
+	if metricsArgs.reset {
+		if metricsArgs.watch {
+			return errors.New("--reset and --watch are mutually exclusive")
+		}
+		out, err := localClient.SnapshotAndResetDaemonMetrics(ctx)
+		if err != nil {
+			return err
+		}
+		Stdout.Write(out)
+		return nil
+	}
 	last := map[string]int64{}
 	for {
 		out, err := localClient.DaemonMetrics(ctx)
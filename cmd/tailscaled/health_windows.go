@@ -0,0 +1,195 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/winutil"
+)
+
+// The service health reporter runs in the Windows service process and
+// reflects the tailscaled subprocess's health into the service's
+// description, as shown by the Services console and "sc qdescription",
+// and, if the LogHealthEvents policy is set, into the Windows Event Log,
+// so that admins can see a node's health in standard Windows tooling.
+//
+// The service itself stays in SERVICE_RUNNING while unhealthy: the SCM has
+// no degraded state, and any other state would confuse its recovery actions.
+
+// serviceDescription is the service's description when it's healthy.
+const serviceDescription = "Connects this computer to others on the Tailscale network."
+
+const (
+	healthPollInterval = 30 * time.Second
+
+	// maxDescriptionProblemLen is the longest health problem put in the
+	// service description; longer ones are truncated.
+	maxDescriptionProblemLen = 256
+)
+
+// Event Log event IDs for health transitions.
+const (
+	eventHealthy  = 100
+	eventDegraded = 101
+	eventBroken   = 102
+)
+
+// serviceHealthReporter reflects the tailscaled subprocess's health into
+// the Windows service's description and the Event Log.
+type serviceHealthReporter struct {
+	logf logger.Logf
+	lc   *tailscale.LocalClient
+	elog *eventlog.Log // or nil if health events aren't logged
+
+	known   bool          // whether status and problem have been set
+	status  health.Status // as last reported
+	problem string        // as last reported
+}
+
+func newServiceHealthReporter(logf logger.Logf) *serviceHealthReporter {
+	r := &serviceHealthReporter{
+		logf: logger.WithPrefix(logf, "service health: "),
+		lc:   &tailscale.LocalClient{Socket: args.socketpath},
+	}
+	if winutil.GetPolicyInteger("LogHealthEvents", 0) != 0 {
+		elog, err := eventlog.Open(serviceName)
+		if err != nil {
+			r.logf("opening event log: %v", err)
+		} else {
+			r.elog = elog
+		}
+	}
+	return r
+}
+
+// run polls the subprocess's health every healthPollInterval until ctx is
+// done, then restores the service's description.
+func (r *serviceHealthReporter) run(ctx context.Context) {
+	if envknob.Bool("TS_DEBUG_DISABLE_SERVICE_HEALTH") {
+		r.logf("disabled")
+		return
+	}
+	defer func() {
+		if r.elog != nil {
+			r.elog.Close()
+		}
+		if r.known && r.status != health.StatusHealthy {
+			r.setDescription(serviceDescription)
+		}
+	}()
+	t := time.NewTicker(healthPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(ctx, healthPollInterval)
+		st, err := r.lc.HealthState(ctx)
+		cancel()
+		if err != nil {
+			// The subprocess is starting or restarting, or
+			// wedged, which the service watchdog handles.
+			continue
+		}
+		r.update(st.Status, st.OverallError)
+	}
+}
+
+// update reports status and problem, if they've changed.
+func (r *serviceHealthReporter) update(status health.Status, problem string) {
+	if r.known && status == r.status && problem == r.problem {
+		return
+	}
+	wasHealthy := !r.known || r.status == health.StatusHealthy
+	r.known, r.status, r.problem = true, status, problem
+
+	if status == health.StatusHealthy {
+		if !wasHealthy {
+			r.setDescription(serviceDescription)
+			r.logEvent(eventHealthy, "Tailscale is healthy again.")
+		}
+		return
+	}
+	r.setDescription(fmt.Sprintf("%s (%v: %s)", serviceDescription, status, truncate(problem, maxDescriptionProblemLen)))
+	r.logEvent(eventForStatus(status), fmt.Sprintf("Tailscale is %v: %s", status, problem))
+}
+
+func eventForStatus(status health.Status) uint32 {
+	switch status {
+	case health.StatusHealthy:
+		return eventHealthy
+	case health.StatusBroken:
+		return eventBroken
+	}
+	return eventDegraded
+}
+
+func (r *serviceHealthReporter) logEvent(eid uint32, msg string) {
+	if r.elog == nil {
+		return
+	}
+	var err error
+	switch eid {
+	case eventHealthy:
+		err = r.elog.Info(eid, msg)
+	case eventBroken:
+		err = r.elog.Error(eid, msg)
+	default:
+		err = r.elog.Warning(eid, msg)
+	}
+	if err != nil {
+		r.logf("writing event: %v", err)
+	}
+}
+
+// setDescription sets the Windows service's description to desc.
+func (r *serviceHealthReporter) setDescription(desc string) {
+	m, err := mgr.Connect()
+	if err != nil {
+		r.logf("connecting to service manager: %v", err)
+		return
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		r.logf("opening service: %v", err)
+		return
+	}
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		r.logf("getting service config: %v", err)
+		return
+	}
+	if c.Description == desc {
+		return
+	}
+	c.Description = desc
+	if err := s.UpdateConfig(c); err != nil {
+		r.logf("setting service description: %v", err)
+	}
+}
+
+// truncate returns s, truncated to at most n bytes with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
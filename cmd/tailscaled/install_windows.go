@@ -51,7 +51,7 @@ func installSystemDaemonWindows(args []string) (err error) {
 		StartType:    mgr.StartAutomatic,
 		ErrorControl: mgr.ErrorNormal,
 		DisplayName:  serviceName,
-		Description:  "Connects this computer to others on the Tailscale network.",
+		Description:  serviceDescription,
 	}
 
 	service, err = m.CreateService(serviceName, exe, c)
@@ -33,6 +33,8 @@
 	"tailscale.com/cmd/tailscaled/childproc"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/health/webhook"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/ipn/store"
@@ -113,6 +115,9 @@ func defaultTunName() string {
 	verbose        int
 	socksAddr      string // listen address for SOCKS5 server
 	httpProxyAddr  string // listen address for HTTP proxy server
+	taildropHook   string // command to run for each received Taildrop file
+	healthProbe    string // listen address for readiness and liveness probes
+	healthWebhooks string // comma-separated URLs to post health transitions to
 }
 
 var (
@@ -143,6 +148,9 @@ func main() {
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
+	flag.StringVar(&args.taildropHook, "taildrop-receive-hook", "", "optional path of a command to run for each received Taildrop file, with its path as the argument and details of the file and sender in TS_FILE_* and TS_SENDER_* environment variables")
+	flag.StringVar(&args.healthProbe, "health-probe", "", `optional [ip]:port to serve readiness (/healthz/ready) and liveness (/healthz/live) probes on, as for Kubernetes (e.g. ":9002")`)
+	flag.StringVar(&args.healthWebhooks, "health-webhook", "", "optional comma-separated URLs to post health changes to as JSON, signed with the key in $TS_HEALTH_WEBHOOK_SECRET if set")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 0 && filepath.Base(os.Args[0]) == "tailscale" && beCLI != nil {
@@ -260,6 +268,7 @@ func ipnServerOpts() (o ipnserver.Options) {
 	}
 
 	o.VarRoot = args.statedir
+	o.TaildropReceiveHook = args.taildropHook
 
 	// If an absolute --state is provided but not --statedir, try to derive
 	// a state directory.
@@ -364,6 +373,9 @@ func run() error {
 		}
 		go runDebugServer(debugMux, args.debug)
 	}
+	if args.healthProbe != "" {
+		go runDebugServer(newHealthProbeMux(), args.healthProbe)
+	}
 
 	ns, err := newNetstack(logf, dialer, e)
 	if err != nil {
@@ -420,6 +432,16 @@ func run() error {
 		}
 	}()
 
+	if args.healthWebhooks != "" {
+		hostname, _ := os.Hostname()
+		go webhook.Run(ctx, webhook.Config{
+			URLs:   strings.Split(args.healthWebhooks, ","),
+			Secret: []byte(envknob.String("TS_HEALTH_WEBHOOK_SECRET")),
+			Node:   hostname,
+			Logf:   logf,
+		})
+	}
+
 	opts := ipnServerOpts()
 
 	store, err := store.New(logf, statePathOrDefault())
@@ -557,6 +579,7 @@ func tryEngine(logf logger.Logf, linkMon *monitor.Mon, dialer *tsdial.Dialer, na
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/metrics", servePrometheusMetrics)
+	mux.HandleFunc("/debug/health-history", health.ServeDebugHistory)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -569,6 +592,15 @@ func servePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	tsweb.VarzHandler(w, r)
 	clientmetric.WritePrometheusExpositionFormat(w)
+	health.WritePrometheus(w)
+}
+
+// newHealthProbeMux returns the handler for the --health-probe server.
+func newHealthProbeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz/ready", health.ServeReadiness)
+	mux.HandleFunc("/healthz/live", health.ServeLiveness)
+	return mux
 }
 
 func runDebugServer(mux *http.ServeMux, addr string) {
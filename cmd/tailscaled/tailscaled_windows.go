@@ -107,6 +107,7 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 
 	ctx, cancel := context.WithCancel(context.Background())
 	doneCh := make(chan struct{})
+	restartCh := make(chan struct{})
 	go func() {
 		defer close(doneCh)
 		args := []string{"/subproc", service.Policy.PublicID.String()}
@@ -117,8 +118,21 @@ func (service *ipnService) Execute(args []string, r <-chan svc.ChangeRequest, ch
 		// writer that logpolicy already installed as the global
 		// output.
 		logger := log.New(log.Default().Writer(), "", 0)
-		ipnserver.BabysitProc(ctx, args, logger.Printf)
+		ipnserver.BabysitProcWithRestart(ctx, args, logger.Printf, restartCh)
 	}()
+	go newServiceWatchdog(log.Printf, restartCh, func() {
+		// Exit without telling Windows that the service stopped,
+		// so that it applies the service's recovery actions (set
+		// by installSystemDaemonWindows) and restarts it.
+		syslogf("Service watchdog restarting service")
+		cancel()
+		select {
+		case <-doneCh:
+		case <-time.After(10 * time.Second):
+		}
+		os.Exit(1)
+	}).run(ctx)
+	go newServiceHealthReporter(log.Printf).run(ctx)
 
 	changes <- svc.Status{State: svc.Running, Accepts: svcAccepts}
 	syslogf("Service running")
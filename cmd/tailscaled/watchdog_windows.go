@@ -0,0 +1,258 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/logger"
+	"tailscale.com/version"
+)
+
+// The service watchdog runs in the Windows service process and checks on
+// the tailscaled subprocess, which does the actual work. If the subprocess
+// is wedged (its LocalAPI stops responding, or its wireguard-go receive
+// funcs stop running), the watchdog recovers it in stages, each more
+// disruptive than the last, writing a diagnostic bundle before each.
+
+const (
+	watchdogInterval     = time.Minute
+	watchdogProbeTimeout = 30 * time.Second
+
+	// watchdogFailures is how many consecutive failed checks there
+	// must be before the watchdog recovers.
+	watchdogFailures = 3
+
+	// watchdogResetAfter is how long the subprocess must stay
+	// healthy before recovery starts over at the first stage.
+	watchdogResetAfter = 15 * time.Minute
+
+	// maxDiagBundles is the number of diagnostic bundles to keep.
+	maxDiagBundles = 5
+)
+
+// recoveryStage is a step the watchdog takes to recover a wedged
+// subprocess.
+type recoveryStage int
+
+const (
+	recoverEngine     recoveryStage = iota // rebind the engine's sockets, restarting its receive funcs
+	recoverSubprocess                      // restart the subprocess, re-creating the TUN interface and engine
+	recoverService                         // exit, for the service manager to restart the service
+)
+
+func (s recoveryStage) String() string {
+	switch s {
+	case recoverEngine:
+		return "engine-restart"
+	case recoverSubprocess:
+		return "subprocess-restart"
+	case recoverService:
+		return "service-restart"
+	}
+	return fmt.Sprintf("stage-%d", int(s))
+}
+
+// serviceWatchdog checks on and recovers the tailscaled subprocess.
+type serviceWatchdog struct {
+	logf    logger.Logf
+	lc      *tailscale.LocalClient
+	diagDir string // where diagnostic bundles are written
+
+	restartSubprocess chan<- struct{} // to ipnserver.BabysitProcWithRestart
+	exitService       func()
+
+	stage        recoveryStage // next recovery stage
+	failures     int           // consecutive failed checks
+	responded    bool          // whether the LocalAPI has responded since the last recovery
+	healthySince time.Time     // or zero if the last check failed
+}
+
+func newServiceWatchdog(logf logger.Logf, restartSubprocess chan<- struct{}, exitService func()) *serviceWatchdog {
+	return &serviceWatchdog{
+		logf:              logger.WithPrefix(logf, "watchdog: "),
+		lc:                &tailscale.LocalClient{Socket: args.socketpath},
+		diagDir:           filepath.Join(filepath.Dir(statePathOrDefault()), "diagnostics"),
+		restartSubprocess: restartSubprocess,
+		exitService:       exitService,
+	}
+}
+
+// run checks on the subprocess every watchdogInterval until ctx is done.
+func (w *serviceWatchdog) run(ctx context.Context) {
+	if envknob.Bool("TS_DEBUG_DISABLE_SERVICE_WATCHDOG") {
+		w.logf("disabled")
+		return
+	}
+	t := time.NewTicker(watchdogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		w.checkAndRecover(ctx)
+	}
+}
+
+func (w *serviceWatchdog) checkAndRecover(ctx context.Context) {
+	st, problem := w.check(ctx)
+	if problem == "" {
+		w.failures = 0
+		if w.healthySince.IsZero() {
+			w.healthySince = time.Now()
+		}
+		if w.stage > recoverEngine && time.Since(w.healthySince) > watchdogResetAfter {
+			w.logf("healthy for %v; resetting recovery", watchdogResetAfter)
+			w.stage = recoverEngine
+		}
+		return
+	}
+	w.healthySince = time.Time{}
+	w.failures++
+	w.logf("check failed (%d/%d): %s", w.failures, watchdogFailures, problem)
+	if w.failures < watchdogFailures {
+		return
+	}
+	w.failures = 0
+
+	stage := w.stage
+	if st == nil && stage == recoverEngine {
+		// Rebinding the engine's sockets is done via the LocalAPI.
+		stage = recoverSubprocess
+	}
+	if dir, err := w.writeDiagBundle(ctx, stage, problem, st); err != nil {
+		w.logf("writing diagnostic bundle: %v", err)
+	} else {
+		w.logf("wrote diagnostic bundle to %s", dir)
+	}
+	w.logf("recovering: %v", stage)
+	w.recover(ctx, stage)
+	if stage < recoverService {
+		w.stage = stage + 1
+	}
+}
+
+// check reports a problem with the subprocess, if any, along with its
+// status if its LocalAPI responded.
+func (w *serviceWatchdog) check(ctx context.Context) (_ *ipnstate.Status, problem string) {
+	ctx, cancel := context.WithTimeout(ctx, watchdogProbeTimeout)
+	defer cancel()
+	st, err := w.lc.StatusWithoutPeers(ctx)
+	if err != nil {
+		if !w.responded {
+			// Still starting up (possibly retrying for a
+			// while during boot), or it was just restarted.
+			return nil, ""
+		}
+		return nil, fmt.Sprintf("LocalAPI not responding: %v", err)
+	}
+	w.responded = true
+	if st.BackendState != "Running" {
+		return st, ""
+	}
+	hs, err := w.lc.HealthState(ctx)
+	if err != nil {
+		return st, fmt.Sprintf("LocalAPI not responding: %v", err)
+	}
+	if p, ok := stuckReceiveFunc(hs); ok {
+		return st, p.Error
+	}
+	return st, ""
+}
+
+// stuckReceiveFunc returns the health problem in hs of one of the
+// wireguard-go receive funcs not running, if any.
+func stuckReceiveFunc(hs *health.State) (_ health.Problem, ok bool) {
+	for _, p := range hs.Problems {
+		if p.Code == health.IssueReceiveFuncStopped {
+			return p, true
+		}
+	}
+	return health.Problem{}, false
+}
+
+func (w *serviceWatchdog) recover(ctx context.Context, stage recoveryStage) {
+	switch stage {
+	case recoverEngine:
+		ctx, cancel := context.WithTimeout(ctx, watchdogProbeTimeout)
+		defer cancel()
+		if err := w.lc.DebugAction(ctx, "rebind"); err != nil {
+			w.logf("rebind: %v", err)
+		}
+	case recoverSubprocess:
+		w.responded = false
+		select {
+		case w.restartSubprocess <- struct{}{}:
+		case <-ctx.Done():
+		}
+	case recoverService:
+		w.exitService()
+	}
+}
+
+// writeDiagBundle writes a directory of diagnostics about problem to
+// w.diagDir, removing the oldest bundles beyond maxDiagBundles. st is
+// the subprocess's status, or nil if its LocalAPI didn't respond.
+func (w *serviceWatchdog) writeDiagBundle(ctx context.Context, stage recoveryStage, problem string, st *ipnstate.Status) (dir string, err error) {
+	now := time.Now().UTC()
+	dir = filepath.Join(w.diagDir, now.Format("20060102T150405Z")+"-"+stage.String())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	defer w.pruneDiagBundles()
+
+	summary := fmt.Sprintf("time: %v\nversion: %v\nrecovery: %v\nproblem: %v\n", now.Format(time.RFC3339), version.Long, stage, problem)
+	if err := os.WriteFile(filepath.Join(dir, "summary.txt"), []byte(summary), 0600); err != nil {
+		return "", err
+	}
+	if st != nil {
+		j, _ := json.MarshalIndent(st, "", "\t")
+		os.WriteFile(filepath.Join(dir, "status.json"), j, 0600)
+
+		ctx, cancel := context.WithTimeout(ctx, watchdogProbeTimeout)
+		defer cancel()
+		if g, err := w.lc.Goroutines(ctx); err == nil {
+			os.WriteFile(filepath.Join(dir, "goroutines.txt"), g, 0600)
+		}
+	}
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	os.WriteFile(filepath.Join(dir, "service-goroutines.txt"), buf, 0600)
+	return dir, nil
+}
+
+func (w *serviceWatchdog) pruneDiagBundles() {
+	ents, err := os.ReadDir(w.diagDir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, de := range ents {
+		if de.IsDir() {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names) // oldest first, by their timestamp prefix
+	for len(names) > maxDiagBundles {
+		os.RemoveAll(filepath.Join(w.diagDir, names[0]))
+		names = names[1:]
+	}
+}
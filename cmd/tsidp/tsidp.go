@@ -0,0 +1,141 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The tsidp command runs an OpenID Connect identity provider on a
+// tailnet, as its own node, so web apps on the tailnet can offer
+// "log in with Tailscale".
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsidp"
+	"tailscale.com/tsnet"
+)
+
+var (
+	hostname    = flag.String("hostname", "idp", "hostname for the provider's node on the tailnet")
+	dir         = flag.String("dir", "", "directory for state and the signing key; default is chosen by tsnet")
+	clientsFile = flag.String("clients", "", "JSON file of the web apps that may use the provider: [{\"ID\": ..., \"Secret\": ..., \"RedirectURIs\": [...]}]")
+)
+
+func main() {
+	flag.Parse()
+	if *clientsFile == "" {
+		log.Fatal("--clients is required")
+	}
+	j, err := os.ReadFile(*clientsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var clients []tsidp.Client
+	if err := json.Unmarshal(j, &clients); err != nil {
+		log.Fatalf("parsing %s: %v", *clientsFile, err)
+	}
+
+	ts := &tsnet.Server{Hostname: *hostname, Dir: *dir}
+	lc, err := ts.LocalClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	domain, err := certDomain(lc.Status)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyDir := *dir
+	if keyDir == "" {
+		if keyDir, err = os.UserConfigDir(); err != nil {
+			log.Fatal(err)
+		}
+		keyDir = filepath.Join(keyDir, "tsidp")
+	}
+	key, err := loadOrCreateKey(filepath.Join(keyDir, "tsidp-key.pem"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	idp, err := tsidp.New(tsidp.Options{
+		Issuer:  "https://" + domain,
+		WhoIs:   lc.WhoIs,
+		Clients: clients,
+		Key:     key,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := ts.Listen("tcp", ":443")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = tls.NewListener(ln, &tls.Config{GetCertificate: lc.GetCertificate})
+	log.Printf("tsidp: serving https://%s", domain)
+	log.Fatal(http.Serve(ln, idp))
+}
+
+// certDomain waits for the node to be up and returns its domain for
+// HTTPS certs.
+func certDomain(status func(context.Context) (*ipnstate.Status, error)) (string, error) {
+	for {
+		st, err := status(context.Background())
+		if err != nil {
+			return "", err
+		}
+		if st.BackendState == "Running" {
+			if len(st.CertDomains) == 0 {
+				return "", errors.New("HTTPS certificates aren't enabled for this tailnet")
+			}
+			return st.CertDomains[0], nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// loadOrCreateKey returns the token signing key from the PEM file at
+// path, creating it if it doesn't exist.
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		blk, _ := pem.Decode(b)
+		if blk == nil {
+			return nil, errors.New("no PEM data in " + path)
+		}
+		return x509.ParseECPrivateKey(blk.Bytes)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := atomicfile.WriteFile(path, pemKey, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -13,6 +13,7 @@
 	"time"
 
 	"tailscale.com/health"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
@@ -21,6 +22,7 @@
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/structs"
+	"tailscale.com/types/tkatype"
 )
 
 type LoginGoal struct {
@@ -44,6 +46,47 @@ func (g *LoginGoal) sendLogoutError(err error) {
 
 var _ Client = (*Auto)(nil)
 
+// DefaultMaxBackoff is the default maximum time an Auto client waits
+// between retries of failed control server requests.
+const DefaultMaxBackoff = 30 * time.Second
+
+// BackoffPolicy configures how aggressively an Auto client retries
+// failed requests to the control server.
+type BackoffPolicy struct {
+	// MaxInterval is the maximum time to wait between retries.
+	// If zero, DefaultMaxBackoff is used.
+	MaxInterval time.Duration
+
+	// Jitter is the fraction, in the range [0, 1], by which each
+	// retry interval is randomly lengthened or shortened. If zero,
+	// the backoff package's default is used. If negative, jitter is
+	// disabled.
+	Jitter float64
+
+	// WakeDelay is how long to wait after the client is unpaused
+	// (for example, when the network comes back after the machine
+	// wakes from sleep) before reconnecting. If zero, the client
+	// reconnects immediately.
+	WakeDelay time.Duration
+}
+
+// apply configures bo according to p.
+func (p BackoffPolicy) apply(bo *backoff.Backoff) {
+	max := p.MaxInterval
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	bo.SetMaxBackoff(max)
+	switch {
+	case p.Jitter < 0:
+		bo.SetJitter(0)
+	case p.Jitter > 0:
+		bo.SetJitter(p.Jitter)
+	default:
+		bo.SetJitter(0.5)
+	}
+}
+
 // Auto connects to a tailcontrol server for a node.
 // It's a concrete implementation of the Client interface.
 type Auto struct {
@@ -68,6 +111,7 @@ type Auto struct {
 	inLiteMapUpdate bool       // true if a lite (non-streaming) map request is outstanding
 	inSendStatus    int        // number of sendStatus calls currently in progress
 	state           State
+	backoffPolicy   BackoffPolicy
 
 	authCtx    context.Context // context used for auth requests
 	mapCtx     context.Context // context used for netmap requests
@@ -105,12 +149,14 @@ func NewNoStart(opts Options) (*Auto, error) {
 	c := &Auto{
 		direct:     direct,
 		timeNow:    opts.TimeNow,
-		logf:       opts.Logf,
+		logf:       logger.ComponentLogf(opts.Logf, "controlclient"),
 		newMapCh:   make(chan struct{}, 1),
 		quit:       make(chan struct{}),
 		authDone:   make(chan struct{}),
 		mapDone:    make(chan struct{}),
 		statusFunc: opts.Status,
+
+		backoffPolicy: opts.Backoff,
 	}
 	c.authCtx, c.authCancel = context.WithCancel(context.Background())
 	c.mapCtx, c.mapCancel = context.WithCancel(context.Background())
@@ -150,6 +196,18 @@ func (c *Auto) SetPaused(paused bool) {
 	}
 }
 
+// SetBackoffPolicy changes how aggressively the client retries failed
+// requests to the control server. It takes effect from the next retry.
+func (c *Auto) SetBackoffPolicy(p BackoffPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p == c.backoffPolicy {
+		return
+	}
+	c.logf("[v1] setBackoffPolicy(%+v)", p)
+	c.backoffPolicy = p
+}
+
 // Start starts the client's goroutines.
 //
 // It should only be called for clients created by NewNoStart.
@@ -266,12 +324,13 @@ func (c *Auto) cancelMapSafely() {
 
 func (c *Auto) authRoutine() {
 	defer close(c.authDone)
-	bo := backoff.NewBackoff("authRoutine", c.logf, 30*time.Second)
+	bo := backoff.NewBackoff("authRoutine", c.logf, DefaultMaxBackoff)
 
 	for {
 		c.mu.Lock()
 		goal := c.loginGoal
 		ctx := c.authCtx
+		c.backoffPolicy.apply(bo)
 		if goal != nil {
 			c.logf("[v1] authRoutine: %s; wantLoggedIn=%v", c.state, goal.wantLoggedIn)
 		} else {
@@ -408,7 +467,7 @@ func (c *Auto) unpausedChanLocked() <-chan struct{} {
 
 func (c *Auto) mapRoutine() {
 	defer close(c.mapDone)
-	bo := backoff.NewBackoff("mapRoutine", c.logf, 30*time.Second)
+	bo := backoff.NewBackoff("mapRoutine", c.logf, DefaultMaxBackoff)
 
 	for {
 		c.mu.Lock()
@@ -423,8 +482,23 @@ func (c *Auto) mapRoutine() {
 				c.logf("mapRoutine: quit")
 				return
 			}
+			c.mu.Lock()
+			wakeDelay := c.backoffPolicy.WakeDelay
+			c.mu.Unlock()
+			if wakeDelay > 0 {
+				c.logf("mapRoutine: waiting %v before reconnecting", wakeDelay)
+				t := time.NewTimer(wakeDelay)
+				select {
+				case <-t.C:
+				case <-c.quit:
+					t.Stop()
+					c.logf("mapRoutine: quit")
+					return
+				}
+			}
 			continue
 		}
+		c.backoffPolicy.apply(bo)
 		c.logf("[v1] mapRoutine: %s", c.state)
 		loggedIn := c.loggedIn
 		ctx := c.mapCtx
@@ -563,6 +637,15 @@ func (c *Auto) SetNetInfo(ni *tailcfg.NetInfo) {
 	c.sendNewMapRequest()
 }
 
+func (c *Auto) SetNodeKeySignature(sig tkatype.MarshaledSignature) {
+	if !c.direct.SetNodeKeySignature(sig) {
+		return
+	}
+
+	// Send new signature to server
+	c.sendNewMapRequest()
+}
+
 func (c *Auto) sendStatus(who string, err error, url string, nm *netmap.NetworkMap) {
 	c.mu.Lock()
 	if c.closed {
@@ -727,3 +810,9 @@ func (c *Auto) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
 func (c *Auto) DoNoiseRequest(req *http.Request) (*http.Response, error) {
 	return c.direct.DoNoiseRequest(req)
 }
+
+// Diagnostics returns a snapshot of the diagnostics recorded about
+// recent attempts to connect to the control server.
+func (c *Auto) Diagnostics() *ipnstate.ControlDiag {
+	return c.direct.Diagnostics()
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"tailscale.com/control/controlhttp"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/dnscache"
+)
+
+// maxDiagEntries is the number of entries of each kind that connDiag
+// retains.
+const maxDiagEntries = 10
+
+// connDiag records diagnostics about recent attempts to reach the
+// control server: DNS lookups, dials, Noise handshakes, proxy
+// selection and HTTP results. It's safe for concurrent use.
+type connDiag struct {
+	serverURL string
+
+	mu          sync.Mutex
+	dns         []ipnstate.ControlDNSLookup
+	dials       []ipnstate.ControlDial
+	handshakes  []ipnstate.ControlHandshake
+	http        []ipnstate.ControlHTTPResult
+	proxy       map[string]string // URL host => redacted proxy URL last used for it
+	lastSuccess time.Time
+}
+
+func newConnDiag(serverURL string) *connDiag {
+	return &connDiag{serverURL: serverURL}
+}
+
+// appendBounded appends v to s, dropping the oldest entries so that
+// the result has at most maxDiagEntries elements.
+func appendBounded[T any](s []T, v T) []T {
+	if len(s) >= maxDiagEntries {
+		s = append(s[:0], s[len(s)-maxDiagEntries+1:]...)
+	}
+	return append(s, v)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Snapshot returns a copy of the recorded diagnostics.
+func (d *connDiag) Snapshot() *ipnstate.ControlDiag {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return &ipnstate.ControlDiag{
+		ServerURL:   d.serverURL,
+		DNS:         append([]ipnstate.ControlDNSLookup(nil), d.dns...),
+		Dials:       append([]ipnstate.ControlDial(nil), d.dials...),
+		Handshakes:  append([]ipnstate.ControlHandshake(nil), d.handshakes...),
+		HTTP:        append([]ipnstate.ControlHTTPResult(nil), d.http...),
+		LastSuccess: d.lastSuccess,
+	}
+}
+
+func (d *connDiag) noteDNS(host string, allIPs []net.IPAddr, dur time.Duration, err error) {
+	e := ipnstate.ControlDNSLookup{
+		Time:     time.Now(),
+		Host:     host,
+		Duration: dur,
+		Err:      errString(err),
+	}
+	for _, ip := range allIPs {
+		if ipp, ok := netip.AddrFromSlice(ip.IP); ok {
+			e.IPs = append(e.IPs, ipp.Unmap())
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dns = appendBounded(d.dns, e)
+}
+
+func (d *connDiag) noteDial(network, addr string, dur time.Duration, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials = appendBounded(d.dials, ipnstate.ControlDial{
+		Time:     time.Now(),
+		Network:  network,
+		Addr:     addr,
+		Duration: dur,
+		Err:      errString(err),
+	})
+}
+
+func (d *connDiag) noteHandshake(u *url.URL, dur time.Duration, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handshakes = appendBounded(d.handshakes, ipnstate.ControlHandshake{
+		Time:     time.Now(),
+		URL:      u.String(),
+		Duration: dur,
+		Err:      errString(err),
+	})
+}
+
+func (d *connDiag) noteProxy(u *url.URL, proxy *url.URL, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.proxy == nil {
+		d.proxy = map[string]string{}
+	}
+	switch {
+	case err != nil:
+		d.proxy[u.Host] = "error: " + err.Error()
+	case proxy != nil:
+		d.proxy[u.Host] = proxy.Redacted()
+	default:
+		delete(d.proxy, u.Host)
+	}
+}
+
+func (d *connDiag) noteHTTP(u *url.URL, noise bool, statusCode int, dur time.Duration, err error) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Strip the query, which can be long and isn't interesting.
+	uc := *u
+	uc.RawQuery = ""
+	d.http = appendBounded(d.http, ipnstate.ControlHTTPResult{
+		Time:       now,
+		URL:        uc.String(),
+		Noise:      noise,
+		Proxy:      d.proxy[u.Host],
+		StatusCode: statusCode,
+		Duration:   dur,
+		Err:        errString(err),
+	})
+	if statusCode != 0 {
+		d.lastSuccess = now
+	}
+}
+
+// tracedProxy wraps the proxy selection func proxy to record which
+// proxy (if any) is used for each request.
+func (d *connDiag) tracedProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		d.noteProxy(req.URL, u, err)
+		return u, err
+	}
+}
+
+// tracedDialer wraps dial, which must dial IP addresses (not
+// hostnames), to record each dial attempt.
+func (d *connDiag) tracedDialer(dial dnscache.DialContextFunc) dnscache.DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t0 := time.Now()
+		c, err := dial(ctx, network, addr)
+		d.noteDial(network, addr, time.Since(t0), err)
+		return c, err
+	}
+}
+
+// tracedResolvingDialer wraps dial, which must be a dnscache.Dialer
+// using resolver, to additionally record the DNS results for each host
+// dialed. The lookup populates resolver's cache, so dial then reuses it.
+func (d *connDiag) tracedResolvingDialer(dial dnscache.DialContextFunc, resolver *dnscache.Resolver) dnscache.DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if _, err := netip.ParseAddr(host); err != nil {
+				t0 := time.Now()
+				_, _, allIPs, err := resolver.LookupIP(ctx, host)
+				d.noteDNS(host, allIPs, time.Since(t0), err)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// controlhttpTrace returns the hooks used to record the progress of
+// controlhttp dials.
+func (d *connDiag) controlhttpTrace() *controlhttp.Trace {
+	return &controlhttp.Trace{
+		Proxy: d.noteProxy,
+		Upgrade: func(u *url.URL, statusCode int, dur time.Duration, err error) {
+			d.noteHTTP(u, false, statusCode, dur, err)
+		},
+		Handshake: d.noteHandshake,
+	}
+}
+
+// diagTransport is an http.RoundTripper that records the result of
+// each request it makes.
+type diagTransport struct {
+	rt    http.RoundTripper
+	diag  *connDiag
+	noise bool
+}
+
+func (t *diagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t0 := time.Now()
+	res, err := t.rt.RoundTrip(req)
+	var statusCode int
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+	t.diag.noteHTTP(req.URL, t.noise, statusCode, time.Since(t0), err)
+	return res, err
+}
+
+func (t *diagTransport) CloseIdleConnections() {
+	if c, ok := t.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
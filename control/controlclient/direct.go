@@ -47,6 +47,7 @@
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/opt"
 	"tailscale.com/types/persist"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/singleflight"
@@ -73,6 +74,7 @@ type Direct struct {
 	skipIPForwardingCheck  bool
 	pinger                 Pinger
 	popBrowser             func(url string) // or nil
+	diag                   *connDiag
 
 	mu             sync.Mutex        // mutex guards the following fields
 	serverKey      key.MachinePublic // original ("legacy") nacl crypto_box-based public key
@@ -88,8 +90,9 @@ type Direct struct {
 	hostinfo      *tailcfg.Hostinfo // always non-nil
 	netinfo       *tailcfg.NetInfo
 	endpoints     []tailcfg.Endpoint
-	everEndpoints bool   // whether we've ever had non-empty endpoints
-	lastPingURL   string // last PingRequest.URL received, for dup suppression
+	nodeKeySig    tkatype.MarshaledSignature // or nil
+	everEndpoints bool                       // whether we've ever had non-empty endpoints
+	lastPingURL   string                     // last PingRequest.URL received, for dup suppression
 }
 
 type Options struct {
@@ -129,6 +132,10 @@ type Options struct {
 	// MapResponse.PingRequest queries from the control plane.
 	// If nil, PingRequest queries are not answered.
 	Pinger Pinger
+
+	// Backoff optionally configures how aggressively the Auto
+	// client retries failed requests. The zero value uses defaults.
+	Backoff BackoffPolicy
 }
 
 // Pinger is the LocalBackend.Ping method.
@@ -164,6 +171,7 @@ func NewDirect(opts Options) (*Direct, error) {
 		opts.Logf = log.Printf
 	}
 
+	diag := newConnDiag(opts.ServerURL)
 	httpc := opts.HTTPTestClient
 	if httpc == nil && runtime.GOOS == "js" {
 		// In js/wasm, net/http.Transport (as of Go 1.18) will
@@ -178,18 +186,19 @@ func NewDirect(opts Options) (*Direct, error) {
 			UseLastGood:      true,
 			LookupIPFallback: dnsfallback.Lookup,
 		}
+		systemDial := diag.tracedDialer(opts.Dialer.SystemDial)
 		tr := http.DefaultTransport.(*http.Transport).Clone()
-		tr.Proxy = tshttpproxy.ProxyFromEnvironment
+		tr.Proxy = diag.tracedProxy(tshttpproxy.ProxyFromEnvironment)
 		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
-		tr.TLSClientConfig = tlsdial.Config(serverURL.Hostname(), tr.TLSClientConfig)
-		tr.DialContext = dnscache.Dialer(opts.Dialer.SystemDial, dnsCache)
-		tr.DialTLSContext = dnscache.TLSDialer(opts.Dialer.SystemDial, dnsCache, tr.TLSClientConfig)
+		tr.TLSClientConfig = tlsdial.ControlConfig(serverURL.Hostname(), tr.TLSClientConfig)
+		tr.DialContext = diag.tracedResolvingDialer(dnscache.Dialer(systemDial, dnsCache), dnsCache)
+		tr.DialTLSContext = diag.tracedResolvingDialer(dnscache.TLSDialer(systemDial, dnsCache, tr.TLSClientConfig), dnsCache)
 		tr.ForceAttemptHTTP2 = true
 		// Disable implicit gzip compression; the various
 		// handlers (register, map, set-dns, etc) do their own
 		// zstd compression per naclbox.
 		tr.DisableCompression = true
-		httpc = &http.Client{Transport: tr}
+		httpc = &http.Client{Transport: &diagTransport{rt: tr, diag: diag}}
 	}
 
 	c := &Direct{
@@ -198,7 +207,7 @@ func NewDirect(opts Options) (*Direct, error) {
 		getNLPublicKey:         opts.GetNLPublicKey,
 		serverURL:              opts.ServerURL,
 		timeNow:                opts.TimeNow,
-		logf:                   opts.Logf,
+		logf:                   logger.ComponentLogf(opts.Logf, "controlclient"),
 		newDecompressor:        opts.NewDecompressor,
 		keepAlive:              opts.KeepAlive,
 		persist:                opts.Persist,
@@ -211,6 +220,7 @@ func NewDirect(opts Options) (*Direct, error) {
 		pinger:                 opts.Pinger,
 		popBrowser:             opts.PopBrowserURL,
 		dialer:                 opts.Dialer,
+		diag:                   diag,
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(hostinfo.New())
@@ -225,6 +235,12 @@ func NewDirect(opts Options) (*Direct, error) {
 	return c, nil
 }
 
+// Diagnostics returns a snapshot of the diagnostics recorded about
+// recent attempts to connect to the control server.
+func (c *Direct) Diagnostics() *ipnstate.ControlDiag {
+	return c.diag.Snapshot()
+}
+
 // Close closes the underlying Noise connection(s).
 func (c *Direct) Close() error {
 	c.mu.Lock()
@@ -273,6 +289,20 @@ func (c *Direct) SetNetInfo(ni *tailcfg.NetInfo) bool {
 	return true
 }
 
+// SetNodeKeySignature remembers sig, the node's key signature, for the
+// next map request. It reports whether the signature has changed.
+func (c *Direct) SetNodeKeySignature(sig tkatype.MarshaledSignature) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if bytes.Equal(sig, c.nodeKeySig) {
+		return false
+	}
+	c.nodeKeySig = append(tkatype.MarshaledSignature(nil), sig...)
+	c.logf("[v1] NodeKeySignature: %d bytes", len(sig))
+	return true
+}
+
 func (c *Direct) GetPersist() persist.Persist {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -513,7 +543,9 @@ func (c *Direct) doLogin(ctx context.Context, opt loginOpt) (mustRegen bool, new
 	if err != nil {
 		return regen, opt.URL, err
 	}
+	t0 := time.Now()
 	res, err := httpc.Do(req)
+	noteControlRequest(ctx, t0, err)
 	if err != nil {
 		return regen, opt.URL, fmt.Errorf("register request: %w", err)
 	}
@@ -689,6 +721,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		epTypes = append(epTypes, ep.Type)
 	}
 	everEndpoints := c.everEndpoints
+	nodeKeySig := c.nodeKeySig
 	c.mu.Unlock()
 
 	machinePrivKey, err := c.getMachinePrivKey()
@@ -728,6 +761,8 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		DebugFlags:    c.debugFlags,
 		OmitPeers:     cb == nil,
 
+		NodeKeySignature: nodeKeySig,
+
 		// On initial startup before we know our endpoints, set the ReadOnly flag
 		// to tell the control server not to distribute out our (empty) endpoints to peers.
 		// Presumably we'll learn our endpoints in a half second and do another post
@@ -792,7 +827,9 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		return err
 	}
 
+	tDo := time.Now()
 	res, err := httpc.Do(req)
+	noteControlRequest(ctx, tDo, err)
 	if err != nil {
 		vlogf("netmap: Do: %v", err)
 		return err
@@ -958,8 +995,14 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, readOnly bool
 		}
 
 		if DevKnob.StripEndpoints {
-			for _, p := range resp.Peers {
-				p.Endpoints = nil
+			for i, p := range resp.Peers {
+				// Peers may be shared with earlier netmaps;
+				// don't mutate them in place.
+				if p.Endpoints != nil {
+					p = p.Clone()
+					p.Endpoints = nil
+					resp.Peers[i] = p
+				}
 			}
 		}
 		if DevKnob.StripCaps {
@@ -1301,7 +1344,7 @@ func (c *Direct) getNoiseClient() (*noiseClient, error) {
 		if err != nil {
 			return nil, err
 		}
-		nc, err := newNoiseClient(k, serverNoiseKey, c.serverURL, c.dialer)
+		nc, err := newNoiseClient(k, serverNoiseKey, c.serverURL, c.dialer, c.diag)
 		if err != nil {
 			return nil, err
 		}
@@ -1418,7 +1461,24 @@ func (c *Direct) DoNoiseRequest(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	return nc.Do(req)
+	t0 := time.Now()
+	res, err := nc.Do(req)
+	noteControlRequest(req.Context(), t0, err)
+	return res, err
+}
+
+// noteControlRequest records the outcome of a request to control that
+// started at start, for the health package's control latency and failure
+// rate checks. Requests canceled by the caller aren't counted.
+func noteControlRequest(ctx context.Context, start time.Time, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		health.NoteControlRequestFailed()
+		return
+	}
+	health.NoteControlRTT(time.Since(start))
 }
 
 // doPingerPing sends a Ping to pr.IP using pinger, and sends an http request back to
@@ -1478,18 +1538,20 @@ func postPingResult(start time.Time, logf logger.Logf, c *http.Client, pr *tailc
 }
 
 var (
-	metricMapRequestsActive = clientmetric.NewGauge("controlclient_map_requests_active")
+	metricGroup = clientmetric.NewGroup("controlclient", "control server client")
+
+	metricMapRequestsActive = metricGroup.NewGauge("map_requests_active", "map requests currently in flight")
 
-	metricMapRequests     = clientmetric.NewCounter("controlclient_map_requests")
-	metricMapRequestsLite = clientmetric.NewCounter("controlclient_map_requests_lite")
-	metricMapRequestsPoll = clientmetric.NewCounter("controlclient_map_requests_poll")
+	metricMapRequests     = metricGroup.NewCounter("map_requests", "map requests sent")
+	metricMapRequestsLite = metricGroup.NewCounter("map_requests_lite", "non-streaming map requests sent")
+	metricMapRequestsPoll = metricGroup.NewCounter("map_requests_poll", "streaming map requests sent")
 
-	metricMapResponseMessages   = clientmetric.NewCounter("controlclient_map_response_message") // any message type
-	metricMapResponsePings      = clientmetric.NewCounter("controlclient_map_response_ping")
-	metricMapResponseKeepAlives = clientmetric.NewCounter("controlclient_map_response_keepalive")
-	metricMapResponseMap        = clientmetric.NewCounter("controlclient_map_response_map")       // any non-keepalive map response
-	metricMapResponseMapDelta   = clientmetric.NewCounter("controlclient_map_response_map_delta") // 2nd+ non-keepalive map response
+	metricMapResponseMessages   = metricGroup.NewCounter("map_response_message", "map response messages of any type received")
+	metricMapResponsePings      = metricGroup.NewCounter("map_response_ping", "map responses containing a ping request")
+	metricMapResponseKeepAlives = metricGroup.NewCounter("map_response_keepalive", "keep-alive map responses received")
+	metricMapResponseMap        = metricGroup.NewCounter("map_response_map", "non-keep-alive map responses received")
+	metricMapResponseMapDelta   = metricGroup.NewCounter("map_response_map_delta", "non-keep-alive map responses after the first in a stream")
 
-	metricSetDNS      = clientmetric.NewCounter("controlclient_setdns")
-	metricSetDNSError = clientmetric.NewCounter("controlclient_setdns_error")
+	metricSetDNS      = metricGroup.NewCounter("setdns", "SetDNS requests sent")
+	metricSetDNSError = metricGroup.NewCounter("setdns_error", "SetDNS requests that failed")
 )
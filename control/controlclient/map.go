@@ -27,6 +27,12 @@
 // in the omitted data implicit from prior MapResponse values from
 // within the same session (the same long-poll HTTP response to the
 // one MapRequest).
+//
+// Successive NetworkMaps share the values that didn't change between
+// MapResponses, including the *tailcfg.Node of each unchanged peer, so
+// a delta only costs work proportional to what it changed. Nodes that
+// may be shared are never mutated; they're cloned first.
+// See netmap.NetworkMap.DiffFrom.
 type mapSession struct {
 	// Immutable fields.
 	privateNodeKey         key.NodePrivate
@@ -43,7 +49,8 @@ type mapSession struct {
 	lastParsedPacketFilter []filter.Match
 	lastSSHPolicy          *tailcfg.SSHPolicy
 	collectServices        bool
-	previousPeers          []*tailcfg.Node // for delta-purposes
+	previousPeers          []*tailcfg.Node // for delta-purposes; shared with the last NetworkMap, sorted by ID
+	lastMagicDNSSuffix     string          // suffix previousPeers' display names were initialized with
 	lastDomain             string
 	lastHealth             []string
 	lastPopBrowserURL      string
@@ -80,9 +87,9 @@ func (ms *mapSession) addUserProfile(userID tailcfg.UserID) {
 // or incremental MapResponse within the session, filling in omitted
 // information from prior MapResponse values.
 func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.NetworkMap {
-	undeltaPeers(resp, ms.previousPeers)
+	prevPeers := ms.previousPeers
+	undeltaPeers(resp, prevPeers)
 
-	ms.previousPeers = cloneNodes(resp.Peers) // defensive/lazy clone, since this escapes to who knows where
 	for _, up := range resp.UserProfiles {
 		ms.lastUserProfile[up.ID] = up
 	}
@@ -179,17 +186,31 @@ func (ms *mapSession) netmapForResponse(resp *tailcfg.MapResponse) *netmap.Netwo
 	if nm.SelfNode != nil {
 		nm.SelfNode.InitDisplayNames(magicDNSSuffix)
 	}
-	for _, peer := range resp.Peers {
-		peer.InitDisplayNames(magicDNSSuffix)
-		if !peer.Sharer.IsZero() {
-			if ms.keepSharerAndUserSplit {
-				ms.addUserProfile(peer.Sharer)
-			} else {
+	suffixChanged := magicDNSSuffix != ms.lastMagicDNSSuffix
+	for i, peer := range resp.Peers {
+		// Peers are sorted by ID, so walk prevPeers alongside to
+		// find which nodes are shared with the previous NetworkMap.
+		for len(prevPeers) > 0 && prevPeers[0].ID < peer.ID {
+			prevPeers = prevPeers[1:]
+		}
+		shared := len(prevPeers) > 0 && prevPeers[0] == peer
+		if shared && suffixChanged {
+			peer = peer.Clone()
+			resp.Peers[i] = peer
+		}
+		if !shared || suffixChanged {
+			peer.InitDisplayNames(magicDNSSuffix)
+			if !peer.Sharer.IsZero() && !ms.keepSharerAndUserSplit {
 				peer.User = peer.Sharer
 			}
 		}
+		if !peer.Sharer.IsZero() && ms.keepSharerAndUserSplit {
+			ms.addUserProfile(peer.Sharer)
+		}
 		ms.addUserProfile(peer.User)
 	}
+	ms.previousPeers = resp.Peers
+	ms.lastMagicDNSSuffix = magicDNSSuffix
 	if DevKnob.ForceProxyDNS {
 		nm.DNS.Proxied = true
 	}
@@ -264,13 +285,35 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 	}
 
 	if len(mapRes.PeerSeenChange) != 0 || len(mapRes.OnlineChange) != 0 || len(mapRes.PeersChangedPatch) != 0 {
-		peerByID := make(map[tailcfg.NodeID]*tailcfg.Node, len(newFull))
-		for _, n := range newFull {
-			peerByID[n.ID] = n
+		if len(removed) == 0 && len(mapRes.PeersChanged) == 0 {
+			// newFull is still prev, which may be referenced by an
+			// earlier NetworkMap. Copy it before replacing elements.
+			newFull = append([]*tailcfg.Node(nil), newFull...)
+		}
+		idx := make(map[tailcfg.NodeID]int, len(newFull))
+		for i, n := range newFull {
+			idx[n.ID] = i
+		}
+		// patched maps from a NodeID to the node being patched, which
+		// is cloned on first use so that nodes shared with earlier
+		// NetworkMaps are never mutated.
+		patched := map[tailcfg.NodeID]*tailcfg.Node{}
+		peerByID := func(id tailcfg.NodeID) (*tailcfg.Node, bool) {
+			if n, ok := patched[id]; ok {
+				return n, true
+			}
+			i, ok := idx[id]
+			if !ok {
+				return nil, false
+			}
+			n := newFull[i].Clone()
+			newFull[i] = n
+			patched[id] = n
+			return n, true
 		}
 		now := clockNow()
 		for nodeID, seen := range mapRes.PeerSeenChange {
-			if n, ok := peerByID[nodeID]; ok {
+			if n, ok := peerByID(nodeID); ok {
 				if seen {
 					n.LastSeen = &now
 				} else {
@@ -279,13 +322,13 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 			}
 		}
 		for nodeID, online := range mapRes.OnlineChange {
-			if n, ok := peerByID[nodeID]; ok {
+			if n, ok := peerByID(nodeID); ok {
 				online := online
 				n.Online = &online
 			}
 		}
 		for _, ec := range mapRes.PeersChangedPatch {
-			if n, ok := peerByID[ec.NodeID]; ok {
+			if n, ok := peerByID(ec.NodeID); ok {
 				if ec.DERPRegion != 0 {
 					n.DERP = fmt.Sprintf("%s:%v", tailcfg.DerpMagicIP, ec.DERPRegion)
 				}
@@ -342,17 +385,6 @@ func sortNodes(v []*tailcfg.Node) {
 	sort.Slice(v, func(i, j int) bool { return v[i].ID < v[j].ID })
 }
 
-func cloneNodes(v1 []*tailcfg.Node) []*tailcfg.Node {
-	if v1 == nil {
-		return nil
-	}
-	v2 := make([]*tailcfg.Node, len(v1))
-	for i, n := range v1 {
-		v2[i] = n.Clone()
-	}
-	return v2
-}
-
 var debugSelfIPv6Only = envknob.Bool("TS_DEBUG_SELF_V6_ONLY")
 
 func filterSelfAddresses(in []netip.Prefix) (ret []netip.Prefix) {
@@ -450,6 +450,55 @@ func TestNetmapForResponse(t *testing.T) {
 			t.Errorf("Node mismatch in 2nd netmap; got: %s", j)
 		}
 	})
+	t.Run("incremental_peers", func(t *testing.T) {
+		ms := newTestMapSession(t)
+		nm1 := ms.netmapForResponse(&tailcfg.MapResponse{
+			Node: &tailcfg.Node{Name: "self.foo.ts.net."},
+			Peers: []*tailcfg.Node{
+				{ID: 1, Name: "one.foo.ts.net."},
+				{ID: 2, Name: "two.foo.ts.net."},
+				{ID: 3, Name: "three.foo.ts.net."},
+			},
+		})
+		online := true
+		nm2 := ms.netmapForResponse(&tailcfg.MapResponse{
+			OnlineChange: map[tailcfg.NodeID]bool{2: online},
+		})
+		if got := formatNodes(nm1.Peers); got != `(1, "one.foo.ts.net."), (2, "two.foo.ts.net."), (3, "three.foo.ts.net.")` {
+			t.Errorf("1st netmap mutated by delta: %s", got)
+		}
+		if nm1.Peers[0] != nm2.Peers[0] || nm1.Peers[2] != nm2.Peers[2] {
+			t.Error("unchanged peers not shared between netmaps")
+		}
+		if nm2.Peers[1].Online == nil || *nm2.Peers[1].Online != online {
+			t.Errorf("2nd netmap peer 2 = %s", formatNodes(nm2.Peers[1:2]))
+		}
+		if nm2.Peers[1].ComputedName != "two" {
+			t.Errorf("ComputedName = %q; want two", nm2.Peers[1].ComputedName)
+		}
+
+		d := nm2.DiffFrom(nm1)
+		want := &netmap.Diff{PeersChanged: []tailcfg.NodeID{2}}
+		if !reflect.DeepEqual(d, want) {
+			t.Errorf("diff = %+v; want %+v", d, want)
+		}
+
+		nm3 := ms.netmapForResponse(&tailcfg.MapResponse{
+			PeersRemoved: []tailcfg.NodeID{1},
+			PeersChanged: []*tailcfg.Node{{ID: 4, Name: "four.foo.ts.net."}},
+		})
+		if nm3.Peers[0] != nm2.Peers[1] || nm3.Peers[1] != nm2.Peers[2] {
+			t.Error("unchanged peers not shared between netmaps")
+		}
+		d = nm3.DiffFrom(nm2)
+		want = &netmap.Diff{
+			PeersAdded:   []tailcfg.NodeID{4},
+			PeersRemoved: []tailcfg.NodeID{1},
+		}
+		if !reflect.DeepEqual(d, want) {
+			t.Errorf("diff = %+v; want %+v", d, want)
+		}
+	})
 }
 
 // TestDeltaDebug tests that tailcfg.Debug values can be omitted in MapResposnes
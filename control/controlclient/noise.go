@@ -52,6 +52,7 @@ type noiseClient struct {
 	host         string // the host part of serverURL
 	httpPort     string // the default port to call
 	httpsPort    string // the fallback Noise-over-https port
+	diag         *connDiag
 
 	// mu only protects the following variables.
 	mu       sync.Mutex
@@ -61,7 +62,8 @@ type noiseClient struct {
 
 // newNoiseClient returns a new noiseClient for the provided server and machine key.
 // serverURL is of the form https://<host>:<port> (no trailing slash).
-func newNoiseClient(priKey key.MachinePrivate, serverPubKey key.MachinePublic, serverURL string, dialer *tsdial.Dialer) (*noiseClient, error) {
+// Connection attempts are recorded in diag.
+func newNoiseClient(priKey key.MachinePrivate, serverPubKey key.MachinePublic, serverURL string, dialer *tsdial.Dialer, diag *connDiag) (*noiseClient, error) {
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, err
@@ -89,6 +91,7 @@ func newNoiseClient(priKey key.MachinePrivate, serverPubKey key.MachinePublic, s
 		httpPort:     httpPort,
 		httpsPort:    httpsPort,
 		dialer:       dialer,
+		diag:         diag,
 	}
 
 	// Create the HTTP/2 Transport using a net/http.Transport
@@ -116,7 +119,7 @@ func newNoiseClient(priKey key.MachinePrivate, serverPubKey key.MachinePublic, s
 	// one that dials.
 	h2Transport.ConnPool = nil
 
-	np.Client = &http.Client{Transport: h2Transport}
+	np.Client = &http.Client{Transport: &diagTransport{rt: h2Transport, diag: diag, noise: true}}
 	return np, nil
 }
 
@@ -159,13 +162,14 @@ func (nc *noiseClient) dial(_, _ string, _ *tls.Config) (net.Conn, error) {
 	// highest latency links.
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	ctx = controlhttp.WithTrace(ctx, nc.diag.controlhttpTrace())
 
 	if tailcfg.CurrentCapabilityVersion > math.MaxUint16 {
 		// Panic, because a test should have started failing several
 		// thousand version numbers before getting to this point.
 		panic("capability version is too high to fit in the wire protocol")
 	}
-	conn, err := controlhttp.Dial(ctx, nc.host, nc.httpPort, nc.httpsPort, nc.privKey, nc.serverPubKey, uint16(tailcfg.CurrentCapabilityVersion), nc.dialer.SystemDial)
+	conn, err := controlhttp.Dial(ctx, nc.host, nc.httpPort, nc.httpsPort, nc.privKey, nc.serverPubKey, uint16(tailcfg.CurrentCapabilityVersion), nc.diag.tracedDialer(nc.dialer.SystemDial))
 	if err != nil {
 		return nil, err
 	}
@@ -178,7 +178,11 @@ func (a *dialParams) dialURL(ctx context.Context, u *url.URL) (*controlbase.Conn
 	if err != nil {
 		return nil, err
 	}
+	t0 := time.Now()
 	cbConn, err := cont(ctx, netConn)
+	if h := contextTrace(ctx).Handshake; h != nil {
+		h(u, time.Since(t0), err)
+	}
 	if err != nil {
 		netConn.Close()
 		return nil, err
@@ -198,12 +202,19 @@ func (a *dialParams) tryURLUpgrade(ctx context.Context, u *url.URL, init []byte)
 	tr := http.DefaultTransport.(*http.Transport).Clone()
 	defer tr.CloseIdleConnections()
 	tr.Proxy = a.proxyFunc
+	if traceProxy := contextTrace(ctx).Proxy; traceProxy != nil && a.proxyFunc != nil {
+		tr.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxy, err := a.proxyFunc(req)
+			traceProxy(req.URL, proxy, err)
+			return proxy, err
+		}
+	}
 	tshttpproxy.SetTransportGetProxyConnectHeader(tr)
 	tr.DialContext = dnscache.Dialer(a.dialer, dns)
 	// Disable HTTP2, since h2 can't do protocol switching.
 	tr.TLSClientConfig.NextProtos = []string{}
 	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
-	tr.TLSClientConfig = tlsdial.Config(a.host, tr.TLSClientConfig)
+	tr.TLSClientConfig = tlsdial.ControlConfig(a.host, tr.TLSClientConfig)
 	if a.insecureTLS {
 		tr.TLSClientConfig.InsecureSkipVerify = true
 		tr.TLSClientConfig.VerifyConnection = nil
@@ -250,7 +261,15 @@ func (a *dialParams) tryURLUpgrade(ctx context.Context, u *url.URL, init []byte)
 	}
 	req = req.WithContext(ctx)
 
+	t0 := time.Now()
 	resp, err := tr.RoundTrip(req)
+	if traceUpgrade := contextTrace(ctx).Upgrade; traceUpgrade != nil {
+		var statusCode int
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		traceUpgrade(u, statusCode, time.Since(t0), err)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -9,6 +9,7 @@
 	"encoding/base64"
 	"net"
 	"net/url"
+	"time"
 
 	"nhooyr.io/websocket"
 	"tailscale.com/control/controlbase"
@@ -46,7 +47,11 @@ func Dial(ctx context.Context, host string, httpPort string, httpsPort string, m
 		return nil, err
 	}
 	netConn := websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)
+	t0 := time.Now()
 	cbConn, err := cont(ctx, netConn)
+	if h := contextTrace(ctx).Handshake; h != nil {
+		h(wsURL, time.Since(t0), err)
+	}
 	if err != nil {
 		netConn.Close()
 		return nil, err
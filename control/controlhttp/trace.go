@@ -0,0 +1,49 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlhttp
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// Trace is a set of hooks to run at various stages of a Dial, in the
+// style of net/http/httptrace. Any particular hook may be nil.
+//
+// Hooks may be called concurrently from the HTTP and HTTPS dial
+// attempts, so they must be safe for concurrent use.
+type Trace struct {
+	// Proxy, if non-nil, is called with the proxy selected for an
+	// upgrade request to u. The proxy is nil if the request is
+	// made directly.
+	Proxy func(u *url.URL, proxy *url.URL, err error)
+
+	// Upgrade, if non-nil, is called when the HTTP upgrade request
+	// to u completes. statusCode is zero if no response was received.
+	Upgrade func(u *url.URL, statusCode int, d time.Duration, err error)
+
+	// Handshake, if non-nil, is called when the Noise handshake over
+	// the connection upgraded from u completes.
+	Handshake func(u *url.URL, d time.Duration, err error)
+}
+
+type traceContextKey struct{}
+
+// WithTrace returns a new context based on the provided parent ctx.
+// Dials made with the returned context will use the provided trace
+// hooks.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, t)
+}
+
+// contextTrace returns the Trace associated with the provided
+// context. If none, it returns the zero Trace, whose hooks are all nil.
+func contextTrace(ctx context.Context) *Trace {
+	if t, ok := ctx.Value(traceContextKey{}).(*Trace); ok && t != nil {
+		return t
+	}
+	return &Trace{}
+}
@@ -28,6 +28,7 @@
 	"net/netip"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,10 +41,12 @@
 	"tailscale.com/client/tailscale"
 	"tailscale.com/disco"
 	"tailscale.com/envknob"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/metrics"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/pad32"
+	"tailscale.com/types/views"
 	"tailscale.com/version"
 )
 
@@ -132,20 +135,40 @@ type Server struct {
 	dupClientKeys                expvar.Int // current number of public keys we have 2+ connections for
 	dupClientConns               expvar.Int // current number of connections sharing a public key
 	dupClientConnTotal           expvar.Int // total number of accepted connections when a dup key existed
+	clientsRateLimited           expvar.Int // times a client started exceeding its rate limit
 	unknownFrames                expvar.Int
 	homeMovesIn                  expvar.Int // established clients announce home server moves in
 	homeMovesOut                 expvar.Int // established clients announce home server moves out
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
+	handshakeFailures            metrics.LabelMap
 	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
 
+	// clientRateLimit is the limit on the packets each client (other
+	// than mesh peers) may send through the server.
+	clientRateLimit ClientRateLimit
+
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// verifyClientTags and verifyClientCap, if set, further restrict
+	// verified clients to peers with one of the ACL tags or to which
+	// the tailnet's ACLs grant the capability.
+	verifyClientTags []string
+	verifyClientCap  string
+
+	capMu    sync.Mutex
+	capCache map[key.NodePublic]capResult // whether clients have verifyClientCap
+
+	// verifyClientFunc, if non-nil, accepts or rejects clients
+	// other than mesh peers; see SetVerifyClientFunc.
+	verifyClientFunc func(clientKey key.NodePublic, remoteAddr string) error
+
 	mu       sync.Mutex
 	closed   bool
+	draining bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
 	clients  map[key.NodePublic]clientSet
 	watchers map[*sclient]bool // mesh peer -> true
@@ -163,6 +186,10 @@ type Server struct {
 
 	// maps from netip.AddrPort to a client's public key
 	keyOfAddr map[netip.AddrPort]key.NodePublic
+
+	// drainSpread is the period over which clients are
+	// disconnected when draining.
+	drainSpread time.Duration
 }
 
 // clientSet represents 1 or more *sclients.
@@ -306,6 +333,7 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		packetsRecvByKind:    metrics.LabelMap{Label: "kind"},
 		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
 		packetsDroppedType:   metrics.LabelMap{Label: "type"},
+		handshakeFailures:    metrics.LabelMap{Label: "reason"},
 		clients:              map[key.NodePublic]clientSet{},
 		clientsMesh:          map[key.NodePublic]PacketForwarder{},
 		netConns:             map[Conn]chan struct{}{},
@@ -325,6 +353,8 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("rate_limited"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -346,6 +376,62 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// ClientRateLimit is a limit on the rate at which a client may send
+// packets through the server. Packets beyond it are dropped. Zero
+// rates mean no limit.
+type ClientRateLimit struct {
+	BytesPerSecond float64 // rate of packet bytes
+	BytesBurst     int     // if zero, one second's worth (at least MaxPacketSize)
+
+	PacketsPerSecond float64
+	PacketsBurst     int // if zero, one second's worth (at least 1)
+}
+
+// SetClientRateLimit sets the rate limit applied to each client other
+// than mesh peers.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(l ClientRateLimit) {
+	s.clientRateLimit = l
+}
+
+// newLimiter returns a rate limiter for perSecond with the given
+// burst, or a default burst of one second's worth, but at least min.
+// It returns nil if perSecond is zero.
+func newLimiter(perSecond float64, burst, min int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(perSecond)
+		if burst < min {
+			burst = min
+		}
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// SetVerifyClientPolicy restricts the clients accepted when verifying
+// clients (see SetVerifyClient) to peers that have at least one of the
+// given ACL tags (such as "tag:relay-users"), or to which the tailnet's
+// ACLs grant the capability cap. An empty tags and cap accept all
+// peers.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClientPolicy(tags []string, cap string) {
+	s.verifyClientTags = tags
+	s.verifyClientCap = cap
+}
+
+// SetVerifyClientFunc sets a func that is called to accept or reject,
+// by returning an error, each client other than mesh peers, after any
+// verification through tailscaled (see SetVerifyClient).
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClientFunc(f func(clientKey key.NodePublic, remoteAddr string) error) {
+	s.verifyClientFunc = f
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -384,6 +470,60 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// drainTryFor is the TryFor duration sent to clients when draining,
+// after which they give up on the region they were connected to.
+const drainTryFor = 5 * time.Second
+
+// Drain puts s in drain mode, before it's stopped for a restart or
+// upgrade. It stops accepting new clients other than mesh peers, and
+// sends each connected client (other than mesh peers) a restarting
+// frame and disconnects it, at random times spread over the given
+// period so that the clients don't all reconnect elsewhere at once.
+//
+// Drain doesn't wait for the clients to disconnect; see NumClients.
+// It reports whether s was not already draining.
+func (s *Server) Drain(spread time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining || s.closed {
+		return false
+	}
+	s.draining = true
+	s.drainSpread = spread
+	for _, cs := range s.clients {
+		cs.ForeachClient(s.drainClientLocked)
+	}
+	return true
+}
+
+// drainClientLocked schedules c, if not a mesh peer, to be sent a
+// restarting frame and disconnected, at a random time within the
+// drain period. s.mu must be held.
+func (s *Server) drainClientLocked(c *sclient) {
+	if c.canMesh {
+		return
+	}
+	var d time.Duration
+	if s.drainSpread > 0 {
+		d = time.Duration(rand.Int63n(int64(s.drainSpread)))
+	}
+	time.AfterFunc(d, func() { close(c.drain) })
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// NumClients returns the number of connected clients, other than mesh
+// peers.
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.curClients.Value()) - s.numMeshPeersLocked()
+}
+
 func (s *Server) isClosed() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -523,6 +663,10 @@ func (s *Server) registerClient(c *sclient) {
 	s.keyOfAddr[c.remoteIPPort] = c.key
 	s.curClients.Add(1)
 	s.broadcastPeerStateChangeLocked(c.key, true)
+	if s.draining {
+		// It raced with Drain.
+		s.drainClientLocked(c)
+	}
 }
 
 // broadcastPeerStateChangeLocked enqueues a message to all watchers
@@ -645,16 +789,30 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	nc.SetDeadline(time.Now().Add(10 * time.Second))
 	bw := &lazyBufioWriter{w: nc, lbw: brw.Writer}
 	if err := s.sendServerKey(bw); err != nil {
+		s.handshakeFailures.Add("send_server_key", 1)
 		return fmt.Errorf("send server key: %v", err)
 	}
 	nc.SetDeadline(time.Now().Add(10 * time.Second))
 	clientKey, clientInfo, err := s.recvClientKey(br)
 	if err != nil {
+		s.handshakeFailures.Add("recv_client_key", 1)
 		return fmt.Errorf("receive client key: %v", err)
 	}
 	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+		s.handshakeFailures.Add("rejected", 1)
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
+	canMesh := clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey
+	if f := s.verifyClientFunc; f != nil && !canMesh {
+		if err := f(clientKey, remoteAddr); err != nil {
+			s.handshakeFailures.Add("rejected", 1)
+			return fmt.Errorf("client %x rejected: %v", clientKey, err)
+		}
+	}
+	if !canMesh && s.isDraining() {
+		s.handshakeFailures.Add("draining", 1)
+		return fmt.Errorf("client %x rejected: server draining", clientKey)
+	}
 
 	// At this point we trust the client so we don't time out.
 	nc.SetDeadline(time.Time{})
@@ -680,11 +838,16 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		sendPongCh:     make(chan [8]byte, 1),
 		peerGone:       make(chan key.NodePublic),
-		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
+		drain:          make(chan struct{}),
+		canMesh:        canMesh,
 	}
 
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		l := s.clientRateLimit
+		c.bytesLimiter = newLimiter(l.BytesPerSecond, l.BytesBurst, MaxPacketSize)
+		c.packetsLimiter = newLimiter(l.PacketsPerSecond, l.PacketsBurst, 1)
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -693,8 +856,9 @@ func (s *Server) accept(ctx context.Context, nc Conn, brw *bufio.ReadWriter, rem
 	s.registerClient(c)
 	defer s.unregisterClient(c)
 
-	err = s.sendServerInfo(c.bw, clientKey)
+	err = s.sendServerInfo(c)
 	if err != nil {
+		s.handshakeFailures.Add("send_server_info", 1)
 		return fmt.Errorf("send server info: %v", err)
 	}
 
@@ -732,6 +896,12 @@ func (c *sclient) run(ctx context.Context) error {
 				c.logf("closing; server closed")
 				return nil
 			}
+			select {
+			case <-c.drain:
+				c.logf("closing; server draining")
+				return nil
+			default:
+			}
 			return fmt.Errorf("client %x: readFrameHeader: %w", c.key, err)
 		}
 		c.s.noteClientActivity(c)
@@ -907,6 +1077,11 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.bytesRecv.Add(int64(len(contents)))
+	if !c.allowSend(len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		return nil
+	}
 
 	var fwd PacketForwarder
 	var dstLen int
@@ -949,6 +1124,46 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	return c.sendPkt(dst, p)
 }
 
+// allowSend reports whether the client may send a packet of n bytes
+// under its rate limit, and counts the times it starts exceeding it.
+func (c *sclient) allowSend(n int) bool {
+	if c.bytesLimiter == nil && c.packetsLimiter == nil {
+		return true
+	}
+	now := time.Now()
+	var packets *rate.Reservation
+	ok := true
+	if c.packetsLimiter != nil {
+		packets, ok = reserveNow(c.packetsLimiter, now, 1)
+	}
+	if ok && c.bytesLimiter != nil {
+		if _, ok = reserveNow(c.bytesLimiter, now, n); !ok && packets != nil {
+			// Don't charge a dropped packet against the packet limit.
+			packets.CancelAt(now)
+		}
+	}
+	if !ok && !c.rateLimited {
+		c.s.clientsRateLimited.Add(1)
+	}
+	c.rateLimited = !ok
+	return ok
+}
+
+// reserveNow takes n tokens from l if they are available at now,
+// and reports whether it did. The returned reservation can be
+// cancelled to give the tokens back.
+func reserveNow(l *rate.Limiter, now time.Time, n int) (*rate.Reservation, bool) {
+	r := l.ReserveN(now, n)
+	if !r.OK() {
+		return nil, false
+	}
+	if r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return nil, false
+	}
+	return r, true
+}
+
 // dropReason is why we dropped a DERP frame.
 type dropReason int
 
@@ -962,6 +1177,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // the sending client exceeded its rate limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1055,13 +1271,98 @@ func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error
 	if clientKey == status.Self.PublicKey {
 		return nil
 	}
-	if _, exists := status.Peer[clientKey]; !exists {
+	peer, exists := status.Peer[clientKey]
+	if !exists {
 		return fmt.Errorf("client %v not in set of peers", clientKey)
 	}
+	if !s.clientAllowedByPolicy(peer) {
+		return fmt.Errorf("client %v not allowed by policy", clientKey)
+	}
 	// TODO(bradfitz): add policy for configurable bandwidth rate per client?
 	return nil
 }
 
+// clientAllowedByPolicy reports whether peer is allowed to use the
+// server by the policy set with SetVerifyClientPolicy.
+func (s *Server) clientAllowedByPolicy(peer *ipnstate.PeerStatus) bool {
+	if len(s.verifyClientTags) == 0 && s.verifyClientCap == "" {
+		return true
+	}
+	if peer.Tags != nil {
+		for _, tag := range s.verifyClientTags {
+			if views.SliceContains(*peer.Tags, tag) {
+				return true
+			}
+		}
+	}
+	if s.verifyClientCap == "" || len(peer.TailscaleIPs) == 0 {
+		return false
+	}
+	return s.clientHasCap(peer)
+}
+
+const (
+	// verifyClientCapTimeout is how long to wait for tailscaled to
+	// report a client's capabilities before rejecting it.
+	verifyClientCapTimeout = 5 * time.Second
+
+	// verifyClientCapTTL is how long whether a client has
+	// verifyClientCap is remembered, so that its reconnects don't
+	// each ask tailscaled.
+	verifyClientCapTTL = time.Minute
+)
+
+// capResult is whether a client has verifyClientCap, as of
+// verifyClientCapTTL before expires.
+type capResult struct {
+	allowed bool
+	expires time.Time
+}
+
+// localWhoIs is tailscale.WhoIs, for testing.
+var localWhoIs = tailscale.WhoIs
+
+// clientHasCap reports whether the tailnet's ACLs grant peer the
+// verifyClientCap capability, using the cached answer if it's recent.
+func (s *Server) clientHasCap(peer *ipnstate.PeerStatus) bool {
+	now := timeNow()
+	s.capMu.Lock()
+	r, ok := s.capCache[peer.PublicKey]
+	s.capMu.Unlock()
+	if ok && now.Before(r.expires) {
+		return r.allowed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyClientCapTimeout)
+	defer cancel()
+	who, err := localWhoIs(ctx, netip.AddrPortFrom(peer.TailscaleIPs[0], 0).String())
+	if err != nil {
+		// Not cached, as tailscaled may just be slow or restarting.
+		s.logf("derp: verifying capabilities of %v: %v", peer.PublicKey.ShortString(), err)
+		return false
+	}
+	allowed := false
+	for _, c := range who.Caps {
+		if c == s.verifyClientCap {
+			allowed = true
+			break
+		}
+	}
+
+	s.capMu.Lock()
+	defer s.capMu.Unlock()
+	for k, r := range s.capCache {
+		if !now.Before(r.expires) {
+			delete(s.capCache, k)
+		}
+	}
+	if s.capCache == nil {
+		s.capCache = map[key.NodePublic]capResult{}
+	}
+	s.capCache[peer.PublicKey] = capResult{allowed: allowed, expires: now.Add(verifyClientCapTTL)}
+	return allowed
+}
+
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
 	buf := make([]byte, 0, len(magic)+key.NodePublicRawLen)
 	buf = append(buf, magic...)
@@ -1129,13 +1430,21 @@ type serverInfo struct {
 	TokenBucketBytesBurst     int `json:",omitempty"`
 }
 
-func (s *Server) sendServerInfo(bw *lazyBufioWriter, clientKey key.NodePublic) error {
-	msg, err := json.Marshal(serverInfo{Version: ProtocolVersion})
+func (s *Server) sendServerInfo(c *sclient) error {
+	si := serverInfo{Version: ProtocolVersion}
+	if l := c.bytesLimiter; l != nil {
+		// Let well-behaved clients throttle themselves rather
+		// than have us drop their packets.
+		si.TokenBucketBytesPerSecond = int(l.Limit())
+		si.TokenBucketBytesBurst = l.Burst()
+	}
+	msg, err := json.Marshal(si)
 	if err != nil {
 		return err
 	}
 
-	msgbox := s.privateKey.SealTo(clientKey, msg)
+	bw := c.bw
+	msgbox := s.privateKey.SealTo(c.key, msg)
 	if err := writeFrameHeader(bw.bw(), frameServerInfo, uint32(len(msgbox))); err != nil {
 		return err
 	}
@@ -1251,9 +1560,12 @@ type sclient struct {
 	sendPongCh     chan [8]byte        // pong replies to send to the client; never closed
 	peerGone       chan key.NodePublic // write request that a previous sender has disconnected (not used by mesh peers)
 	meshUpdate     chan struct{}       // write request to write peerStateChange
+	drain          chan struct{}       // closed to send frameRestarting and disconnect (not used by mesh peers)
 	canMesh        bool                // clientInfo had correct mesh token for inter-region routing
 	isDup          atomic.Bool         // whether more than 1 sclient for key is connected
 	isDisabled     atomic.Bool         // whether sends to this peer are disabled due to active/active dups
+	bytesRecv      atomic.Int64        // packet bytes received from the client to relay
+	bytesSent      atomic.Int64        // packet bytes sent to the client
 
 	// replaceLimiter controls how quickly two connections with
 	// the same client key can kick each other off the server by
@@ -1261,9 +1573,12 @@ type sclient struct {
 	replaceLimiter *rate.Limiter
 
 	// Owned by run, not thread-safe.
-	br          *bufio.Reader
-	connectedAt time.Time
-	preferred   bool
+	br             *bufio.Reader
+	connectedAt    time.Time
+	preferred      bool
+	bytesLimiter   *rate.Limiter // or nil if unlimited
+	packetsLimiter *rate.Limiter // or nil if unlimited
+	rateLimited    bool          // whether the last packet was dropped by the limiters
 
 	// Owned by sender, not thread-safe.
 	bw *lazyBufioWriter
@@ -1381,6 +1696,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case <-c.drain:
+			return c.sendRestarting()
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1412,6 +1729,8 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case <-c.drain:
+			return c.sendRestarting()
 		case msg := <-c.sendQueue:
 			werr = c.sendPacket(msg.src, msg.bs)
 			c.recordQueueTime(msg.enqueuedAt)
@@ -1448,6 +1767,23 @@ func (c *sclient) sendPong(data [8]byte) error {
 	return err
 }
 
+// sendRestarting sends and flushes a frameRestarting frame asking the
+// client to reconnect right away, which, as the server is draining,
+// gets it a different server or region.
+func (c *sclient) sendRestarting() error {
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), frameRestarting, 8); err != nil {
+		return err
+	}
+	if err := writeUint32(c.bw.bw(), 0); err != nil { // reconnect in
+		return err
+	}
+	if err := writeUint32(c.bw.bw(), uint32(drainTryFor.Milliseconds())); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.NodePublic) error {
 	c.s.peerGoneFrames.Add(1)
@@ -1525,6 +1861,7 @@ func (c *sclient) sendPacket(srcKey key.NodePublic, contents []byte) (err error)
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.bytesSent.Add(int64(len(contents)))
 		}
 	}()
 
@@ -1674,6 +2011,15 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_clients_total", expvar.Func(func() any { return len(s.clientsMesh) }))
 	m.Set("gauge_clients_local", expvar.Func(func() any { return len(s.clients) }))
 	m.Set("gauge_clients_remote", expvar.Func(func() any { return len(s.clientsMesh) - len(s.clients) }))
+	m.Set("gauge_mesh_peers_connected", s.expVarFunc(func() any { return s.numMeshPeersLocked() }))
+	m.Set("gauge_draining", s.expVarFunc(func() any {
+		if s.draining {
+			return 1
+		}
+		return 0
+	}))
+	m.Set("counter_handshake_failures_reason", &s.handshakeFailures)
+	m.Set("counter_clients_rate_limited", &s.clientsRateLimited)
 	m.Set("gauge_current_dup_client_keys", &s.dupClientKeys)
 	m.Set("gauge_current_dup_client_conns", &s.dupClientConns)
 	m.Set("counter_total_dup_client_conns", &s.dupClientConnTotal)
@@ -1706,6 +2052,127 @@ func (s *Server) ExpVar() expvar.Var {
 	return m
 }
 
+// numMeshPeersLocked returns the number of connected clients that are
+// mesh peers (other DERP servers in the same region).
+func (s *Server) numMeshPeersLocked() int {
+	n := 0
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				n++
+			}
+		})
+	}
+	return n
+}
+
+// WriteClientMetrics writes, in the Prometheus text exposition format,
+// the packet bytes relayed to and from each connected client, keyed by
+// its public key. Bytes of clients with several connections are
+// summed.
+func (s *Server) WriteClientMetrics(w io.Writer) {
+	type counts struct{ recv, sent int64 }
+	s.mu.Lock()
+	keys := make([]key.NodePublic, 0, len(s.clients))
+	byKey := make(map[key.NodePublic]counts, len(s.clients))
+	for k, cs := range s.clients {
+		var b counts
+		cs.ForeachClient(func(c *sclient) {
+			b.recv += c.bytesRecv.Load()
+			b.sent += c.bytesSent.Load()
+		})
+		keys = append(keys, k)
+		byKey[k] = b
+	}
+	s.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+
+	fmt.Fprintf(w, "# TYPE derp_client_bytes_received counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "derp_client_bytes_received{client=%q} %d\n", k.String(), byKey[k].recv)
+	}
+	fmt.Fprintf(w, "# TYPE derp_client_bytes_sent counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "derp_client_bytes_sent{client=%q} %d\n", k.String(), byKey[k].sent)
+	}
+}
+
+// ClientConnInfo describes a client's connection to a Server.
+type ClientConnInfo struct {
+	Key         key.NodePublic
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Mesh        bool  `json:",omitempty"` // whether it's a mesh peer
+	BytesRecv   int64 // packet bytes received from the client to relay
+	BytesSent   int64 // packet bytes sent to the client
+}
+
+// ClientConns returns the server's current client connections,
+// sorted by key and then by connection time.
+func (s *Server) ClientConns() []ClientConnInfo {
+	s.mu.Lock()
+	ret := make([]ClientConnInfo, 0, s.curClients.Value())
+	for _, cs := range s.clients {
+		cs.ForeachClient(func(c *sclient) {
+			ret = append(ret, ClientConnInfo{
+				Key:         c.key,
+				RemoteAddr:  c.remoteAddr,
+				ConnectedAt: c.connectedAt,
+				Mesh:        c.canMesh,
+				BytesRecv:   c.bytesRecv.Load(),
+				BytesSent:   c.bytesSent.Load(),
+			})
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Key != ret[j].Key {
+			return ret[i].Key.Less(ret[j].Key)
+		}
+		return ret[i].ConnectedAt.Before(ret[j].ConnectedAt)
+	})
+	return ret
+}
+
+// CloseClient closes all the connections of the client with public
+// key k, and returns how many there were.
+func (s *Server) CloseClient(k key.NodePublic) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.clients[k]
+	if !ok {
+		return 0
+	}
+	s.logf("derp: closing client %x (%d connections)", k, set.Len())
+	set.ForeachClient(func(c *sclient) {
+		go c.nc.Close()
+	})
+	return set.Len()
+}
+
+// ServeDebugClients serves the list of client connections as JSON.
+// A POST with a "key" form value disconnects that client instead.
+func (s *Server) ServeDebugClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		k, err := key.ParseNodePublicUntyped(mem.S(strings.TrimPrefix(r.FormValue("key"), "nodekey:")))
+		if err != nil {
+			http.Error(w, "invalid key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := s.CloseClient(k)
+		if n == 0 {
+			http.Error(w, "client not connected", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "closed %d connections\n", n)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(s.ClientConns())
+}
+
 func (s *Server) ConsistencyCheck() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
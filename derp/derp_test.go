@@ -18,16 +18,23 @@
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"go4.org/mem"
 	"golang.org/x/time/rate"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/nettest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
 )
 
 func TestClientInfoUnmarshal(t *testing.T) {
@@ -1395,3 +1402,266 @@ func TestServerRepliesToPing(t *testing.T) {
 		}
 	}
 }
+
+func TestClientAllowedByPolicy(t *testing.T) {
+	tags := views.SliceOf([]string{"tag:a", "tag:relay"})
+	tagged := &ipnstate.PeerStatus{Tags: &tags}
+	untagged := &ipnstate.PeerStatus{}
+
+	s := &Server{logf: logger.Discard}
+	if !s.clientAllowedByPolicy(untagged) {
+		t.Error("untagged peer not allowed without a policy")
+	}
+	s.SetVerifyClientPolicy([]string{"tag:relay"}, "")
+	if !s.clientAllowedByPolicy(tagged) {
+		t.Error("tagged peer not allowed")
+	}
+	if s.clientAllowedByPolicy(untagged) {
+		t.Error("untagged peer allowed")
+	}
+	s.SetVerifyClientPolicy([]string{"tag:other"}, "")
+	if s.clientAllowedByPolicy(tagged) {
+		t.Error("peer with other tags allowed")
+	}
+}
+
+func TestClientAllowedByCap(t *testing.T) {
+	var calls int
+	caps := []string{"https://example.com/cap/relay"}
+	oldWhoIs, oldNow := localWhoIs, timeNow
+	defer func() { localWhoIs, timeNow = oldWhoIs, oldNow }()
+	localWhoIs = func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("WhoIs called without a deadline")
+		}
+		return &apitype.WhoIsResponse{Caps: caps}, nil
+	}
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	peer := &ipnstate.PeerStatus{
+		PublicKey:    key.NewNode().Public(),
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+	}
+	s := &Server{logf: logger.Discard}
+	s.SetVerifyClientPolicy(nil, "https://example.com/cap/relay")
+	if !s.clientAllowedByPolicy(peer) || !s.clientAllowedByPolicy(peer) {
+		t.Error("peer with the capability not allowed")
+	}
+	if calls != 1 {
+		t.Errorf("WhoIs called %d times; want 1, then cached", calls)
+	}
+
+	// Once the cached answer expires, the capability is checked again.
+	caps = nil
+	now = now.Add(verifyClientCapTTL)
+	if s.clientAllowedByPolicy(peer) {
+		t.Error("peer allowed after losing the capability")
+	}
+	if calls != 2 {
+		t.Errorf("WhoIs called %d times; want 2", calls)
+	}
+}
+
+func TestWriteClientMetrics(t *testing.T) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+
+	k1, k2 := key.NewNode().Public(), key.NewNode().Public()
+	if k2.Less(k1) {
+		k1, k2 = k2, k1
+	}
+	c1, c2a, c2b := &sclient{key: k1}, &sclient{key: k2}, &sclient{key: k2}
+	c1.bytesRecv.Add(10)
+	c1.bytesSent.Add(20)
+	c2a.bytesRecv.Add(1)
+	c2b.bytesRecv.Add(2)
+	c2b.bytesSent.Add(3)
+	s.clients[k1] = singleClient{c1}
+	s.clients[k2] = &dupClientSet{set: map[*sclient]bool{c2a: true, c2b: true}}
+
+	var buf bytes.Buffer
+	s.WriteClientMetrics(&buf)
+	want := fmt.Sprintf(`# TYPE derp_client_bytes_received counter
+derp_client_bytes_received{client="%[1]v"} 10
+derp_client_bytes_received{client="%[2]v"} 3
+# TYPE derp_client_bytes_sent counter
+derp_client_bytes_sent{client="%[1]v"} 20
+derp_client_bytes_sent{client="%[2]v"} 3
+`, k1, k2)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestServerClientRateLimit(t *testing.T) {
+	s := NewServer(key.NewNode(), logger.Discard)
+	defer s.Close()
+	s.SetClientRateLimit(ClientRateLimit{
+		PacketsPerSecond: 1,
+		PacketsBurst:     3,
+	})
+	l := s.clientRateLimit
+	c := &sclient{
+		s:              s,
+		packetsLimiter: newLimiter(l.PacketsPerSecond, l.PacketsBurst, 1),
+	}
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if c.allowSend(100) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("allowed %d packets; want the burst of 3", allowed)
+	}
+	if got := s.clientsRateLimited.Value(); got != 1 {
+		t.Errorf("clientsRateLimited = %d; want 1", got)
+	}
+
+	// A packet the bytes limit rejects doesn't use up the packet limit.
+	c = &sclient{
+		s:              s,
+		packetsLimiter: newLimiter(1, 2, 1),
+		bytesLimiter:   newLimiter(1, 100, 1),
+	}
+	if c.allowSend(200) {
+		t.Error("allowed packet over the bytes burst")
+	}
+	if !c.allowSend(50) || !c.allowSend(50) {
+		t.Error("packet burst was spent by a rejected packet")
+	}
+
+	if lim := newLimiter(100, 0, MaxPacketSize); lim.Burst() != MaxPacketSize {
+		t.Errorf("default burst = %d; want MaxPacketSize", lim.Burst())
+	}
+	if lim := newLimiter(0, 10, 1); lim != nil {
+		t.Errorf("limiter for zero rate = %v; want nil", lim)
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	w1 := newTestWatcher(t, ts, "w1")
+	if got := ts.s.NumClients(); got != 1 {
+		t.Fatalf("NumClients = %d; want 1", got)
+	}
+
+	if !ts.s.Drain(0) {
+		t.Fatal("Drain returned false; want true")
+	}
+	if ts.s.Drain(0) {
+		t.Error("second Drain returned true; want false")
+	}
+	for {
+		m, err := c1.c.Recv()
+		if err != nil {
+			t.Fatalf("Recv before restarting: %v", err)
+		}
+		if m, ok := m.(ServerRestartingMessage); ok {
+			if m.TryFor != drainTryFor {
+				t.Errorf("TryFor = %v; want %v", m.TryFor, drainTryFor)
+			}
+			break
+		}
+	}
+	if _, err := c1.c.Recv(); err == nil {
+		t.Fatal("Recv after restarting succeeded; want error")
+	}
+	for i := 0; ts.s.NumClients() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("NumClients = %d after drain; want 0", ts.s.NumClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New regular clients are rejected.
+	nc, err := net.Dial("tcp", ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	c2, err := NewClient(key.NewNode(), nc, brw, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Recv(); err == nil {
+		t.Error("new client's Recv succeeded; want error")
+	}
+	if got := ts.s.handshakeFailures.Get("draining").Value(); got != 1 {
+		t.Errorf("draining handshake failures = %d; want 1", got)
+	}
+
+	// Mesh peers stay connected, and can still connect.
+	if err := w1.c.NotePreferred(true); err != nil {
+		t.Errorf("mesh peer write: %v", err)
+	}
+	newTestWatcher(t, ts, "w2")
+	ts.s.mu.Lock()
+	meshPeers := ts.s.numMeshPeersLocked()
+	ts.s.mu.Unlock()
+	if meshPeers != 2 {
+		t.Errorf("mesh peers = %d; want 2", meshPeers)
+	}
+}
+
+func TestServeDebugClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := newTestServer(t, ctx)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	newRegularClient(t, ts, "c2")
+
+	rec := httptest.NewRecorder()
+	ts.s.ServeDebugClients(rec, httptest.NewRequest("GET", "/debug/clients", nil))
+	var conns []ClientConnInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &conns); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.Bytes(), err)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("got %d conns; want 2", len(conns))
+	}
+	var found bool
+	for _, ci := range conns {
+		if ci.Key == c1.pub {
+			found = true
+			if ci.RemoteAddr == "" || ci.ConnectedAt.IsZero() {
+				t.Errorf("c1's conn = %+v; want RemoteAddr and ConnectedAt", ci)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("c1 not in %+v", conns)
+	}
+
+	post := func(k string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/debug/clients", strings.NewReader(url.Values{"key": {k}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ts.s.ServeDebugClients(rec, req)
+		return rec.Code
+	}
+	if code := post("bogus"); code != 400 {
+		t.Errorf("POST of bogus key = %d; want 400", code)
+	}
+	if code := post(key.NewNode().Public().String()); code != 404 {
+		t.Errorf("POST of unknown key = %d; want 404", code)
+	}
+	if code := post(c1.pub.String()); code != 200 {
+		t.Fatalf("POST of c1's key = %d; want 200", code)
+	}
+	for {
+		if _, err := c1.c.Recv(); err != nil {
+			break
+		}
+	}
+}
@@ -525,7 +525,7 @@ func (c *Client) dialRegion(ctx context.Context, reg *tailcfg.DERPRegion) (net.C
 }
 
 func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
-	tlsConf := tlsdial.Config(c.tlsServerName(node), c.TLSConfig)
+	tlsConf := tlsdial.ControlConfig(c.tlsServerName(node), c.TLSConfig)
 	if node != nil {
 		if node.InsecureForTests {
 			tlsConf.InsecureSkipVerify = true
@@ -688,9 +688,23 @@ func firstStr(a, b string) string {
 	return b
 }
 
-// dialNodeUsingProxy connects to n using a CONNECT to the HTTP(s) proxy in proxyURL.
+// dialSOCKS5, if non-nil, dials target through the SOCKS5 proxy pu.
+// It's set conditionally by socks.go.
+var dialSOCKS5 func(ctx context.Context, pu *url.URL, target string) (net.Conn, error)
+
+// dialNodeUsingProxy connects to n using a CONNECT to the HTTP(s) proxy in proxyURL,
+// or through the SOCKS5 proxy in proxyURL.
 func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, proxyURL *url.URL) (proxyConn net.Conn, err error) {
 	pu := proxyURL
+	target := net.JoinHostPort(n.HostName, "443")
+	if pu.Scheme == "socks5" {
+		if dialSOCKS5 == nil {
+			return nil, errors.New("SOCKS5 proxies not supported on this platform")
+		}
+		proxyConn, err = dialSOCKS5(ctx, pu, target)
+		c.logf("derphttp: SOCKS5 dial to %s: %v", target, err)
+		return proxyConn, err
+	}
 	if pu.Scheme == "https" {
 		var d tls.Dialer
 		proxyConn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(pu.Hostname(), firstStr(pu.Port(), "443")))
@@ -720,8 +734,6 @@ func (c *Client) dialNodeUsingProxy(ctx context.Context, n *tailcfg.DERPNode, pr
 		}
 	}()
 
-	target := net.JoinHostPort(n.HostName, "443")
-
 	var authHeader string
 	if v, err := tshttpproxy.GetAuthHeader(pu); err != nil {
 		c.logf("derphttp: error getting proxy auth header for %v: %v", proxyURL, err)
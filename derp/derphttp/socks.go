@@ -0,0 +1,28 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package derphttp
+
+import (
+	"context"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	dialSOCKS5 = dialSOCKS5Proxy
+}
+
+func dialSOCKS5Proxy(ctx context.Context, pu *url.URL, target string) (net.Conn, error) {
+	d, err := proxy.FromURL(pu, new(net.Dialer))
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package derpserver runs a DERP relay server, as embedded by the
+// derper binary and available to other Go programs.
+//
+// It combines a derp.Server with its HTTP handlers (including
+// WebSocket support and the latency probe endpoint) and the
+// connections to the mesh peers that it forwards packets to. Serving
+// HTTPS, STUN and any debug handlers is left to the caller.
+package derpserver
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/metrics"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// Options are the options for New.
+type Options struct {
+	// PrivateKey is the server's private key. It's required.
+	PrivateKey key.NodePrivate
+
+	// Logf, if non-nil, is where the server logs.
+	// The default is log.Printf.
+	Logf logger.Logf
+
+	// MeshKey, if non-empty, is the pre-shared key with which other
+	// DERP servers in the same region identify themselves as mesh
+	// peers.
+	MeshKey string
+
+	// MeshWith is the hostnames of the mesh peers to forward packets
+	// to, with ":port" if not 443. It may include the server's own
+	// hostname. It requires MeshKey.
+	MeshWith []string
+
+	// MeshDNS, if non-empty, is a DNS name listing the mesh peers by
+	// its SRV records, or else its A/AAAA records (with the peers
+	// reached by IP and their TLS certificates verified for the
+	// name). It's re-resolved every minute. It requires MeshKey.
+	MeshDNS string
+
+	// VerifyClients, if true, only accepts clients that are peers of
+	// the tailscaled running on the same machine, further restricted
+	// by VerifyClientTags and VerifyClientCap; see
+	// derp.Server.SetVerifyClientPolicy.
+	VerifyClients    bool
+	VerifyClientTags []string
+	VerifyClientCap  string
+
+	// VerifyClient, if non-nil, is called to accept or reject, by
+	// returning an error, each client other than mesh peers.
+	VerifyClient func(clientKey key.NodePublic, remoteAddr string) error
+
+	// ClientRateLimit is the limit on the packets each client (other
+	// than mesh peers) may send. The zero value means no limit.
+	ClientRateLimit derp.ClientRateLimit
+}
+
+// Server is a DERP relay server.
+type Server struct {
+	s       *derp.Server
+	logf    logger.Logf
+	handler http.Handler
+
+	// meshPeerClients is the number of clients of each mesh peer
+	// (by hostname or IP) that we forward packets to. It drops to
+	// zero when we lose our connection to the peer.
+	meshPeerClients  metrics.LabelMap
+	webSocketAccepts expvar.Int
+
+	mu        sync.Mutex
+	closed    bool
+	meshPeers []*meshPeer // from MeshWith
+	stopDNS   chan struct{}
+	dnsDone   chan struct{} // closed when the MeshDNS loop returns; nil if none
+}
+
+// New returns a new DERP server, already connecting to any mesh peers.
+// Its Handler should be served at "/derp" and "/derp/probe" over HTTPS.
+func New(opts Options) (*Server, error) {
+	if opts.PrivateKey.IsZero() {
+		return nil, errors.New("derpserver: missing PrivateKey")
+	}
+	if (len(opts.MeshWith) > 0 || opts.MeshDNS != "") && opts.MeshKey == "" {
+		return nil, errors.New("derpserver: MeshWith and MeshDNS require MeshKey")
+	}
+	logf := opts.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	ds := &Server{
+		s:               derp.NewServer(opts.PrivateKey, logf),
+		logf:            logf,
+		meshPeerClients: metrics.LabelMap{Label: "peer"},
+		stopDNS:         make(chan struct{}),
+	}
+	s := ds.s
+	s.SetMeshKey(opts.MeshKey)
+	s.SetVerifyClient(opts.VerifyClients)
+	s.SetVerifyClientPolicy(opts.VerifyClientTags, opts.VerifyClientCap)
+	s.SetVerifyClientFunc(opts.VerifyClient)
+	s.SetClientRateLimit(opts.ClientRateLimit)
+
+	mux := http.NewServeMux()
+	mux.Handle("/derp", ds.addWebSocketSupport(derphttp.Handler(s)))
+	mux.HandleFunc("/derp/probe", probeHandler)
+	ds.handler = mux
+
+	for _, host := range opts.MeshWith {
+		p, err := ds.startMeshPeer(meshPeerAddr{host: host})
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
+		ds.meshPeers = append(ds.meshPeers, p)
+	}
+	if opts.MeshDNS != "" {
+		ds.dnsDone = make(chan struct{})
+		go ds.runMeshDNS(opts.MeshDNS)
+	}
+	return ds, nil
+}
+
+// DERP returns the underlying derp.Server, for its debug handlers and
+// other settings.
+func (ds *Server) DERP() *derp.Server { return ds.s }
+
+// Handler returns the handler for the "/derp" (including WebSockets)
+// and "/derp/probe" paths.
+func (ds *Server) Handler() http.Handler { return ds.handler }
+
+// ExpVar returns an expvar variable with the server's metrics,
+// suitable for registering with expvar.Publish.
+func (ds *Server) ExpVar() expvar.Var {
+	m := new(metrics.Set)
+	ds.s.ExpVar().(*metrics.Set).Do(func(kv expvar.KeyValue) {
+		m.Set(kv.Key, kv.Value)
+	})
+	m.Set("gauge_mesh_peer_clients", &ds.meshPeerClients)
+	m.Set("counter_websocket_accepts", &ds.webSocketAccepts)
+	return m
+}
+
+// Close stops connecting to mesh peers and closes the server and all
+// its client connections.
+func (ds *Server) Close() error {
+	ds.mu.Lock()
+	if ds.closed {
+		ds.mu.Unlock()
+		return nil
+	}
+	ds.closed = true
+	close(ds.stopDNS)
+	peers := ds.meshPeers
+	ds.meshPeers = nil
+	ds.mu.Unlock()
+
+	for _, p := range peers {
+		p.stop()
+	}
+	if ds.dnsDone != nil {
+		<-ds.dnsDone
+	}
+	return ds.s.Close()
+}
+
+// probeHandler is the endpoint that js/wasm clients hit to measure
+// DERP latency, since they can't do UDP STUN queries.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "HEAD", "GET":
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	default:
+		http.Error(w, "bogus probe method", http.StatusMethodNotAllowed)
+	}
+}
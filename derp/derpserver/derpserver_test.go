@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+func TestMeshPeersFromSRV(t *testing.T) {
+	got := meshPeersFromSRV([]*net.SRV{
+		{Target: "derp1.example.com.", Port: 443},
+		{Target: "derp2.example.com.", Port: 8443},
+	})
+	want := []meshPeerAddr{
+		{host: "derp1.example.com"},
+		{host: "derp2.example.com:8443"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Error("New without PrivateKey succeeded")
+	}
+	if _, err := New(Options{PrivateKey: key.NewNode(), MeshWith: []string{"derp.example.com"}}); err == nil {
+		t.Error("New with MeshWith but no MeshKey succeeded")
+	}
+}
+
+func TestServer(t *testing.T) {
+	allowed := key.NewNode()
+	ds, err := New(Options{
+		PrivateKey: key.NewNode(),
+		Logf:       logger.WithPrefix(t.Logf, "server: "),
+		VerifyClient: func(k key.NodePublic, remoteAddr string) error {
+			if k != allowed.Public() {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	hs := httptest.NewServer(ds.Handler())
+	defer hs.Close()
+
+	res, err := http.Get(hs.URL + "/derp/probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("probe: status %v, headers %v", res.Status, res.Header)
+	}
+
+	recv := func(k key.NodePrivate) (derp.ReceivedMessage, error) {
+		c, err := derphttp.NewClient(k, hs.URL+"/derp", t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := c.Connect(context.Background()); err != nil {
+			return nil, err
+		}
+		return c.Recv()
+	}
+	if m, err := recv(allowed); err != nil {
+		t.Errorf("allowed client: %v", err)
+	} else if _, ok := m.(derp.ServerInfoMessage); !ok {
+		t.Errorf("allowed client got %T; want ServerInfoMessage", m)
+	}
+	if _, err := recv(key.NewNode()); err == nil {
+		t.Error("disallowed client connected")
+	}
+
+	if vars := ds.ExpVar().String(); !strings.Contains(vars, `"gauge_mesh_peer_clients"`) {
+		t.Errorf("ExpVar missing mesh metrics: %s", vars)
+	}
+}
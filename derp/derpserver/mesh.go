@@ -0,0 +1,219 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derpserver
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// meshDNSInterval is how often the Options.MeshDNS name is re-resolved.
+const meshDNSInterval = time.Minute
+
+// meshPeerAddr is the address of a mesh peer.
+type meshPeerAddr struct {
+	host string     // hostname, with ":port" if not 443, for the URL and TLS
+	ip   netip.Addr // if valid, the IP to dial instead of resolving host
+}
+
+// String returns the name of the peer for logs and metrics.
+func (a meshPeerAddr) String() string {
+	if a.ip.IsValid() {
+		return a.ip.String()
+	}
+	return a.host
+}
+
+// meshPeer is a connection to a mesh peer.
+type meshPeer struct {
+	s       *derp.Server
+	c       *derphttp.Client
+	cancel  context.CancelFunc
+	clients *expvar.Int
+
+	mu      sync.Mutex
+	present map[key.NodePublic]bool // peer's clients we forward packets to
+}
+
+// startMeshPeer starts forwarding packets to the clients of the mesh
+// peer at addr, until the returned peer is stopped.
+func (ds *Server) startMeshPeer(addr meshPeerAddr) (*meshPeer, error) {
+	s := ds.s
+	logf := logger.WithPrefix(ds.logf, fmt.Sprintf("mesh(%q): ", addr))
+	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+addr.host+"/derp", logf)
+	if err != nil {
+		return nil, err
+	}
+	c.MeshKey = s.MeshKey()
+
+	// For meshed peers within a region, connect via VPC addresses.
+	c.SetURLDialer(func(ctx context.Context, network, hostPort string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		var r net.Resolver
+		if addr.ip.IsValid() {
+			return d.DialContext(ctx, network, net.JoinHostPort(addr.ip.String(), port))
+		}
+		if port == "443" && strings.HasSuffix(host, ".tailscale.com") {
+			base := strings.TrimSuffix(host, ".tailscale.com")
+			subCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			defer cancel()
+			vpcHost := base + "-vpc.tailscale.com"
+			ips, _ := r.LookupIP(subCtx, "ip", vpcHost)
+			if len(ips) > 0 {
+				vpcAddr := net.JoinHostPort(ips[0].String(), port)
+				c, err := d.DialContext(subCtx, network, vpcAddr)
+				if err == nil {
+					logf("connected to %v (%v) instead of %v", vpcHost, ips[0], base)
+					return c, nil
+				}
+				logf("failed to connect to %v (%v): %v; trying non-VPC route", vpcHost, ips[0], err)
+			}
+		}
+		return d.DialContext(ctx, network, hostPort)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &meshPeer{
+		s:       s,
+		c:       c,
+		cancel:  cancel,
+		clients: ds.meshPeerClients.Get(addr.String()),
+		present: map[key.NodePublic]bool{},
+	}
+	go c.RunWatchConnectionLoop(ctx, s.PublicKey(), logf, p.add, p.remove)
+	return p, nil
+}
+
+func (p *meshPeer) add(k key.NodePublic) {
+	p.s.AddPacketForwarder(k, p.c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.present[k] {
+		p.present[k] = true
+		p.clients.Add(1)
+	}
+}
+
+func (p *meshPeer) remove(k key.NodePublic) {
+	p.s.RemovePacketForwarder(k, p.c)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.present[k] {
+		delete(p.present, k)
+		p.clients.Add(-1)
+	}
+}
+
+// stop closes the connection to the peer and stops forwarding packets
+// to its clients.
+func (p *meshPeer) stop() {
+	p.cancel()
+	p.c.Close()
+	p.mu.Lock()
+	var keys []key.NodePublic
+	for k := range p.present {
+		keys = append(keys, k)
+	}
+	p.mu.Unlock()
+	for _, k := range keys {
+		p.remove(k)
+	}
+}
+
+// runMeshDNS periodically resolves the DNS name to find mesh peers,
+// connecting to new ones and disconnecting from ones that are gone.
+// It runs until ds is closed.
+func (ds *Server) runMeshDNS(name string) {
+	defer close(ds.dnsDone)
+	peers := map[meshPeerAddr]*meshPeer{}
+	defer func() {
+		for _, p := range peers {
+			p.stop()
+		}
+	}()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		addrs, err := resolveMeshDNS(ctx, net.DefaultResolver, name)
+		cancel()
+		if err != nil {
+			// Keep the current peers rather than dropping them all
+			// during a DNS outage.
+			ds.logf("mesh-dns: resolving %q: %v", name, err)
+		} else {
+			want := map[meshPeerAddr]bool{}
+			for _, a := range addrs {
+				want[a] = true
+				if peers[a] != nil {
+					continue
+				}
+				p, err := ds.startMeshPeer(a)
+				if err != nil {
+					ds.logf("mesh-dns: %v: %v", a, err)
+					continue
+				}
+				ds.logf("mesh-dns: added peer %v", a)
+				peers[a] = p
+			}
+			for a, p := range peers {
+				if !want[a] {
+					ds.logf("mesh-dns: removed peer %v", a)
+					p.stop()
+					delete(peers, a)
+				}
+			}
+		}
+		select {
+		case <-ds.stopDNS:
+			return
+		case <-time.After(meshDNSInterval):
+		}
+	}
+}
+
+// resolveMeshDNS returns the mesh peers listed by the DNS name: the
+// targets of its SRV records if it has any, or else one peer per A or
+// AAAA record, each reached by IP but verified as name.
+func resolveMeshDNS(ctx context.Context, r *net.Resolver, name string) ([]meshPeerAddr, error) {
+	if _, srvs, err := r.LookupSRV(ctx, "", "", name); err == nil && len(srvs) > 0 {
+		return meshPeersFromSRV(srvs), nil
+	}
+	ips, err := r.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]meshPeerAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, meshPeerAddr{host: name, ip: ip.Unmap()})
+	}
+	return addrs, nil
+}
+
+func meshPeersFromSRV(srvs []*net.SRV) []meshPeerAddr {
+	addrs := make([]meshPeerAddr, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		if srv.Port != 443 && srv.Port != 0 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		}
+		addrs = append(addrs, meshPeerAddr{host: host})
+	}
+	return addrs
+}
@@ -2,23 +2,18 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package derpserver
 
 import (
 	"bufio"
-	"expvar"
-	"log"
 	"net/http"
 	"strings"
 
 	"nhooyr.io/websocket"
-	"tailscale.com/derp"
 )
 
-var counterWebSocketAccepts = expvar.NewInt("derp_websocket_accepts")
-
 // addWebSocketSupport returns a Handle wrapping base that adds WebSocket server support.
-func addWebSocketSupport(s *derp.Server, base http.Handler) http.Handler {
+func (ds *Server) addWebSocketSupport(base http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		up := strings.ToLower(r.Header.Get("Upgrade"))
 
@@ -35,7 +30,7 @@ func addWebSocketSupport(s *derp.Server, base http.Handler) http.Handler {
 			OriginPatterns: []string{"*"},
 		})
 		if err != nil {
-			log.Printf("websocket.Accept: %v", err)
+			ds.logf("websocket.Accept: %v", err)
 			return
 		}
 		defer c.Close(websocket.StatusInternalError, "closing")
@@ -43,9 +38,9 @@ func addWebSocketSupport(s *derp.Server, base http.Handler) http.Handler {
 			c.Close(websocket.StatusPolicyViolation, "client must speak the derp subprotocol")
 			return
 		}
-		counterWebSocketAccepts.Add(1)
+		ds.webSocketAccepts.Add(1)
 		wc := websocket.NetConn(r.Context(), c, websocket.MessageBinary)
 		brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
-		s.Accept(r.Context(), wc, brw, r.RemoteAddr)
+		ds.s.Accept(r.Context(), wc, brw, r.RemoteAddr)
 	})
 }
@@ -18,6 +18,7 @@ TS_ACCEPT_DNS="${TS_ACCEPT_DNS:-false}"
 TS_KUBE_SECRET="${TS_KUBE_SECRET:-tailscale}"
 TS_SOCKS5_SERVER="${TS_SOCKS5_SERVER:-}"
 TS_OUTBOUND_HTTP_PROXY_LISTEN="${TS_OUTBOUND_HTTP_PROXY_LISTEN:-}"
+TS_HEALTH_PROBE="${TS_HEALTH_PROBE:-}"
 TS_TAILSCALED_EXTRA_ARGS="${TS_TAILSCALED_EXTRA_ARGS:-}"
 
 set -e
@@ -56,6 +57,10 @@ if [[ ! -z "${TS_OUTBOUND_HTTP_PROXY_LISTEN}" ]]; then
   TAILSCALED_ARGS="${TAILSCALED_ARGS} --outbound-http-proxy-listen ${TS_OUTBOUND_HTTP_PROXY_LISTEN}"
 fi
 
+if [[ ! -z "${TS_HEALTH_PROBE}" ]]; then
+  TAILSCALED_ARGS="${TAILSCALED_ARGS} --health-probe ${TS_HEALTH_PROBE}"
+fi
+
 if [[ ! -z "${TS_TAILSCALED_EXTRA_ARGS}" ]]; then
   TAILSCALED_ARGS="${TAILSCALED_ARGS} ${TS_TAILSCALED_EXTRA_ARGS}"
 fi
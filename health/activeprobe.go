@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// maxProbeTimeout is the longest a probe's check may run.
+const maxProbeTimeout = 30 * time.Second
+
+// activeProbe is a periodic check of a subsystem, from RegisterProbe.
+type activeProbe struct {
+	interval time.Duration
+	check    func(context.Context) error
+
+	lastRun      time.Time     // when check last started, or zero if never
+	lastDuration time.Duration // how long check last took
+	lastErr      error         // what check last returned
+	running      bool          // whether check is running
+}
+
+// probes are the registered active probes, guarded by mu.
+var probes = map[Subsystem]*activeProbe{}
+
+// RegisterProbe registers check as an active probe of sys, replacing any
+// already registered. The periodic self-check calls check about every
+// interval (rounded up to Options.SelfCheckInterval), with a context that
+// times out after the lesser of interval and 30 seconds, and sets sys's
+// health to its result. Unregistering marks sys healthy again.
+func RegisterProbe(sys Subsystem, interval time.Duration, check func(context.Context) error) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	p := &activeProbe{interval: interval, check: check}
+	probes[sys] = p
+	startTimerLocked()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if probes[sys] == p {
+			delete(probes, sys)
+			setLocked(sys, nil)
+		}
+		stopTimerIfUnwatchedLocked()
+	}
+}
+
+// runProbesLocked starts the probes that are due.
+func runProbesLocked() {
+	now := timeNow()
+	for sys, p := range probes {
+		if p.running || (!p.lastRun.IsZero() && now.Sub(p.lastRun) < p.interval) {
+			continue
+		}
+		p.lastRun = now
+		p.running = true
+		go runProbe(context.Background(), sys, p)
+	}
+}
+
+// runProbe runs p, which must have been marked running, and records its
+// result, unless parent is done first.
+func runProbe(parent context.Context, sys Subsystem, p *activeProbe) {
+	timeout := p.interval
+	if timeout > maxProbeTimeout || timeout <= 0 {
+		timeout = maxProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	start := time.Now()
+	err := p.check(ctx)
+	d := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	p.running = false
+	if parent.Err() != nil {
+		// The caller gave up, which says nothing of sys's health.
+		return
+	}
+	p.lastDuration = d
+	p.lastErr = err
+	if probes[sys] == p {
+		setLocked(sys, err)
+	}
+}
+
+// ProbeState is the state of an active probe.
+type ProbeState struct {
+	Name         Subsystem
+	Interval     time.Duration
+	LastRun      time.Time     `json:",omitempty"` // when it last started, if ever
+	LastDuration time.Duration `json:",omitempty"` // how long it last took
+	Error        string        `json:",omitempty"` // what it last returned, if it failed
+}
+
+func allProbesLocked() []ProbeState {
+	var ret []ProbeState
+	for sys, p := range probes {
+		ps := ProbeState{
+			Name:         sys,
+			Interval:     p.interval,
+			LastRun:      p.lastRun,
+			LastDuration: p.lastDuration,
+		}
+		if p.lastErr != nil {
+			ps.Error = p.lastErr.Error()
+		}
+		ret = append(ret, ps)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
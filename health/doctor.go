@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Report is the result of RunChecks.
+type Report struct {
+	Time     time.Time     // when the checks started
+	Duration time.Duration // how long they took
+
+	// Probes are the results of the active probes, sorted by name.
+	Probes []ProbeState `json:",omitempty"`
+
+	// State is the health state once the checks had run.
+	State *State
+}
+
+// RunChecks runs all the health checks now, rather than waiting for the
+// periodic self-check, and returns the result: it runs every active
+// probe (waiting for them, or ctx to be done) and then re-evaluates the
+// cert expiry and overall health. Probes that were already running
+// aren't started again; the report has their previous results. The
+// receive funcs are reported as of the last periodic check, as whether
+// they're running is only meaningful over a full SelfCheckInterval.
+func RunChecks(ctx context.Context) *Report {
+	start := time.Now()
+	var wg sync.WaitGroup
+	mu.Lock()
+	now := timeNow()
+	for sys, p := range probes {
+		if p.running {
+			continue
+		}
+		p.lastRun = now
+		p.running = true
+		wg.Add(1)
+		go func(sys Subsystem, p *activeProbe) {
+			defer wg.Done()
+			runProbe(ctx, sys, p)
+		}(sys, p)
+	}
+	mu.Unlock()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	checkCertsLocked()
+	selfCheckLocked()
+	return &Report{
+		Time:     start,
+		Duration: time.Since(start),
+		Probes:   allProbesLocked(),
+		State:    currentStateLocked(),
+	}
+}
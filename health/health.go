@@ -7,17 +7,22 @@
 package health
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"tailscale.com/envknob"
+	"tailscale.com/ipn"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/multierr"
 )
 
@@ -25,9 +30,14 @@
 	// mu guards everything in this var block.
 	mu sync.Mutex
 
-	sysErr   = map[Subsystem]error{}                     // error key => err (or nil for no error)
-	watchers = map[*watchHandle]func(Subsystem, error){} // opt func to run if error state changes
-	timer    *time.Timer
+	sysErr    = map[Subsystem]error{}      // error key => err (or nil for no error)
+	sysErrSev = map[Subsystem]Severity{}   // error key => severity last sent to watchers
+	watchers  = map[*watchHandle]watcher{} // opt funcs to run if error state changes
+	warnables = map[Subsystem]*Warnable{}  // by name, from NewWarnable
+	timer     selfCheckTimer
+
+	overallSeverity = SeverityError // severity of the SysOverall error, if any
+	certSeverity    = SeverityError // severity of the SysTLSCert error, if any
 
 	debugHandler = map[string]http.Handler{}
 
@@ -39,15 +49,35 @@
 	derpRegionConnected     = map[int]bool{}
 	derpRegionHealthProblem = map[int]string{}
 	derpRegionLastFrame     = map[int]time.Time{}
+	derpRegionLatency       = map[int][]time.Duration{}
 	lastMapRequestHeard     time.Time // time we got a 200 from control for a MapRequest
-	ipnState                string
+	controlRequests         []controlRequest
+	ipnState                ipn.State
+	ipnStateKnown           bool      // whether SetIPNState has been called
+	ipnStateSince           time.Time // when ipnState last changed
 	ipnWantRunning          bool
 	anyInterfaceUp          = true // until told otherwise
 	udp4Unbound             bool
+	udp6Unbound             bool
 	controlHealth           []string
+	controlHealthAcks       = map[string]time.Time{} // ID => snoozed until, or zero if acknowledged
 	lastLoginErr            error
+	certExpiry              = map[string]time.Time{} // TLS cert domain => NotAfter
 )
 
+// Time functions, replaced in tests to control the time-based checks.
+var (
+	timeNow   = time.Now
+	afterFunc = func(d time.Duration, f func()) selfCheckTimer { return time.AfterFunc(d, f) }
+)
+
+// selfCheckTimer is the subset of *time.Timer used for the periodic
+// self-check.
+type selfCheckTimer interface {
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
 // Subsystem is the name of a subsystem whose health can be monitored.
 type Subsystem string
 
@@ -72,30 +102,257 @@
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysNetwork is the name of the subsystem that's unhealthy when
+	// no network interface is up.
+	SysNetwork = Subsystem("network")
+
+	// SysTLSCert is the name of the subsystem for the TLS certs
+	// tailscaled obtains (for "tailscale cert" or tsnet), which is
+	// unhealthy when one expires soon (a warning) or has expired
+	// (an error).
+	SysTLSCert = Subsystem("tls-cert")
+
+	// SysStateStore is the name of the subsystem for the ipn.StateStore
+	// that prefs and keys are persisted to, which is unhealthy when it
+	// can't be written to.
+	SysStateStore = Subsystem("state-store")
+
+	// SysSSH is the name of the Tailscale SSH server subsystem, which
+	// is unhealthy when it can't accept or run sessions.
+	SysSSH = Subsystem("ssh")
+
+	// SysExitNode is the name of the subsystem for the exit node in
+	// use, if any, which is unhealthy when it isn't forwarding traffic.
+	SysExitNode = Subsystem("exit-node")
+
+	// SysTKA is the name of the tailnet lock subsystem, which is
+	// unhealthy when updates to the key authority can't be applied,
+	// or the authority has problems such as expired keys.
+	SysTKA = Subsystem("tailnet-lock")
 )
 
+// dependsOn maps subsystems to the subsystems they depend on, so that
+// their problems while those are unhealthy can be attributed to them.
+// It's guarded by mu.
+var dependsOn = map[Subsystem][]Subsystem{
+	SysDNS:             {SysNetwork, SysDNSManager},
+	SysDNSManager:      {SysNetwork, SysDNSOS},
+	SysDNSOS:           {SysNetwork},
+	SysNetworkCategory: {SysNetwork},
+	SysSSH:             {SysNetwork},
+	SysExitNode:        {SysNetwork},
+}
+
+// AddDependency records that sys depends on the subsystem on, so that
+// problems with sys while on is unhealthy are attributed to on: they're
+// left out of OverallError and reported to watchers as a *CausedError.
+func AddDependency(sys, on Subsystem) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, d := range dependsOn[sys] {
+		if d == on {
+			return
+		}
+	}
+	dependsOn[sys] = append(dependsOn[sys], on)
+}
+
+// causeLocked returns the unhealthy subsystem that sys's problems are
+// a consequence of, found by following dependsOn as far as it goes,
+// or the empty string if none.
+func causeLocked(sys Subsystem) Subsystem {
+	return causeVisitLocked(sys, map[Subsystem]bool{sys: true})
+}
+
+func causeVisitLocked(sys Subsystem, seen map[Subsystem]bool) Subsystem {
+	for _, d := range dependsOn[sys] {
+		if seen[d] {
+			continue // cycle
+		}
+		seen[d] = true
+		if c := causeVisitLocked(d, seen); c != "" {
+			return c
+		}
+		if sysErr[d] != nil {
+			return d
+		}
+	}
+	return ""
+}
+
+// CausedError is the error watchers are given for a subsystem's
+// problem that's a consequence of a problem with another subsystem
+// that it depends on.
+type CausedError struct {
+	Err      error     // the subsystem's own error
+	Cause    Subsystem // the unhealthy subsystem it depends on
+	CauseErr error     // Cause's error
+}
+
+func (e *CausedError) Error() string {
+	return fmt.Sprintf("%v (caused by: %v)", e.Err, e.CauseErr)
+}
+
+func (e *CausedError) Unwrap() error { return e.Err }
+
+// errNetworkDown is SysNetwork's error.
+var errNetworkDown = errors.New("network down")
+
+// Severity is how serious a health problem is.
+type Severity int
+
+const (
+	// SeverityInfo is for conditions worth knowing about that
+	// don't affect connectivity.
+	SeverityInfo Severity = iota
+
+	// SeverityWarning is for conditions that degrade connectivity
+	// or performance, such as elevated DERP latency.
+	SeverityWarning
+
+	// SeverityError is for conditions that break connectivity.
+	// It's the severity of all the built-in subsystems.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Severity) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Severity) UnmarshalText(b []byte) error {
+	for v := SeverityInfo; v <= SeverityError; v++ {
+		if v.String() == string(b) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health severity %q", b)
+}
+
+// Warnable is a named health condition, with a fixed severity, that a
+// subsystem reports the state of.
+type Warnable struct {
+	sys Subsystem
+	sev Severity
+}
+
+// NewWarnable registers a health condition named name with severity
+// sev. Its state is reported to watchers as that of the Subsystem of
+// the same name. It panics if name is already registered or is one of
+// the built-in subsystems, so it's typically called during package
+// initialization.
+func NewWarnable(name string, sev Severity) *Warnable {
+	sys := Subsystem(name)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := warnables[sys]; dup || isBuiltinSubsystem(sys) {
+		panic(fmt.Sprintf("health: duplicate Warnable %q", name))
+	}
+	w := &Warnable{sys: sys, sev: sev}
+	warnables[sys] = w
+	return w
+}
+
+// Subsystem returns the name that w's state is reported under.
+func (w *Warnable) Subsystem() Subsystem { return w.sys }
+
+// Severity returns w's severity.
+func (w *Warnable) Severity() Severity { return w.sev }
+
+// Set sets w's state: unhealthy with err, or healthy if err is nil.
+func (w *Warnable) Set(err error) { set(w.sys, err) }
+
+// Get returns w's error, or nil if it's healthy.
+func (w *Warnable) Get() error { return get(w.sys) }
+
+func isBuiltinSubsystem(sys Subsystem) bool {
+	switch sys {
+	case SysOverall, SysRouter, SysDNS, SysDNSOS, SysDNSManager, SysNetworkCategory, SysNetwork, SysTLSCert, SysStateStore, SysSSH, SysExitNode, SysTKA:
+		return true
+	}
+	return false
+}
+
+// severityLocked returns the severity of an error in key.
+func severityLocked(key Subsystem) Severity {
+	switch key {
+	case SysOverall:
+		return overallSeverity
+	case SysTLSCert:
+		return certSeverity
+	}
+	if w, ok := warnables[key]; ok {
+		return w.sev
+	}
+	return SeverityError
+}
+
 type watchHandle byte
 
+// watcher is a func registered by RegisterWatcher or
+// RegisterSeverityWatcher. Exactly one of its fields is set.
+type watcher struct {
+	cb    func(Subsystem, error)
+	sevCB func(Subsystem, Severity, error)
+}
+
 // RegisterWatcher adds a function that will be called if an
 // error changes state either to unhealthy or from unhealthy. It is
 // not called on transition from unknown to healthy. It must be non-nil
 // and is run in its own goroutine. The returned func unregisters it.
 func RegisterWatcher(cb func(key Subsystem, err error)) (unregister func()) {
+	return registerWatcher(watcher{cb: cb})
+}
+
+// RegisterSeverityWatcher is like RegisterWatcher, but cb is also
+// given the severity of the state, and is also called if the severity
+// of an unhealthy subsystem changes.
+func RegisterSeverityWatcher(cb func(key Subsystem, sev Severity, err error)) (unregister func()) {
+	return registerWatcher(watcher{sevCB: cb})
+}
+
+func registerWatcher(w watcher) (unregister func()) {
 	mu.Lock()
 	defer mu.Unlock()
 	handle := new(watchHandle)
-	watchers[handle] = cb
-	if timer == nil {
-		timer = time.AfterFunc(time.Minute, timerSelfCheck)
-	}
+	watchers[handle] = w
+	startTimerLocked()
 	return func() {
 		mu.Lock()
 		defer mu.Unlock()
 		delete(watchers, handle)
-		if len(watchers) == 0 && timer != nil {
-			timer.Stop()
-			timer = nil
-		}
+		stopTimerIfUnwatchedLocked()
+	}
+}
+
+// startTimerLocked starts the periodic self-check, if it's not already
+// running, for watchers to hear about problems such as receive funcs
+// stopping.
+func startTimerLocked() {
+	if timer == nil {
+		timer = afterFunc(opts.SelfCheckInterval, timerSelfCheck)
+	}
+}
+
+// stopTimerIfUnwatchedLocked stops the periodic self-check if there are
+// no longer any watchers, remediations or probes.
+func stopTimerIfUnwatchedLocked() {
+	if len(watchers) == 0 && len(chanWatchers) == 0 && len(remediations) == 0 && len(probes) == 0 && timer != nil {
+		timer.Stop()
+		timer = nil
 	}
 }
 
@@ -127,6 +384,28 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetStateStoreHealth sets the state of persisting to the state store.
+func SetStateStoreHealth(err error) { set(SysStateStore, WithHint(err, hintStateStore)) }
+
+func StateStoreHealth() error { return get(SysStateStore) }
+
+// SetSSHHealth sets the state of the Tailscale SSH server.
+func SetSSHHealth(err error) { set(SysSSH, err) }
+
+func SSHHealth() error { return get(SysSSH) }
+
+// SetExitNodeHealth sets the state of forwarding traffic through the exit
+// node, as probed by the LocalBackend.
+func SetExitNodeHealth(err error) { set(SysExitNode, WithHint(err, hintExitNode)) }
+
+func ExitNodeHealth() error { return get(SysExitNode) }
+
+// SetTKAHealth sets the state of tailnet lock, as checked by the
+// LocalBackend.
+func SetTKAHealth(err error) { set(SysTKA, err) }
+
+func TKAHealth() error { return get(SysTKA) }
+
 func RegisterDebugHandler(typ string, h http.Handler) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -151,7 +430,73 @@ func set(key Subsystem, err error) {
 	setLocked(key, err)
 }
 
+// debounce is how long a subsystem must stay unhealthy before it's
+// reported as such; see SetDebounce. It's guarded by mu.
+var debounce, _ = time.ParseDuration(envknob.String("TS_DEBUG_HEALTH_DEBOUNCE"))
+
+// pendingErr are the subsystems that have become unhealthy but not yet
+// for long enough to report, with their latest errors. It's guarded by
+// mu.
+var pendingErr = map[Subsystem]*pendingProblem{}
+
+type pendingProblem struct {
+	err error
+}
+
+// SetDebounce sets how long a subsystem must stay unhealthy before
+// watchers are told and it's included in OverallError and the health
+// state, so that briefly flapping subsystems aren't reported. Returning
+// to healthy is always reported at once. Zero, the default, reports
+// problems at once.
+//
+// SysOverall is debounced too, so that conditions it's derived from
+// directly, such as a brief DERP reconnect or a missed keep-alive,
+// aren't reported either. Problems of the other subsystems have been
+// debounced already, so they're reported in SysOverall at once.
+func SetDebounce(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	debounce = d
+}
+
 func setLocked(key Subsystem, err error) {
+	if err == nil {
+		delete(pendingErr, key)
+	} else if debounce > 0 && sysErr[key] == nil && !(key == SysOverall && hasSubsystemIssue(err)) {
+		// Newly unhealthy: only report it if it stays so.
+		if p, ok := pendingErr[key]; ok {
+			p.err = err
+			return
+		}
+		p := &pendingProblem{err: err}
+		pendingErr[key] = p
+		afterFunc(debounce, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if pendingErr[key] != p {
+				return // recovered, or another problem started since
+			}
+			delete(pendingErr, key)
+			applyLocked(key, p.err)
+		})
+		return
+	}
+	applyLocked(key, err)
+}
+
+// hasSubsystemIssue reports whether err, from overallLocked, includes a
+// problem of another subsystem.
+func hasSubsystemIssue(err error) bool {
+	for _, i := range Issues(err) {
+		if i.Code == IssueSubsystem {
+			return true
+		}
+	}
+	return false
+}
+
+// applyLocked records and reports that key is in state err.
+func applyLocked(key Subsystem, err error) {
 	old, ok := sysErr[key]
 	if !ok && err == nil {
 		// Initial happy path.
@@ -159,19 +504,34 @@ func setLocked(key Subsystem, err error) {
 		selfCheckLocked()
 		return
 	}
-	if ok && (old == nil) == (err == nil) {
-		// No change in overall error status (nil-vs-not), so
-		// don't run callbacks, but exact error might've
-		// changed, so note it.
+	sev := severityLocked(key)
+	if ok && (old == nil) == (err == nil) && (err == nil || sev == sysErrSev[key]) {
+		// No change in overall error status (nil-vs-not) or
+		// severity, so don't run callbacks, but exact error
+		// might've changed, so note it.
 		if err != nil {
 			sysErr[key] = err
 		}
 		return
 	}
 	sysErr[key] = err
+	sysErrSev[key] = sev
+	noteUnhealthySinceLocked(key, err)
+	t := recordTransitionLocked(key, sev, old, err)
+	sendToChanWatchersLocked(t)
 	selfCheckLocked()
-	for _, cb := range watchers {
-		go cb(key, err)
+	cbErr := err
+	if err != nil {
+		if c := causeLocked(key); c != "" {
+			cbErr = &CausedError{Err: err, Cause: c, CauseErr: sysErr[c]}
+		}
+	}
+	for _, w := range watchers {
+		if w.sevCB != nil {
+			go w.sevCB(key, sev, cbErr)
+		} else if !ok || (old == nil) != (err == nil) {
+			go w.cb(key, cbErr)
+		}
 	}
 }
 
@@ -182,12 +542,46 @@ func SetControlHealth(problems []string) {
 	selfCheckLocked()
 }
 
+// ControlHealth returns the current health problems reported by the
+// control plane, including any that are acknowledged or snoozed.
+func ControlHealth() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]string(nil), controlHealth...)
+}
+
+// ControlHealthID returns a stable ID for the control plane health
+// message msg. Control sends messages without IDs, so the same text
+// always gets the same ID.
+func ControlHealthID(msg string) string {
+	h := sha256.Sum256([]byte(msg))
+	return hex.EncodeToString(h[:8])
+}
+
+// SetControlHealthAcks sets which control plane health messages,
+// keyed by their ControlHealthID, are excluded from the overall
+// health state. A zero time means the message is acknowledged for as
+// long as control reports it; otherwise, it's snoozed until then.
+func SetControlHealthAcks(acks map[string]time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	controlHealthAcks = acks
+	selfCheckLocked()
+}
+
+// controlHealthAckedLocked reports whether the control plane health
+// message msg is acknowledged or snoozed as of now.
+func controlHealthAckedLocked(msg string, now time.Time) bool {
+	until, ok := controlHealthAcks[ControlHealthID(msg)]
+	return ok && (until.IsZero() || now.Before(until))
+}
+
 // GotStreamedMapResponse notes that we got a tailcfg.MapResponse
 // message in streaming mode, even if it's just a keep-alive message.
 func GotStreamedMapResponse() {
 	mu.Lock()
 	defer mu.Unlock()
-	lastStreamedMapResponse = time.Now()
+	lastStreamedMapResponse = timeNow()
 	selfCheckLocked()
 }
 
@@ -201,9 +595,9 @@ func SetInPollNetMap(v bool) {
 	}
 	inMapPoll = v
 	if v {
-		inMapPollSince = time.Now()
+		inMapPollSince = timeNow()
 	} else {
-		lastMapPollEndedAt = time.Now()
+		lastMapPollEndedAt = timeNow()
 	}
 }
 
@@ -223,6 +617,107 @@ func SetMagicSockDERPHome(region int) {
 	selfCheckLocked()
 }
 
+// derpLatencySamples is how many DERP ping RTTs are averaged for a
+// region's latency.
+const derpLatencySamples = 10
+
+// NoteDERPRegionLatency records a ping round trip time d to a DERP
+// region.
+func NoteDERPRegionLatency(region int, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	samples := append(derpRegionLatency[region], d)
+	if len(samples) > derpLatencySamples {
+		samples = samples[len(samples)-derpLatencySamples:]
+	}
+	derpRegionLatency[region] = samples
+	selfCheckLocked()
+}
+
+// DERPRegionLatency returns the average of the recent ping round trip
+// times to a DERP region, or ok=false if there are none.
+func DERPRegionLatency(region int) (_ time.Duration, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	return derpRegionLatencyLocked(region)
+}
+
+func derpRegionLatencyLocked(region int) (_ time.Duration, ok bool) {
+	samples := derpRegionLatency[region]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+	return sum / time.Duration(len(samples)), true
+}
+
+// controlRequestSamples is how many recent control requests the control
+// round trip time and failure rate are computed over.
+const controlRequestSamples = 20
+
+// controlRequestMinSamples is how many control requests there must be
+// before their failure rate is a problem.
+const controlRequestMinSamples = 4
+
+// controlRequest is the outcome of a request to control.
+type controlRequest struct {
+	rtt    time.Duration // or zero if failed
+	failed bool
+}
+
+// NoteControlRTT records the round trip time d of a successful request
+// to control, up to its response headers.
+func NoteControlRTT(d time.Duration) {
+	noteControlRequest(controlRequest{rtt: d})
+}
+
+// NoteControlRequestFailed records a request to control that failed
+// without a response, such as from a network error.
+func NoteControlRequestFailed() {
+	noteControlRequest(controlRequest{failed: true})
+}
+
+func noteControlRequest(r controlRequest) {
+	mu.Lock()
+	defer mu.Unlock()
+	controlRequests = append(controlRequests, r)
+	if len(controlRequests) > controlRequestSamples {
+		controlRequests = controlRequests[len(controlRequests)-controlRequestSamples:]
+	}
+	selfCheckLocked()
+}
+
+// ControlRTT returns the average round trip time of the recent
+// successful requests to control, or ok=false if there are none.
+func ControlRTT() (_ time.Duration, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	d, _, _ := controlStatsLocked()
+	return d, d > 0
+}
+
+// controlStatsLocked returns the average round trip time of the recent
+// successful control requests (or zero if none), and how many of the
+// recent requests failed.
+func controlStatsLocked() (rtt time.Duration, failed, total int) {
+	var sum time.Duration
+	for _, r := range controlRequests {
+		if r.failed {
+			failed++
+		} else {
+			sum += r.rtt
+		}
+	}
+	total = len(controlRequests)
+	if ok := total - failed; ok > 0 {
+		rtt = sum / time.Duration(ok)
+	}
+	return rtt, failed, total
+}
+
 // NoteMapRequestHeard notes whenever we successfully sent a map request
 // to control for which we received a 200 response.
 func NoteMapRequestHeard(mr *tailcfg.MapRequest) {
@@ -232,7 +727,7 @@ func NoteMapRequestHeard(mr *tailcfg.MapRequest) {
 	// against SetMagicSockDERPHome and
 	// SetDERPRegionConnectedState
 
-	lastMapRequestHeard = time.Now()
+	lastMapRequestHeard = timeNow()
 	selfCheckLocked()
 }
 
@@ -259,15 +754,20 @@ func SetDERPRegionHealth(region int, problem string) {
 func NoteDERPRegionReceivedFrame(region int) {
 	mu.Lock()
 	defer mu.Unlock()
-	derpRegionLastFrame[region] = time.Now()
+	derpRegionLastFrame[region] = timeNow()
 	selfCheckLocked()
 }
 
-// state is an ipn.State.String() value: "Running", "Stopped", "NeedsLogin", etc.
-func SetIPNState(state string, wantRunning bool) {
+// SetIPNState notes the LocalBackend's state, and whether the user wants
+// it to be running.
+func SetIPNState(state ipn.State, wantRunning bool) {
 	mu.Lock()
 	defer mu.Unlock()
+	if !ipnStateKnown || state != ipnState {
+		ipnStateSince = timeNow()
+	}
 	ipnState = state
+	ipnStateKnown = true
 	ipnWantRunning = wantRunning
 	selfCheckLocked()
 }
@@ -277,6 +777,11 @@ func SetAnyInterfaceUp(up bool) {
 	mu.Lock()
 	defer mu.Unlock()
 	anyInterfaceUp = up
+	if up {
+		setLocked(SysNetwork, nil)
+	} else {
+		setLocked(SysNetwork, errNetworkDown)
+	}
 	selfCheckLocked()
 }
 
@@ -288,6 +793,14 @@ func SetUDP4Unbound(unbound bool) {
 	selfCheckLocked()
 }
 
+// SetUDP6Unbound sets whether the udp6 bind failed completely.
+func SetUDP6Unbound(unbound bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	udp6Unbound = unbound
+	selfCheckLocked()
+}
+
 // SetAuthRoutineInError records the latest error encountered as a result of a
 // login attempt. Providing a nil error indicates successful login, or that
 // being logged in w/coordination is not currently desired.
@@ -301,18 +814,70 @@ func timerSelfCheck() {
 	mu.Lock()
 	defer mu.Unlock()
 	checkReceiveFuncs()
+	checkCertsLocked()
 	selfCheckLocked()
+	remediateLocked()
+	runProbesLocked()
 	if timer != nil {
-		timer.Reset(time.Minute)
+		timer.Reset(opts.SelfCheckInterval)
 	}
 }
 
 func selfCheckLocked() {
-	if ipnState == "" {
+	if !ipnStateKnown {
 		// Don't check yet.
 		return
 	}
-	setLocked(SysOverall, overallErrorLocked())
+	st, err := overallLocked()
+	overallSeverity = SeverityWarning
+	if st == StatusBroken {
+		overallSeverity = SeverityError
+	}
+	setLocked(SysOverall, err)
+}
+
+// Status is the overall health state.
+type Status int
+
+const (
+	StatusHealthy  Status = iota
+	StatusDegraded        // problems, but only of info or warning severity
+	StatusBroken          // at least one problem of error severity
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusHealthy:
+		return "healthy"
+	case StatusDegraded:
+		return "degraded"
+	case StatusBroken:
+		return "broken"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Status) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Status) UnmarshalText(b []byte) error {
+	for v := StatusHealthy; v <= StatusBroken; v++ {
+		if v.String() == string(b) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health status %q", b)
+}
+
+// OverallStatus returns whether the node is healthy, degraded (with only
+// info or warning problems) or broken (with at least one error).
+func OverallStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	st, _ := reportedOverallLocked()
+	return st
 }
 
 // OverallError returns a summary of the health state.
@@ -325,38 +890,117 @@ func OverallError() error {
 	return overallErrorLocked()
 }
 
+// SetTLSCertExpiry records that the TLS cert for domain expires at
+// notAfter, for SysTLSCert to report on.
+func SetTLSCertExpiry(domain string, notAfter time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	certExpiry[domain] = notAfter
+	checkCertsLocked()
+}
+
+// checkCertsLocked sets SysTLSCert's state from the soonest-expiring
+// cert, if any.
+func checkCertsLocked() {
+	if len(certExpiry) == 0 {
+		return
+	}
+	var domain string
+	var soonest time.Time
+	for d, t := range certExpiry {
+		if domain == "" || t.Before(soonest) || (t.Equal(soonest) && d < domain) {
+			domain, soonest = d, t
+		}
+	}
+	switch left := soonest.Sub(timeNow()); {
+	case left <= 0:
+		certSeverity = SeverityError
+		setLocked(SysTLSCert, WithHint(fmt.Errorf("TLS cert for %s expired at %v", domain, soonest.UTC().Format(time.RFC3339)), hintTLSCert))
+	case left < opts.CertExpiryWarning:
+		certSeverity = SeverityWarning
+		setLocked(SysTLSCert, WithHint(fmt.Errorf("TLS cert for %s expires in %v", domain, left.Round(time.Hour)), hintTLSCert))
+	default:
+		setLocked(SysTLSCert, nil)
+	}
+}
+
+// WedgedError returns an error if tailscaled itself appears to be
+// stuck, such that restarting it might help, as opposed to it being
+// unhealthy because of the network, its configuration or the control
+// plane. It returns nil otherwise.
+func WedgedError() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if !ipnWantRunning || ipnState != ipn.Running {
+		return nil
+	}
+	var errs []error
+	for _, recv := range receiveFuncs {
+		if recv.missing {
+			errs = append(errs, fmt.Errorf("%s is not running", recv.name))
+		}
+	}
+	return multierr.New(errs...)
+}
+
 var fakeErrForTesting = envknob.String("TS_DEBUG_FAKE_HEALTH_ERROR")
 
 func overallErrorLocked() error {
+	_, err := reportedOverallLocked()
+	return err
+}
+
+// reportedOverallLocked is like overallLocked, but while a new problem
+// is being debounced (see SetDebounce), it reports the healthy state
+// that preceded it.
+func reportedOverallLocked() (Status, error) {
+	if _, ok := pendingErr[SysOverall]; ok {
+		return StatusHealthy, nil
+	}
+	return overallLocked()
+}
+
+// overallLocked returns the overall health status and a summary of
+// its problems.
+func overallLocked() (Status, error) {
 	if !anyInterfaceUp {
-		return errors.New("network down")
+		return StatusBroken, newIssue(IssueNetworkDown, SeverityError, hintNetworkDown, nil, "%v", errNetworkDown)
+	}
+	now := timeNow()
+	inState := now.Sub(ipnStateSince).Round(time.Second)
+	switch ipnState {
+	case ipn.NeedsMachineAuth:
+		return StatusBroken, newIssue(IssueNeedsMachineAuth, SeverityError, hintMachineAuth, []string{"since", ipnStateSince.UTC().Format(time.RFC3339)}, "waiting for an admin to approve this device (for %v)", inState)
+	case ipn.NeedsLogin:
+		if lastLoginErr == nil {
+			return StatusBroken, newIssue(IssueNeedsLogin, SeverityError, hintLogin, []string{"since", ipnStateSince.UTC().Format(time.RFC3339)}, "logged out (for %v)", inState)
+		}
 	}
 	if !ipnWantRunning {
-		return fmt.Errorf("state=%v, wantRunning=%v", ipnState, ipnWantRunning)
+		return StatusBroken, newIssue(IssueStopped, SeverityError, hintStopped, []string{"state", ipnState.String()}, "state=%v, wantRunning=%v", ipnState, ipnWantRunning)
 	}
 	if lastLoginErr != nil {
-		return fmt.Errorf("not logged in, last login error=%v", lastLoginErr)
+		return StatusBroken, newIssue(IssueLoginError, SeverityError, hintLogin, []string{"error", lastLoginErr.Error()}, "not logged in, last login error=%v", lastLoginErr)
 	}
-	now := time.Now()
-	if !inMapPoll && (lastMapPollEndedAt.IsZero() || now.Sub(lastMapPollEndedAt) > 10*time.Second) {
-		return errors.New("not in map poll")
+	if !inMapPoll && (lastMapPollEndedAt.IsZero() || now.Sub(lastMapPollEndedAt) > opts.MapPollGrace) {
+		return StatusBroken, newIssue(IssueNotInMapPoll, SeverityError, hintControl, nil, "not in map poll")
 	}
-	const tooIdle = 2*time.Minute + 5*time.Second
-	if d := now.Sub(lastStreamedMapResponse).Round(time.Second); d > tooIdle {
-		return fmt.Errorf("no map response in %v", d)
+	if d := now.Sub(lastStreamedMapResponse).Round(time.Second); d > opts.MaxIdle {
+		return StatusBroken, newIssue(IssueNoMapResponse, SeverityError, hintControl, []string{"idle", d.String()}, "no map response in %v", d)
 	}
 	rid := derpHomeRegion
+	region := strconv.Itoa(rid)
 	if rid == 0 {
-		return errors.New("no DERP home")
+		return StatusBroken, newIssue(IssueNoDERPHome, SeverityError, hintDERP, nil, "no DERP home")
 	}
 	if !derpRegionConnected[rid] {
-		return fmt.Errorf("not connected to home DERP region %v", rid)
+		return StatusBroken, newIssue(IssueDERPHomeDisconnected, SeverityError, hintDERP, []string{"region", region}, "not connected to home DERP region %v", rid)
 	}
-	if d := now.Sub(derpRegionLastFrame[rid]).Round(time.Second); d > tooIdle {
-		return fmt.Errorf("haven't heard from home DERP region %v in %v", rid, d)
+	if d := now.Sub(derpRegionLastFrame[rid]).Round(time.Second); d > opts.MaxIdle {
+		return StatusBroken, newIssue(IssueDERPHomeIdle, SeverityError, hintDERP, []string{"region", region, "idle", d.String()}, "haven't heard from home DERP region %v in %v", rid, d)
 	}
-	if udp4Unbound {
-		return errors.New("no udp4 bind")
+	if udp4Unbound && udp6Unbound {
+		return StatusBroken, newIssue(IssueUDPUnbound, SeverityError, hintUDPBind, []string{"network", "udp4+udp6"}, "no udp4 or udp6 bind")
 	}
 
 	// TODO: use
@@ -366,37 +1010,69 @@ func overallErrorLocked() error {
 	_ = lastMapRequestHeard
 
 	var errs []error
+	add := func(i *Issue) { errs = append(errs, i) }
+	// With only one address family bound, peers can still be reached
+	// directly over the other one (or DERP).
+	if udp4Unbound {
+		add(newIssue(IssueUDPUnbound, SeverityWarning, hintUDPBind, []string{"network", "udp4"}, "no udp4 bind"))
+	}
+	if udp6Unbound {
+		add(newIssue(IssueUDPUnbound, SeverityWarning, hintUDPBind, []string{"network", "udp6"}, "no udp6 bind"))
+	}
+	if d, ok := derpRegionLatencyLocked(rid); ok && d > opts.DERPHomeLatency {
+		ms := d.Milliseconds()
+		add(newIssue(IssueDERPHomeLatency, SeverityWarning, hintDERPLatency, []string{"region", region, "latency_ms", strconv.FormatInt(ms, 10)}, "home DERP latency %dms", ms))
+	}
+	if d, failed, total := controlStatsLocked(); d > opts.ControlRTT {
+		ms := d.Milliseconds()
+		add(newIssue(IssueControlRTT, SeverityWarning, hintControl, []string{"latency_ms", strconv.FormatInt(ms, 10)}, "control latency %dms", ms))
+	} else if total >= controlRequestMinSamples && float64(failed)/float64(total) > opts.ControlFailureRate {
+		add(newIssue(IssueControlFailures, SeverityWarning, hintControl, []string{"failed", strconv.Itoa(failed), "requests", strconv.Itoa(total)}, "%d of %d recent control requests failed", failed, total))
+	}
 	for _, recv := range receiveFuncs {
 		if recv.missing {
-			errs = append(errs, fmt.Errorf("%s is not running", recv.name))
+			add(newIssue(IssueReceiveFuncStopped, SeverityError, hintReceiveFunc, []string{"name", recv.name}, "%s is not running", recv.name))
 		}
 	}
 	for sys, err := range sysErr {
-		if err == nil || sys == SysOverall {
+		if err == nil || sys == SysOverall || causeLocked(sys) != "" {
 			continue
 		}
-		errs = append(errs, fmt.Errorf("%v: %w", sys, err))
+		i := newIssue(IssueSubsystem, severityLocked(sys), Hint{}, []string{"subsystem", string(sys)}, "%v: %v", sys, err)
+		i.err = err
+		add(i)
 	}
 	for regionID, problem := range derpRegionHealthProblem {
-		errs = append(errs, fmt.Errorf("derp%d: %v", regionID, problem))
+		add(newIssue(IssueDERPRegion, SeverityError, hintDERP, []string{"region", strconv.Itoa(regionID), "problem", problem}, "derp%d: %v", regionID, problem))
 	}
 	for _, s := range controlHealth {
-		errs = append(errs, errors.New(s))
+		if controlHealthAckedLocked(s, now) {
+			continue
+		}
+		add(newIssue(IssueControl, SeverityError, Hint{}, []string{"message", s}, "%s", s))
 	}
 	if e := fakeErrForTesting; len(errs) == 0 && e != "" {
-		return errors.New(e)
+		return StatusBroken, errors.New(e)
+	}
+	if len(errs) == 0 {
+		return StatusHealthy, nil
 	}
 	sort.Slice(errs, func(i, j int) bool {
 		// Not super efficient (stringifying these in a sort), but probably max 2 or 3 items.
 		return errs[i].Error() < errs[j].Error()
 	})
-	return multierr.New(errs...)
+	for _, err := range errs {
+		if err.(*Issue).Severity == SeverityError {
+			return StatusBroken, multierr.New(errs...)
+		}
+	}
+	return StatusDegraded, multierr.New(errs...)
 }
 
 var (
-	ReceiveIPv4 = ReceiveFuncStats{name: "ReceiveIPv4"}
-	ReceiveIPv6 = ReceiveFuncStats{name: "ReceiveIPv6"}
-	ReceiveDERP = ReceiveFuncStats{name: "ReceiveDERP"}
+	ReceiveIPv4 = newReceiveFuncStats("ReceiveIPv4", "ipv4")
+	ReceiveIPv6 = newReceiveFuncStats("ReceiveIPv6", "ipv6")
+	ReceiveDERP = newReceiveFuncStats("ReceiveDERP", "derp")
 
 	receiveFuncs = []*ReceiveFuncStats{&ReceiveIPv4, &ReceiveIPv6, &ReceiveDERP}
 )
@@ -423,11 +1099,29 @@ type ReceiveFuncStats struct {
 	inCall uint32 // bool, accessed atomically
 	// missing indicates whether the receive func is not running.
 	missing bool
+
+	// metricCalls and metricMissing export numCalls and missing, for
+	// operators to see when a receive path stalls.
+	metricCalls   *clientmetric.Metric
+	metricMissing *clientmetric.Metric
+}
+
+// newReceiveFuncStats returns the stats for the receive func name, whose
+// client metrics are suffixed with path.
+func newReceiveFuncStats(name, path string) ReceiveFuncStats {
+	return ReceiveFuncStats{
+		name:          name,
+		metricCalls:   clientmetric.NewCounter("health_receive_func_calls_" + path),
+		metricMissing: clientmetric.NewGauge("health_receive_func_missing_" + path),
+	}
 }
 
 func (s *ReceiveFuncStats) Enter() {
 	atomic.AddUint64(&s.numCalls, 1)
 	atomic.StoreUint32(&s.inCall, 1)
+	if s.metricCalls != nil {
+		s.metricCalls.Add(1)
+	}
 }
 
 func (s *ReceiveFuncStats) Exit() {
@@ -436,20 +1130,225 @@ func (s *ReceiveFuncStats) Exit() {
 
 func checkReceiveFuncs() {
 	for _, recv := range receiveFuncs {
-		recv.missing = false
-		prev := recv.prevNumCalls
-		numCalls := atomic.LoadUint64(&recv.numCalls)
-		recv.prevNumCalls = numCalls
-		if numCalls > prev {
-			// OK: the function has gotten called since last we checked
-			continue
+		recv.missing = recv.isMissing()
+		if recv.metricMissing != nil {
+			recv.metricMissing.Set(int64(boolInt(recv.missing)))
 		}
-		if atomic.LoadUint32(&recv.inCall) == 1 {
-			// OK: the function is active, probably blocked due to inactivity
+	}
+}
+
+// isMissing reports whether the receive func has stopped running since
+// the last check.
+func (s *ReceiveFuncStats) isMissing() bool {
+	prev := s.prevNumCalls
+	numCalls := atomic.LoadUint64(&s.numCalls)
+	s.prevNumCalls = numCalls
+	if numCalls > prev {
+		// OK: the function has gotten called since last we checked
+		return false
+	}
+	if atomic.LoadUint32(&s.inCall) == 1 {
+		// OK: the function is active, probably blocked due to inactivity
+		return false
+	}
+	// Not OK: The function is not active, and not accumulating new calls.
+	// It is probably MIA.
+	return true
+}
+
+// State is a snapshot of the health state, for the LocalAPI.
+type State struct {
+	Status       Status
+	OverallError string `json:",omitempty"` // empty if healthy
+
+	// Problems are the individual problems that OverallError
+	// summarizes, with their remediation hints.
+	Problems []Problem `json:",omitempty"`
+
+	// Subsystems are the states of the subsystems that have
+	// reported, including Warnables, sorted by name.
+	Subsystems []SubsystemState
+
+	IPNState       string    // an ipn.State.String() value, or empty if unknown
+	IPNStateSince  time.Time `json:",omitempty"` // when IPNState last changed
+	WantRunning    bool
+	AnyInterfaceUp bool
+	UDP4Unbound    bool
+	UDP6Unbound    bool
+
+	InMapPoll               bool
+	InMapPollSince          time.Time `json:",omitempty"`
+	LastMapPollEndedAt      time.Time `json:",omitempty"`
+	LastStreamedMapResponse time.Time `json:",omitempty"`
+	LastMapRequestHeard     time.Time `json:",omitempty"` // last 200 response to a map request
+
+	ControlRTT      time.Duration `json:",omitempty"` // average recent control request RTT, if known
+	ControlFailures int           `json:",omitempty"` // of the recent control requests
+	ControlRequests int           `json:",omitempty"` // recent control requests, up to a limit
+
+	DERPHomeRegion int // or zero if none
+	DERPRegions    []DERPRegionState
+	ReceiveFuncs   []ReceiveFuncState
+	Probes         []ProbeState `json:",omitempty"`
+}
+
+// SubsystemState is the health of a Subsystem.
+type SubsystemState struct {
+	Name     Subsystem
+	Severity Severity
+	Error    string    `json:",omitempty"` // empty if healthy
+	CausedBy Subsystem `json:",omitempty"` // unhealthy subsystem that Error is a consequence of
+	Hint     *Hint     `json:",omitempty"` // how to fix Error, if known
+}
+
+// Problem is one of the problems summarized by OverallError.
+type Problem struct {
+	Error  string
+	Code   IssueCode         `json:",omitempty"`
+	Params map[string]string `json:",omitempty"`
+	Hint   *Hint             `json:",omitempty"` // how to fix it, if known
+}
+
+// problemStates returns the Problems in err, as from OverallError.
+func problemStates(err error) []Problem {
+	var ps []Problem
+	for _, e := range problems(err) {
+		p := Problem{Error: e.Error()}
+		var i *Issue
+		if errors.As(e, &i) {
+			p.Code, p.Params = i.Code, i.Params
+		}
+		if h, ok := HintOf(e); ok {
+			p.Hint = &h
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// DERPRegionState is the health of the connection to a DERP region.
+type DERPRegionState struct {
+	RegionID     int
+	Connected    bool
+	LastFrame    time.Time     `json:",omitempty"` // last frame received
+	LastFrameAge time.Duration `json:",omitempty"` // since LastFrame, as of the snapshot
+	Latency      time.Duration `json:",omitempty"` // average recent ping RTT, if known
+	Problem      string        `json:",omitempty"`
+}
+
+// DERPRegionStatus returns the health of the connection to a DERP
+// region, or ok=false if nothing is known about it.
+func DERPRegionStatus(region int) (_ DERPRegionState, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	_, connKnown := derpRegionConnected[region]
+	_, hasProblem := derpRegionHealthProblem[region]
+	if !connKnown && !hasProblem {
+		return DERPRegionState{}, false
+	}
+	return derpRegionStateLocked(region, timeNow()), true
+}
+
+// AllDERPRegions returns the health of the connections to the DERP
+// regions that anything is known about, sorted by region ID.
+func AllDERPRegions() []DERPRegionState {
+	mu.Lock()
+	defer mu.Unlock()
+	return allDERPRegionsLocked()
+}
+
+func allDERPRegionsLocked() []DERPRegionState {
+	regions := map[int]bool{}
+	for rid := range derpRegionConnected {
+		regions[rid] = true
+	}
+	for rid := range derpRegionHealthProblem {
+		regions[rid] = true
+	}
+	now := timeNow()
+	var rs []DERPRegionState
+	for rid := range regions {
+		rs = append(rs, derpRegionStateLocked(rid, now))
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].RegionID < rs[j].RegionID })
+	return rs
+}
+
+func derpRegionStateLocked(region int, now time.Time) DERPRegionState {
+	rs := DERPRegionState{
+		RegionID:  region,
+		Connected: derpRegionConnected[region],
+		LastFrame: derpRegionLastFrame[region],
+		Problem:   derpRegionHealthProblem[region],
+	}
+	if !rs.LastFrame.IsZero() {
+		rs.LastFrameAge = now.Sub(rs.LastFrame)
+	}
+	rs.Latency, _ = derpRegionLatencyLocked(region)
+	return rs
+}
+
+// ReceiveFuncState is the state of a wireguard-go receive func.
+type ReceiveFuncState struct {
+	Name    string
+	Calls   uint64 // times it has been called
+	Missing bool   // not running as of the last check
+}
+
+// CurrentState returns a snapshot of the health state.
+func CurrentState() *State {
+	mu.Lock()
+	defer mu.Unlock()
+	return currentStateLocked()
+}
+
+func currentStateLocked() *State {
+	st, err := reportedOverallLocked()
+	s := &State{
+		Status:                  st,
+		IPNStateSince:           ipnStateSince,
+		WantRunning:             ipnWantRunning,
+		AnyInterfaceUp:          anyInterfaceUp,
+		UDP4Unbound:             udp4Unbound,
+		UDP6Unbound:             udp6Unbound,
+		InMapPoll:               inMapPoll,
+		LastMapPollEndedAt:      lastMapPollEndedAt,
+		LastStreamedMapResponse: lastStreamedMapResponse,
+		LastMapRequestHeard:     lastMapRequestHeard,
+		DERPHomeRegion:          derpHomeRegion,
+	}
+	if err != nil {
+		s.OverallError = err.Error()
+		s.Problems = problemStates(err)
+	}
+	if ipnStateKnown {
+		s.IPNState = ipnState.String()
+	}
+	if inMapPoll {
+		s.InMapPollSince = inMapPollSince
+	}
+	s.ControlRTT, s.ControlFailures, s.ControlRequests = controlStatsLocked()
+	for sys, err := range sysErr {
+		if sys == SysOverall {
 			continue
 		}
-		// Not OK: The function is not active, and not accumulating new calls.
-		// It is probably MIA.
-		recv.missing = true
+		ss := SubsystemState{Name: sys, Severity: severityLocked(sys)}
+		if err != nil {
+			ss.Error = err.Error()
+			ss.CausedBy = causeLocked(sys)
+			if h, ok := HintOf(err); ok {
+				ss.Hint = &h
+			}
+		}
+		s.Subsystems = append(s.Subsystems, ss)
+	}
+	sort.Slice(s.Subsystems, func(i, j int) bool { return s.Subsystems[i].Name < s.Subsystems[j].Name })
+
+	s.DERPRegions = allDERPRegionsLocked()
+
+	for _, recv := range receiveFuncs {
+		s.ReceiveFuncs = append(s.ReceiveFuncs, ReceiveFuncState{Name: recv.name, Calls: atomic.LoadUint64(&recv.numCalls), Missing: recv.missing})
 	}
+	s.Probes = allProbesLocked()
+	return s
 }
@@ -0,0 +1,987 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tstest"
+	"tailscale.com/util/clientmetric"
+)
+
+// setHealthyForTest sets the package's state to that of a healthy,
+// running node, restoring the original state when t is done.
+func setHealthyForTest(t *testing.T) {
+	mu.Lock()
+	defer mu.Unlock()
+	oldSysErr, oldSysErrSev := sysErr, sysErrSev
+	oldState, oldWant, oldPoll := ipnState, ipnWantRunning, inMapPoll
+	oldKnown, oldStateSince := ipnStateKnown, ipnStateSince
+	oldStreamed, oldHome := lastStreamedMapResponse, derpHomeRegion
+	oldConnected, oldFrame := derpRegionConnected, derpRegionLastFrame
+	oldDebounce, oldPending := debounce, pendingErr
+	oldUp, oldCerts := anyInterfaceUp, certExpiry
+	oldUDP4, oldUDP6 := udp4Unbound, udp6Unbound
+	oldFuncs, oldLatency := receiveFuncs, derpRegionLatency
+	oldOpts, oldControl := opts, controlRequests
+	oldSince := unhealthySince
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		sysErr, sysErrSev = oldSysErr, oldSysErrSev
+		ipnState, ipnWantRunning, inMapPoll = oldState, oldWant, oldPoll
+		ipnStateKnown, ipnStateSince = oldKnown, oldStateSince
+		lastStreamedMapResponse, derpHomeRegion = oldStreamed, oldHome
+		derpRegionConnected, derpRegionLastFrame = oldConnected, oldFrame
+		debounce, pendingErr = oldDebounce, oldPending
+		anyInterfaceUp, certExpiry = oldUp, oldCerts
+		udp4Unbound, udp6Unbound = oldUDP4, oldUDP6
+		receiveFuncs, derpRegionLatency = oldFuncs, oldLatency
+		opts, controlRequests = oldOpts, oldControl
+		unhealthySince = oldSince
+	})
+
+	now := timeNow()
+	sysErr, sysErrSev = map[Subsystem]error{}, map[Subsystem]Severity{}
+	ipnState, ipnWantRunning, inMapPoll = ipn.Running, true, true
+	ipnStateKnown, ipnStateSince = true, now
+	lastStreamedMapResponse, derpHomeRegion = now, 1
+	derpRegionConnected = map[int]bool{1: true}
+	derpRegionLastFrame = map[int]time.Time{1: now}
+	debounce, pendingErr = 0, map[Subsystem]*pendingProblem{}
+	anyInterfaceUp, certExpiry = true, map[string]time.Time{}
+	udp4Unbound, udp6Unbound = false, false
+	receiveFuncs, derpRegionLatency = nil, map[int][]time.Duration{}
+	opts, controlRequests = defaultOptions, nil
+	unhealthySince = map[Subsystem]time.Time{}
+	for _, recv := range oldFuncs {
+		receiveFuncs = append(receiveFuncs, &ReceiveFuncStats{name: recv.name})
+	}
+}
+
+// setAfterFuncForTest replaces afterFunc until t is done with one whose
+// timers never fire by themselves. Functions scheduled after the debounce
+// duration are passed to debounced, if non-nil, for the test to run.
+func setAfterFuncForTest(t *testing.T, debounced func(f func())) {
+	mu.Lock()
+	defer mu.Unlock()
+	oldAfterFunc := afterFunc
+	afterFunc = func(d time.Duration, f func()) selfCheckTimer {
+		if debounced != nil && d == debounce {
+			debounced(f)
+		}
+		return fakeTimer{}
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		afterFunc = oldAfterFunc
+	})
+}
+
+// newTestWarnable returns a new Warnable, unregistered when t is done.
+func newTestWarnable(t *testing.T, name string, sev Severity) *Warnable {
+	w := NewWarnable(name, sev)
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(warnables, w.sys)
+	})
+	return w
+}
+
+func TestOverallStatus(t *testing.T) {
+	setHealthyForTest(t)
+	latency := newTestWarnable(t, "test-latency", SeverityWarning)
+	broken := newTestWarnable(t, "test-broken", SeverityError)
+
+	if got := OverallStatus(); got != StatusHealthy {
+		t.Fatalf("initially %v; want healthy", got)
+	}
+	latency.Set(errors.New("slow"))
+	if got := OverallStatus(); got != StatusDegraded {
+		t.Errorf("with warning: %v; want degraded", got)
+	}
+	if OverallError() == nil {
+		t.Errorf("with warning: OverallError is nil")
+	}
+	broken.Set(errors.New("bad"))
+	if got := OverallStatus(); got != StatusBroken {
+		t.Errorf("with error: %v; want broken", got)
+	}
+	broken.Set(nil)
+	latency.Set(nil)
+	if got := OverallStatus(); got != StatusHealthy {
+		t.Errorf("after clearing: %v; want healthy", got)
+	}
+}
+
+func TestWatcherSeverity(t *testing.T) {
+	setHealthyForTest(t)
+	w := newTestWarnable(t, "test-watched", SeverityInfo)
+	type change struct {
+		sev Severity
+		err error
+	}
+	changes := make(chan change, 10)
+	unregister := RegisterSeverityWatcher(func(key Subsystem, sev Severity, err error) {
+		if key == w.Subsystem() {
+			changes <- change{sev, err}
+		}
+	})
+	defer unregister()
+
+	w.Set(errors.New("fyi"))
+	select {
+	case c := <-changes:
+		if c.sev != SeverityInfo || c.err == nil {
+			t.Errorf("got %v, %v; want info, non-nil", c.sev, c.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for watcher")
+	}
+}
+
+func TestNewWarnableDuplicate(t *testing.T) {
+	newTestWarnable(t, "test-dup", SeverityInfo)
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for duplicate Warnable")
+		}
+	}()
+	NewWarnable("test-dup", SeverityInfo)
+}
+
+func TestCurrentState(t *testing.T) {
+	setHealthyForTest(t)
+	w := newTestWarnable(t, "test-state", SeverityWarning)
+	w.Set(errors.New("meh"))
+
+	j, err := json.Marshal(CurrentState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st State
+	if err := json.Unmarshal(j, &st); err != nil {
+		t.Fatalf("%v in %s", err, j)
+	}
+	if st.Status != StatusDegraded {
+		t.Errorf("Status = %v; want degraded", st.Status)
+	}
+	if len(st.DERPRegions) != 1 || !st.DERPRegions[0].Connected {
+		t.Errorf("DERPRegions = %+v; want region 1 connected", st.DERPRegions)
+	}
+	var found bool
+	for _, ss := range st.Subsystems {
+		if ss.Name == "test-state" {
+			found = true
+			if ss.Severity != SeverityWarning || ss.Error != "meh" {
+				t.Errorf("subsystem = %+v", ss)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("test-state not in %+v", st.Subsystems)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	setHealthyForTest(t)
+	w := newTestWarnable(t, "test-prom", SeverityWarning)
+	w.Set(errors.New("meh"))
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf)
+	for _, want := range []string{
+		"tailscaled_health_status 1\n",
+		`tailscaled_health_subsystem{name="test-prom"} 0` + "\n",
+		`tailscaled_health_subsystem_severity{name="test-prom"} 1` + "\n",
+		"tailscaled_health_derp_home_connected 1\n",
+		"tailscaled_health_seconds_since_last_map_response 0\n",
+		`tailscaled_health_receive_func_missing{name="ReceiveDERP"} 0` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRecentTransitions(t *testing.T) {
+	setHealthyForTest(t)
+	mu.Lock()
+	oldTransitions, oldNext := transitions, transitionsNext
+	transitions, transitionsNext = make([]Transition, 0, maxTransitions), 0
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions, transitionsNext = oldTransitions, oldNext
+	})
+
+	w := newTestWarnable(t, "test-history", SeverityWarning)
+	for i := 0; i < maxTransitions; i++ {
+		w.Set(errors.New("flap"))
+		w.Set(nil)
+	}
+	var own []Transition
+	for _, tr := range RecentTransitions(-1) {
+		if tr.Subsystem == w.Subsystem() {
+			own = append(own, tr)
+		}
+	}
+	if len(RecentTransitions(-1)) != maxTransitions {
+		t.Errorf("kept %d transitions; want %d", len(RecentTransitions(-1)), maxTransitions)
+	}
+	if len(own) == 0 || own[len(own)-1].NewError != "" || own[len(own)-1].OldError != "flap" {
+		t.Errorf("last transition = %+v; want flap -> ok", own[len(own)-1])
+	}
+	if got := RecentTransitions(3); len(got) != 3 {
+		t.Errorf("RecentTransitions(3) returned %d", len(got))
+	}
+}
+
+func TestWatchChan(t *testing.T) {
+	setHealthyForTest(t)
+	a := newTestWarnable(t, "test-chan-a", SeverityWarning)
+	b := newTestWarnable(t, "test-chan-b", SeverityWarning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := WatchChan(ctx, WatchOpts{Subsystems: []Subsystem{b.Subsystem()}})
+	overall := WatchChan(ctx, WatchOpts{OverallOnly: true})
+
+	a.Set(errors.New("a broke"))
+	b.Set(errors.New("b broke"))
+	if tr := <-ch; tr.Subsystem != b.Subsystem() || tr.NewError != "b broke" {
+		t.Errorf("got %+v; want b's transition", tr)
+	}
+	if tr := <-overall; tr.Subsystem != SysOverall || tr.Severity != SeverityWarning {
+		t.Errorf("got %+v; want overall warning", tr)
+	}
+
+	cancel()
+	for range ch {
+		// Drain until closed.
+	}
+}
+
+// useClockForTest makes the package use clock, until t is done.
+func useClockForTest(t *testing.T, clock *tstest.Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	oldNow := timeNow
+	timeNow = clock.Now
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		timeNow = oldNow
+	})
+}
+
+func TestMapResponseIdle(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+	NoteDERPRegionReceivedFrame(1)
+	GotStreamedMapResponse()
+
+	if err := OverallError(); err != nil {
+		t.Fatalf("initially: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	NoteDERPRegionReceivedFrame(1)
+	if err := OverallError(); err != nil {
+		t.Fatalf("after 2m: %v", err)
+	}
+	clock.Advance(10 * time.Second)
+	NoteDERPRegionReceivedFrame(1)
+	err := OverallError()
+	if err == nil || !strings.Contains(err.Error(), "no map response in 2m10s") {
+		t.Errorf("after 2m10s: %v; want no map response error", err)
+	}
+}
+
+var (
+	testReceiveCalls   = clientmetric.NewCounter("health_receive_func_calls_test")
+	testReceiveMissing = clientmetric.NewGauge("health_receive_func_missing_test")
+)
+
+func TestReceiveFuncMissing(t *testing.T) {
+	setHealthyForTest(t)
+	mu.Lock()
+	oldFuncs := receiveFuncs
+	recv := &ReceiveFuncStats{
+		name:          "ReceiveTest",
+		metricCalls:   testReceiveCalls,
+		metricMissing: testReceiveMissing,
+	}
+	startCalls := testReceiveCalls.Value()
+	receiveFuncs = []*ReceiveFuncStats{recv}
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		receiveFuncs = oldFuncs
+	})
+
+	// Called since the last check: fine.
+	recv.Enter()
+	recv.Exit()
+	timerSelfCheck()
+	if err := OverallError(); err != nil {
+		t.Fatalf("after call: %v", err)
+	}
+	// Not called, and not in a call: missing.
+	timerSelfCheck()
+	if err := OverallError(); err == nil || !strings.Contains(err.Error(), "ReceiveTest is not running") {
+		t.Errorf("after idle: %v; want ReceiveTest not running", err)
+	}
+	if got := recv.metricMissing.Value(); got != 1 {
+		t.Errorf("missing metric = %d; want 1", got)
+	}
+	// Blocked in a call: fine.
+	recv.Enter()
+	timerSelfCheck()
+	if err := OverallError(); err != nil {
+		t.Errorf("while in call: %v", err)
+	}
+	if got := recv.metricMissing.Value(); got != 0 {
+		t.Errorf("missing metric = %d; want 0", got)
+	}
+	if got := recv.metricCalls.Value() - startCalls; got != 2 {
+		t.Errorf("calls metric = %d; want 2", got)
+	}
+}
+
+// fakeTimer is a selfCheckTimer that never fires by itself.
+type fakeTimer struct{}
+
+func (fakeTimer) Stop() bool               { return true }
+func (fakeTimer) Reset(time.Duration) bool { return true }
+
+func TestDebounce(t *testing.T) {
+	setHealthyForTest(t)
+	w := newTestWarnable(t, "test-flappy", SeverityWarning)
+
+	var fire []func()
+	setAfterFuncForTest(t, func(f func()) { fire = append(fire, f) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Transitions are sent to the channel as they're reported.
+	reported := WatchChan(ctx, WatchOpts{Subsystems: []Subsystem{w.Subsystem()}})
+	numReported := 0
+	drainReported := func() int {
+		for {
+			select {
+			case <-reported:
+				numReported++
+			default:
+				return numReported
+			}
+		}
+	}
+	SetDebounce(10 * time.Second)
+
+	// A flap shorter than the debounce isn't reported.
+	w.Set(errors.New("flap"))
+	if err := OverallError(); err != nil {
+		t.Fatalf("during flap: %v", err)
+	}
+	w.Set(nil)
+	for _, f := range fire {
+		f()
+	}
+	fire = nil
+	if err := OverallError(); err != nil {
+		t.Fatalf("after flap: %v", err)
+	}
+	if n := drainReported(); n != 0 {
+		t.Fatalf("flap reported %d times", n)
+	}
+
+	// A lasting problem is, once debounced.
+	w.Set(errors.New("first"))
+	w.Set(errors.New("latest"))
+	if err := OverallError(); err != nil {
+		t.Fatalf("before debounce: %v", err)
+	}
+	if len(fire) != 1 {
+		t.Fatalf("got %d debounce timers; want 1", len(fire))
+	}
+	fire[0]()
+	if err := OverallError(); err == nil || !strings.Contains(err.Error(), "test-flappy: latest") {
+		t.Fatalf("after debounce: %v; want test-flappy error", err)
+	}
+	if n := drainReported(); n != 1 {
+		t.Fatalf("reported %d times; want 1", n)
+	}
+
+	// Recovery is reported at once.
+	w.Set(nil)
+	if err := OverallError(); err != nil {
+		t.Fatalf("after recovery: %v", err)
+	}
+	if n := drainReported(); n != 2 {
+		t.Fatalf("reported %d times; want 2", n)
+	}
+}
+
+func TestDebounceOverall(t *testing.T) {
+	setHealthyForTest(t)
+
+	var fire []func()
+	setAfterFuncForTest(t, func(f func()) { fire = append(fire, f) })
+	SetDebounce(10 * time.Second)
+
+	// A brief DERP reconnect isn't reported.
+	SetDERPRegionConnectedState(1, false)
+	if err := OverallError(); err != nil {
+		t.Fatalf("during reconnect: %v", err)
+	}
+	if st := CurrentState(); st.Status != StatusHealthy {
+		t.Fatalf("status during reconnect = %v; want healthy", st.Status)
+	}
+	SetDERPRegionConnectedState(1, true)
+	for _, f := range fire {
+		f()
+	}
+	fire = nil
+	if err := OverallError(); err != nil {
+		t.Fatalf("after reconnect: %v", err)
+	}
+
+	// A lasting disconnect is, once debounced.
+	SetDERPRegionConnectedState(1, false)
+	if len(fire) != 1 {
+		t.Fatalf("got %d debounce timers; want 1", len(fire))
+	}
+	fire[0]()
+	if issues := Issues(OverallError()); len(issues) != 1 || issues[0].Code != IssueDERPHomeDisconnected {
+		t.Fatalf("after debounce: %+v; want home DERP disconnected", issues)
+	}
+	if err := get(SysOverall); err == nil {
+		t.Error("SysOverall healthy after debounce")
+	}
+}
+
+func TestDependentProblems(t *testing.T) {
+	setHealthyForTest(t)
+	up := newTestWarnable(t, "test-upstream", SeverityError)
+	down := newTestWarnable(t, "test-downstream", SeverityWarning)
+	AddDependency(down.Subsystem(), up.Subsystem())
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(dependsOn, down.Subsystem())
+	})
+
+	errs := make(chan error, 10)
+	defer RegisterWatcher(func(sys Subsystem, err error) {
+		if sys == down.Subsystem() {
+			errs <- err
+		}
+	})()
+
+	up.Set(errors.New("upstream broke"))
+	down.Set(errors.New("downstream broke"))
+	select {
+	case err := <-errs:
+		var ce *CausedError
+		if !errors.As(err, &ce) || ce.Cause != up.Subsystem() {
+			t.Errorf("watcher got %v; want CausedError from %v", err, up.Subsystem())
+		}
+		if got, want := err.Error(), "downstream broke (caused by: upstream broke)"; got != want {
+			t.Errorf("watcher error = %q; want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for watcher")
+	}
+	err := OverallError()
+	if err == nil || !strings.Contains(err.Error(), "upstream broke") || strings.Contains(err.Error(), "downstream") {
+		t.Errorf("OverallError = %v; want only the upstream problem", err)
+	}
+	for _, ss := range CurrentState().Subsystems {
+		if ss.Name == down.Subsystem() && ss.CausedBy != up.Subsystem() {
+			t.Errorf("downstream CausedBy = %q; want %q", ss.CausedBy, up.Subsystem())
+		}
+	}
+
+	// Once the cause is fixed, the downstream problem stands alone.
+	up.Set(nil)
+	err = OverallError()
+	if err == nil || !strings.Contains(err.Error(), "test-downstream: downstream broke") {
+		t.Errorf("OverallError = %v; want the downstream problem", err)
+	}
+}
+
+func TestNetworkDown(t *testing.T) {
+	setHealthyForTest(t)
+	SetAnyInterfaceUp(false)
+	set(SysDNSOS, errors.New("no resolv.conf"))
+	if got := get(SysNetwork); got != errNetworkDown {
+		t.Errorf("network error = %v; want %v", got, errNetworkDown)
+	}
+	for _, ss := range CurrentState().Subsystems {
+		if ss.Name == SysDNSOS && ss.CausedBy != SysNetwork {
+			t.Errorf("dns-os CausedBy = %q; want %q", ss.CausedBy, SysNetwork)
+		}
+	}
+	SetAnyInterfaceUp(true)
+	if got := get(SysNetwork); got != nil {
+		t.Errorf("network error after up = %v; want nil", got)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	setHealthyForTest(t)
+	probe := func(h http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+	if got := probe(ServeReadiness); got != http.StatusOK {
+		t.Errorf("ready = %d; want 200", got)
+	}
+	if got := probe(ServeLiveness); got != http.StatusOK {
+		t.Errorf("live = %d; want 200", got)
+	}
+
+	SetInPollNetMap(false)
+	if got := probe(ServeReadiness); got != http.StatusServiceUnavailable {
+		t.Errorf("ready out of map poll = %d; want 503", got)
+	}
+	if got := probe(ServeLiveness); got != http.StatusOK {
+		t.Errorf("live out of map poll = %d; want 200", got)
+	}
+}
+
+func certSeverityForTest() Severity {
+	mu.Lock()
+	defer mu.Unlock()
+	return severityLocked(SysTLSCert)
+}
+
+func TestTLSCertExpiry(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+
+	SetTLSCertExpiry("a.example.ts.net", clock.Now().Add(60*24*time.Hour))
+	SetTLSCertExpiry("b.example.ts.net", clock.Now().Add(20*24*time.Hour))
+	if err := get(SysTLSCert); err != nil {
+		t.Fatalf("initially: %v", err)
+	}
+
+	clock.Advance(10 * 24 * time.Hour)
+	timerSelfCheck()
+	err := get(SysTLSCert)
+	if err == nil || !strings.Contains(err.Error(), "b.example.ts.net expires in 240h") {
+		t.Errorf("10 days later: %v; want b.example.ts.net expiring", err)
+	}
+	if got := certSeverityForTest(); got != SeverityWarning {
+		t.Errorf("severity = %v; want warning", got)
+	}
+
+	clock.Advance(10 * 24 * time.Hour)
+	timerSelfCheck()
+	err = get(SysTLSCert)
+	if err == nil || !strings.Contains(err.Error(), "b.example.ts.net expired") {
+		t.Errorf("20 days later: %v; want b.example.ts.net expired", err)
+	}
+	if got := certSeverityForTest(); got != SeverityError {
+		t.Errorf("severity = %v; want error", got)
+	}
+
+	// Renewed.
+	SetTLSCertExpiry("b.example.ts.net", clock.Now().Add(90*24*time.Hour))
+	if err := get(SysTLSCert); err != nil {
+		t.Errorf("after renewal: %v", err)
+	}
+}
+
+func TestUDPUnbound(t *testing.T) {
+	setHealthyForTest(t)
+	tests := []struct {
+		udp4, udp6 bool
+		want       Status
+		wantErr    string
+	}{
+		{false, false, StatusHealthy, ""},
+		{true, false, StatusDegraded, "no udp4 bind"},
+		{false, true, StatusDegraded, "no udp6 bind"},
+		{true, true, StatusBroken, "no udp4 or udp6 bind"},
+	}
+	for _, tt := range tests {
+		SetUDP4Unbound(tt.udp4)
+		SetUDP6Unbound(tt.udp6)
+		if got := OverallStatus(); got != tt.want {
+			t.Errorf("udp4=%v, udp6=%v: status = %v; want %v", tt.udp4, tt.udp6, got, tt.want)
+		}
+		var gotErr string
+		if err := OverallError(); err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != tt.wantErr {
+			t.Errorf("udp4=%v, udp6=%v: error = %q; want %q", tt.udp4, tt.udp6, gotErr, tt.wantErr)
+		}
+	}
+}
+
+func TestDERPHomeLatency(t *testing.T) {
+	setHealthyForTest(t)
+	for i := 0; i < derpLatencySamples; i++ {
+		NoteDERPRegionLatency(1, 100*time.Millisecond)
+		NoteDERPRegionLatency(2, time.Second) // not home
+	}
+	if err := OverallError(); err != nil {
+		t.Fatalf("with low latency: %v", err)
+	}
+	for i := 0; i < derpLatencySamples/2+1; i++ {
+		NoteDERPRegionLatency(1, 2*time.Second)
+	}
+	if got, want := OverallStatus(), StatusDegraded; got != want {
+		t.Errorf("status = %v; want %v", got, want)
+	}
+	if err := OverallError(); err == nil || err.Error() != "home DERP latency 1240ms" {
+		t.Errorf("OverallError = %v; want home DERP latency 1240ms", err)
+	}
+	if d, _ := DERPRegionLatency(1); d != 1240*time.Millisecond {
+		t.Errorf("latency = %v; want 1.24s", d)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+	NoteDERPRegionReceivedFrame(1)
+	GotStreamedMapResponse()
+
+	SetOptions(Options{MaxIdle: 5 * time.Minute})
+	if got := CurrentOptions(); got.MaxIdle != 5*time.Minute || got.MapPollGrace != defaultOptions.MapPollGrace {
+		t.Errorf("CurrentOptions = %+v; want MaxIdle 5m and the other defaults", got)
+	}
+	clock.Advance(3 * time.Minute)
+	NoteDERPRegionReceivedFrame(1)
+	if err := OverallError(); err != nil {
+		t.Fatalf("after 3m with MaxIdle 5m: %v", err)
+	}
+	SetOptions(Options{})
+	if err := OverallError(); err == nil || !strings.Contains(err.Error(), "no map response in 3m0s") {
+		t.Errorf("after 3m with default MaxIdle: %v; want no map response error", err)
+	}
+}
+
+func TestHints(t *testing.T) {
+	setHealthyForTest(t)
+	w := newTestWarnable(t, "test-hinted", SeverityWarning)
+	fix := Hint{Text: "turn it off and on again", URL: "https://example.com/fix"}
+	w.Set(WithHint(errors.New("it broke"), fix))
+	SetUDP4Unbound(true)
+
+	err := OverallError()
+	hints := Hints(err)
+	if len(hints) != 2 || hints[0] != hintUDPBind || hints[1] != fix {
+		t.Errorf("Hints = %+v; want udp bind hint and %+v", hints, fix)
+	}
+	st := CurrentState()
+	if len(st.Problems) != 2 || st.Problems[1].Error != "test-hinted: it broke" || st.Problems[1].Hint == nil || *st.Problems[1].Hint != fix {
+		t.Errorf("Problems = %+v", st.Problems)
+	}
+	for _, ss := range st.Subsystems {
+		if ss.Name == w.Subsystem() && (ss.Hint == nil || *ss.Hint != fix) {
+			t.Errorf("subsystem hint = %+v; want %+v", ss.Hint, fix)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	ServeDebugHistory(rec, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(rec.Body.String(), "problem: test-hinted: it broke\n  hint: turn it off and on again\n  see: https://example.com/fix\n") {
+		t.Errorf("debug page lacks hint:\n%s", rec.Body)
+	}
+}
+
+func TestIssues(t *testing.T) {
+	setHealthyForTest(t)
+	w := newTestWarnable(t, "test-issue", SeverityWarning)
+	w.Set(errors.New("it broke"))
+	SetUDP6Unbound(true)
+
+	err := OverallError()
+	issues := Issues(err)
+	if len(issues) != 2 {
+		t.Fatalf("Issues = %+v; want 2", issues)
+	}
+	if i := issues[0]; i.Code != IssueUDPUnbound || i.Severity != SeverityWarning || i.Params["network"] != "udp6" {
+		t.Errorf("first issue = %+v", i)
+	}
+	if i := issues[1]; i.Code != IssueSubsystem || i.Params["subsystem"] != "test-issue" || i.Error() != "test-issue: it broke" {
+		t.Errorf("second issue = %+v", i)
+	}
+	st := CurrentState()
+	if len(st.Problems) != 2 || st.Problems[0].Code != IssueUDPUnbound || st.Problems[1].Params["subsystem"] != "test-issue" {
+		t.Errorf("Problems = %+v", st.Problems)
+	}
+	if got, want := Summary(), []string{"test-issue", "udp-unbound"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Summary = %q; want %q", got, want)
+	}
+
+	SetUDP4Unbound(true)
+	issues = Issues(OverallError())
+	if len(issues) != 1 || issues[0].Code != IssueUDPUnbound || issues[0].Severity != SeverityError || issues[0].Params["network"] != "udp4+udp6" {
+		t.Errorf("Issues with both unbound = %+v", issues)
+	}
+}
+
+func TestControlRTT(t *testing.T) {
+	setHealthyForTest(t)
+	if _, ok := ControlRTT(); ok {
+		t.Fatal("ControlRTT ok with no requests")
+	}
+	NoteControlRTT(100 * time.Millisecond)
+	NoteControlRTT(300 * time.Millisecond)
+	if d, ok := ControlRTT(); !ok || d != 200*time.Millisecond {
+		t.Errorf("ControlRTT = %v, %v; want 200ms", d, ok)
+	}
+	if err := OverallError(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	NoteControlRTT(5900 * time.Millisecond)
+	issues := Issues(OverallError())
+	if len(issues) != 1 || issues[0].Code != IssueControlRTT || issues[0].Params["latency_ms"] != "2100" {
+		t.Errorf("Issues = %+v; want control-rtt of 2100ms", issues)
+	}
+	if st := CurrentState(); st.Status != StatusDegraded || st.ControlRTT != 2100*time.Millisecond {
+		t.Errorf("state = %v, RTT %v; want degraded, 2.1s", st.Status, st.ControlRTT)
+	}
+
+	for i := 0; i < controlRequestSamples; i++ {
+		NoteControlRTT(10 * time.Millisecond)
+	}
+	for i := 0; i < controlRequestSamples/2; i++ {
+		NoteControlRequestFailed()
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("error at half failed: %v", err)
+	}
+	NoteControlRequestFailed()
+	issues = Issues(OverallError())
+	if len(issues) != 1 || issues[0].Code != IssueControlFailures || issues[0].Params["failed"] != "11" {
+		t.Errorf("Issues = %+v; want 11 control failures", issues)
+	}
+}
+
+func TestRemediation(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+	setAfterFuncForTest(t, nil)
+
+	w := newTestWarnable(t, "test-fixable", SeverityWarning)
+	done := make(chan bool, 1)
+	mu.Lock()
+	remediationDoneForTest = func() { done <- true }
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		remediationDoneForTest = nil
+	})
+	fixed := make(chan error, 1)
+	fixErr := errors.New("still broken")
+	unregister := RegisterRemediation(w.Subsystem(), func(err error) error {
+		fixed <- err
+		return fixErr
+	})
+	defer unregister()
+
+	w.Set(errors.New("broken"))
+	clock.Advance(opts.RemediateAfter - time.Second)
+	timerSelfCheck()
+	select {
+	case err := <-fixed:
+		t.Fatalf("remediated too soon: %v", err)
+	default:
+	}
+
+	clock.Advance(time.Second)
+	timerSelfCheck()
+	if err := <-fixed; err == nil || err.Error() != "broken" {
+		t.Errorf("remediation got %v; want broken", err)
+	}
+	waitForTransition := func(want string) {
+		t.Helper()
+		<-done
+		if ts := RecentTransitions(1); len(ts) != 1 || ts[0].Remediation != want {
+			t.Fatalf("last transition = %+v; want remediation %q", ts, want)
+		}
+	}
+	waitForTransition("failed: still broken")
+
+	// Rate limited.
+	clock.Advance(opts.RemediateInterval - time.Second)
+	timerSelfCheck()
+	select {
+	case err := <-fixed:
+		t.Fatalf("remediated again too soon: %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	fixErr = nil
+	timerSelfCheck()
+	<-fixed
+	waitForTransition("succeeded")
+}
+
+func TestIPNStateIssues(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+
+	SetIPNState(ipn.NeedsMachineAuth, true)
+	clock.Advance(3 * time.Minute)
+	issues := Issues(OverallError())
+	if len(issues) != 1 || issues[0].Code != IssueNeedsMachineAuth || issues[0].Error() != "waiting for an admin to approve this device (for 3m0s)" {
+		t.Errorf("Issues = %+v; want needs-machine-auth for 3m", issues)
+	}
+
+	SetIPNState(ipn.NeedsLogin, true)
+	clock.Advance(time.Minute)
+	issues = Issues(OverallError())
+	if len(issues) != 1 || issues[0].Code != IssueNeedsLogin || issues[0].Error() != "logged out (for 1m0s)" {
+		t.Errorf("Issues = %+v; want needs-login for 1m", issues)
+	}
+	if st := CurrentState(); st.IPNState != "NeedsLogin" || !st.IPNStateSince.Equal(clock.Now().Add(-time.Minute)) {
+		t.Errorf("state = %q since %v", st.IPNState, st.IPNStateSince)
+	}
+
+	SetIPNState(ipn.Stopped, false)
+	issues = Issues(OverallError())
+	if len(issues) != 1 || issues[0].Code != IssueStopped || issues[0].Params["state"] != "Stopped" {
+		t.Errorf("Issues = %+v; want stopped", issues)
+	}
+}
+
+func TestDERPRegionStatus(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+	NoteDERPRegionReceivedFrame(1)
+	SetDERPRegionHealth(2, "too many clients")
+	t.Cleanup(func() { SetDERPRegionHealth(2, "") })
+	clock.Advance(5 * time.Second)
+
+	if _, ok := DERPRegionStatus(3); ok {
+		t.Error("got status for unknown region 3")
+	}
+	st, ok := DERPRegionStatus(1)
+	if !ok || !st.Connected || st.LastFrameAge != 5*time.Second || st.Problem != "" {
+		t.Errorf("region 1 = %+v, %v", st, ok)
+	}
+	all := AllDERPRegions()
+	if len(all) != 2 || all[0].RegionID != 1 || all[1].RegionID != 2 || all[1].Problem != "too many clients" || all[1].Connected {
+		t.Errorf("AllDERPRegions = %+v", all)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	clock := &tstest.Clock{}
+	useClockForTest(t, clock)
+	setHealthyForTest(t)
+	setAfterFuncForTest(t, nil)
+
+	const sys = Subsystem("test-probe")
+	ran := make(chan bool, 1)
+	probeErr := errors.New("unreachable")
+	unregister := RegisterProbe(sys, 5*time.Minute, func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("probe context has no deadline")
+		}
+		ran <- true
+		return probeErr
+	})
+	defer unregister()
+
+	// The probe's result is recorded, and sent to the channel, once it
+	// has stopped running.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transitions := WatchChan(ctx, WatchOpts{Subsystems: []Subsystem{sys}})
+	waitForHealth := func(want error) {
+		t.Helper()
+		<-transitions
+		if got := get(sys); got != want {
+			t.Fatalf("health = %v; want %v", got, want)
+		}
+	}
+
+	timerSelfCheck()
+	<-ran
+	waitForHealth(probeErr)
+	if ps := CurrentState().Probes; len(ps) != 1 || ps[0].Name != sys || ps[0].Error != "unreachable" || ps[0].Interval != 5*time.Minute {
+		t.Errorf("Probes = %+v", ps)
+	}
+
+	clock.Advance(time.Minute)
+	timerSelfCheck()
+	select {
+	case <-ran:
+		t.Fatal("probe ran again before its interval")
+	default:
+	}
+
+	clock.Advance(4 * time.Minute)
+	probeErr = nil
+	timerSelfCheck()
+	<-ran
+	waitForHealth(nil)
+
+	unregister()
+	if ps := CurrentState().Probes; len(ps) != 0 {
+		t.Errorf("after unregister, Probes = %+v", ps)
+	}
+}
+
+func TestRunChecks(t *testing.T) {
+	setHealthyForTest(t)
+	setAfterFuncForTest(t, nil)
+
+	const sys = Subsystem("test-doctor")
+	unregister := RegisterProbe(sys, time.Hour, func(ctx context.Context) error {
+		return errors.New("no route")
+	})
+	defer func() { unregister() }()
+
+	r := RunChecks(context.Background())
+	if len(r.Probes) != 1 || r.Probes[0].Name != sys || r.Probes[0].Error != "no route" {
+		t.Errorf("Probes = %+v", r.Probes)
+	}
+	if r.State.Status != StatusBroken || !strings.Contains(r.State.OverallError, "no route") {
+		t.Errorf("State = %v, %q; want broken by no route", r.State.Status, r.State.OverallError)
+	}
+
+	// A cancelled run doesn't record the probe's result.
+	unregister()
+	unregister = RegisterProbe(sys, time.Hour, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r := RunChecks(ctx); r.State.Status != StatusHealthy {
+		t.Errorf("after cancelled run, State = %v, %q; want healthy", r.State.Status, r.State.OverallError)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+
+	"tailscale.com/util/multierr"
+)
+
+// Hint is remediation guidance for a health problem, for CLIs and GUIs
+// to show alongside it.
+type Hint struct {
+	Text string // short fix-it guidance
+	URL  string `json:",omitempty"` // where to read more, if anywhere
+}
+
+// HintedError is a health problem with a remediation Hint.
+type HintedError struct {
+	Err  error
+	Hint Hint
+}
+
+func (e *HintedError) Error() string { return e.Err.Error() }
+func (e *HintedError) Unwrap() error { return e.Err }
+
+// WithHint returns err with the remediation hint h, or nil if err is nil.
+// Warnables can use it for the errors they Set.
+func WithHint(err error, h Hint) error {
+	if err == nil {
+		return nil
+	}
+	return &HintedError{Err: err, Hint: h}
+}
+
+// HintOf returns the remediation hint of a single health problem, if
+// it has one.
+func HintOf(err error) (_ Hint, ok bool) {
+	var he *HintedError
+	if errors.As(err, &he) {
+		return he.Hint, true
+	}
+	var i *Issue
+	if errors.As(err, &i) && i.Hint.Text != "" {
+		return i.Hint, true
+	}
+	return Hint{}, false
+}
+
+// Hints returns the remediation hints of the problems in err, such as
+// an error from OverallError, in order, for those that have one.
+func Hints(err error) []Hint {
+	var hints []Hint
+	for _, e := range problems(err) {
+		if h, ok := HintOf(e); ok {
+			hints = append(hints, h)
+		}
+	}
+	return hints
+}
+
+// problems returns the individual problems in err, as summarized by
+// OverallError.
+func problems(err error) []error {
+	if me, ok := err.(multierr.Error); ok {
+		return me.Errors()
+	}
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+const kbFirewallPorts = "https://tailscale.com/kb/1082/firewall-ports/"
+
+// Hints for the built-in problems.
+var (
+	hintNetworkDown = Hint{Text: "Connect this device to a network."}
+	hintLogin       = Hint{Text: "Run 'tailscale up' to log in."}
+	hintStopped     = Hint{Text: "Run 'tailscale up' to connect."}
+	hintMachineAuth = Hint{Text: "Ask an admin of your tailnet to approve this device in the admin console.", URL: "https://tailscale.com/kb/1099/device-authorization/"}
+	hintControl     = Hint{Text: "Check that this device can reach the coordination server over HTTPS; a firewall or proxy may be blocking it.", URL: kbFirewallPorts}
+	hintDERP        = Hint{Text: "Check that this device can reach Tailscale's DERP relay servers over HTTPS; a firewall or proxy may be blocking them.", URL: kbFirewallPorts}
+	hintDERPLatency = Hint{Text: "Connections relayed through DERP will be slow. Check for network congestion, or allow direct connections through your firewall.", URL: kbFirewallPorts}
+	hintUDPBind     = Hint{Text: "Another process may hold the port. Stop it, or run tailscaled with a different --port (0 picks any free port)."}
+	hintReceiveFunc = Hint{Text: "tailscaled's packet processing is stuck. Restart tailscaled, and report a bug if it happens again."}
+	hintStateStore  = Hint{Text: "Check that the disk holding tailscaled's state isn't full or read-only, and that tailscaled can write to it."}
+	hintTLSCert     = Hint{Text: "Run 'tailscale cert' for the domain to renew it."}
+	hintExitNode    = Hint{Text: "The exit node may have lost its internet connection. Use a different exit node, or stop using one with 'tailscale up --exit-node='."}
+)
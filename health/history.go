@@ -0,0 +1,109 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxTransitions is the number of health transitions kept in memory.
+const maxTransitions = 128
+
+var (
+	// transitions is a ring buffer of the most recent transitions,
+	// guarded by mu. Once full, transitionsNext is the oldest.
+	transitions     = make([]Transition, 0, maxTransitions)
+	transitionsNext int
+)
+
+// Transition is a change of a Subsystem's health state, as reported to
+// watchers.
+type Transition struct {
+	Time      time.Time
+	Subsystem Subsystem
+	Severity  Severity
+	OldError  string `json:",omitempty"` // empty if it was healthy or unknown
+	NewError  string `json:",omitempty"` // empty if it's now healthy
+
+	// Remediation, if non-empty, is that this isn't a change of
+	// state but an event of the subsystem's self-repair action (from
+	// RegisterRemediation): "attempting", "succeeded" or "failed: err".
+	Remediation string `json:",omitempty"`
+}
+
+func (t Transition) String() string {
+	state := func(err string) string {
+		if err == "" {
+			return "ok"
+		}
+		return err
+	}
+	if t.Remediation != "" {
+		return fmt.Sprintf("%s %s (%v): %s; remediation %s", t.Time.Format(time.RFC3339), t.Subsystem, t.Severity, state(t.NewError), t.Remediation)
+	}
+	return fmt.Sprintf("%s %s (%v): %s -> %s", t.Time.Format(time.RFC3339), t.Subsystem, t.Severity, state(t.OldError), state(t.NewError))
+}
+
+// recordTransitionLocked adds the transition of key to the history and
+// returns it.
+func recordTransitionLocked(key Subsystem, sev Severity, old, new error) Transition {
+	t := Transition{Time: timeNow(), Subsystem: key, Severity: sev}
+	if old != nil {
+		t.OldError = old.Error()
+	}
+	if new != nil {
+		t.NewError = new.Error()
+	}
+	appendTransitionLocked(t)
+	return t
+}
+
+// appendTransitionLocked adds t to the history.
+func appendTransitionLocked(t Transition) {
+	if len(transitions) < maxTransitions {
+		transitions = append(transitions, t)
+		return
+	}
+	transitions[transitionsNext] = t
+	transitionsNext = (transitionsNext + 1) % maxTransitions
+}
+
+// RecentTransitions returns up to the n most recent health
+// transitions, oldest first. Only the last 128 are kept.
+func RecentTransitions(n int) []Transition {
+	mu.Lock()
+	defer mu.Unlock()
+	all := append(append([]Transition(nil), transitions[transitionsNext:]...), transitions[:transitionsNext]...)
+	if n >= 0 && n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return all
+}
+
+// ServeDebugHistory serves the current health problems, with their
+// remediation hints, and the recent health transitions, newest first,
+// as text.
+func ServeDebugHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, p := range problemStates(OverallError()) {
+		fmt.Fprintf(w, "problem: %s\n", p.Error)
+		if p.Hint != nil {
+			fmt.Fprintf(w, "  hint: %s\n", p.Hint.Text)
+			if p.Hint.URL != "" {
+				fmt.Fprintf(w, "  see: %s\n", p.Hint.URL)
+			}
+		}
+	}
+	ts := RecentTransitions(-1)
+	if len(ts) == 0 {
+		fmt.Fprintln(w, "no health transitions")
+		return
+	}
+	for i := len(ts) - 1; i >= 0; i-- {
+		fmt.Fprintln(w, ts[i])
+	}
+}
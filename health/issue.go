@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// IssueCode is a stable, machine-readable code for a kind of health
+// problem, for GUIs and automation to act on without parsing error
+// messages.
+type IssueCode string
+
+const (
+	IssueNetworkDown          IssueCode = "network-down"
+	IssueStopped              IssueCode = "stopped"                // params: state
+	IssueNeedsLogin           IssueCode = "needs-login"            // params: since
+	IssueNeedsMachineAuth     IssueCode = "needs-machine-auth"     // params: since
+	IssueLoginError           IssueCode = "login-error"            // params: error
+	IssueNotInMapPoll         IssueCode = "not-in-map-poll"        //
+	IssueNoMapResponse        IssueCode = "no-map-response"        // params: idle
+	IssueNoDERPHome           IssueCode = "no-derp-home"           //
+	IssueDERPHomeDisconnected IssueCode = "derp-home-disconnected" // params: region
+	IssueDERPHomeIdle         IssueCode = "derp-home-idle"         // params: region, idle
+	IssueDERPHomeLatency      IssueCode = "derp-home-latency"      // params: region, latency_ms
+	IssueDERPRegion           IssueCode = "derp-region"            // params: region, problem
+	IssueUDPUnbound           IssueCode = "udp-unbound"            // params: network ("udp4", "udp6" or "udp4+udp6")
+	IssueReceiveFuncStopped   IssueCode = "receive-func-stopped"   // params: name
+	IssueSubsystem            IssueCode = "subsystem"              // params: subsystem
+	IssueControl              IssueCode = "control"                // params: message
+	IssueControlRTT           IssueCode = "control-rtt"            // params: latency_ms
+	IssueControlFailures      IssueCode = "control-failures"       // params: failed, requests
+)
+
+// Issue is a health problem, as summarized by OverallError, with a
+// stable code. Use Issues to get those of an OverallError.
+type Issue struct {
+	Code     IssueCode
+	Severity Severity
+
+	// Params are details of the problem, as documented for each
+	// IssueCode.
+	Params map[string]string
+
+	// Hint is how to fix the problem, if known.
+	Hint Hint
+
+	msg string
+	err error // what it wraps, if anything
+}
+
+func (i *Issue) Error() string { return i.msg }
+func (i *Issue) Unwrap() error { return i.err }
+
+// newIssue returns an Issue with the given code, severity, hint and
+// params (as key/value pairs), whose message is formatted from format
+// and args.
+func newIssue(code IssueCode, sev Severity, hint Hint, params []string, format string, args ...any) *Issue {
+	i := &Issue{
+		Code:     code,
+		Severity: sev,
+		Hint:     hint,
+		msg:      fmt.Sprintf(format, args...),
+	}
+	for j := 0; j+1 < len(params); j += 2 {
+		if i.Params == nil {
+			i.Params = map[string]string{}
+		}
+		i.Params[params[j]] = params[j+1]
+	}
+	return i
+}
+
+// Issues returns the Issues in err, such as an error from OverallError,
+// in order.
+func Issues(err error) []*Issue {
+	var issues []*Issue
+	for _, e := range problems(err) {
+		var i *Issue
+		if errors.As(e, &i) {
+			issues = append(issues, i)
+		}
+	}
+	return issues
+}
+
+// Summary returns a compact summary of the current health problems, for
+// reporting to the control plane: the codes of the overall health
+// issues, with the names of unhealthy subsystems in place of
+// IssueSubsystem, sorted and without duplicates. It's empty if healthy.
+func Summary() []string {
+	seen := map[string]bool{}
+	var sum []string
+	for _, i := range Issues(OverallError()) {
+		s := string(i.Code)
+		if i.Code == IssueSubsystem {
+			s = i.Params["subsystem"]
+		}
+		if !seen[s] {
+			seen[s] = true
+			sum = append(sum, s)
+		}
+	}
+	sort.Strings(sum)
+	return sum
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"strconv"
+	"time"
+
+	"tailscale.com/envknob"
+)
+
+// Options are tunable thresholds for the health checks, for deployments
+// with high-latency links or that are battery-constrained. Zero fields
+// use their defaults.
+type Options struct {
+	// MapPollGrace is how long after a map poll ends that not being
+	// in one is a problem. The default is 10 seconds.
+	MapPollGrace time.Duration
+
+	// MaxIdle is how long without a map response from control, or
+	// a frame from the home DERP region, is a problem. The default
+	// is 2m5s, just over the keep-alive interval of each.
+	MaxIdle time.Duration
+
+	// SelfCheckInterval is how often the periodic checks (of the
+	// receive funcs and cert expiry, and any due probes) run, while
+	// there are watchers, remediations or probes.
+	// The default is 1 minute.
+	SelfCheckInterval time.Duration
+
+	// DERPHomeLatency is the average home DERP region latency above
+	// which the node is degraded. The default is 500ms.
+	DERPHomeLatency time.Duration
+
+	// CertExpiryWarning is how long before a TLS cert expires that
+	// the tls-cert subsystem warns about it. The default is 14 days.
+	CertExpiryWarning time.Duration
+
+	// ControlRTT is the average recent control request round trip
+	// time above which the node is degraded. The default is 2s.
+	ControlRTT time.Duration
+
+	// ControlFailureRate is the fraction of recent control requests
+	// failing above which the node is degraded. The default is 0.5.
+	ControlFailureRate float64
+
+	// RemediateAfter is how long a subsystem must stay unhealthy
+	// before its self-repair action, if any, is run. The default is
+	// 5 minutes.
+	RemediateAfter time.Duration
+
+	// RemediateInterval is the minimum time between runs of a
+	// subsystem's self-repair action. The default is 15 minutes.
+	RemediateInterval time.Duration
+}
+
+var defaultOptions = Options{
+	MapPollGrace:       10 * time.Second,
+	MaxIdle:            2*time.Minute + 5*time.Second,
+	SelfCheckInterval:  time.Minute,
+	DERPHomeLatency:    500 * time.Millisecond,
+	CertExpiryWarning:  14 * 24 * time.Hour,
+	ControlRTT:         2 * time.Second,
+	ControlFailureRate: 0.5,
+	RemediateAfter:     5 * time.Minute,
+	RemediateInterval:  15 * time.Minute,
+}
+
+// opts are the current options, with defaults filled in. It's guarded
+// by mu.
+var opts = optionsFromEnv().withDefaults()
+
+// optionsFromEnv returns the options set by environment variables, for
+// debugging.
+func optionsFromEnv() Options {
+	d := func(envVar string) time.Duration {
+		v, _ := time.ParseDuration(envknob.String(envVar))
+		return v
+	}
+	failureRate, _ := strconv.ParseFloat(envknob.String("TS_DEBUG_HEALTH_CONTROL_FAILURE_RATE"), 64)
+	return Options{
+		MapPollGrace:       d("TS_DEBUG_HEALTH_MAP_POLL_GRACE"),
+		MaxIdle:            d("TS_DEBUG_HEALTH_MAX_IDLE"),
+		SelfCheckInterval:  d("TS_DEBUG_HEALTH_SELF_CHECK_INTERVAL"),
+		DERPHomeLatency:    d("TS_DEBUG_HEALTH_DERP_HOME_LATENCY"),
+		CertExpiryWarning:  d("TS_DEBUG_HEALTH_CERT_EXPIRY_WARNING"),
+		ControlRTT:         d("TS_DEBUG_HEALTH_CONTROL_RTT"),
+		ControlFailureRate: failureRate,
+		RemediateAfter:     d("TS_DEBUG_HEALTH_REMEDIATE_AFTER"),
+		RemediateInterval:  d("TS_DEBUG_HEALTH_REMEDIATE_INTERVAL"),
+	}
+}
+
+func (o Options) withDefaults() Options {
+	def := func(v *time.Duration, d time.Duration) {
+		if *v <= 0 {
+			*v = d
+		}
+	}
+	def(&o.MapPollGrace, defaultOptions.MapPollGrace)
+	def(&o.MaxIdle, defaultOptions.MaxIdle)
+	def(&o.SelfCheckInterval, defaultOptions.SelfCheckInterval)
+	def(&o.DERPHomeLatency, defaultOptions.DERPHomeLatency)
+	def(&o.CertExpiryWarning, defaultOptions.CertExpiryWarning)
+	def(&o.ControlRTT, defaultOptions.ControlRTT)
+	def(&o.RemediateAfter, defaultOptions.RemediateAfter)
+	def(&o.RemediateInterval, defaultOptions.RemediateInterval)
+	if o.ControlFailureRate <= 0 {
+		o.ControlFailureRate = defaultOptions.ControlFailureRate
+	}
+	return o
+}
+
+// SetOptions sets the health check thresholds, replacing any set by
+// environment variables.
+func SetOptions(o Options) {
+	mu.Lock()
+	defer mu.Unlock()
+	opts = o.withDefaults()
+	if timer != nil {
+		timer.Reset(opts.SelfCheckInterval)
+	}
+	checkCertsLocked()
+	selfCheckLocked()
+}
+
+// CurrentOptions returns the health check thresholds in use, with
+// defaults filled in.
+func CurrentOptions() Options {
+	mu.Lock()
+	defer mu.Unlock()
+	return opts
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// livenessLockTimeout is how long LivenessError waits for the health
+// state's lock before considering tailscaled deadlocked.
+const livenessLockTimeout = 10 * time.Second
+
+// ReadinessError returns why tailscaled isn't ready to carry traffic:
+// it's not running, in a map poll and connected to its home DERP
+// region. It returns nil if it's ready.
+func ReadinessError() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if ipnState != ipn.Running {
+		return fmt.Errorf("state=%v", ipnState)
+	}
+	if !inMapPoll {
+		return errors.New("not in map poll")
+	}
+	if derpHomeRegion == 0 {
+		return errors.New("no DERP home")
+	}
+	if !derpRegionConnected[derpHomeRegion] {
+		return fmt.Errorf("not connected to home DERP region %v", derpHomeRegion)
+	}
+	return nil
+}
+
+// LivenessError returns why tailscaled should be restarted: it's
+// wedged (see WedgedError) or seemingly deadlocked. It returns nil if
+// it's alive.
+func LivenessError() error {
+	errc := make(chan error, 1)
+	go func() { errc <- WedgedError() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(livenessLockTimeout):
+		return fmt.Errorf("health state locked for over %v; deadlocked?", livenessLockTimeout)
+	}
+}
+
+// ServeReadiness is an HTTP handler for readiness probes, such as
+// Kubernetes's. It responds 200 if ReadinessError is nil, else 503.
+func ServeReadiness(w http.ResponseWriter, r *http.Request) {
+	serveProbe(w, ReadinessError())
+}
+
+// ServeLiveness is an HTTP handler for liveness probes, such as
+// Kubernetes's. It responds 200 if LivenessError is nil, else 503.
+func ServeLiveness(w http.ResponseWriter, r *http.Request) {
+	serveProbe(w, LivenessError())
+}
+
+func serveProbe(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
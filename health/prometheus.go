@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// WritePrometheus writes the health state to w as Prometheus gauges,
+// in the text exposition format:
+//
+//   - tailscaled_health_status: 0 healthy, 1 degraded or 2 broken
+//   - tailscaled_health_subsystem{name}: 1 if healthy, else 0
+//   - tailscaled_health_subsystem_severity{name}: 0 info, 1 warning or 2 error
+//   - tailscaled_health_derp_home_connected: 1 if connected to the home DERP region
+//   - tailscaled_health_derp_home_latency_seconds: average recent ping RTT, if known
+//   - tailscaled_health_seconds_since_last_map_response: or -1 if none yet
+//   - tailscaled_health_receive_func_missing{name}: 1 if not running
+func WritePrometheus(w io.Writer) {
+	st := CurrentState()
+	now := timeNow()
+
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	gauge("tailscaled_health_status", "Overall health: 0 healthy, 1 degraded, 2 broken.")
+	fmt.Fprintf(w, "tailscaled_health_status %d\n", st.Status)
+
+	gauge("tailscaled_health_subsystem", "Whether each subsystem is healthy.")
+	for _, ss := range st.Subsystems {
+		fmt.Fprintf(w, "tailscaled_health_subsystem{name=%q} %d\n", ss.Name, boolInt(ss.Error == ""))
+	}
+	gauge("tailscaled_health_subsystem_severity", "Severity of each subsystem's problems: 0 info, 1 warning, 2 error.")
+	for _, ss := range st.Subsystems {
+		fmt.Fprintf(w, "tailscaled_health_subsystem_severity{name=%q} %d\n", ss.Name, ss.Severity)
+	}
+
+	homeConnected := false
+	var homeLatency time.Duration
+	for _, r := range st.DERPRegions {
+		if r.RegionID == st.DERPHomeRegion {
+			homeConnected = r.Connected
+			homeLatency = r.Latency
+		}
+	}
+	gauge("tailscaled_health_derp_home_connected", "Whether connected to the home DERP region.")
+	fmt.Fprintf(w, "tailscaled_health_derp_home_connected %d\n", boolInt(homeConnected))
+	if homeLatency > 0 {
+		gauge("tailscaled_health_derp_home_latency_seconds", "Average recent ping round trip time to the home DERP region.")
+		fmt.Fprintf(w, "tailscaled_health_derp_home_latency_seconds %.3f\n", homeLatency.Seconds())
+	}
+
+	since := -1.0
+	if !st.LastStreamedMapResponse.IsZero() {
+		since = now.Sub(st.LastStreamedMapResponse).Seconds()
+	}
+	gauge("tailscaled_health_seconds_since_last_map_response", "Seconds since the last map response from control, or -1 if none.")
+	fmt.Fprintf(w, "tailscaled_health_seconds_since_last_map_response %.0f\n", since)
+
+	gauge("tailscaled_health_receive_func_missing", "Whether each wireguard-go receive func has stopped running.")
+	for _, rf := range st.ReceiveFuncs {
+		fmt.Fprintf(w, "tailscaled_health_receive_func_missing{name=%q} %d\n", rf.Name, boolInt(rf.Missing))
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
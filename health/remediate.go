@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import "time"
+
+// remediation is a self-repair action for a subsystem, from
+// RegisterRemediation.
+type remediation struct {
+	fix         func(error) error
+	lastAttempt time.Time // or zero if never attempted
+	running     bool      // whether fix is running
+}
+
+var (
+	// remediations are the registered self-repair actions, guarded
+	// by mu.
+	remediations = map[Subsystem]*remediation{}
+
+	// unhealthySince is when each unhealthy subsystem became so,
+	// guarded by mu.
+	unhealthySince = map[Subsystem]time.Time{}
+
+	// remediationDoneForTest, if non-nil, is called with mu held once
+	// a remediation's result has been recorded.
+	remediationDoneForTest func()
+)
+
+// RegisterRemediation registers fix as the self-repair action for sys,
+// replacing any already registered. Once sys has stayed unhealthy (other
+// than as a consequence of another subsystem's problem) for
+// Options.RemediateAfter, the periodic self-check calls fix with the
+// problem, at most once per Options.RemediateInterval. fix should set
+// sys's health itself if it repairs it. Attempts and their results are
+// recorded in the transition history.
+func RegisterRemediation(sys Subsystem, fix func(err error) error) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	r := &remediation{fix: fix}
+	remediations[sys] = r
+	startTimerLocked()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if remediations[sys] == r {
+			delete(remediations, sys)
+		}
+		stopTimerIfUnwatchedLocked()
+	}
+}
+
+// noteUnhealthySinceLocked records when sys transitioned to err.
+func noteUnhealthySinceLocked(sys Subsystem, err error) {
+	if err == nil {
+		delete(unhealthySince, sys)
+	} else if _, ok := unhealthySince[sys]; !ok {
+		unhealthySince[sys] = timeNow()
+	}
+}
+
+// remediateLocked starts the remediations that are due.
+func remediateLocked() {
+	now := timeNow()
+	for sys, r := range remediations {
+		err := sysErr[sys]
+		if err == nil || r.running || causeLocked(sys) != "" {
+			continue
+		}
+		if now.Sub(unhealthySince[sys]) < opts.RemediateAfter {
+			continue
+		}
+		if !r.lastAttempt.IsZero() && now.Sub(r.lastAttempt) < opts.RemediateInterval {
+			continue
+		}
+		r.lastAttempt = now
+		r.running = true
+		recordRemediationLocked(sys, err, "attempting", nil)
+		go runRemediation(sys, r, err)
+	}
+}
+
+func runRemediation(sys Subsystem, r *remediation, err error) {
+	fixErr := r.fix(err)
+	mu.Lock()
+	defer mu.Unlock()
+	r.running = false
+	if fixErr != nil {
+		recordRemediationLocked(sys, sysErr[sys], "failed", fixErr)
+	} else {
+		recordRemediationLocked(sys, sysErr[sys], "succeeded", nil)
+	}
+	if remediationDoneForTest != nil {
+		remediationDoneForTest()
+	}
+}
+
+// recordRemediationLocked records a remediation event of sys, whose
+// problem is err, in the transition history.
+func recordRemediationLocked(sys Subsystem, err error, event string, fixErr error) {
+	t := Transition{Time: timeNow(), Subsystem: sys, Severity: severityLocked(sys), Remediation: event}
+	if err != nil {
+		t.OldError = err.Error()
+		t.NewError = t.OldError
+	}
+	if fixErr != nil {
+		t.Remediation += ": " + fixErr.Error()
+	}
+	appendTransitionLocked(t)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import "context"
+
+// chanWatchers are the WatchChan subscribers, guarded by mu.
+var chanWatchers = map[*chanWatcher]bool{}
+
+type chanWatcher struct {
+	ch   chan Transition
+	want func(Subsystem) bool
+}
+
+// WatchOpts are the options for WatchChan.
+type WatchOpts struct {
+	// Subsystems, if non-empty, are the only subsystems to send
+	// transitions of.
+	Subsystems []Subsystem
+
+	// OverallOnly, if true, means to only send transitions of
+	// SysOverall. It overrides Subsystems.
+	OverallOnly bool
+
+	// BufferSize is the channel's capacity. The default is 16.
+	BufferSize int
+}
+
+// WatchChan returns a channel of health transitions, as are also passed
+// to RegisterSeverityWatcher callbacks, in the order they happen. Transitions are
+// dropped rather than block if the channel is full. The channel is
+// closed once ctx is done.
+func WatchChan(ctx context.Context, opts WatchOpts) <-chan Transition {
+	size := opts.BufferSize
+	if size <= 0 {
+		size = 16
+	}
+	cw := &chanWatcher{
+		ch:   make(chan Transition, size),
+		want: func(Subsystem) bool { return true },
+	}
+	switch {
+	case opts.OverallOnly:
+		cw.want = func(sys Subsystem) bool { return sys == SysOverall }
+	case len(opts.Subsystems) > 0:
+		set := map[Subsystem]bool{}
+		for _, sys := range opts.Subsystems {
+			set[sys] = true
+		}
+		cw.want = func(sys Subsystem) bool { return set[sys] }
+	}
+
+	mu.Lock()
+	chanWatchers[cw] = true
+	startTimerLocked()
+	mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		delete(chanWatchers, cw)
+		close(cw.ch) // with mu held, so no more sends
+		stopTimerIfUnwatchedLocked()
+	}()
+	return cw.ch
+}
+
+func sendToChanWatchersLocked(t Transition) {
+	for cw := range chanWatchers {
+		if !cw.want(t.Subsystem) {
+			continue
+		}
+		select {
+		case cw.ch <- t:
+		default:
+		}
+	}
+}
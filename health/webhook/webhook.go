@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package webhook posts tailscaled's health transitions to webhooks, so
+// operators of headless nodes can be alerted by the nodes themselves.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+)
+
+// SignatureHeader is the HTTP header with a payload's signature, of the
+// form "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">".
+const SignatureHeader = "Tailscale-Health-Signature"
+
+const (
+	defaultCoalesce = 5 * time.Second
+	maxAttempts     = 8
+	maxBackoff      = time.Minute
+	postTimeout     = 30 * time.Second
+)
+
+// Config is the configuration for Run.
+type Config struct {
+	// URLs are the webhooks to post payloads to.
+	URLs []string
+
+	// Secret, if non-empty, is the key payloads are signed with in
+	// the SignatureHeader.
+	Secret []byte
+
+	// Node, if non-empty, names the node in payloads.
+	Node string
+
+	// Coalesce is how long to wait after a transition for others to
+	// send along with it. The default is 5 seconds.
+	Coalesce time.Duration
+
+	// Logf is the logger. It must be non-nil.
+	Logf logger.Logf
+
+	// HTTPClient is the client to post with, or nil for
+	// http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Payload is the JSON body posted to webhooks.
+type Payload struct {
+	Node         string `json:",omitempty"`
+	Time         time.Time
+	Status       health.Status
+	OverallError string `json:",omitempty"`
+
+	// Transitions are those since the last payload, oldest first.
+	Transitions []health.Transition
+}
+
+// Run posts a Payload to each of cfg.URLs whenever subsystems' health
+// changes, until ctx is done. Failed posts are retried with backoff.
+func Run(ctx context.Context, cfg Config) {
+	if cfg.Coalesce <= 0 {
+		cfg.Coalesce = defaultCoalesce
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	var senders []chan []byte
+	for _, u := range cfg.URLs {
+		ch := make(chan []byte, 16)
+		senders = append(senders, ch)
+		go cfg.sendLoop(ctx, u, ch)
+	}
+
+	transitions := health.WatchChan(ctx, health.WatchOpts{BufferSize: 128})
+	for {
+		t, ok := <-transitions
+		if !ok {
+			return
+		}
+		batch := []health.Transition{t}
+		timer := time.NewTimer(cfg.Coalesce)
+	coalesce:
+		for {
+			select {
+			case t, ok := <-transitions:
+				if !ok {
+					timer.Stop()
+					return
+				}
+				batch = append(batch, t)
+			case <-timer.C:
+				break coalesce
+			}
+		}
+
+		body, err := json.Marshal(cfg.payload(batch))
+		if err != nil {
+			cfg.Logf("health webhook: %v", err)
+			continue
+		}
+		for i, ch := range senders {
+			select {
+			case ch <- body:
+			default:
+				cfg.Logf("health webhook: dropping payload for %s; too far behind", cfg.URLs[i])
+			}
+		}
+	}
+}
+
+func (cfg *Config) payload(batch []health.Transition) *Payload {
+	st := health.CurrentState()
+	return &Payload{
+		Node:         cfg.Node,
+		Time:         time.Now(),
+		Status:       st.Status,
+		OverallError: st.OverallError,
+		Transitions:  batch,
+	}
+}
+
+// sendLoop posts the bodies from ch to url until ctx is done.
+func (cfg *Config) sendLoop(ctx context.Context, url string, ch <-chan []byte) {
+	logf := logger.WithPrefix(cfg.Logf, "health webhook: ")
+	for {
+		var body []byte
+		select {
+		case <-ctx.Done():
+			return
+		case body = <-ch:
+		}
+		bo := backoff.NewBackoff("health-webhook", logf, maxBackoff)
+		for attempt := 1; ; attempt++ {
+			err := cfg.post(ctx, url, body)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			if attempt == maxAttempts {
+				logf("giving up on %s after %d attempts: %v", url, attempt, err)
+				break
+			}
+			bo.BackOff(ctx, err)
+		}
+	}
+}
+
+func (cfg *Config) post(ctx context.Context, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, postTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(cfg.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(cfg.Secret, time.Now(), body))
+	}
+	res, err := cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, res.Status)
+	}
+	return nil
+}
+
+// Sign returns the SignatureHeader value for body, sent at t and signed
+// with secret.
+func Sign(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/health"
+)
+
+var (
+	testA = health.NewWarnable("test-webhook-a", health.SeverityWarning)
+	testB = health.NewWarnable("test-webhook-b", health.SeverityWarning)
+)
+
+func TestRun(t *testing.T) {
+	secret := []byte("sekrit")
+	payloads := make(chan *Payload, 10)
+	failed := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sig := r.Header.Get(SignatureHeader)
+		ts, _, _ := strings.Cut(strings.TrimPrefix(sig, "t="), ",")
+		sec, _ := strconv.ParseInt(ts, 10, 64)
+		if want := Sign(secret, time.Unix(sec, 0), body); sig != want {
+			t.Errorf("signature = %q; want %q", sig, want)
+		}
+		if !failed {
+			// Fail the first attempt, to test retries.
+			failed = true
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		p := new(Payload)
+		if err := json.Unmarshal(body, p); err != nil {
+			t.Error(err)
+		}
+		payloads <- p
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, Config{
+		URLs:     []string{ts.URL},
+		Secret:   secret,
+		Node:     "test-node",
+		Coalesce: 100 * time.Millisecond,
+		Logf:     t.Logf,
+	})
+	time.Sleep(10 * time.Millisecond) // for Run to start watching
+
+	testA.Set(errors.New("a broke"))
+	testB.Set(errors.New("b broke"))
+	defer testA.Set(nil)
+	defer testB.Set(nil)
+
+	select {
+	case p := <-payloads:
+		if p.Node != "test-node" {
+			t.Errorf("Node = %q; want test-node", p.Node)
+		}
+		var got []string
+		for _, tr := range p.Transitions {
+			got = append(got, string(tr.Subsystem)+": "+tr.NewError)
+		}
+		if want := "test-webhook-a: a broke,test-webhook-b: b broke"; strings.Join(got, ",") != want {
+			t.Errorf("transitions = %q; want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for payload")
+	}
+}
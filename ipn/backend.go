@@ -6,6 +6,7 @@
 
 import (
 	"fmt"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -85,15 +86,42 @@ type Notify struct {
 	// of being transferred.
 	IncomingFiles []PartialFile `json:",omitempty"`
 
+	// FileReceived, if non-nil, is a file that has just finished
+	// being received.
+	FileReceived *ReceivedFile `json:",omitempty"`
+
 	// LocalTCPPort, if non-nil, informs the UI frontend which
 	// (non-zero) localhost TCP port it's listening on.
 	// This is currently only used by Tailscale when run in the
 	// macOS Network Extension.
 	LocalTCPPort *uint16 `json:",omitempty"`
 
+	// Health, if non-nil, is a change in the health of one of the
+	// backend's subsystems, sent as it happens so UIs needn't poll
+	// the status to notice transient problems.
+	Health *HealthChange `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
+// HealthChange is a change in the health of a backend subsystem, as sent
+// in a Notify. It mirrors the health package's SubsystemState, which can't
+// be used here as that package depends on this one.
+type HealthChange struct {
+	Subsystem string // a health.Subsystem, with "overall" summarizing the rest
+	Severity  string `json:",omitempty"` // "info", "warning" or "error"; empty if healthy
+	Error     string `json:",omitempty"` // empty if healthy
+	HintText  string `json:",omitempty"` // how to fix Error, if known
+	HintURL   string `json:",omitempty"` // where to read more about fixing Error, if anywhere
+}
+
+func (h *HealthChange) String() string {
+	if h.Error == "" {
+		return h.Subsystem + ":ok"
+	}
+	return fmt.Sprintf("%s:%s", h.Subsystem, h.Severity)
+}
+
 func (n Notify) String() string {
 	var sb strings.Builder
 	sb.WriteString("Notify{")
@@ -127,9 +155,15 @@ func (n Notify) String() string {
 	if len(n.IncomingFiles) != 0 {
 		sb.WriteString("IncomingFiles ")
 	}
+	if n.FileReceived != nil {
+		sb.WriteString("FileReceived ")
+	}
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if n.Health != nil {
+		fmt.Fprintf(&sb, "health=%v ", n.Health)
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
@@ -152,6 +186,19 @@ type PartialFile struct {
 	Done bool `json:",omitempty"`
 }
 
+// ReceivedFile is a file that has finished being received, and who
+// sent it.
+type ReceivedFile struct {
+	Name     string    // e.g. "foo.jpg"
+	Path     string    // where it was written, possibly with a ".partial" suffix in "direct" file mode
+	Size     int64     // in bytes
+	Received time.Time // when the transfer finished
+
+	SenderNode      string     // the sending node's name, e.g. "laptop"
+	SenderLoginName string     // the sending node's user, e.g. "foo@example.com"
+	SenderIP        netip.Addr // the sending node's Tailscale IP
+}
+
 // StateKey is an opaque identifier for a set of LocalBackend state
 // (preferences, private keys, etc.).
 //
@@ -24,6 +24,16 @@ func (src *Prefs) Clone() *Prefs {
 	*dst = *src
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	if dst.ControlBackoff != nil {
+		dst.ControlBackoff = new(ControlBackoffPrefs)
+		*dst.ControlBackoff = *src.ControlBackoff
+	}
+	if dst.ClientMetrics != nil {
+		dst.ClientMetrics = new(ClientMetricsPrefs)
+		*dst.ClientMetrics = *src.ClientMetrics
+	}
+	dst.ControlPins = append(src.ControlPins[:0:0], src.ControlPins...)
+	dst.ControlHealthAcks = append(src.ControlHealthAcks[:0:0], src.ControlHealthAcks...)
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
 		*dst.Persist = *src.Persist
@@ -52,5 +62,11 @@ func (src *Prefs) Clone() *Prefs {
 	NoSNAT                 bool
 	NetfilterMode          preftype.NetfilterMode
 	OperatorUser           string
+	ControlBackoff         *ControlBackoffPrefs
+	LocalOnlyLogs          bool
+	ClientMetrics          *ClientMetricsPrefs
+	ProxyURL               string
+	ControlPins            []string
+	ControlHealthAcks      []ControlHealthAck
 	Persist                *persist.Persist
 }{})
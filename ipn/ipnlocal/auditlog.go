@@ -0,0 +1,255 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+)
+
+const (
+	// auditLogMaxSize is the size at which the audit log file is
+	// rotated. At most two files are kept, so the audit log uses at
+	// most about twice this much disk.
+	auditLogMaxSize = 1 << 20
+
+	// auditLogMaxMem is the number of entries kept in memory when
+	// there's no state directory to write the audit log to.
+	auditLogMaxMem = 1000
+)
+
+// auditLog is a local, append-only, size-bounded log of changes to
+// prefs and to control-provided policy, stored as JSON lines (one
+// ipnstate.AuditLogEntry each) in the state directory. It's safe for
+// concurrent use.
+type auditLog struct {
+	logf logger.Logf
+	path string // or empty to only keep entries in memory
+
+	mu   sync.Mutex
+	f    *os.File // or nil if not yet opened
+	size int64
+	mem  []ipnstate.AuditLogEntry // only used if path is empty
+}
+
+func newAuditLog(logf logger.Logf, varRoot string) *auditLog {
+	al := &auditLog{logf: logf}
+	if varRoot != "" {
+		al.path = filepath.Join(varRoot, "audit.log")
+	}
+	return al
+}
+
+// add appends e to the log, setting its Time if zero.
+func (al *auditLog) add(e ipnstate.AuditLogEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.path == "" {
+		if len(al.mem) >= auditLogMaxMem {
+			al.mem = append(al.mem[:0], al.mem[len(al.mem)-auditLogMaxMem+1:]...)
+		}
+		al.mem = append(al.mem, e)
+		return
+	}
+	if err := al.writeLocked(e); err != nil {
+		al.logf("auditlog: %v", err)
+	}
+}
+
+func (al *auditLog) writeLocked(e ipnstate.AuditLogEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if al.f != nil && al.size+int64(len(line)) > auditLogMaxSize {
+		al.f.Close()
+		al.f = nil
+		if err := os.Rename(al.path, al.path+".1"); err != nil {
+			return fmt.Errorf("rotating: %w", err)
+		}
+	}
+	if al.f == nil {
+		f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		al.f, al.size = f, fi.Size()
+	}
+	n, err := al.f.Write(line)
+	al.size += int64(n)
+	return err
+}
+
+// entries returns the logged entries at or after since, oldest first.
+// If limit is positive, only the most recent limit entries are returned.
+func (al *auditLog) entries(since time.Time, limit int) ([]ipnstate.AuditLogEntry, error) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	var all []ipnstate.AuditLogEntry
+	if al.path == "" {
+		all = append(all, al.mem...)
+	} else {
+		for _, name := range []string{al.path + ".1", al.path} {
+			var err error
+			all, err = appendAuditLogFile(all, name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	ret := all[:0]
+	for _, e := range all {
+		if !e.Time.Before(since) {
+			ret = append(ret, e)
+		}
+	}
+	if limit > 0 && len(ret) > limit {
+		ret = ret[len(ret)-limit:]
+	}
+	return ret, nil
+}
+
+func appendAuditLogFile(dst []ipnstate.AuditLogEntry, name string) ([]ipnstate.AuditLogEntry, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return dst, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	bs.Buffer(nil, auditLogMaxSize)
+	for bs.Scan() {
+		var e ipnstate.AuditLogEntry
+		if err := json.Unmarshal(bs.Bytes(), &e); err != nil {
+			// Likely a partial write; skip it.
+			continue
+		}
+		dst = append(dst, e)
+	}
+	return dst, bs.Err()
+}
+
+// prefsChangeString returns a human-readable description of the
+// differences between oldp and newp, or the empty string if there are
+// none. Persist is not included.
+func prefsChangeString(oldp, newp *ipn.Prefs) string {
+	if oldp == nil {
+		oldp = new(ipn.Prefs)
+	}
+	var sb strings.Builder
+	ov, nv := reflect.ValueOf(oldp).Elem(), reflect.ValueOf(newp).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == "Persist" {
+			continue
+		}
+		of, nf := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(of, nf) {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(", ")
+		}
+		if name == "ProxyURL" {
+			// May contain credentials.
+			fmt.Fprintf(&sb, "%s: %s => %s", name, ipn.RedactProxyURL(oldp.ProxyURL), ipn.RedactProxyURL(newp.ProxyURL))
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s => %s", name, auditValueString(ov.Field(i)), auditValueString(nv.Field(i)))
+	}
+	return sb.String()
+}
+
+func auditValueString(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "<nil>"
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// netmapAuditEntries returns the audit log entries for the policy
+// changes from old to nm described by diff.
+func netmapAuditEntries(old, nm *netmap.NetworkMap, diff *netmap.Diff) []ipnstate.AuditLogEntry {
+	var ret []ipnstate.AuditLogEntry
+	add := func(kind, change string) {
+		ret = append(ret, ipnstate.AuditLogEntry{
+			Kind:   kind,
+			Source: "control",
+			Change: change,
+		})
+	}
+	if diff.PacketFilterChanged {
+		add("packet-filter", fmt.Sprintf("%d filter rules", len(nm.PacketFilter)))
+	}
+	if diff.SSHPolicyChanged {
+		if nm.SSHPolicy == nil {
+			add("ssh-policy", "removed")
+		} else {
+			add("ssh-policy", fmt.Sprintf("%d SSH rules", len(nm.SSHPolicy.Rules)))
+		}
+	}
+	if diff.DNSChanged {
+		add("dns", fmt.Sprintf("%d resolvers, %d search domains, %d routes, proxied=%v",
+			len(nm.DNS.Resolvers), len(nm.DNS.Domains), len(nm.DNS.Routes), nm.DNS.Proxied))
+	}
+	if old == nil || diff.Full {
+		return ret
+	}
+
+	// Subnet routes and exit nodes, as reflected in peers' AllowedIPs.
+	var routes []string
+	routeChange := func(n *tailcfg.Node, before, after string) {
+		routes = append(routes, fmt.Sprintf("%s: %s => %s", n.Name, before, after))
+	}
+	for _, id := range diff.PeersAdded {
+		if n, ok := peerByID(nm, id); ok && len(n.AllowedIPs) > len(n.Addresses) {
+			routeChange(n, "[]", fmt.Sprint(n.AllowedIPs))
+		}
+	}
+	for _, id := range diff.PeersRemoved {
+		if n, ok := peerByID(old, id); ok && len(n.AllowedIPs) > len(n.Addresses) {
+			routeChange(n, fmt.Sprint(n.AllowedIPs), "[]")
+		}
+	}
+	for _, id := range diff.PeersChanged {
+		on, ok1 := peerByID(old, id)
+		nn, ok2 := peerByID(nm, id)
+		if ok1 && ok2 && !reflect.DeepEqual(on.AllowedIPs, nn.AllowedIPs) {
+			routeChange(nn, fmt.Sprint(on.AllowedIPs), fmt.Sprint(nn.AllowedIPs))
+		}
+	}
+	if len(routes) > 0 {
+		add("routes", strings.Join(routes, "; "))
+	}
+	return ret
+}
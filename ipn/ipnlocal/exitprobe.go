@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+)
+
+// The exit node prober checks that the exit node in use still forwards
+// traffic, which a WireGuard session that looks alive doesn't show. It
+// asks the exit node to resolve a name over its peerapi DoH service,
+// which the exit node does via its own internet connection.
+
+const (
+	// exitNodeProbeInterval is how often the exit node is probed.
+	exitNodeProbeInterval = time.Minute
+
+	// exitNodeProbeTimeout is how long a probe can take.
+	exitNodeProbeTimeout = 10 * time.Second
+
+	// exitNodeProbeFailures is how many consecutive probes must fail
+	// before the exit node is unhealthy.
+	exitNodeProbeFailures = 2
+
+	// exitNodeProbeName is the name the exit node is asked to resolve.
+	exitNodeProbeName = "controlplane.tailscale.com"
+)
+
+var disableExitNodeProbe = envknob.Bool("TS_DEBUG_DISABLE_EXIT_NODE_PROBE")
+
+// probeExitNode probes the exit node in use, if any, every
+// exitNodeProbeInterval, reporting the result to the health package,
+// until b is shut down.
+func (b *LocalBackend) probeExitNode() {
+	if disableExitNodeProbe {
+		return
+	}
+	t := time.NewTicker(exitNodeProbeInterval)
+	defer t.Stop()
+	failures := 0
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+		dohURL, name, ok := b.exitNodeProbeTarget()
+		if !ok {
+			failures = 0
+			health.SetExitNodeHealth(nil)
+			continue
+		}
+		err := b.probeExitNodeDNS(dohURL)
+		if err == nil {
+			failures = 0
+			health.SetExitNodeHealth(nil)
+			continue
+		}
+		failures++
+		b.logf("exit node probe of %s failed (%d/%d): %v", name, failures, exitNodeProbeFailures, err)
+		if failures >= exitNodeProbeFailures {
+			health.SetExitNodeHealth(fmt.Errorf("exit node %s isn't forwarding traffic: %w", name, err))
+		}
+	}
+}
+
+// exitNodeProbeTarget returns the DoH URL and name of the exit node to
+// probe, or ok=false if none is in use, or if it can't be probed.
+func (b *LocalBackend) exitNodeProbeTarget() (dohURL, name string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != ipn.Running || b.netMap == nil || b.prefs == nil {
+		return "", "", false
+	}
+	dohURL, ok = exitNodeCanProxyDNS(b.netMap, b.prefs.ExitNodeID)
+	if !ok {
+		return "", "", false
+	}
+	name = string(b.prefs.ExitNodeID)
+	if p, ok := b.netMap.PeerWithStableID(b.prefs.ExitNodeID); ok && p.ComputedName != "" {
+		name = p.ComputedName
+	}
+	return dohURL, name, true
+}
+
+// probeExitNodeDNS asks the exit node's DoH service at dohURL to resolve
+// exitNodeProbeName.
+func (b *LocalBackend) probeExitNodeDNS(dohURL string) error {
+	ctx, cancel := context.WithTimeout(b.ctx, exitNodeProbeTimeout)
+	defer cancel()
+	q := url.Values{"q": {exitNodeProbeName}, "t": {"A"}}
+	req, err := http.NewRequestWithContext(ctx, "GET", dohURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := b.dialer.PeerAPIHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS query: %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"time"
+
+	"golang.org/x/exp/slices"
+	"tailscale.com/envknob"
+	"tailscale.com/health"
+)
+
+// reportHealthToControl is whether the node opts in to including a
+// summary of its health problems in its Hostinfo (as Hostinfo.Health),
+// for the admin console to show.
+var reportHealthToControl = envknob.Bool("TS_REPORT_HEALTH_TO_CONTROL")
+
+const (
+	// hostinfoHealthCoalesce is how long after a health change the
+	// Hostinfo health summary is updated, so that several changes at
+	// once (such as when the network goes down) cause one update.
+	hostinfoHealthCoalesce = 10 * time.Second
+
+	// hostinfoHealthMinInterval is the minimum time between updates of
+	// the Hostinfo health summary, so that flapping doesn't cause map
+	// churn.
+	hostinfoHealthMinInterval = time.Minute
+)
+
+// scheduleHostinfoHealthLocked schedules an update of the Hostinfo health
+// summary, if one isn't already scheduled. b.mu must be held.
+func (b *LocalBackend) scheduleHostinfoHealthLocked() {
+	if b.hostinfoHealthTimer != nil || b.shutdownCalled {
+		return
+	}
+	delay := hostinfoHealthCoalesce
+	if d := time.Until(b.hostinfoHealthAt.Add(hostinfoHealthMinInterval)); d > delay {
+		delay = d
+	}
+	b.hostinfoHealthTimer = time.AfterFunc(delay, b.updateHostinfoHealth)
+}
+
+// updateHostinfoHealth sets the Hostinfo health summary to the current
+// one, sending it to control if it changed.
+func (b *LocalBackend) updateHostinfoHealth() {
+	sum := health.Summary()
+	b.mu.Lock()
+	b.hostinfoHealthTimer = nil
+	if b.hostinfo == nil || slices.Equal(b.hostinfo.Health, sum) {
+		b.mu.Unlock()
+		return
+	}
+	b.hostinfoHealthAt = time.Now()
+	b.hostinfo.Health = sum
+	hi := b.hostinfo.Clone()
+	b.mu.Unlock()
+	b.doSetHostinfoFilterServices(hi)
+}
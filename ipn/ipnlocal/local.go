@@ -12,7 +12,9 @@
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
@@ -33,11 +35,15 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
+	"tailscale.com/logpolicy"
+	"tailscale.com/logtail"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
 	"tailscale.com/syncs"
@@ -50,12 +56,15 @@
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/types/views"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/deephash"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/multierr"
 	"tailscale.com/util/osshare"
 	"tailscale.com/util/systemd"
+	"tailscale.com/util/winutil"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
@@ -87,6 +96,10 @@ type SSHServer interface {
 
 	// Shutdown is called when tailscaled is shutting down.
 	Shutdown()
+
+	// Recordings returns the sessions recorded to local disk,
+	// newest first.
+	Recordings() ([]apitype.SSHRecording, error)
 }
 
 type newSSHServerFunc func(logger.Logf, *LocalBackend) (SSHServer, error)
@@ -121,6 +134,7 @@ type LocalBackend struct {
 	backendLogID          string
 	unregisterLinkMon     func()
 	unregisterHealthWatch func()
+	unregisterTKAProbe    func()           // or nil if there's no key authority
 	portpoll              *portlist.Poller // may be nil
 	portpollOnce          sync.Once        // guards starting readPoller
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
@@ -149,14 +163,24 @@ type LocalBackend struct {
 	machinePrivKey key.MachinePrivate
 	nlPrivKey      key.NLPrivate
 	tka            *tka.Authority
+	tkaInformErr   error                      // from the last TKAInform, if it failed
+	tkaNodeKeySig  tkatype.MarshaledSignature // this node's key signature, or nil
+	tkaSigner      tka.Signer                 // re-signs tkaNodeKeySig, or nil to use nlPrivKey
+	tkaResignErr   error                      // from the last re-signing, if it failed
+	tkaResigning   bool                       // whether resignTKANodeKeyLoop is running
 	state          ipn.State
 	capFileSharing bool // whether netMap contains the file sharing capability
 	// hostinfo is mutated in-place while mu is held.
 	hostinfo *tailcfg.Hostinfo
+	// hostinfoHealthTimer, if non-nil, is the pending update of
+	// hostinfo.Health, last updated at hostinfoHealthAt.
+	hostinfoHealthTimer *time.Timer
+	hostinfoHealthAt    time.Time
 	// netMap is not mutated in-place once set.
 	netMap           *netmap.NetworkMap
 	nodeByAddr       map[netip.Addr]*tailcfg.Node
-	activeLogin      string // last logged LoginName from netMap
+	audit            *auditLog // or nil until first used; see auditLogLocked
+	activeLogin      string    // last logged LoginName from netMap
 	engineStatus     ipn.EngineStatus
 	endpoints        []tailcfg.Endpoint
 	blocked          bool
@@ -170,6 +194,7 @@ type LocalBackend struct {
 	loginFlags       controlclient.LoginFlags
 	incomingFiles    map[*incomingFile]bool
 	lastStatusTime   time.Time // status.AsOf value of the last processed status update
+	proxyURL         string    // last proxy URL passed to tshttpproxy.SetProxy; empty means none
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
 	// intermediate buffered directory for "pick-up" later. If
@@ -185,6 +210,17 @@ type LocalBackend struct {
 	directFileRoot          string
 	directFileDoFinalRename bool // false on macOS, true on several NAS platforms
 
+	// fileReceivedHook is the command to run for each received
+	// file, or empty; see SetFileReceivedHook.
+	fileReceivedHook string
+
+	// notifyMu guards notifySubs and lastNotification, which are
+	// separate from mu so that notifications can be published with
+	// or without mu held.
+	notifyMu         sync.Mutex
+	notifySubs       map[chan apitype.Notification]bool
+	lastNotification map[string]apitype.Notification // by ID
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -222,7 +258,7 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 	b := &LocalBackend{
 		ctx:            ctx,
 		ctxCancel:      cancel,
-		logf:           logf,
+		logf:           logger.ComponentLogf(logf, "ipnlocal"),
 		keyLogf:        logger.LogOnChange(logf, 5*time.Minute, time.Now),
 		statsLogf:      logger.LogOnChange(logf, 5*time.Minute, time.Now),
 		e:              e,
@@ -248,7 +284,12 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 	b.linkChange(false, linkMon.InterfaceState())
 	b.unregisterLinkMon = linkMon.RegisterChangeCallback(b.linkChange)
 
-	b.unregisterHealthWatch = health.RegisterWatcher(b.onHealthChange)
+	b.unregisterHealthWatch = health.RegisterSeverityWatcher(b.onHealthChange)
+
+	if wc, ok := store.(ipn.WritabilityChecker); ok {
+		go b.checkStoreWritable(wc)
+	}
+	go b.probeExitNode()
 
 	wiredPeerAPIPort := false
 	if ig, ok := e.(wgengine.InternalsGetter); ok {
@@ -264,6 +305,32 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 	return b, nil
 }
 
+// storeCheckInterval is how often checkStoreWritable checks the state
+// store.
+const storeCheckInterval = 5 * time.Minute
+
+// checkStoreWritable checks that the state store can persist state now
+// and every storeCheckInterval, reporting the result to the health
+// package, until b is shut down.
+func (b *LocalBackend) checkStoreWritable(wc ipn.WritabilityChecker) {
+	t := time.NewTicker(storeCheckInterval)
+	defer t.Stop()
+	var lastErr error
+	for {
+		err := wc.CheckWritable()
+		if err != nil && (lastErr == nil || err.Error() != lastErr.Error()) {
+			b.logf("state store not writable: %v", err)
+		}
+		lastErr = err
+		health.SetStateStoreHealth(err)
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
 // Dialer returns the backend's dialer.
 func (b *LocalBackend) Dialer() *tsdial.Dialer {
 	return b.dialer
@@ -291,6 +358,17 @@ func (b *LocalBackend) SetDirectFileDoFinalRename(v bool) {
 	b.directFileDoFinalRename = v
 }
 
+// SetFileReceivedHook sets the path of a command to run, as
+// tailscaled's own user, each time a file finishes being received.
+// It's run with the received file's path as its argument, and with
+// details of the file and its sender in the TS_FILE_* and TS_SENDER_*
+// environment variables. The empty string means none.
+func (b *LocalBackend) SetFileReceivedHook(cmd string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fileReceivedHook = cmd
+}
+
 // b.mu must be held.
 func (b *LocalBackend) maybePauseControlClientLocked() {
 	if b.cc == nil {
@@ -300,6 +378,76 @@ func (b *LocalBackend) maybePauseControlClientLocked() {
 	b.cc.SetPaused((b.state == ipn.Stopped && b.netMap != nil) || !networkUp)
 }
 
+// noPolicy is the default value passed to winutil.GetPolicyInteger to
+// distinguish an unset policy from one explicitly set to zero.
+const noPolicy = ^uint64(0)
+
+// controlBackoffPolicy returns the control client backoff policy to use
+// for prefs. Values set by system policy take precedence over prefs.
+func controlBackoffPolicy(prefs *ipn.Prefs) controlclient.BackoffPolicy {
+	var bp ipn.ControlBackoffPrefs
+	if prefs != nil && prefs.ControlBackoff != nil {
+		bp = *prefs.ControlBackoff
+	}
+	if v := winutil.GetPolicyInteger("ControlMaxBackoffSeconds", noPolicy); v != noPolicy {
+		bp.MaxIntervalSeconds = int(v)
+	}
+	if v := winutil.GetPolicyInteger("ControlBackoffJitterPercent", noPolicy); v != noPolicy {
+		if v == 0 {
+			bp.JitterPercent = -1
+		} else {
+			bp.JitterPercent = int(v)
+		}
+	}
+	if v := winutil.GetPolicyInteger("ControlWakeDelaySeconds", noPolicy); v != noPolicy {
+		bp.WakeDelaySeconds = int(v)
+	}
+
+	var p controlclient.BackoffPolicy
+	p.MaxInterval = time.Duration(bp.MaxIntervalSeconds) * time.Second
+	switch {
+	case bp.JitterPercent < 0:
+		p.Jitter = -1
+	case bp.JitterPercent > 0:
+		p.Jitter = float64(bp.JitterPercent) / 100
+	}
+	p.WakeDelay = time.Duration(bp.WakeDelaySeconds) * time.Second
+	return p
+}
+
+// clientMetricsEncodeInterval returns the interval to pass to
+// clientmetric.SetEncodeInterval for prefs. Values set by system
+// policy take precedence over prefs.
+func clientMetricsEncodeInterval(prefs *ipn.Prefs) time.Duration {
+	var mp ipn.ClientMetricsPrefs
+	if prefs != nil && prefs.ClientMetrics != nil {
+		mp = *prefs.ClientMetrics
+	}
+	if v := winutil.GetPolicyInteger("ClientMetricsUploadIntervalSeconds", noPolicy); v != noPolicy {
+		mp.UploadIntervalSeconds = int(v)
+	}
+	if winutil.GetPolicyInteger("NoClientMetricsUpload", 0) == 1 {
+		mp.NoUpload = true
+	}
+	if mp.NoUpload {
+		return -1
+	}
+	return time.Duration(mp.UploadIntervalSeconds) * time.Second
+}
+
+// proxyURL returns the proxy URL to use for control and DERP
+// connections for prefs, or the empty string to use the environment's.
+// A value set by system policy takes precedence over prefs.
+func proxyURL(prefs *ipn.Prefs) string {
+	if v := winutil.GetPolicyString("ProxyURL", ""); v != "" {
+		return v
+	}
+	if prefs == nil {
+		return ""
+	}
+	return prefs.ProxyURL
+}
+
 // linkChange is our link monitor callback, called whenever the network changes.
 // major is whether ifst is different than earlier.
 func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
@@ -335,11 +483,20 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 	}
 }
 
-func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
+func (b *LocalBackend) onHealthChange(sys health.Subsystem, sev health.Severity, err error) {
 	if err == nil {
 		b.logf("health(%q): ok", sys)
 	} else {
-		b.logf("health(%q): error: %v", sys, err)
+		b.logf("health(%q): %v: %v", sys, sev, err)
+	}
+	b.send(ipn.Notify{Health: healthChange(sys, sev, err)})
+	if sys != health.SysOverall { // overall just summarizes the others
+		b.publishNotification(healthNotification(sys, sev, err))
+	}
+	if reportHealthToControl {
+		b.mu.Lock()
+		b.scheduleHostinfoHealthLocked()
+		b.mu.Unlock()
 	}
 }
 
@@ -352,6 +509,9 @@ func (b *LocalBackend) Shutdown() {
 		return
 	}
 	b.shutdownCalled = true
+	if b.hostinfoHealthTimer != nil {
+		b.hostinfoHealthTimer.Stop()
+	}
 
 	if b.loginFlags&controlclient.LoginEphemeral != 0 {
 		b.mu.Unlock()
@@ -370,6 +530,9 @@ func (b *LocalBackend) Shutdown() {
 
 	b.unregisterLinkMon()
 	b.unregisterHealthWatch()
+	if b.unregisterTKAProbe != nil {
+		b.unregisterTKAProbe()
+	}
 	if cc != nil {
 		cc.Shutdown()
 	}
@@ -635,6 +798,12 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	}
 	b.mu.Unlock()
 
+	if st.NetMap != nil {
+		if n, ok := keyExpiryNotification(st.NetMap.Expiry, time.Now()); ok {
+			b.publishNotification(n)
+		}
+	}
+
 	if keyExpiryExtended && wasBlocked {
 		// Key extended, unblock the engine
 		b.blockEngineUpdates(false)
@@ -656,14 +825,16 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		// Since we're logged out now, our netmap cache is invalid.
 		// Since st.NetMap==nil means "netmap is unchanged", there is
 		// no other way to represent this change.
-		b.setNetMapLocked(nil)
+		b.setNetMapLocked(nil, nil)
 		b.e.SetNetworkMap(new(netmap.NetworkMap))
 	}
 
 	prefs := b.prefs
+	oldPrefs := prefs.Clone()
 	stateKey := b.stateKey
 	netMap := b.netMap
 	interact := b.interact
+	audit := b.auditLogLocked()
 
 	if prefs.ControlURL == "" {
 		// Once we get a message from the control plane, set
@@ -680,11 +851,13 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			b.prefs.Persist = st.Persist.Clone()
 		}
 	}
+	var nmDiff *netmap.Diff
 	if st.NetMap != nil {
+		nmDiff = st.NetMap.DiffFrom(netMap)
 		if b.findExitNodeIDLocked(st.NetMap) {
 			prefsChanged = true
 		}
-		b.setNetMapLocked(st.NetMap)
+		b.setNetMapLocked(st.NetMap, nmDiff)
 	}
 	if st.URL != "" {
 		b.authURL = st.URL
@@ -710,7 +883,19 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	b.mu.Unlock()
 
 	// Now complete the lock-free parts of what we started while locked.
+	if nmDiff != nil {
+		for _, e := range netmapAuditEntries(netMap, st.NetMap, nmDiff) {
+			audit.add(e)
+		}
+	}
 	if prefsChanged {
+		if change := prefsChangeString(oldPrefs, prefs); change != "" {
+			audit.add(ipnstate.AuditLogEntry{
+				Kind:   "prefs",
+				Source: "control",
+				Change: change,
+			})
+		}
 		if stateKey != "" {
 			if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
 				b.logf("Failed to save new controlclient state: %v", err)
@@ -720,7 +905,10 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	}
 	if st.NetMap != nil {
 		if netMap != nil {
-			diff := st.NetMap.ConciseDiffFrom(netMap)
+			var diff string
+			if nmDiff.SelfChanged || nmDiff.PeersModified() {
+				diff = st.NetMap.ConciseDiffFrom(netMap)
+			}
 			if strings.TrimSpace(diff) == "" {
 				b.logf("[v1] netmap diff: (none)")
 			} else {
@@ -729,7 +917,9 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		}
 
 		b.e.SetNetworkMap(st.NetMap)
-		b.e.SetDERPMap(st.NetMap.DERPMap)
+		if nmDiff.DERPMapChanged {
+			b.e.SetDERPMap(st.NetMap.DERPMap)
+		}
 
 		b.send(ipn.Notify{NetMap: st.NetMap})
 	}
@@ -972,6 +1162,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 	if b.hostinfo != nil {
 		hostinfo.Services = b.hostinfo.Services // keep any previous services
+		hostinfo.Health = b.hostinfo.Health
 	}
 	b.hostinfo = hostinfo
 	b.state = ipn.NoState
@@ -984,6 +1175,18 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	if opts.UpdatePrefs != nil {
 		newPrefs := opts.UpdatePrefs
 		newPrefs.Persist = b.prefs.Persist
+		if change := prefsChangeString(b.prefs, newPrefs); change != "" {
+			var actor string
+			if b.userID != "" {
+				actor = "user-id " + b.userID
+			}
+			b.auditLogLocked().add(ipnstate.AuditLogEntry{
+				Kind:   "prefs",
+				Source: "Start",
+				Actor:  actor,
+				Change: change,
+			})
+		}
 		b.prefs = newPrefs
 
 		if opts.StateKey != "" {
@@ -992,6 +1195,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 			}
 		}
 		b.setAtomicValuesFromPrefs(b.prefs)
+		b.applyPrefsSideEffectsLocked(b.prefs)
 	}
 
 	wantRunning := b.prefs.WantRunning
@@ -1013,8 +1217,9 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	}
 	b.applyPrefsToHostinfo(hostinfo, b.prefs)
 
-	b.setNetMapLocked(nil)
+	b.setNetMapLocked(nil, nil)
 	persistv := b.prefs.Persist
+	backoffPolicy := controlBackoffPolicy(b.prefs)
 	b.updateFilterLocked(nil, nil)
 	b.mu.Unlock()
 
@@ -1075,6 +1280,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		PopBrowserURL:        b.tellClientToBrowseToURL,
 		Dialer:               b.Dialer(),
 		Status:               b.setClientStatus,
+		Backoff:              backoffPolicy,
 
 		// Don't warn about broken Linux IP forwarding when
 		// netstack is being used.
@@ -1088,11 +1294,15 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.cc = cc
 	b.ccAuto, _ = cc.(*controlclient.Auto)
 	endpoints := b.endpoints
+	nodeKeySig := b.tkaNodeKeySig
 	b.mu.Unlock()
 
 	if endpoints != nil {
 		cc.UpdateEndpoints(endpoints)
 	}
+	if nodeKeySig != nil {
+		cc.SetNodeKeySignature(nodeKeySig)
+	}
 
 	b.e.SetNetInfoCallback(b.setNetInfo)
 
@@ -1477,6 +1687,42 @@ func (b *LocalBackend) sendFileNotify() {
 	b.send(n)
 }
 
+// fileReceived notifies frontends that rf has finished being received,
+// and runs the hook from SetFileReceivedHook, if any.
+func (b *LocalBackend) fileReceived(rf ipn.ReceivedFile) {
+	b.mu.Lock()
+	hook := b.fileReceivedHook
+	b.mu.Unlock()
+
+	b.send(ipn.Notify{FileReceived: &rf})
+	b.publishNotification(fileReceivedNotification(rf))
+	if hook != "" {
+		go b.runFileReceivedHook(hook, rf)
+	}
+}
+
+// fileReceivedHookTimeout is how long the command from
+// SetFileReceivedHook may run for each file.
+const fileReceivedHookTimeout = 10 * time.Minute
+
+func (b *LocalBackend) runFileReceivedHook(hook string, rf ipn.ReceivedFile) {
+	ctx, cancel := context.WithTimeout(context.Background(), fileReceivedHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook, rf.Path)
+	cmd.Env = append(os.Environ(),
+		"TS_FILE_NAME="+rf.Name,
+		"TS_FILE_PATH="+rf.Path,
+		"TS_FILE_SIZE="+strconv.FormatInt(rf.Size, 10),
+		"TS_SENDER_NODE="+rf.SenderNode,
+		"TS_SENDER_LOGIN_NAME="+rf.SenderLoginName,
+		"TS_SENDER_IP="+rf.SenderIP.String(),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		// Don't log the output, as it may well contain the file name.
+		b.logf("file received hook failed: %v (%d bytes of output)", err, len(out))
+	}
+}
+
 // popBrowserAuthNow shuts down the data plane and sends an auth URL
 // to the connected frontend, if any.
 func (b *LocalBackend) popBrowserAuthNow() {
@@ -1738,6 +1984,7 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs) (err
 	b.logf("using backend prefs for %q: %s", key, b.prefs.Pretty())
 
 	b.setAtomicValuesFromPrefs(b.prefs)
+	b.applyPrefsSideEffectsLocked(b.prefs)
 
 	return nil
 }
@@ -1754,6 +2001,45 @@ func (b *LocalBackend) setAtomicValuesFromPrefs(p *ipn.Prefs) {
 	}
 }
 
+// applyPrefsSideEffectsLocked applies the process-wide settings that
+// come from the prefs p, which may be nil: local-only logging, the
+// client metrics interval, the proxy, control health acks and the
+// control TLS pins.
+//
+// b.mu must be held.
+func (b *LocalBackend) applyPrefsSideEffectsLocked(p *ipn.Prefs) {
+	if localOnly := p != nil && p.LocalOnlyLogs || logpolicy.LocalOnlyLogsPolicy(); localOnly != logtail.LocalOnly() {
+		b.logf("local-only logs: %v", localOnly)
+		logtail.SetLocalOnly(localOnly)
+	}
+	clientmetric.SetEncodeInterval(clientMetricsEncodeInterval(p))
+	if pu := proxyURL(p); pu != b.proxyURL {
+		var u *url.URL
+		var err error
+		if pu != "" {
+			u, err = url.Parse(pu)
+		}
+		if err != nil {
+			// Keep using the previous proxy.
+			b.logf("invalid proxy URL: %v", err)
+		} else {
+			b.proxyURL = pu
+			b.logf("proxy: %q", ipn.RedactProxyURL(pu))
+			tshttpproxy.SetProxy(u)
+		}
+	}
+	health.SetControlHealthAcks(controlHealthAcks(p))
+	var pins []string
+	if p != nil {
+		pins = p.ControlPins
+	}
+	if cp, err := tlsdial.ParsePins(pins); err != nil {
+		b.logf("invalid control pins: %v", err)
+	} else {
+		tlsdial.SetControlPins(cp)
+	}
+}
+
 // State returns the backend state machine's current state.
 func (b *LocalBackend) State() ipn.State {
 	b.mu.Lock()
@@ -1933,6 +2219,14 @@ func (b *LocalBackend) checkPrefsLocked(p *ipn.Prefs) error {
 	if err := b.checkSSHPrefsLocked(p); err != nil {
 		errs = append(errs, err)
 	}
+	if p.ProxyURL != "" {
+		if err := tshttpproxy.ValidateProxyURL(p.ProxyURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid proxy URL: %w", err))
+		}
+	}
+	if _, err := tlsdial.ParsePins(p.ControlPins); err != nil {
+		errs = append(errs, fmt.Errorf("invalid control pins: %w", err))
+	}
 	return multierr.New(errs...)
 }
 
@@ -2011,6 +2305,12 @@ func (b *LocalBackend) isDefaultServerLocked() bool {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return b.EditPrefsAs(mp, "")
+}
+
+// EditPrefsAs is like EditPrefs, but records actor as the local user
+// or process responsible for the change in the audit log.
+func (b *LocalBackend) EditPrefsAs(mp *ipn.MaskedPrefs, actor string) (*ipn.Prefs, error) {
 	b.mu.Lock()
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
@@ -2030,7 +2330,7 @@ func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 		return p1, nil
 	}
 	b.logf("EditPrefs: %v", mp.Pretty())
-	b.setPrefsLockedOnEntry("EditPrefs", p1) // does a b.mu.Unlock
+	b.setPrefsLockedOnEntry("EditPrefs", actor, p1) // does a b.mu.Unlock
 
 	// Note: don't perform any actions for the new prefs here. Not
 	// every prefs change goes through EditPrefs. Put your actions
@@ -2045,16 +2345,20 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 		panic("SetPrefs got nil prefs")
 	}
 	b.mu.Lock()
-	b.setPrefsLockedOnEntry("SetPrefs", newp)
+	b.setPrefsLockedOnEntry("SetPrefs", "", newp)
 }
 
 // setPrefsLockedOnEntry requires b.mu be held to call it, but it
 // unlocks b.mu when done. newp ownership passes to this function.
-func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
+//
+// caller and actor are recorded in the audit log. If actor is empty,
+// the current controlling user (if any) is recorded instead.
+func (b *LocalBackend) setPrefsLockedOnEntry(caller, actor string, newp *ipn.Prefs) {
 	netMap := b.netMap
 	stateKey := b.stateKey
 
 	b.setAtomicValuesFromPrefs(newp)
+	b.applyPrefsSideEffectsLocked(newp)
 
 	oldp := b.prefs
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
@@ -2074,6 +2378,10 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	hostInfoChanged := !oldHi.Equal(newHi)
 	userID := b.userID
 	cc := b.cc
+	audit := b.auditLogLocked()
+	if b.ccAuto != nil && !oldp.ControlBackoff.Equals(newp.ControlBackoff) {
+		b.ccAuto.SetBackoffPolicy(controlBackoffPolicy(newp))
+	}
 
 	// [GRINDER STATS LINE] - please don't remove (used for log parsing)
 	if caller == "SetPrefs" {
@@ -2089,6 +2397,20 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	}
 	b.mu.Unlock()
 
+	if oldp.ExitNodeID != newp.ExitNodeID {
+		b.publishNotification(exitNodeNotification(netMap, newp.ExitNodeID))
+	}
+	if change := prefsChangeString(oldp, newp); change != "" {
+		if actor == "" && userID != "" {
+			actor = "user-id " + userID
+		}
+		audit.add(ipnstate.AuditLogEntry{
+			Kind:   "prefs",
+			Source: caller,
+			Actor:  actor,
+			Change: change,
+		})
+	}
 	if stateKey != "" {
 		if err := b.store.WriteState(stateKey, newp.ToBytes()); err != nil {
 			b.logf("failed to save new controlclient state: %v", err)
@@ -2133,6 +2455,26 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	b.send(ipn.Notify{Prefs: newp})
 }
 
+// auditLogLocked returns b's audit log, creating it on first use.
+//
+// b.mu must be held.
+func (b *LocalBackend) auditLogLocked() *auditLog {
+	if b.audit == nil {
+		b.audit = newAuditLog(b.logf, b.TailscaleVarRoot())
+	}
+	return b.audit
+}
+
+// AuditLog returns the entries in the local audit log of prefs and
+// policy changes at or after since, oldest first. If limit is
+// positive, only the most recent limit entries are returned.
+func (b *LocalBackend) AuditLog(since time.Time, limit int) ([]ipnstate.AuditLogEntry, error) {
+	b.mu.Lock()
+	audit := b.auditLogLocked()
+	b.mu.Unlock()
+	return audit.entries(since, limit)
+}
+
 // GetPeerAPIPort returns the port number for the peerapi server
 // running on the provided IP.
 func (b *LocalBackend) GetPeerAPIPort(ip netip.Addr) (port uint16, ok bool) {
@@ -2504,11 +2846,30 @@ func dnsConfigForNetmap(nm *netmap.NetworkMap, prefs *ipn.Prefs, logf logger.Log
 }
 
 // SetTailnetKeyAuthority sets the key authority which should be
-// used for locked tailnets.
+// used for locked tailnets, and loads this node's key signature, if
+// one was stored.
 //
 // It should only be called before the LocalBackend is used.
 func (b *LocalBackend) SetTailnetKeyAuthority(a *tka.Authority) {
 	b.tka = a
+	if b.store != nil {
+		sig, err := b.store.ReadState(ipn.TKANodeKeySigStateKey)
+		switch {
+		case err == nil:
+			b.tkaNodeKeySig = sig
+			if b.ctx != nil {
+				b.tkaResigning = true
+				go b.resignTKANodeKeyLoop()
+			}
+		case err != ipn.ErrStateNotExist:
+			b.logf("error reading %v key of %v: %v", ipn.TKANodeKeySigStateKey, b.store, err)
+		}
+	}
+	b.unregisterTKAProbe = health.RegisterProbe(health.SysTKA, tkaHealthInterval, func(context.Context) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.tkaHealthLocked()
+	})
 }
 
 // SetVarRoot sets the root directory of Tailscale's writable
@@ -2872,7 +3233,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 
 	// prefs may change irrespective of state; WantRunning should be explicitly
 	// set before potential early return even if the state is unchanged.
-	health.SetIPNState(newState.String(), prefs.WantRunning)
+	health.SetIPNState(newState, prefs.WantRunning)
 	if oldState == newState {
 		return
 	}
@@ -3046,13 +3407,14 @@ func (b *LocalBackend) ResetForClientDisconnect() {
 	}
 	b.stateKey = ""
 	b.userID = ""
-	b.setNetMapLocked(nil)
+	b.setNetMapLocked(nil, nil)
 	b.prefs = new(ipn.Prefs)
 	b.keyExpired = false
 	b.authURL = ""
 	b.authURLSticky = ""
 	b.activeLogin = ""
 	b.setAtomicValuesFromPrefs(nil)
+	b.applyPrefsSideEffectsLocked(nil)
 }
 
 func (b *LocalBackend) ShouldRunSSH() bool { return b.sshAtomicBool.Load() && canSSH }
@@ -3142,7 +3504,11 @@ func hasCapability(nm *netmap.NetworkMap, cap string) bool {
 	return false
 }
 
-func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
+// setNetMapLocked sets b.netMap to nm and updates the state derived
+// from it. If non-nil, diff describes how nm differs from the previous
+// b.netMap and is used to update that state incrementally.
+func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap, diff *netmap.Diff) {
+	oldNetMap := b.netMap
 	b.dialer.SetNetMap(nm)
 	var login string
 	if nm != nil {
@@ -3177,6 +3543,10 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 	}
 
 	// Update the nodeByAddr index.
+	if b.nodeByAddr != nil && oldNetMap != nil && diff != nil && !diff.Full {
+		b.updateNodeByAddrLocked(oldNetMap, nm, diff)
+		return
+	}
 	if b.nodeByAddr == nil {
 		b.nodeByAddr = map[netip.Addr]*tailcfg.Node{}
 	}
@@ -3205,6 +3575,65 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 	}
 }
 
+// updateNodeByAddrLocked updates the nodeByAddr index, which must
+// currently reflect oldNM, for the nodes that diff reports changed in
+// nm.
+//
+// Entries are matched by node ID rather than pointer, as the index may
+// still hold an earlier copy of a node that diff saw as unchanged.
+//
+// b.mu must be held.
+func (b *LocalBackend) updateNodeByAddrLocked(oldNM, nm *netmap.NetworkMap, diff *netmap.Diff) {
+	if !diff.SelfChanged && !diff.PeersModified() {
+		return
+	}
+	removeNode := func(n *tailcfg.Node) {
+		for _, ipp := range n.Addresses {
+			if cur, ok := b.nodeByAddr[ipp.Addr()]; ok && ipp.IsSingleIP() && cur.ID == n.ID {
+				delete(b.nodeByAddr, ipp.Addr())
+			}
+		}
+	}
+	addNode := func(n *tailcfg.Node) {
+		for _, ipp := range n.Addresses {
+			if ipp.IsSingleIP() {
+				b.nodeByAddr[ipp.Addr()] = n
+			}
+		}
+	}
+	// Remove everything that went away or changed before adding
+	// anything, in case addresses moved between nodes.
+	if diff.SelfChanged && oldNM.SelfNode != nil {
+		removeNode(oldNM.SelfNode)
+	}
+	for _, ids := range [][]tailcfg.NodeID{diff.PeersRemoved, diff.PeersChanged} {
+		for _, id := range ids {
+			if n, ok := peerByID(oldNM, id); ok {
+				removeNode(n)
+			}
+		}
+	}
+	if diff.SelfChanged && nm.SelfNode != nil {
+		addNode(nm.SelfNode)
+	}
+	for _, ids := range [][]tailcfg.NodeID{diff.PeersAdded, diff.PeersChanged} {
+		for _, id := range ids {
+			if n, ok := peerByID(nm, id); ok {
+				addNode(n)
+			}
+		}
+	}
+}
+
+// peerByID returns the peer in nm with the given ID.
+func peerByID(nm *netmap.NetworkMap, id tailcfg.NodeID) (_ *tailcfg.Node, ok bool) {
+	i := sort.Search(len(nm.Peers), func(i int) bool { return nm.Peers[i].ID >= id })
+	if i < len(nm.Peers) && nm.Peers[i].ID == id {
+		return nm.Peers[i], true
+	}
+	return nil, false
+}
+
 // OperatorUserID returns the current pref's OperatorUser's ID (in
 // os/user.User.Uid string form), or the empty string if none.
 func (b *LocalBackend) OperatorUserID() string {
@@ -3497,6 +3926,103 @@ func (b *LocalBackend) SetExpirySooner(ctx context.Context, expiry time.Time) er
 	return cc.SetExpirySooner(ctx, expiry)
 }
 
+// ControlHealth returns the health problems currently reported by the
+// control plane, and whether each is acknowledged or snoozed.
+func (b *LocalBackend) ControlHealth() []apitype.ControlHealthMessage {
+	b.mu.Lock()
+	var acks []ipn.ControlHealthAck
+	if b.prefs != nil {
+		acks = b.prefs.ControlHealthAcks
+	}
+	b.mu.Unlock()
+
+	now := time.Now()
+	var ret []apitype.ControlHealthMessage
+	for _, text := range health.ControlHealth() {
+		m := apitype.ControlHealthMessage{ID: health.ControlHealthID(text), Text: text}
+		for _, a := range acks {
+			if a.ID != m.ID {
+				continue
+			}
+			if a.Until.IsZero() {
+				m.Acked = true
+			} else if now.Before(a.Until) {
+				m.SnoozedUntil = a.Until
+			}
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// AckControlHealth acknowledges the control plane health message with
+// the given ID, omitting it from the node's health state for as long
+// as control reports it. If until is non-zero, the message is instead
+// only snoozed until then.
+//
+// The acknowledgement is persisted in prefs.
+func (b *LocalBackend) AckControlHealth(id string, until time.Time) error {
+	current := health.ControlHealth()
+	found := false
+	for _, text := range current {
+		if health.ControlHealthID(text) == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no current control health message with ID %q", id)
+	}
+
+	b.mu.Lock()
+	var acks []ipn.ControlHealthAck
+	if b.prefs != nil {
+		acks = b.prefs.ControlHealthAcks
+	}
+	b.mu.Unlock()
+
+	ack := ipn.ControlHealthAck{ID: id, Until: until}
+	_, err := b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			ControlHealthAcks: updateControlHealthAcks(acks, current, ack, time.Now()),
+		},
+		ControlHealthAcksSet: true,
+	})
+	return err
+}
+
+// updateControlHealthAcks returns acks with ack added, replacing any
+// previous one for the same message. To keep prefs from growing
+// forever, it drops acks of messages that aren't among the current
+// ones and snoozes that ended before now.
+func updateControlHealthAcks(acks []ipn.ControlHealthAck, current []string, ack ipn.ControlHealthAck, now time.Time) []ipn.ControlHealthAck {
+	isCurrent := map[string]bool{}
+	for _, text := range current {
+		isCurrent[health.ControlHealthID(text)] = true
+	}
+	var ret []ipn.ControlHealthAck
+	for _, a := range acks {
+		if a.ID == ack.ID || !isCurrent[a.ID] || (!a.Until.IsZero() && !now.Before(a.Until)) {
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return append(ret, ack)
+}
+
+// controlHealthAcks returns the acknowledged or snoozed control plane
+// health messages in prefs, as expected by health.SetControlHealthAcks.
+func controlHealthAcks(prefs *ipn.Prefs) map[string]time.Time {
+	m := map[string]time.Time{}
+	if prefs == nil {
+		return m
+	}
+	for _, a := range prefs.ControlHealthAcks {
+		m[a.ID] = a.Until
+	}
+	return m
+}
+
 // exitNodeCanProxyDNS reports the DoH base URL ("http://foo/dns-query") without query parameters
 // to exitNodeID's DoH service, if available.
 //
@@ -3562,6 +4088,18 @@ func (b *LocalBackend) DoNoiseRequest(req *http.Request) (*http.Response, error)
 	return cc.DoNoiseRequest(req)
 }
 
+// ControlDiagnostics returns diagnostics about the control client's
+// recent attempts to connect to the control server.
+func (b *LocalBackend) ControlDiagnostics() (*ipnstate.ControlDiag, error) {
+	b.mu.Lock()
+	cc := b.ccAuto
+	b.mu.Unlock()
+	if cc == nil {
+		return nil, errors.New("no client")
+	}
+	return cc.Diagnostics(), nil
+}
+
 func (b *LocalBackend) sshServerOrInit() (_ SSHServer, err error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -3578,6 +4116,16 @@ func (b *LocalBackend) sshServerOrInit() (_ SSHServer, err error) {
 	return b.sshServer, nil
 }
 
+// SSHRecordings returns the Tailscale SSH sessions recorded to local
+// disk, newest first.
+func (b *LocalBackend) SSHRecordings() ([]apitype.SSHRecording, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return nil, err
+	}
+	return s.Recordings()
+}
+
 func (b *LocalBackend) HandleSSHConn(c net.Conn) (err error) {
 	s, err := b.sshServerOrInit()
 	if err != nil {
@@ -14,10 +14,14 @@
 	"time"
 
 	"go4.org/netipx"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/tsdial"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -638,3 +642,171 @@ type interfacePrefix struct {
 		})
 	}
 }
+
+func TestControlBackoffPolicy(t *testing.T) {
+	tests := []struct {
+		name  string
+		prefs *ipn.Prefs
+		want  controlclient.BackoffPolicy
+	}{
+		{"nil", nil, controlclient.BackoffPolicy{}},
+		{"unset", &ipn.Prefs{}, controlclient.BackoffPolicy{}},
+		{
+			name: "all",
+			prefs: &ipn.Prefs{ControlBackoff: &ipn.ControlBackoffPrefs{
+				MaxIntervalSeconds: 300,
+				JitterPercent:      25,
+				WakeDelaySeconds:   10,
+			}},
+			want: controlclient.BackoffPolicy{
+				MaxInterval: 5 * time.Minute,
+				Jitter:      0.25,
+				WakeDelay:   10 * time.Second,
+			},
+		},
+		{
+			name:  "no-jitter",
+			prefs: &ipn.Prefs{ControlBackoff: &ipn.ControlBackoffPrefs{JitterPercent: -1}},
+			want:  controlclient.BackoffPolicy{Jitter: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := controlBackoffPolicy(tt.prefs); got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientMetricsEncodeInterval(t *testing.T) {
+	tests := []struct {
+		name  string
+		prefs *ipn.Prefs
+		want  time.Duration
+	}{
+		{"nil", nil, 0},
+		{"unset", &ipn.Prefs{}, 0},
+		{"interval", &ipn.Prefs{ClientMetrics: &ipn.ClientMetricsPrefs{UploadIntervalSeconds: 60}}, time.Minute},
+		{"no-upload", &ipn.Prefs{ClientMetrics: &ipn.ClientMetricsPrefs{UploadIntervalSeconds: 60, NoUpload: true}}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientMetricsEncodeInterval(tt.prefs); got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateControlHealthAcks(t *testing.T) {
+	id := health.ControlHealthID
+	now := time.Unix(1000, 0)
+	current := []string{"a", "b", "c"}
+	acks := []ipn.ControlHealthAck{
+		{ID: id("a")},
+		{ID: id("b"), Until: now.Add(-time.Second)}, // snooze over
+		{ID: id("c"), Until: now.Add(time.Hour)},
+		{ID: id("gone")},
+	}
+	got := updateControlHealthAcks(acks, current, ipn.ControlHealthAck{ID: id("a"), Until: now.Add(time.Minute)}, now)
+	want := []ipn.ControlHealthAck{
+		{ID: id("c"), Until: now.Add(time.Hour)},
+		{ID: id("a"), Until: now.Add(time.Minute)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestExitNodeProbeTarget(t *testing.T) {
+	exit := &tailcfg.Node{
+		StableID:     "exit",
+		ComputedName: "exit-box",
+		Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.1.2/32")},
+		Hostinfo: (&tailcfg.Hostinfo{
+			Services: []tailcfg.Service{
+				{Proto: tailcfg.PeerAPI4, Port: 444},
+				{Proto: tailcfg.PeerAPIDNS, Port: 1},
+			},
+		}).View(),
+	}
+	b := &LocalBackend{
+		state: ipn.Running,
+		netMap: &netmap.NetworkMap{
+			Addresses: []netip.Prefix{netip.MustParsePrefix("100.64.1.1/32")},
+			Peers:     []*tailcfg.Node{exit},
+		},
+		prefs: &ipn.Prefs{ExitNodeID: "exit"},
+	}
+	dohURL, name, ok := b.exitNodeProbeTarget()
+	if !ok || dohURL != "http://100.64.1.2:444/dns-query" || name != "exit-box" {
+		t.Errorf("got %q, %q, %v; want exit-box's DoH URL", dohURL, name, ok)
+	}
+
+	b.state = ipn.Stopped
+	if _, _, ok := b.exitNodeProbeTarget(); ok {
+		t.Error("got target while stopped")
+	}
+	b.state = ipn.Running
+	b.prefs.ExitNodeID = ""
+	if _, _, ok := b.exitNodeProbeTarget(); ok {
+		t.Error("got target without an exit node")
+	}
+}
+
+func TestNodeByAddrReallocatedPeers(t *testing.T) {
+	peer := func(id tailcfg.NodeID, ip string) *tailcfg.Node {
+		return &tailcfg.Node{
+			ID:        id,
+			User:      1,
+			Addresses: []netip.Prefix{netip.MustParsePrefix(ip + "/32")},
+		}
+	}
+	netMap := func(peers ...*tailcfg.Node) *netmap.NetworkMap {
+		return &netmap.NetworkMap{
+			User:         1,
+			UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{1: {LoginName: "a@example.com"}},
+			Peers:        peers,
+		}
+	}
+	b := &LocalBackend{logf: t.Logf, dialer: new(tsdial.Dialer)}
+	set := func(nm *netmap.NetworkMap) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.setNetMapLocked(nm, nm.DiffFrom(b.netMap))
+	}
+
+	nm1 := netMap(peer(2, "100.64.0.2"), peer(3, "100.64.0.3"))
+	set(nm1)
+	// A full update reallocates the peers, but they're equal, so the
+	// diff doesn't report them and the index keeps nm1's copies.
+	nm2 := netMap(nm1.Peers[0].Clone(), nm1.Peers[1].Clone())
+	if d := nm2.DiffFrom(nm1); d.PeersModified() {
+		t.Fatalf("diff of equal peers = %+v; want none modified", d)
+	}
+	set(nm2)
+	set(netMap(nm2.Peers[1].Clone()))
+
+	if n, _, ok := b.WhoIs(netip.MustParseAddrPort("100.64.0.2:0")); ok {
+		t.Errorf("WhoIs of removed peer's IP = node %v; want none", n.ID)
+	}
+	if n, _, ok := b.WhoIs(netip.MustParseAddrPort("100.64.0.3:0")); !ok || n.ID != 3 {
+		t.Errorf("WhoIs of remaining peer's IP = %v, %v; want node 3", n, ok)
+	}
+}
+
+func TestProxyPrefKeptOnParseError(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	defer b.applyPrefsSideEffectsLocked(nil)
+	b.applyPrefsSideEffectsLocked(&ipn.Prefs{ProxyURL: "http://proxy.example:8080"})
+	b.applyPrefsSideEffectsLocked(&ipn.Prefs{ProxyURL: "http://%zz"})
+
+	if b.proxyURL != "http://proxy.example:8080" {
+		t.Errorf("proxyURL = %q; want the previous proxy", b.proxyURL)
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if u, err := tshttpproxy.ProxyFromEnvironment(req); err != nil || u == nil || u.Host != "proxy.example:8080" {
+		t.Errorf("proxy = %v, %v; want proxy.example:8080", u, err)
+	}
+}
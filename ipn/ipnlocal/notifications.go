@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// keyExpiryWarning is how long before the node key expires that a
+// key-expiry notification is first sent.
+const keyExpiryWarning = 7 * 24 * time.Hour
+
+// SubscribeNotifications returns a channel of user-facing notifications,
+// for GUI clients to show, until unsubscribe is called. Notifications are
+// dropped rather than block if the channel isn't drained.
+func (b *LocalBackend) SubscribeNotifications() (_ <-chan apitype.Notification, unsubscribe func()) {
+	ch := make(chan apitype.Notification, 16)
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	if b.notifySubs == nil {
+		b.notifySubs = map[chan apitype.Notification]bool{}
+	}
+	b.notifySubs[ch] = true
+	return ch, func() {
+		b.notifyMu.Lock()
+		defer b.notifyMu.Unlock()
+		delete(b.notifySubs, ch)
+	}
+}
+
+// publishNotification sends n to the SubscribeNotifications subscribers,
+// unless it's the same as the last notification with its ID.
+//
+// Received files are events rather than states, so they are always sent
+// and not remembered; otherwise lastNotification would grow by one entry
+// per file name forever.
+func (b *LocalBackend) publishNotification(n apitype.Notification) {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	if n.Type != apitype.NotificationFileReceived {
+		if last, ok := b.lastNotification[n.ID]; ok && last.Severity == n.Severity && last.Title == n.Title && last.Body == n.Body {
+			return
+		}
+		if b.lastNotification == nil {
+			b.lastNotification = map[string]apitype.Notification{}
+		}
+		b.lastNotification[n.ID] = n
+	}
+	for ch := range b.notifySubs {
+		select {
+		case ch <- n:
+		default:
+		}
+	}
+}
+
+// healthNotification returns the notification for subsystem sys's health
+// changing to err (nil meaning healthy), of severity sev.
+func healthNotification(sys health.Subsystem, sev health.Severity, err error) apitype.Notification {
+	n := apitype.Notification{
+		ID:   "health:" + string(sys),
+		Type: apitype.NotificationHealth,
+	}
+	if err != nil {
+		n.Severity = apitype.SeverityWarning
+		switch sev {
+		case health.SeverityInfo:
+			n.Severity = apitype.SeverityInfo
+		case health.SeverityError:
+			n.Severity = apitype.SeverityError
+		}
+		n.Title = fmt.Sprintf("Tailscale problem: %s", sys)
+		n.Body = err.Error()
+	} else {
+		n.Severity = apitype.SeverityInfo
+		n.Title = fmt.Sprintf("Tailscale problem resolved: %s", sys)
+	}
+	return n
+}
+
+// healthChange returns the ipn.Notify health change for subsystem sys's
+// health changing to err (nil meaning healthy), of severity sev.
+func healthChange(sys health.Subsystem, sev health.Severity, err error) *ipn.HealthChange {
+	hc := &ipn.HealthChange{Subsystem: string(sys)}
+	if err == nil {
+		return hc
+	}
+	hc.Severity = sev.String()
+	hc.Error = err.Error()
+	if h, ok := health.HintOf(err); ok {
+		hc.HintText = h.Text
+		hc.HintURL = h.URL
+	}
+	return hc
+}
+
+// keyExpiryNotification returns the notification for the node key that
+// expires at expiry, if it has expired or does so within keyExpiryWarning
+// of now.
+func keyExpiryNotification(expiry, now time.Time) (_ apitype.Notification, ok bool) {
+	if expiry.IsZero() || expiry.Sub(now) > keyExpiryWarning {
+		return apitype.Notification{}, false
+	}
+	n := apitype.Notification{
+		ID:   "key-expiry",
+		Type: apitype.NotificationKeyExpiry,
+	}
+	when := expiry.UTC().Format("2006-01-02 15:04 MST")
+	if expiry.After(now) {
+		n.Severity = apitype.SeverityWarning
+		n.Title = "Tailscale key expiring soon"
+		n.Body = fmt.Sprintf("This machine's key expires at %s. Reauthenticate to stay connected.", when)
+	} else {
+		n.Severity = apitype.SeverityError
+		n.Title = "Tailscale key expired"
+		n.Body = fmt.Sprintf("This machine's key expired at %s. Reauthenticate to reconnect.", when)
+	}
+	return n, true
+}
+
+// fileReceivedNotification returns the notification for rf being received.
+func fileReceivedNotification(rf ipn.ReceivedFile) apitype.Notification {
+	from := rf.SenderNode
+	if rf.SenderLoginName != "" {
+		from = fmt.Sprintf("%s (%s)", rf.SenderNode, rf.SenderLoginName)
+	}
+	return apitype.Notification{
+		ID:       "file-received:" + rf.Name,
+		Type:     apitype.NotificationFileReceived,
+		Severity: apitype.SeverityInfo,
+		Title:    "File received",
+		Body:     fmt.Sprintf("Received %q from %s.", rf.Name, from),
+		Time:     rf.Received,
+	}
+}
+
+// exitNodeNotification returns the notification for the exit node
+// changing to id (empty meaning none), as named in nm.
+func exitNodeNotification(nm *netmap.NetworkMap, id tailcfg.StableNodeID) apitype.Notification {
+	n := apitype.Notification{
+		ID:       "exit-node",
+		Type:     apitype.NotificationExitNode,
+		Severity: apitype.SeverityInfo,
+	}
+	if id.IsZero() {
+		n.Title = "Exit node turned off"
+		n.Body = "Internet traffic is no longer routed through an exit node."
+		return n
+	}
+	name := string(id)
+	if nm != nil {
+		if peer, ok := nm.PeerWithStableID(id); ok && peer.ComputedName != "" {
+			name = peer.ComputedName
+		}
+	}
+	n.Title = "Exit node changed"
+	n.Body = fmt.Sprintf("Internet traffic is now routed through %s.", name)
+	return n
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+)
+
+func TestKeyExpiryNotification(t *testing.T) {
+	now := time.Date(2022, 8, 26, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		expiry  time.Time
+		wantOK  bool
+		wantSev apitype.NotificationSeverity
+	}{
+		{"no-expiry", time.Time{}, false, ""},
+		{"far", now.Add(30 * 24 * time.Hour), false, ""},
+		{"soon", now.Add(24 * time.Hour), true, apitype.SeverityWarning},
+		{"expired", now.Add(-time.Minute), true, apitype.SeverityError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, ok := keyExpiryNotification(tt.expiry, now)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantOK)
+			}
+			if n.Severity != tt.wantSev {
+				t.Errorf("severity = %q; want %q", n.Severity, tt.wantSev)
+			}
+			if ok && n.ID != "key-expiry" {
+				t.Errorf("ID = %q; want key-expiry", n.ID)
+			}
+		})
+	}
+}
+
+func TestPublishNotification(t *testing.T) {
+	b := new(LocalBackend)
+	ch, unsubscribe := b.SubscribeNotifications()
+	defer unsubscribe()
+
+	problem := healthNotification(health.SysDNS, health.SeverityWarning, errors.New("no resolvers"))
+	b.publishNotification(problem)
+	b.publishNotification(problem) // duplicate, dropped
+	b.publishNotification(healthNotification(health.SysDNS, health.SeverityWarning, nil))
+
+	var got []apitype.Notification
+	for len(got) < 2 {
+		select {
+		case n := <-ch:
+			got = append(got, n)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout; got %d notifications", len(got))
+		}
+	}
+	select {
+	case n := <-ch:
+		t.Fatalf("unexpected extra notification %+v", n)
+	default:
+	}
+	if got[0].ID != "health:dns" || got[1].ID != "health:dns" {
+		t.Errorf("IDs = %q, %q; want health:dns", got[0].ID, got[1].ID)
+	}
+	if got[0].Severity != apitype.SeverityWarning || got[1].Severity != apitype.SeverityInfo {
+		t.Errorf("severities = %q, %q; want warning, info", got[0].Severity, got[1].Severity)
+	}
+
+	// Each received file is its own notification, even with the same
+	// name, and isn't kept for deduplication.
+	rf := fileReceivedNotification(ipn.ReceivedFile{Name: "a.txt", SenderNode: "peer"})
+	b.publishNotification(rf)
+	b.publishNotification(rf)
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-ch:
+			if n.Type != apitype.NotificationFileReceived {
+				t.Errorf("notification %d type = %q; want file-received", i, n.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for file notification %d", i)
+		}
+	}
+	if len(b.lastNotification) != 1 {
+		t.Errorf("lastNotification has %d entries; want 1", len(b.lastNotification))
+	}
+}
+
+func TestHealthChange(t *testing.T) {
+	hc := healthChange(health.SysDNS, health.SeverityError, health.WithHint(errors.New("no resolvers"), health.Hint{Text: "check DNS", URL: "https://example.com/dns"}))
+	want := ipn.HealthChange{
+		Subsystem: "dns",
+		Severity:  "error",
+		Error:     "no resolvers",
+		HintText:  "check DNS",
+		HintURL:   "https://example.com/dns",
+	}
+	if *hc != want {
+		t.Errorf("got %+v; want %+v", *hc, want)
+	}
+	if hc := healthChange(health.SysDNS, health.SeverityError, nil); *hc != (ipn.HealthChange{Subsystem: "dns"}) {
+		t.Errorf("healthy: got %+v", *hc)
+	}
+}
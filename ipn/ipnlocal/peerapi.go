@@ -565,6 +565,9 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/v0/dnsfwd":
 		h.handleServeDNSFwd(w, r)
 		return
+	case "/v0/health-history":
+		h.handleServeHealthHistory(w, r)
+		return
 	case "/v0/wol":
 		h.handleWakeOnLAN(w, r)
 		return
@@ -810,6 +813,20 @@ func (h *peerAPIHandler) handlePeerPut(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "{}\n")
 	h.ps.knownEmpty.Store(false)
 	h.ps.b.sendFileNotify()
+
+	finalPath := dstFile
+	if h.ps.directFileMode && !h.ps.directFileDoFinalRename {
+		finalPath = partialFile
+	}
+	h.ps.b.fileReceived(ipn.ReceivedFile{
+		Name:            baseName,
+		Path:            finalPath,
+		Size:            finalSize,
+		Received:        time.Now(),
+		SenderNode:      h.peerNode.ComputedName,
+		SenderLoginName: h.peerUser.LoginName,
+		SenderIP:        h.remoteAddr.Addr(),
+	})
 }
 
 func approxSize(n int64) string {
@@ -895,6 +912,14 @@ func (h *peerAPIHandler) handleServeDNSFwd(w http.ResponseWriter, r *http.Reques
 	dh.ServeHTTP(w, r)
 }
 
+func (h *peerAPIHandler) handleServeHealthHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.canDebug() {
+		http.Error(w, "denied; no debug access", http.StatusForbidden)
+		return
+	}
+	health.ServeDebugHistory(w, r)
+}
+
 func (h *peerAPIHandler) handleWakeOnLAN(w http.ResponseWriter, r *http.Request) {
 	if !h.canWakeOnLAN() {
 		http.Error(w, "no WoL access", http.StatusForbidden)
@@ -19,6 +19,7 @@
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"go4.org/netipx"
 	"tailscale.com/ipn"
@@ -491,6 +492,73 @@ func TestFileDeleteRace(t *testing.T) {
 	}
 }
 
+func TestFileReceivedHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook is a shell script")
+	}
+	dir := t.TempDir()
+	hookOut := filepath.Join(t.TempDir(), "hook.out")
+	hook := filepath.Join(t.TempDir(), "hook.sh")
+	script := "#!/bin/sh\necho \"$1 $TS_FILE_NAME $TS_FILE_SIZE $TS_SENDER_NODE $TS_SENDER_LOGIN_NAME $TS_SENDER_IP\" > " + hookOut + ".tmp\nmv " + hookOut + ".tmp " + hookOut + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	notified := make(chan ipn.ReceivedFile, 1)
+	lb := &LocalBackend{
+		logf:             t.Logf,
+		capFileSharing:   true,
+		fileReceivedHook: hook,
+		notify: func(n ipn.Notify) {
+			if n.FileReceived != nil {
+				notified <- *n.FileReceived
+			}
+		},
+	}
+	ph := &peerAPIHandler{
+		isSelf:     true,
+		remoteAddr: netip.MustParseAddrPort("100.100.100.101:12345"),
+		peerNode: &tailcfg.Node{
+			ComputedName: "some-peer-name",
+		},
+		peerUser: tailcfg.UserProfile{LoginName: "foo@example.com"},
+		ps: &peerAPIServer{
+			b:       lb,
+			rootDir: dir,
+		},
+	}
+	lb.peerAPIServer = ph.ps
+	rr := httptest.NewRecorder()
+	ph.ServeHTTP(rr, httptest.NewRequest("PUT", "/v0/put/foo.txt", strings.NewReader("hello")))
+	if res := rr.Result(); res.StatusCode != 200 {
+		t.Fatal(res.Status)
+	}
+
+	wantPath := filepath.Join(dir, "foo.txt")
+	select {
+	case rf := <-notified:
+		if rf.Name != "foo.txt" || rf.Path != wantPath || rf.Size != 5 || rf.SenderNode != "some-peer-name" || rf.SenderLoginName != "foo@example.com" {
+			t.Errorf("FileReceived = %+v", rf)
+		}
+	default:
+		t.Error("no FileReceived notification")
+	}
+
+	want := wantPath + " foo.txt 5 some-peer-name foo@example.com 100.100.100.101\n"
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		got, err := os.ReadFile(hookOut)
+		if err == nil {
+			if string(got) != want {
+				t.Errorf("hook output = %q; want %q", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hook didn't run")
+		}
+	}
+}
+
 // Tests "foo.jpg.deleted" marks (for Windows).
 func TestDeletedMarkers(t *testing.T) {
 	dir := t.TempDir()
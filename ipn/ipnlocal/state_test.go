@@ -22,6 +22,7 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/persist"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/wgengine"
 )
 
@@ -247,6 +248,11 @@ func (cc *mockControl) SetNetInfo(ni *tailcfg.NetInfo) {
 	cc.called("SetNetInfo")
 }
 
+func (cc *mockControl) SetNodeKeySignature(sig tkatype.MarshaledSignature) {
+	cc.logf("SetNodeKeySignature: %d bytes", len(sig))
+	cc.called("SetNodeKeySignature")
+}
+
 func (cc *mockControl) UpdateEndpoints(endpoints []tailcfg.Endpoint) {
 	// validate endpoint information here?
 	cc.logf("UpdateEndpoints:  ep=%v", endpoints)
@@ -289,6 +295,8 @@ func TestStateMachine(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewLocalBackend: %v", err)
 	}
+	// Stop b's health watcher from logging once the test is done.
+	t.Cleanup(b.Shutdown)
 
 	cc := newMockControl(t)
 	cc.statusFunc = b.setClientStatus
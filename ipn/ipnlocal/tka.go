@@ -0,0 +1,360 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tka"
+	"tailscale.com/types/tkatype"
+)
+
+// tkaHealthInterval is how often the key authority's health is checked.
+const tkaHealthInterval = time.Hour
+
+// tkaResignInterval is how often this node's key signature is checked,
+// and tkaResignBefore how long before it expires it's replaced.
+const (
+	tkaResignInterval = time.Hour
+	tkaResignBefore   = 7 * 24 * time.Hour
+)
+
+// TKAInform applies updates to the key authority, such as those from
+// other nodes or the control plane, reporting a failure to the health
+// package until a later call succeeds.
+func (b *LocalBackend) TKAInform(updates []tka.AUM) error {
+	b.mu.Lock()
+	if b.tka == nil {
+		b.mu.Unlock()
+		return errors.New("network-lock is not initialized")
+	}
+	b.tkaInformErr = nil
+	if err := b.tka.Inform(updates); err != nil {
+		b.tkaInformErr = fmt.Errorf("applying network-lock updates: %w", err)
+	}
+	err := b.tkaInformErr
+	health.SetTKAHealth(b.tkaHealthLocked())
+	b.mu.Unlock()
+
+	// The updates may have changed which keys are trusted, and until
+	// when.
+	b.tkaResign()
+	return err
+}
+
+// tkaHealthLocked returns the problem with the key authority, if any.
+func (b *LocalBackend) tkaHealthLocked() error {
+	if b.tka == nil {
+		return nil
+	}
+	if b.tkaInformErr != nil {
+		return b.tkaInformErr
+	}
+	if b.tkaResignErr != nil {
+		return b.tkaResignErr
+	}
+	if !b.nlPrivKey.IsZero() {
+		if r, ok := b.tka.RevocationInfo(b.nlPrivKey.KeyID()); ok {
+			return fmt.Errorf("this node's network-lock key was revoked (%v)", r.Reason)
+		}
+	}
+	if expired := b.tka.KeysExpiringBefore(time.Now()); len(expired) > 0 {
+		return fmt.Errorf("%d trusted network-lock keys have expired and can't sign updates", len(expired))
+	}
+	// Forks are settled by fork resolution, so most need no attention.
+	// The exception is when updates this node signed lost, and so were
+	// never applied. In a long chain, forks near head may go unchecked,
+	// which is no reason to report the authority unhealthy.
+	forks, err := b.tka.Forks()
+	if err != nil && !errors.Is(err, tka.ErrForksTruncated) {
+		return fmt.Errorf("checking for network-lock forks: %w", err)
+	}
+	if !b.nlPrivKey.IsZero() {
+		keyID := b.nlPrivKey.KeyID()
+		for _, f := range forks {
+			for _, br := range f.Branches[1:] {
+				if signedBy(br.Signers, keyID) {
+					return fmt.Errorf("network-lock updates signed by this node after %v lost to a competing branch (by %v) and weren't applied", f.ForkPoint, f.Rule)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// signedBy reports whether keyID is among signers.
+func signedBy(signers []tkatype.KeyID, keyID tkatype.KeyID) bool {
+	for _, s := range signers {
+		if bytes.Equal(s, keyID) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTKANodeKeySignature sets this node's key signature, and the signer
+// used to replace it before it expires, as it does when the key that
+// made it expires. The signature is stored, so it's used again when
+// tailscaled restarts, and sent to control, which distributes it to
+// peers. If signer is nil, this node's network-lock key is used while
+// the authority trusts it; otherwise sig is only checked, with problems
+// reported to the health package.
+func (b *LocalBackend) SetTKANodeKeySignature(sig tkatype.MarshaledSignature, signer tka.Signer) {
+	b.mu.Lock()
+	b.tkaSigner = signer
+	cc := b.setTKANodeKeySigLocked(sig)
+	if !b.tkaResigning && b.ctx != nil {
+		b.tkaResigning = true
+		go b.resignTKANodeKeyLoop()
+	}
+	b.mu.Unlock()
+
+	if cc != nil {
+		cc.SetNodeKeySignature(sig)
+	}
+	b.tkaResign()
+}
+
+// setTKANodeKeySigLocked sets and stores this node's key signature,
+// returning the control client to send it to, if any.
+func (b *LocalBackend) setTKANodeKeySigLocked(sig tkatype.MarshaledSignature) controlclient.Client {
+	b.tkaNodeKeySig = sig
+	if b.store != nil {
+		if err := b.store.WriteState(ipn.TKANodeKeySigStateKey, sig); err != nil {
+			b.logf("error writing node key signature to store: %v", err)
+		}
+	}
+	return b.cc
+}
+
+// TKANodeKeySignature returns this node's key signature, which may have
+// been replaced since it was set, or nil if none is set.
+func (b *LocalBackend) TKANodeKeySignature() tkatype.MarshaledSignature {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tkaNodeKeySig
+}
+
+// resignTKANodeKeyLoop replaces this node's key signature as needed
+// every tkaResignInterval, until b is shut down.
+func (b *LocalBackend) resignTKANodeKeyLoop() {
+	t := time.NewTicker(tkaResignInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+		b.tkaResign()
+	}
+}
+
+// tkaResign replaces this node's key signature if it's invalid or
+// expires within tkaResignBefore, storing the new one and sending it to
+// control, and reports any problem to the health package.
+//
+// The signer may be slow, as a tka.RemoteSigner is, so it's called
+// without b.mu held, with a snapshot of the authority.
+func (b *LocalBackend) tkaResign() {
+	b.mu.Lock()
+	if b.tka == nil || b.tkaNodeKeySig == nil {
+		b.mu.Unlock()
+		return
+	}
+	snap, old := b.tka.Snapshot(), b.tkaNodeKeySig
+	signer := b.tkaSigner
+	if signer == nil && !b.nlPrivKey.IsZero() && snap.KeyTrusted(b.nlPrivKey.KeyID()) {
+		signer = b.nlPrivKey
+	}
+	b.mu.Unlock()
+
+	sig, err := b.resignNodeKey(snap, old, signer)
+
+	b.mu.Lock()
+	if !bytes.Equal(b.tkaNodeKeySig, old) {
+		// Replaced while signing, by a caller that checks the new one.
+		b.mu.Unlock()
+		return
+	}
+	var cc controlclient.Client
+	if sig != nil {
+		cc = b.setTKANodeKeySigLocked(sig)
+	}
+	b.tkaResignErr = err
+	health.SetTKAHealth(b.tkaHealthLocked())
+	b.mu.Unlock()
+
+	if cc != nil {
+		cc.SetNodeKeySignature(sig)
+	}
+}
+
+// resignNodeKey returns a replacement for sig, this node's key
+// signature, from signer if sig is invalid or expires within
+// tkaResignBefore, or nil if it needn't be replaced. It returns an error
+// if sig couldn't be replaced, or if its replacement expires soon too.
+func (b *LocalBackend) resignNodeKey(snap *tka.Snapshot, sig tkatype.MarshaledSignature, signer tka.Signer) (tkatype.MarshaledSignature, error) {
+	exp, err := snap.NodeKeySignatureExpiry(sig)
+	if err == nil && (exp.IsZero() || time.Until(exp) > tkaResignBefore) {
+		return nil, nil
+	}
+	if signer == nil {
+		if err != nil {
+			return nil, fmt.Errorf("this node's key signature is invalid: %w", err)
+		}
+		return nil, fmt.Errorf("this node's key signature expires at %v, and there's no signer to replace it", exp.UTC().Format(time.RFC3339))
+	}
+
+	var old tka.NodeKeySignature
+	if err := old.Unserialize(sig); err != nil {
+		return nil, fmt.Errorf("decoding this node's key signature: %w", err)
+	}
+	newSig, err := snap.SignNodeKey(old.Pubkey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("re-signing this node's key: %w", err)
+	}
+	newExp, err := snap.NodeKeySignatureExpiry(newSig)
+	if err != nil {
+		return nil, fmt.Errorf("re-signing this node's key: %w", err)
+	}
+	if !exp.IsZero() && !newExp.IsZero() && !newExp.After(exp) {
+		return nil, fmt.Errorf("this node's key signature expires at %v, and the signer's key doesn't outlast it", exp.UTC().Format(time.RFC3339))
+	}
+	if newExp.IsZero() {
+		b.logf("tka: re-signed this node's key")
+	} else {
+		b.logf("tka: re-signed this node's key, until %v", newExp.UTC().Format(time.RFC3339))
+	}
+	if !newExp.IsZero() && time.Until(newExp) <= tkaResignBefore {
+		return newSig, fmt.Errorf("this node's key signature expires at %v, as does the signer's key", newExp.UTC().Format(time.RFC3339))
+	}
+	return newSig, nil
+}
+
+// TKAStatus returns the key authority's head and trusted keys.
+func (b *LocalBackend) TKAStatus() *ipnstate.TKAStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tka == nil {
+		return &ipnstate.TKAStatus{}
+	}
+	st := &ipnstate.TKAStatus{
+		Enabled:            true,
+		Head:               b.tka.Head().String(),
+		SignatureThreshold: b.tka.SignatureThreshold(),
+	}
+	for _, k := range b.tka.Keys() {
+		st.Keys = append(st.Keys, ipnstate.TKAKey{
+			KeyID: k.ID(),
+			Kind:  k.Kind.String(),
+			Votes: k.Votes,
+			Meta:  k.Meta,
+		})
+	}
+	return st
+}
+
+// TKALog returns up to limit of the most recent updates in the key
+// authority's active chain, newest first.
+func (b *LocalBackend) TKALog(limit int) ([]ipnstate.TKAUpdate, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tka == nil {
+		return nil, errors.New("network-lock is not initialized")
+	}
+	// Walking back from head reads only the updates returned, so b.mu
+	// isn't held for longer the longer the chain gets.
+	entries, err := b.tka.RecentHistory(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ipnstate.TKAUpdate, 0, len(entries))
+	for _, e := range entries {
+		u := ipnstate.TKAUpdate{
+			Hash:    e.Hash.String(),
+			Kind:    e.Kind.String(),
+			KeyID:   e.KeyID,
+			Signers: e.Signers,
+			Raw:     e.AUM.Serialize(),
+		}
+		if a := e.AUM.Annotation; a != nil {
+			u.Ticket, u.Reason = a.Ticket, a.Reason
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// TKASign signs a serialized AUM with this node's network-lock key, on
+// behalf of another node building updates (see tka.RemoteSigner). It
+// only signs updates that apply to the authority's current head, and
+// logs what each one does.
+func (b *LocalBackend) TKASign(serializedAUM []byte) ([]tkatype.Signature, error) {
+	var aum tka.AUM
+	if err := aum.Unserialize(serializedAUM); err != nil {
+		return nil, fmt.Errorf("decoding AUM: %w", err)
+	}
+
+	// The authority is checked under b.mu, as TKAInform may be applying
+	// updates to it concurrently.
+	b.mu.Lock()
+	nlPriv := b.nlPrivKey
+	err := b.tkaCheckSignableLocked(aum)
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	parent, _ := aum.Parent()
+	b.logf("tka: signing update after %v: %s", parent, describeAUM(aum))
+	return nlPriv.SignAUM(aum.SigHash())
+}
+
+// tkaCheckSignableLocked returns an error if this node shouldn't sign
+// aum, because its key isn't trusted or aum doesn't apply to head.
+func (b *LocalBackend) tkaCheckSignableLocked(aum tka.AUM) error {
+	if b.tka == nil {
+		return errors.New("network-lock is not initialized")
+	}
+	if b.nlPrivKey.IsZero() || !b.tka.KeyTrusted(b.nlPrivKey.KeyID()) {
+		return errors.New("this node's network-lock key is not trusted")
+	}
+	if err := b.tka.CheckUpdate(aum); err != nil {
+		return fmt.Errorf("refusing to sign update: %w", err)
+	}
+	return nil
+}
+
+// describeAUM returns a human-readable summary of what aum does.
+func describeAUM(aum tka.AUM) string {
+	switch aum.MessageKind {
+	case tka.AUMAddKey:
+		return fmt.Sprintf("add key %x with %d votes", aum.Key.ID(), aum.Key.Votes)
+	case tka.AUMRemoveKey:
+		return fmt.Sprintf("remove key %x", aum.KeyID)
+	case tka.AUMUpdateKey:
+		s := fmt.Sprintf("update key %x", aum.KeyID)
+		if aum.Votes != nil {
+			s += fmt.Sprintf(" votes=%d", *aum.Votes)
+		}
+		if aum.Meta != nil {
+			s += fmt.Sprintf(" meta=%v", aum.Meta)
+		}
+		return s
+	case tka.AUMAnnotate:
+		return fmt.Sprintf("annotate ticket=%q reason=%q", aum.Annotation.Ticket, aum.Annotation.Reason)
+	case tka.AUMCheckpoint:
+		return fmt.Sprintf("checkpoint with %d keys, signature threshold %d", len(aum.State.Keys), aum.State.SignatureThreshold)
+	}
+	return aum.MessageKind.String()
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tka"
+	"tailscale.com/types/key"
+)
+
+func TestTKASign(t *testing.T) {
+	nlPriv := key.NewNLPrivate()
+	nlKey := tka.Key{Kind: tka.Key25519, Public: nlPriv.KeyID(), Votes: 2}
+	authority, _, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{nlKey},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{1}, 32)},
+	}, nlPriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+	b := &LocalBackend{logf: t.Logf, tka: authority, nlPrivKey: nlPriv}
+
+	// An update built elsewhere, signed by b.
+	builder := authority.NewUpdater(tka.RemoteSigner{Sign: b.TKASign})
+	if err := builder.SetKeyVote(nlKey.ID(), 3); err != nil {
+		t.Fatalf("SetKeyVote() failed: %v", err)
+	}
+	updates, err := builder.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := authority.Inform(updates); err != nil {
+		t.Fatalf("remotely-signed update rejected: %v", err)
+	}
+
+	// The same update no longer applies to head.
+	if _, err := b.TKASign(updates[0].Serialize()); err == nil {
+		t.Error("TKASign() of a stale update succeeded")
+	}
+	if _, err := b.TKASign([]byte("garbage")); err == nil {
+		t.Error("TKASign() of garbage succeeded")
+	}
+
+	b.nlPrivKey = key.NewNLPrivate()
+	builder = authority.NewUpdater(tka.RemoteSigner{Sign: b.TKASign})
+	if err := builder.SetKeyVote(nlKey.ID(), 4); err == nil {
+		t.Error("signing with an untrusted key succeeded")
+	}
+}
+
+func TestTKAHealth(t *testing.T) {
+	nlPriv := key.NewNLPrivate()
+	nlKey := tka.Key{Kind: tka.Key25519, Public: nlPriv.KeyID(), Votes: 2}
+	authority, genesis, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{nlKey},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{1}, 32)},
+	}, nlPriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+	b := &LocalBackend{logf: t.Logf, nlPrivKey: nlPriv}
+	b.SetTailnetKeyAuthority(authority)
+	defer b.unregisterTKAProbe()
+	defer health.SetTKAHealth(nil)
+
+	if err := b.TKAInform([]tka.AUM{genesis}); err != nil {
+		t.Fatalf("TKAInform() of known updates failed: %v", err)
+	}
+	if err := health.TKAHealth(); err != nil {
+		t.Errorf("TKAHealth() = %v, want healthy", err)
+	}
+
+	// An update signed by an untrusted key fails to apply.
+	builder := authority.NewUpdater(key.NewNLPrivate())
+	if err := builder.SetKeyVote(nlKey.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := builder.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.TKAInform(updates); err == nil {
+		t.Fatal("TKAInform() of an untrusted update succeeded")
+	}
+	if err := health.TKAHealth(); err == nil {
+		t.Error("TKAHealth() healthy after a failed update")
+	}
+
+	// Expired keys are a problem too.
+	builder = authority.NewUpdater(nlPriv)
+	if err := builder.SetKeyExpiry(nlKey.ID(), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if updates, err = builder.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.TKAInform(updates); err != nil {
+		t.Fatalf("TKAInform() failed: %v", err)
+	}
+	if err := health.TKAHealth(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("TKAHealth() = %v, want expired keys", err)
+	}
+}
+
+func TestTKAHealthForks(t *testing.T) {
+	nlPriv := key.NewNLPrivate()
+	nlKey := tka.Key{Kind: tka.Key25519, Public: nlPriv.KeyID(), Votes: 1}
+	otherPriv := key.NewNLPrivate()
+	otherKey := tka.Key{Kind: tka.Key25519, Public: otherPriv.KeyID(), Votes: 2}
+	authority, _, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{nlKey, otherKey},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{1}, 32)},
+	}, otherPriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+	b := &LocalBackend{logf: t.Logf, nlPrivKey: nlPriv}
+	b.SetTailnetKeyAuthority(authority)
+	defer b.unregisterTKAProbe()
+	defer health.SetTKAHealth(nil)
+
+	// fork informs competing updates from head, signed by each of
+	// signers.
+	fork := func(signers ...tka.Signer) {
+		t.Helper()
+		var updates []tka.AUM
+		for i, signer := range signers {
+			builder := authority.NewUpdater(signer)
+			if err := builder.SetKeyVote(otherKey.ID(), uint(3+i)); err != nil {
+				t.Fatal(err)
+			}
+			u, err := builder.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			updates = append(updates, u...)
+		}
+		if err := b.TKAInform(updates); err != nil {
+			t.Fatalf("TKAInform() failed: %v", err)
+		}
+	}
+
+	// A fork between other nodes' updates is settled by fork resolution.
+	fork(otherPriv, otherPriv)
+	if err := health.TKAHealth(); err != nil {
+		t.Errorf("TKAHealth() = %v, want healthy", err)
+	}
+
+	// A fork that this node's update loses isn't.
+	fork(otherPriv, nlPriv)
+	if err := health.TKAHealth(); err == nil || !strings.Contains(err.Error(), "lost") {
+		t.Errorf("TKAHealth() = %v, want this node's update lost", err)
+	}
+}
+
+func TestTKAResign(t *testing.T) {
+	nlPriv := key.NewNLPrivate()
+	nlKey := tka.Key{Kind: tka.Key25519, Public: nlPriv.KeyID(), Votes: 2}
+	otherPriv := key.NewNLPrivate()
+	otherKey := tka.Key{Kind: tka.Key25519, Public: otherPriv.KeyID(), Votes: 1}
+	authority, _, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{nlKey, otherKey},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{1}, 32)},
+	}, nlPriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+	cc := newMockControl(t)
+	store := new(mem.Store)
+	b := &LocalBackend{logf: t.Logf, nlPrivKey: nlPriv, cc: cc, store: store}
+	b.SetTailnetKeyAuthority(authority)
+	defer b.unregisterTKAProbe()
+	defer health.SetTKAHealth(nil)
+
+	nodeKey := key.NewNode().Public()
+	nodePub, _ := nodeKey.MarshalBinary()
+	sig, err := authority.SignNodeKey(nodePub, otherPriv)
+	if err != nil {
+		t.Fatalf("SignNodeKey() failed: %v", err)
+	}
+
+	// A signature that doesn't expire is left alone.
+	b.SetTKANodeKeySignature(sig, nlPriv)
+	if got := b.TKANodeKeySignature(); !bytes.Equal(got, sig) {
+		t.Error("signature that doesn't expire was replaced")
+	}
+	cc.assertCalls("SetNodeKeySignature")
+
+	// Once the key that made it is about to expire, it's replaced.
+	builder := authority.NewUpdater(nlPriv)
+	if err := builder.SetKeyExpiry(otherKey.ID(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := builder.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.TKAInform(updates); err != nil {
+		t.Fatalf("TKAInform() failed: %v", err)
+	}
+	if err := health.TKAHealth(); err != nil {
+		t.Errorf("TKAHealth() = %v, want healthy", err)
+	}
+	resigned := b.TKANodeKeySignature()
+	var decoded tka.NodeKeySignature
+	if err := decoded.Unserialize(resigned); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.KeyID, nlKey.ID()) || !bytes.Equal(decoded.Pubkey, nodePub) {
+		t.Errorf("re-signed signature = %+v, want node key signed by %x", decoded, nlKey.ID())
+	}
+	// The new signature is sent to control, and stored.
+	cc.assertCalls("SetNodeKeySignature")
+	if stored, err := store.ReadState(ipn.TKANodeKeySigStateKey); err != nil || !bytes.Equal(stored, resigned) {
+		t.Errorf("stored signature = %x, %v; want the re-signed one", stored, err)
+	}
+	b2 := &LocalBackend{logf: t.Logf, store: store}
+	b2.SetTailnetKeyAuthority(authority)
+	b2.unregisterTKAProbe()
+	if got := b2.TKANodeKeySignature(); !bytes.Equal(got, resigned) {
+		t.Error("stored signature wasn't loaded")
+	}
+
+	// Without a signer, this node's key is used while it's trusted.
+	b.SetTKANodeKeySignature(sig, nil)
+	if got := b.TKANodeKeySignature(); bytes.Equal(got, sig) {
+		t.Error("signature wasn't replaced using this node's key")
+	}
+
+	// Otherwise, the impending expiry is reported.
+	b.nlPrivKey = key.NewNLPrivate()
+	b.SetTKANodeKeySignature(sig, nil)
+	if err := health.TKAHealth(); err == nil || !strings.Contains(err.Error(), "no signer") {
+		t.Errorf("TKAHealth() = %v, want no signer", err)
+	}
+}
+
+func TestTKAStatusAndLog(t *testing.T) {
+	b := &LocalBackend{logf: t.Logf}
+	if st := b.TKAStatus(); st.Enabled {
+		t.Errorf("TKAStatus() without an authority = %+v, want disabled", st)
+	}
+	if _, err := b.TKALog(10); err == nil {
+		t.Error("TKALog() without an authority succeeded")
+	}
+
+	nlPriv := key.NewNLPrivate()
+	nlKey := tka.Key{Kind: tka.Key25519, Public: nlPriv.KeyID(), Votes: 2, Meta: map[string]string{"owner": "ops"}}
+	authority, _, err := tka.Create(&tka.Mem{}, tka.State{
+		Keys:               []tka.Key{nlKey},
+		DisablementSecrets: [][]byte{bytes.Repeat([]byte{1}, 32)},
+	}, nlPriv)
+	if err != nil {
+		t.Fatalf("tka.Create() failed: %v", err)
+	}
+	b.tka = authority
+	builder := authority.NewUpdater(nlPriv)
+	if err := builder.Annotate(tka.Annotation{Ticket: "OPS-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.SetKeyVote(nlKey.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := builder.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authority.Inform(updates); err != nil {
+		t.Fatal(err)
+	}
+
+	st := b.TKAStatus()
+	if !st.Enabled || st.Head != authority.Head().String() || st.SignatureThreshold != 1 {
+		t.Errorf("TKAStatus() = %+v", st)
+	}
+	if len(st.Keys) != 1 || st.Keys[0].Votes != 3 || st.Keys[0].Kind != "25519" || st.Keys[0].Meta["owner"] != "ops" {
+		t.Errorf("TKAStatus().Keys = %+v", st.Keys)
+	}
+
+	log, err := b.TKALog(2)
+	if err != nil {
+		t.Fatalf("TKALog() failed: %v", err)
+	}
+	if len(log) != 2 {
+		t.Fatalf("TKALog(2) returned %d updates", len(log))
+	}
+	if log[0].Hash != st.Head || log[0].Kind != "update-key" {
+		t.Errorf("newest update = %+v, want the vote change at head", log[0])
+	}
+	if log[1].Kind != "annotate" || log[1].Ticket != "OPS-1" {
+		t.Errorf("second update = %+v, want the annotation", log[1])
+	}
+}
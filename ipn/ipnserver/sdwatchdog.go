@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/systemd"
+)
+
+// runSystemdWatchdog keeps systemd's watchdog (per the unit's
+// WatchdogSec) from firing while tailscaled isn't wedged, so that
+// systemd restarts it if it is. It also reports changes in overall
+// health as the unit's status. It runs until ctx is done.
+func runSystemdWatchdog(ctx context.Context, logf logger.Logf) {
+	unregister := health.RegisterWatcher(func(sys health.Subsystem, err error) {
+		if sys != health.SysOverall {
+			return
+		}
+		if err != nil {
+			systemd.Status("Unhealthy: %v", err)
+		} else {
+			systemd.Status("Healthy")
+		}
+	})
+	defer unregister()
+
+	interval, ok := systemd.WatchdogInterval()
+	if !ok {
+		<-ctx.Done()
+		return
+	}
+	// Ping at half the interval, as systemd recommends.
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	wasWedged := false
+	for {
+		if err := health.WedgedError(); err != nil {
+			if !wasWedged {
+				logf("systemd watchdog: not notifying while wedged: %v", err)
+			}
+			wasWedged = true
+		} else {
+			if wasWedged {
+				logf("systemd watchdog: no longer wedged")
+			}
+			wasWedged = false
+			systemd.Watchdog()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
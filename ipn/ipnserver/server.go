@@ -88,6 +88,11 @@ type Options struct {
 
 	// LoginFlags specifies the LoginFlags to pass to the client.
 	LoginFlags controlclient.LoginFlags
+
+	// TaildropReceiveHook, if non-empty, is the path of a command to
+	// run each time a Taildrop file finishes being received; see
+	// ipnlocal.LocalBackend.SetFileReceivedHook.
+	TaildropReceiveHook string
 }
 
 // Server is an IPN backend and its set of 0 or more active localhost
@@ -135,6 +140,33 @@ type connIdentity struct {
 	User   *user.User
 }
 
+// actor returns a description of the user and process on the other end
+// of the connection, for the audit log, or the empty string if unknown.
+func (ci connIdentity) actor() string {
+	var uid string
+	var pid int
+	if ci.NotWindows {
+		if ci.Creds == nil {
+			return ""
+		}
+		uid, _ = ci.Creds.UserID()
+		pid, _ = ci.Creds.PID()
+	} else {
+		uid, pid = ci.UserID, ci.Pid
+		if ci.User != nil && ci.User.Username != "" {
+			uid = ci.User.Username
+		}
+	}
+	var parts []string
+	if uid != "" {
+		parts = append(parts, "user "+uid)
+	}
+	if pid != 0 {
+		parts = append(parts, fmt.Sprintf("pid %d", pid))
+	}
+	return strings.Join(parts, ", ")
+}
+
 // getConnIdentity returns the localhost TCP connection's identity information
 // (pid, userid, user). If it's not Windows (for now), it returns a nil error
 // and a ConnIdentity with NotWindows set true. It's only an error if we expected
@@ -767,6 +799,7 @@ func New(logf logger.Logf, logid string, store ipn.StateStore, eng wgengine.Engi
 		return nil, fmt.Errorf("NewLocalBackend: %v", err)
 	}
 	b.SetVarRoot(opts.VarRoot)
+	b.SetFileReceivedHook(opts.TaildropReceiveHook)
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
@@ -867,6 +900,7 @@ func (s *Server) Run(ctx context.Context, ln net.Listener) error {
 	}
 
 	systemd.Ready()
+	go runSystemdWatchdog(ctx, s.logf)
 	bo := backoff.NewBackoff("ipnserver", s.logf, 30*time.Second)
 	var connNum int
 	for {
@@ -893,6 +927,12 @@ func (s *Server) Run(ctx context.Context, ln net.Listener) error {
 //
 // It's only currently (2020-10-29) used on Windows.
 func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
+	BabysitProcWithRestart(ctx, args, logf, nil)
+}
+
+// BabysitProcWithRestart is like BabysitProc, but also kills the child
+// process, so that it's restarted, each time restart receives a value.
+func BabysitProcWithRestart(ctx context.Context, args []string, logf logger.Logf, restart <-chan struct{}) {
 
 	executable, err := os.Executable()
 	if err != nil {
@@ -993,7 +1033,17 @@ func BabysitProc(ctx context.Context, args []string, logf logger.Logf) {
 			proc.p = cmd.Process
 			proc.mu.Unlock()
 
+			waitDone := make(chan struct{})
+			go func(p *os.Process) {
+				select {
+				case <-restart:
+					logf("BabysitProc: restart requested")
+					p.Kill()
+				case <-waitDone:
+				}
+			}(cmd.Process)
 			err = cmd.Wait()
+			close(waitDone)
 			log.Printf("subprocess exited: %v", err)
 		}
 
@@ -1064,6 +1114,7 @@ func (s *Server) localhostHandler(ci connIdentity) http.Handler {
 	lah := localapi.NewHandler(s.b, s.logf, s.backendLogID)
 	lah.PermitRead, lah.PermitWrite = s.localAPIPermissions(ci)
 	lah.PermitCert = s.connCanFetchCerts(ci)
+	lah.Actor = ci.actor()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/localapi/") {
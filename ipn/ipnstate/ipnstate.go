@@ -20,6 +20,7 @@
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/types/views"
 	"tailscale.com/util/dnsname"
 )
@@ -569,3 +570,131 @@ func sortKey(ps *PeerStatus) string {
 	raw := ps.PublicKey.Raw32()
 	return string(raw[:])
 }
+
+// ControlDiag contains diagnostics about the node's recent attempts to
+// connect to its control plane server. It's returned by the LocalAPI to
+// help debug "can't connect to control" problems.
+//
+// Each slice holds only the most recent few entries, oldest first.
+type ControlDiag struct {
+	ServerURL string // URL of the control server
+
+	DNS        []ControlDNSLookup
+	Dials      []ControlDial
+	Handshakes []ControlHandshake
+	HTTP       []ControlHTTPResult
+
+	// LastSuccess is the last time an HTTP request to the control
+	// server returned a response (of any status).
+	LastSuccess time.Time `json:",omitempty"`
+}
+
+// ControlDNSLookup is the result of resolving the control server's host.
+type ControlDNSLookup struct {
+	Time     time.Time
+	Host     string
+	IPs      []netip.Addr `json:",omitempty"`
+	Duration time.Duration
+	Err      string `json:",omitempty"`
+}
+
+// ControlDial is a single TCP dial attempt to the control server
+// or to a proxy in front of it.
+type ControlDial struct {
+	Time     time.Time
+	Network  string // "tcp", "tcp4", "tcp6"
+	Addr     string // ip:port dialed
+	Duration time.Duration
+	Err      string `json:",omitempty"`
+}
+
+// ControlHandshake is the result of one ts2021 Noise handshake attempt.
+type ControlHandshake struct {
+	Time     time.Time
+	URL      string // URL used for the HTTP upgrade
+	Duration time.Duration
+	Err      string `json:",omitempty"`
+}
+
+// ControlHTTPResult is the result of one HTTP request to the control
+// server, over either TLS or the Noise transport.
+type ControlHTTPResult struct {
+	Time       time.Time
+	URL        string
+	Noise      bool   `json:",omitempty"` // whether the Noise transport was used
+	Proxy      string `json:",omitempty"` // proxy URL used, if any
+	StatusCode int    `json:",omitempty"` // zero if no response
+	Duration   time.Duration
+	Err        string `json:",omitempty"`
+}
+
+// AuditLogEntry is an entry in the node's local audit log of changes
+// to its prefs and to the policy it received from the control plane.
+type AuditLogEntry struct {
+	Time time.Time
+
+	// Kind is what changed: "prefs", "packet-filter", "ssh-policy",
+	// "dns" or "routes".
+	Kind string
+
+	// Source is what made the change: "EditPrefs" (LocalAPI, such
+	// as the CLI), "SetPrefs" or "Start" (IPN bus, such as the
+	// Windows GUI), or "control".
+	Source string
+
+	// Actor, if known, identifies the local user or process that
+	// made the change.
+	Actor string `json:",omitempty"`
+
+	// Change is a human-readable description of the change.
+	Change string
+}
+
+// TKAStatus describes the tailnet key authority, as returned by the
+// tka-status LocalAPI endpoint.
+type TKAStatus struct {
+	// Enabled is whether this node has a key authority. If not, the
+	// other fields are empty.
+	Enabled bool
+
+	// Head is the hash of the authority's latest update, in base32.
+	Head string `json:",omitempty"`
+
+	// SignatureThreshold is how many distinct trusted keys must sign
+	// each update.
+	SignatureThreshold uint `json:",omitempty"`
+
+	// Keys are the keys the authority trusts.
+	Keys []TKAKey `json:",omitempty"`
+}
+
+// TKAKey describes a key trusted by the tailnet key authority.
+type TKAKey struct {
+	KeyID tkatype.KeyID
+	Kind  string // such as "25519"
+	Votes uint
+	Meta  map[string]string `json:",omitempty"`
+}
+
+// TKAUpdate describes an update to the tailnet key authority, as
+// returned by the tka-log LocalAPI endpoint.
+type TKAUpdate struct {
+	// Hash is the update's hash, in base32.
+	Hash string
+
+	// Kind is the kind of update, such as "add-key".
+	Kind string
+
+	// KeyID identifies the key the update affects, if any.
+	KeyID tkatype.KeyID `json:",omitempty"`
+
+	// Signers identify the keys that signed the update.
+	Signers []tkatype.KeyID
+
+	// Ticket and Reason are those of an annotation.
+	Ticket string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+
+	// Raw is the serialized update.
+	Raw []byte
+}
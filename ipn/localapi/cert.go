@@ -15,6 +15,7 @@
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -30,12 +31,16 @@
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/acme"
+	"tailscale.com/atomicfile"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/types/logger"
 	"tailscale.com/version/distro"
@@ -74,6 +79,12 @@ func (h *Handler) certDir() (string, error) {
 
 var acmeDebug = envknob.Bool("TS_DEBUG_ACME")
 
+// serveCert serves a cert for the domain in the URL path, which may be a
+// wildcard ("*.foo.ts.net"), with any "san" query parameters naming extra
+// DNS names (subject alternative names) for it to cover.
+//
+// A POST with "renew=true" gets a new cert even if the cached one is still
+// valid.
 func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite && !h.PermitCert {
 		http.Error(w, "cert access denied", http.StatusForbidden)
@@ -92,8 +103,10 @@ func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	names := certNames(domain, r.URL.Query()["san"])
+
 	now := time.Now()
-	logf := logger.WithPrefix(h.logf, fmt.Sprintf("cert(%q): ", domain))
+	logf := logger.WithPrefix(h.logf, fmt.Sprintf("cert(%q): ", names))
 	traceACME := func(v any) {
 		if !acmeDebug {
 			return
@@ -102,18 +115,19 @@ func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 		log.Printf("acme %T: %s", v, j)
 	}
 
-	if pair, ok := h.getCertPEMCached(dir, domain, now); ok {
+	force := r.Method == "POST" && r.FormValue("renew") == "true"
+	if pair, ok := h.getCertPEMCached(dir, names, now); ok && !force {
 		future := now.AddDate(0, 0, 14)
-		if h.shouldStartDomainRenewal(dir, domain, future) {
+		if h.shouldStartDomainRenewal(dir, names, future) {
 			logf("starting async renewal")
 			// Start renewal in the background.
-			go h.getCertPEM(context.Background(), logf, traceACME, dir, domain, future)
+			go h.getCertPEM(context.Background(), logf, traceACME, dir, names, future, false)
 		}
 		serveKeyPair(w, r, pair)
 		return
 	}
 
-	pair, err := h.getCertPEM(r.Context(), logf, traceACME, dir, domain, now)
+	pair, err := h.getCertPEM(r.Context(), logf, traceACME, dir, names, now, force)
 	if err != nil {
 		logf("getCertPEM: %v", err)
 		http.Error(w, fmt.Sprint(err), 500)
@@ -122,17 +136,44 @@ func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 	serveKeyPair(w, r, pair)
 }
 
-func (h *Handler) shouldStartDomainRenewal(dir, domain string, future time.Time) bool {
+// certNames returns the DNS names for a cert for domain and the extra names
+// sans, without duplicates. The first is domain.
+func certNames(domain string, sans []string) []string {
+	names := []string{domain}
+	for _, san := range sans {
+		if !containsString(names, san) {
+			names = append(names, san)
+		}
+	}
+	return names
+}
+
+// certFileBase returns the base name of the cached key and cert files for a
+// cert for names, whose first element is its primary name.
+func certFileBase(names []string) string {
+	// "*" isn't permitted in file names on Windows.
+	base := strings.Replace(names[0], "*", "wildcard", 1)
+	if len(names) == 1 {
+		return base
+	}
+	sans := append([]string(nil), names[1:]...)
+	sort.Strings(sans)
+	sum := sha256.Sum256([]byte(strings.Join(sans, ",")))
+	return fmt.Sprintf("%s+%x", base, sum[:6])
+}
+
+func (h *Handler) shouldStartDomainRenewal(dir string, names []string, future time.Time) bool {
 	renewMu.Lock()
 	defer renewMu.Unlock()
 	now := time.Now()
-	if last, ok := lastRenewCheck[domain]; ok && now.Sub(last) < time.Minute {
+	base := certFileBase(names)
+	if last, ok := lastRenewCheck[base]; ok && now.Sub(last) < time.Minute {
 		// We checked very recently. Don't bother reparsing &
 		// validating the x509 cert.
 		return false
 	}
-	lastRenewCheck[domain] = now
-	_, ok := h.getCertPEMCached(dir, domain, future)
+	lastRenewCheck[base] = now
+	_, ok := h.getCertPEMCached(dir, names, future)
 	return !ok
 }
 
@@ -157,27 +198,31 @@ type keyPair struct {
 	cached  bool
 }
 
-func keyFile(dir, domain string) string  { return filepath.Join(dir, domain+".key") }
-func certFile(dir, domain string) string { return filepath.Join(dir, domain+".crt") }
+func keyFile(dir, base string) string  { return filepath.Join(dir, base+".key") }
+func certFile(dir, base string) string { return filepath.Join(dir, base+".crt") }
 
 // getCertPEMCached returns a non-nil keyPair and true if a cached
-// keypair for domain exists on disk in dir that is valid at the
+// keypair for names exists on disk in dir that is valid at the
 // provided now time.
-func (h *Handler) getCertPEMCached(dir, domain string, now time.Time) (p *keyPair, ok bool) {
-	if keyPEM, err := os.ReadFile(keyFile(dir, domain)); err == nil {
-		certPEM, _ := os.ReadFile(certFile(dir, domain))
-		if validCertPEM(domain, keyPEM, certPEM, now) {
+func (h *Handler) getCertPEMCached(dir string, names []string, now time.Time) (p *keyPair, ok bool) {
+	base := certFileBase(names)
+	if keyPEM, err := os.ReadFile(keyFile(dir, base)); err == nil {
+		certPEM, _ := os.ReadFile(certFile(dir, base))
+		if validCertPEM(names, keyPEM, certPEM, now) {
 			return &keyPair{certPEM: certPEM, keyPEM: keyPEM, cached: true}, true
 		}
 	}
 	return nil, false
 }
 
-func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME func(any), dir, domain string, now time.Time) (*keyPair, error) {
+// getCertPEM returns a cert for names, from the cache in dir if it has one
+// valid at now and force is false, else from ACME.
+func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME func(any), dir string, names []string, now time.Time, force bool) (*keyPair, error) {
 	acmeMu.Lock()
 	defer acmeMu.Unlock()
 
-	if p, ok := h.getCertPEMCached(dir, domain, now); ok {
+	if p, ok := h.getCertPEMCached(dir, names, now); ok && !force {
+		noteCertExpiry(dir, names)
 		return p, nil
 	}
 
@@ -211,13 +256,17 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 		return nil, fmt.Errorf("unexpected ACME account status %q", a.Status)
 	}
 
-	// Before hitting LetsEncrypt, see if this is a domain that Tailscale will do DNS challenges for.
+	// Before hitting LetsEncrypt, see if these are domains that Tailscale will do DNS challenges for.
 	st := h.b.StatusWithoutPeers()
-	if err := checkCertDomain(st, domain); err != nil {
-		return nil, err
+	var ids []acme.AuthzID
+	for _, name := range names {
+		if err := checkCertDomain(st, name); err != nil {
+			return nil, err
+		}
+		ids = append(ids, acme.AuthzID{Type: "dns", Value: name})
 	}
 
-	order, err := ac.AuthorizeOrder(ctx, []acme.AuthzID{{Type: "dns", Value: domain}})
+	order, err := ac.AuthorizeOrder(ctx, ids)
 	if err != nil {
 		return nil, err
 	}
@@ -229,13 +278,19 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 			return nil, err
 		}
 		traceACME(az)
+		if az.Status == acme.StatusValid {
+			continue
+		}
 		for _, ch := range az.Challenges {
 			if ch.Type == "dns-01" {
 				rec, err := ac.DNS01ChallengeRecord(ch.Token)
 				if err != nil {
 					return nil, err
 				}
-				key := "_acme-challenge." + domain
+				// For a wildcard, the identifier is the domain
+				// without the "*." prefix, which is where the
+				// challenge record goes.
+				key := "_acme-challenge." + az.Identifier.Value
 
 				var resolver net.Resolver
 				var ok bool
@@ -261,6 +316,14 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 					return nil, fmt.Errorf("Accept: %v", err)
 				}
 				traceACME(chal)
+				if len(order.AuthzURLs) > 1 {
+					// A domain and its wildcard share a challenge
+					// record name, so wait for this challenge to
+					// be checked before SetDNS replaces its record.
+					if _, err := ac.WaitAuthorization(ctx, az.URI); err != nil {
+						return nil, fmt.Errorf("WaitAuthorization: %w", err)
+					}
+				}
 				break
 			}
 		}
@@ -289,11 +352,7 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 	if err := encodeECDSAKey(&privPEM, certPrivKey); err != nil {
 		return nil, err
 	}
-	if err := ioutil.WriteFile(keyFile(dir, domain), privPEM.Bytes(), 0600); err != nil {
-		return nil, err
-	}
-
-	csr, err := certRequest(certPrivKey, domain, nil)
+	csr, err := certRequest(certPrivKey, names[0], nil, names...)
 	if err != nil {
 		return nil, err
 	}
@@ -312,13 +371,159 @@ func (h *Handler) getCertPEM(ctx context.Context, logf logger.Logf, traceACME fu
 			return nil, err
 		}
 	}
-	if err := ioutil.WriteFile(certFile(dir, domain), certPEM.Bytes(), 0644); err != nil {
+	base := certFileBase(names)
+	_, statErr := os.Stat(certFile(dir, base))
+	renewal := statErr == nil
+	// Replace the key and then the cert, each atomically, so readers of
+	// the cert dir never see a partial file. The pair is consistent again
+	// once the cert is written, which is when the event is published.
+	if err := atomicfile.WriteFile(keyFile(dir, base), privPEM.Bytes(), 0600); err != nil {
 		return nil, err
 	}
+	if err := atomicfile.WriteFile(certFile(dir, base), certPEM.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	if ci, err := certInfo(dir, base); err == nil {
+		publishCertEvent(apitype.CertEvent{CertInfo: ci, Renewal: renewal})
+		health.SetTLSCertExpiry(names[0], ci.NotAfter)
+	}
 
 	return &keyPair{certPEM: certPEM.Bytes(), keyPEM: privPEM.Bytes()}, nil
 }
 
+// noteCertExpiry tells the health package when the cert for names in dir
+// expires.
+func noteCertExpiry(dir string, names []string) {
+	if ci, err := certInfo(dir, certFileBase(names)); err == nil {
+		health.SetTLSCertExpiry(names[0], ci.NotAfter)
+	}
+}
+
+// serveCerts serves the certs in the cert dir, as JSON []apitype.CertInfo.
+//
+// The cert dir's layout is stable, for other programs to use the certs
+// directly: each cert is a PEM certificate chain in "<name>.crt", with its
+// PEM private key in "<name>.key", where <name> is the cert's first DNS name
+// with any "*" replaced by "wildcard" and, if it has other names, a "+" and
+// a hash of them appended. Both files are replaced atomically on renewal,
+// after which "cert-events" subscribers are notified.
+func (h *Handler) serveCerts(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite && !h.PermitCert {
+		http.Error(w, "cert access denied", http.StatusForbidden)
+		return
+	}
+	dir, err := h.certDir()
+	if err != nil {
+		h.logf("certDir: %v", err)
+		http.Error(w, "failed to get cert dir", 500)
+		return
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	certs := []apitype.CertInfo{}
+	for _, ent := range ents {
+		base := strings.TrimSuffix(ent.Name(), ".crt")
+		if base == ent.Name() || ent.IsDir() {
+			continue
+		}
+		ci, err := certInfo(dir, base)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, ci)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(certs)
+}
+
+// certInfo returns information about the cert with the given base name in
+// dir, as named by certFileBase.
+func certInfo(dir, base string) (apitype.CertInfo, error) {
+	ci := apitype.CertInfo{
+		CertPath: certFile(dir, base),
+		KeyPath:  keyFile(dir, base),
+	}
+	certPEM, err := os.ReadFile(ci.CertPath)
+	if err != nil {
+		return ci, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return ci, errors.New("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ci, err
+	}
+	ci.Names = leaf.DNSNames
+	if cn := leaf.Subject.CommonName; cn != "" && !containsString(ci.Names, cn) {
+		ci.Names = append([]string{cn}, ci.Names...)
+	}
+	ci.NotBefore = leaf.NotBefore
+	ci.NotAfter = leaf.NotAfter
+	return ci, nil
+}
+
+var (
+	certEventsMu   sync.Mutex
+	certEventsSubs = map[chan apitype.CertEvent]bool{}
+)
+
+// publishCertEvent sends ev to the current "cert-events" subscribers,
+// dropping it for those that are behind.
+func publishCertEvent(ev apitype.CertEvent) {
+	certEventsMu.Lock()
+	defer certEventsMu.Unlock()
+	for ch := range certEventsSubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// serveCertEvents streams an apitype.CertEvent, as a line of JSON, each
+// time a cert is obtained or renewed, until the client goes away.
+func (h *Handler) serveCertEvents(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite && !h.PermitCert {
+		http.Error(w, "cert access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan apitype.CertEvent, 16)
+	certEventsMu.Lock()
+	certEventsSubs[ch] = true
+	certEventsMu.Unlock()
+	defer func() {
+		certEventsMu.Lock()
+		delete(certEventsSubs, ch)
+		certEventsMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
 // certRequest generates a CSR for the given common name cn and optional SANs.
 func certRequest(key crypto.Signer, cn string, ext []pkix.Extension, san ...string) ([]byte, error) {
 	req := &x509.CertificateRequest{
@@ -390,7 +595,9 @@ func acmeKey(dir string) (crypto.Signer, error) {
 	return privKey, nil
 }
 
-func validCertPEM(domain string, keyPEM, certPEM []byte, now time.Time) bool {
+// validCertPEM reports whether keyPEM and certPEM are a valid key pair for a
+// cert covering all of names at now.
+func validCertPEM(names []string, keyPEM, certPEM []byte, now time.Time) bool {
 	if len(keyPEM) == 0 || len(certPEM) == 0 {
 		return false
 	}
@@ -415,19 +622,49 @@ func validCertPEM(domain string, keyPEM, certPEM []byte, now time.Time) bool {
 		return false
 	}
 	_, err = leaf.Verify(x509.VerifyOptions{
-		DNSName:       domain,
 		CurrentTime:   now,
 		Intermediates: intermediates,
 	})
-	return err == nil
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			// VerifyHostname doesn't accept wildcards; require
+			// the exact name.
+			if !containsString(leaf.DNSNames, name) {
+				return false
+			}
+		} else if leaf.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
+// checkCertDomain reports whether Tailscale will do DNS challenges for
+// domain, either one of st's cert domains or a wildcard ("*.<domain>") for
+// one of them.
 func checkCertDomain(st *ipnstate.Status, domain string) error {
 	if domain == "" {
 		return errors.New("missing domain name")
 	}
+	// A wildcard's DNS challenge is for the domain it's under.
+	base := strings.TrimPrefix(domain, "*.")
+	if base == "" {
+		return errors.New("missing domain name")
+	}
 	for _, d := range st.CertDomains {
-		if d == domain {
+		if d == base {
 			return nil
 		}
 	}
@@ -436,7 +673,7 @@ func checkCertDomain(st *ipnstate.Status, domain string) error {
 	okay := st.CertDomains[:len(st.CertDomains):len(st.CertDomains)]
 	if st.Self != nil {
 		if v := strings.Trim(st.Self.DNSName, "."); v != "" {
-			if v == domain {
+			if v == base {
 				return nil
 			}
 			okay = append(okay, v)
@@ -15,3 +15,11 @@
 func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "disabled on "+runtime.GOOS, http.StatusNotFound)
 }
+
+func (h *Handler) serveCerts(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "disabled on "+runtime.GOOS, http.StatusNotFound)
+}
+
+func (h *Handler) serveCertEvents(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "disabled on "+runtime.GOOS, http.StatusNotFound)
+}
@@ -26,11 +26,13 @@
 	"time"
 
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netutil"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/version"
@@ -75,6 +77,11 @@ type Handler struct {
 	// cert fetching access.
 	PermitCert bool
 
+	// Actor, if non-empty, identifies the local user or process on
+	// the other end of the connection. It's recorded in the audit log
+	// for changes made through this handler.
+	Actor string
+
 	b            *ipnlocal.LocalBackend
 	logf         logger.Logf
 	backendLogID string
@@ -112,6 +119,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/localapi/v0/whois":
 		h.serveWhoIs(w, r)
+	case "/localapi/v0/certs":
+		h.serveCerts(w, r)
+	case "/localapi/v0/cert-events":
+		h.serveCertEvents(w, r)
 	case "/localapi/v0/goroutines":
 		h.serveGoroutines(w, r)
 	case "/localapi/v0/profile":
@@ -142,12 +153,38 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveMetrics(w, r)
 	case "/localapi/v0/debug":
 		h.serveDebug(w, r)
+	case "/localapi/v0/debug-control":
+		h.serveDebugControl(w, r)
+	case "/localapi/v0/audit-log":
+		h.serveAuditLog(w, r)
+	case "/localapi/v0/log-levels":
+		h.serveLogLevels(w, r)
+	case "/localapi/v0/health":
+		h.serveHealth(w, r)
+	case "/localapi/v0/doctor":
+		h.serveDoctor(w, r)
+	case "/localapi/v0/control-health":
+		h.serveControlHealth(w, r)
+	case "/localapi/v0/notifications":
+		h.serveNotifications(w, r)
+	case "/localapi/v0/control-health-ack":
+		h.serveControlHealthAck(w, r)
+	case "/localapi/v0/ssh-recordings":
+		h.serveSSHRecordings(w, r)
 	case "/localapi/v0/set-expiry-sooner":
 		h.serveSetExpirySooner(w, r)
 	case "/localapi/v0/dial":
 		h.serveDial(w, r)
 	case "/localapi/v0/id-token":
 		h.serveIDToken(w, r)
+	case "/localapi/v0/tka-sign":
+		h.serveTKASign(w, r)
+	case "/localapi/v0/tka-status":
+		h.serveTKAStatus(w, r)
+	case "/localapi/v0/tka-log":
+		h.serveTKALog(w, r)
+	case "/localapi/v0/tka-node-key-signature":
+		h.serveTKANodeKeySignature(w, r)
 	case "/localapi/v0/upload-client-metrics":
 		h.serveUploadClientMetrics(w, r)
 	case "/":
@@ -157,6 +194,122 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveTKASign signs the serialized AUM in the request body with this
+// node's network-lock key, for another node building updates, and
+// returns the signatures.
+func (h *Handler) serveTKASign(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "tka-sign access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	aum, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sigs, err := h.b.TKASign(aum)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sigs)
+}
+
+// serveTKAStatus returns the key authority's head and trusted keys.
+func (h *Handler) serveTKAStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "tka-status access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.TKAStatus())
+}
+
+// maxTKALogLimit is the most updates serveTKALog returns.
+const maxTKALogLimit = 2000
+
+// serveTKALog returns the key authority's most recent updates, newest
+// first, up to the "limit" query parameter (default 50).
+func (h *Handler) serveTKALog(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "tka-log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	limit := 50
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTKALogLimit {
+			http.Error(w, fmt.Sprintf("invalid limit; want 1 to %d", maxTKALogLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	updates, err := h.b.TKALog(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(updates)
+}
+
+// serveTKANodeKeySignature returns this node's key signature on GET,
+// and sets it to the serialized tka.NodeKeySignature in the request body
+// on POST. A signature set this way is re-signed with this node's
+// network-lock key before it expires, while the key is trusted.
+func (h *Handler) serveTKANodeKeySignature(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "tka-node-key-signature access denied", http.StatusForbidden)
+			return
+		}
+		sig := h.b.TKANodeKeySignature()
+		if sig == nil {
+			http.Error(w, "no node key signature", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(sig)
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "tka-node-key-signature access denied", http.StatusForbidden)
+			return
+		}
+		sig, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var decoded tka.NodeKeySignature
+		if err := decoded.Unserialize(sig); err != nil {
+			http.Error(w, "invalid node key signature: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.b.SetTKANodeKeySignature(sig, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or POST", 400)
+	}
+}
+
 // serveIDToken handles requests to get an OIDC ID token.
 func (h *Handler) serveIDToken(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
@@ -274,6 +427,13 @@ func (h *Handler) serveMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "text/plain")
+	if r.Method == "POST" && defBool(r.FormValue("reset"), false) {
+		// Counters are reported as their increase since the
+		// previous reset, for callers that collect metrics
+		// locally rather than relying on their upload.
+		clientmetric.WritePrometheusSnapshot(w, clientmetric.SnapshotAndReset())
+		return
+	}
 	clientmetric.WritePrometheusExpositionFormat(w)
 }
 
@@ -306,6 +466,109 @@ func (h *Handler) serveDebug(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "done\n")
 }
 
+// serveDebugControl returns diagnostics about the node's recent
+// attempts to connect to the control server.
+func (h *Handler) serveDebugControl(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	diag, err := h.b.ControlDiagnostics()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(diag)
+}
+
+// serveAuditLog returns the local audit log of prefs and policy
+// changes. The optional "since" (RFC 3339) and "limit" query
+// parameters restrict which entries are returned.
+func (h *Handler) serveAuditLog(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "audit log access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid 'since' parameter: "+err.Error(), 400)
+			return
+		}
+	}
+	var limit int
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid 'limit' parameter: "+err.Error(), 400)
+			return
+		}
+	}
+	entries, err := h.b.AuditLog(since, limit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(entries)
+}
+
+// serveLogLevels reports (on GET) or sets (on POST, with "component"
+// and "level" parameters) the per-component log levels of the process.
+func (h *Handler) serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "log-levels access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "log-levels access denied", http.StatusForbidden)
+			return
+		}
+		component := r.FormValue("component")
+		if component == "" {
+			http.Error(w, "missing 'component' parameter", 400)
+			return
+		}
+		var level logger.Level
+		if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			http.Error(w, "invalid 'level' parameter: "+err.Error(), 400)
+			return
+		}
+		logger.SetComponentLevel(component, level)
+		h.logf("log level of %q set to %v", component, level)
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	levels := map[string]string{}
+	for c, l := range logger.ComponentLevels() {
+		levels[c] = l.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(levels)
+}
+
 // serveProfileFunc is the implementation of Handler.serveProfile, after auth,
 // for platforms where we want to link it in.
 var serveProfileFunc func(http.ResponseWriter, *http.Request)
@@ -407,7 +670,7 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var err error
-		prefs, err = h.b.EditPrefs(mp)
+		prefs, err = h.b.EditPrefsAs(mp, h.Actor)
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadRequest)
@@ -656,6 +919,126 @@ func (h *Handler) serveSetExpirySooner(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "done\n")
 }
 
+// serveHealth returns the node's health state as a JSON health.State.
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "health access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health.CurrentState())
+}
+
+// serveDoctor runs all the health checks now and returns the
+// health.Report.
+func (h *Handler) serveDoctor(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "doctor access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health.RunChecks(r.Context()))
+}
+
+// serveControlHealth returns the health problems reported by the
+// control plane, with their IDs and acknowledgement state.
+func (h *Handler) serveControlHealth(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "control-health access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.ControlHealth())
+}
+
+// serveNotifications streams an apitype.Notification, as a line of
+// JSON, for each user-facing event (for GUI clients to show as desktop
+// notifications) until the client goes away.
+func (h *Handler) serveNotifications(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "notifications access denied", http.StatusForbidden)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, unsubscribe := h.b.SubscribeNotifications()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case n := <-ch:
+			if err := enc.Encode(n); err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
+// serveSSHRecordings serves the list of Tailscale SSH sessions
+// recorded to local disk. It requires write access, as who logged in
+// where and when is sensitive.
+func (h *Handler) serveSSHRecordings(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "ssh-recordings access denied", http.StatusForbidden)
+		return
+	}
+	recs, err := h.b.SSHRecordings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
+
+// serveControlHealthAck acknowledges the control plane health message
+// given by the "id" parameter, or, if the "snooze" parameter is set
+// to a duration such as "8h", snoozes it for that long.
+func (h *Handler) serveControlHealthAck(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "control-health-ack access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing 'id' parameter", http.StatusBadRequest)
+		return
+	}
+	var until time.Time
+	if v := r.FormValue("snooze"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid 'snooze' duration", http.StatusBadRequest)
+			return
+		}
+		until = time.Now().Add(d)
+	}
+	if err := h.b.AckControlHealth(id, until); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "done\n")
+}
+
 func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	if r.Method != "POST" {
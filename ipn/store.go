@@ -38,6 +38,11 @@
 	// NLKeyStateKey is the key under which we store the nodes'
 	// network-lock node key, in its key.NLPrivate.MarshalText representation.
 	NLKeyStateKey = StateKey("_nl-node-key")
+
+	// TKANodeKeySigStateKey is the key under which we store the tailnet
+	// key authority's signature of the node's key, as a serialized
+	// tka.NodeKeySignature.
+	TKANodeKeySigStateKey = StateKey("_tka-node-key-sig")
 )
 
 // StateStore persists state, and produces it back on request.
@@ -48,3 +53,11 @@ type StateStore interface {
 	// WriteState saves bs as the state associated with ID.
 	WriteState(id StateKey, bs []byte) error
 }
+
+// WritabilityChecker is implemented by StateStores that can check
+// whether they can still persist state, without changing it.
+type WritabilityChecker interface {
+	// CheckWritable returns an error if the store can't currently
+	// persist state, such as because its disk is full or read-only.
+	CheckWritable() error
+}
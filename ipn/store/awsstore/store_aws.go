@@ -19,6 +19,7 @@
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/types/logger"
@@ -151,7 +152,9 @@ func (s *awsStore) WriteState(id ipn.StateKey, bs []byte) (err error) {
 	}
 
 	// Persist the state in AWS SSM parameter store
-	return s.persistState()
+	err = s.persistState()
+	health.SetStateStoreHealth(err)
+	return err
 }
 
 // PersistState saves the states into the AWS SSM parameter store
@@ -10,6 +10,7 @@
 	"context"
 	"time"
 
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/kube"
 	"tailscale.com/types/logger"
@@ -55,7 +56,8 @@ func (s *Store) ReadState(id ipn.StateKey) ([]byte, error) {
 }
 
 // WriteState implements the StateStore interface.
-func (s *Store) WriteState(id ipn.StateKey, bs []byte) error {
+func (s *Store) WriteState(id ipn.StateKey, bs []byte) (err error) {
+	defer func() { health.SetStateStoreHealth(err) }()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -83,3 +85,20 @@ func (s *Store) WriteState(id ipn.StateKey, bs []byte) error {
 	}
 	return err
 }
+
+// CheckWritable implements ipn.WritabilityChecker. It updates the secret
+// without changing it.
+func (s *Store) CheckWritable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	secret, err := s.client.GetSecret(ctx, s.secretName)
+	if err != nil {
+		if st, ok := err.(*kube.Status); ok && st.Code == 404 {
+			// Not written yet; WriteState will create it.
+			return nil
+		}
+		return err
+	}
+	return s.client.UpdateSecret(ctx, secret)
+}
@@ -17,6 +17,7 @@
 	"sync"
 
 	"tailscale.com/atomicfile"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/paths"
@@ -186,5 +187,31 @@ func (s *FileStore) WriteState(id ipn.StateKey, bs []byte) error {
 	if err != nil {
 		return err
 	}
-	return atomicfile.WriteFile(s.path, bs, 0600)
+	err = atomicfile.WriteFile(s.path, bs, 0600)
+	health.SetStateStoreHealth(err)
+	return err
+}
+
+// CheckWritable implements ipn.WritabilityChecker. It writes the state to
+// a temporary file alongside the state file, which it then removes.
+func (s *FileStore) CheckWritable() error {
+	s.mu.RLock()
+	bs, err := json.MarshalIndent(s.cache, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".check-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(bs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
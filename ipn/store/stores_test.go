@@ -5,7 +5,9 @@
 package store
 
 import (
+	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"tailscale.com/ipn"
@@ -178,3 +180,33 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestFileStoreCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(t.Logf, filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc := store.(ipn.WritabilityChecker)
+	if err := wc.CheckWritable(); err != nil {
+		t.Fatalf("CheckWritable: %v", err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 {
+		t.Errorf("CheckWritable left files behind: %v", ents)
+	}
+
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("can't make the directory read-only")
+	}
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+	if err := wc.CheckWritable(); err == nil {
+		t.Error("CheckWritable succeeded in read-only directory")
+	}
+}
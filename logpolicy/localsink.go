@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"os"
+	"sync"
+
+	"tailscale.com/envknob"
+	"tailscale.com/util/winutil"
+)
+
+// LocalOnlyLogsPolicy reports whether the environment (TS_LOGS_LOCAL_ONLY)
+// or system policy (LogsLocalOnly, on Windows) requires that logs never
+// be uploaded, only written locally. See logtail.SetLocalOnly.
+func LocalOnlyLogsPolicy() bool {
+	return envknob.Bool("TS_LOGS_LOCAL_ONLY") || winutil.GetPolicyInteger("LogsLocalOnly", 0) == 1
+}
+
+// localSinkMaxSize is the size at which the local-only log file is
+// rotated. One rotated file is kept.
+const localSinkMaxSize = 10 << 20
+
+// localSink is the logtail.Config.LocalSink used in local-only mode:
+// an append-only file that's rotated once it reaches
+// localSinkMaxSize.
+type localSink struct {
+	path string
+
+	mu   sync.Mutex
+	f    *os.File // or nil if not yet opened
+	size int64
+}
+
+func (s *localSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil && s.size+int64(len(p)) > localSinkMaxSize {
+		s.f.Close()
+		s.f = nil
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return 0, err
+		}
+	}
+	if s.f == nil {
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		s.f, s.size = f, fi.Size()
+	}
+	n, err := s.f.Write(p)
+	s.size += int64(n)
+	return n, err
+}
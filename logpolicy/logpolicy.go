@@ -24,6 +24,7 @@
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
@@ -71,6 +72,26 @@ func getLogTarget() string {
 	return getLogTargetOnce.v
 }
 
+// redactorsFromPolicy returns the log redactors configured by the
+// environment (TS_LOG_REDACT_REGEXP) or system policy (LogRedactRegexp,
+// on Windows): a regular expression whose matches are replaced with
+// "[redacted]" before logs are uploaded.
+func redactorsFromPolicy(logf logger.Logf) []logtail.Redactor {
+	pat := envknob.String("TS_LOG_REDACT_REGEXP")
+	if pat == "" {
+		pat = winutil.GetPolicyString("LogRedactRegexp", "")
+	}
+	if pat == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		logf("logpolicy: invalid log redaction regexp: %v", err)
+		return nil
+	}
+	return []logtail.Redactor{logtail.RedactRegexp(re, "[redacted]")}
+}
+
 // LogHost returns the hostname only (without port) of the configured
 // logtail server, or the default.
 func LogHost() string {
@@ -531,7 +552,8 @@ func New(collection string) *Policy {
 			}
 			return w
 		},
-		HTTPC: &http.Client{Transport: NewLogtailTransport(logtail.DefaultHost)},
+		HTTPC:     &http.Client{Transport: NewLogtailTransport(logtail.DefaultHost)},
+		Redactors: redactorsFromPolicy(earlyLogf),
 	}
 	if collection == logtail.CollectionNode {
 		conf.MetricsDelta = clientmetric.EncodeLogTailMetricsDelta
@@ -564,6 +586,27 @@ func New(collection string) *Policy {
 		}
 	}
 
+	sink := &localSink{path: filchPrefix + ".local.log"}
+	conf.LocalSink = sink
+	if LocalOnlyLogsPolicy() {
+		logtail.SetLocalOnly(true)
+	}
+
+	// Rather than discarding logs that couldn't be uploaded yet (such
+	// as during long offline periods), rotate them into compressed
+	// segments, keeping the same worst-case disk use as two
+	// default-sized files without rotation.
+	if filchOptions.MaxFileSize == 0 {
+		filchOptions.MaxFileSize = 20 << 20
+	}
+	filchOptions.MaxTotalSize = 5 * int64(filchOptions.MaxFileSize)
+	filchOptions.MaxAge = 7 * 24 * time.Hour
+	filchOptions.Compress = true
+	// If even that isn't enough, shed verbose and then other
+	// non-error entries before discarding errors and health changes.
+	filchOptions.Priority = func(line []byte) int { return int(logtail.EntryPriority(line)) }
+	filchOptions.ShedBelow = int(logtail.PriorityHigh)
+
 	filchBuf, filchErr := filch.New(filchPrefix, filchOptions)
 	if filchBuf != nil {
 		conf.Buffer = filchBuf
@@ -592,6 +635,9 @@ func New(collection string) *Policy {
 		goVersion(),
 		os.Args)
 	log.Printf("LogID: %v", newc.PublicID)
+	if logtail.LocalOnly() {
+		log.Printf("Logs are local-only (%s); not uploading.", sink.path)
+	}
 	if filchErr != nil {
 		log.Printf("filch failed: %v", filchErr)
 	}
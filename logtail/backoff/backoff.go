@@ -18,6 +18,7 @@
 type Backoff struct {
 	n          int // number of consecutive failures
 	maxBackoff time.Duration
+	jitter     float64 // fraction by which each interval is randomized
 
 	// Name is the name of this backoff timer, for logging purposes.
 	name string
@@ -41,10 +42,32 @@ func NewBackoff(name string, logf logger.Logf, maxBackoff time.Duration) *Backof
 		name:       name,
 		logf:       logf,
 		maxBackoff: maxBackoff,
+		jitter:     0.5,
 		NewTimer:   time.NewTimer,
 	}
 }
 
+// SetMaxBackoff changes the maximum backoff interval to d.
+// It must not be called concurrently with BackOff.
+func (b *Backoff) SetMaxBackoff(d time.Duration) {
+	b.maxBackoff = d
+}
+
+// SetJitter sets the fraction f, in the range [0, 1], by which each
+// backoff interval is randomly lengthened or shortened, to prevent
+// accidental "thundering herd" problems. The default is 0.5. A value
+// of 0 disables jitter.
+// It must not be called concurrently with BackOff.
+func (b *Backoff) SetJitter(f float64) {
+	if f < 0 {
+		f = 0
+	}
+	if f > 1 {
+		f = 1
+	}
+	b.jitter = f
+}
+
 // Backoff sleeps an increasing amount of time if err is non-nil.
 // and the context is not a
 // It resets the backoff schedule once err is nil.
@@ -66,9 +89,10 @@ func (b *Backoff) BackOff(ctx context.Context, err error) {
 	if d > b.maxBackoff {
 		d = b.maxBackoff
 	}
-	// Randomize the delay between 0.5-1.5 x msec, in order
-	// to prevent accidental "thundering herd" problems.
-	d = time.Duration(float64(d) * (rand.Float64() + 0.5))
+	// Randomize the delay between (1-jitter) and (1+jitter) x msec,
+	// 0.5-1.5 by default, in order to prevent accidental "thundering
+	// herd" problems.
+	d = time.Duration(float64(d) * (1 - b.jitter + 2*b.jitter*rand.Float64()))
 
 	if d >= b.LogLongerThan {
 		b.logf("%s: [v1] backoff: %d msec", b.name, d.Milliseconds())
@@ -9,22 +9,64 @@
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"tailscale.com/util/clientmetric"
 )
 
 var stderrFD = 2 // a variable for testing
 
 const defaultMaxFileSize = 50 << 20
 
+var (
+	metricDroppedLines    = clientmetric.NewCounter("filch_dropped_lines")
+	metricRotatedSegments = clientmetric.NewCounter("filch_rotated_segments")
+	metricShedLines       = clientmetric.NewCounter("filch_shed_lines")
+)
+
 type Options struct {
 	ReplaceStderr bool // dup over fd 2 so everything written to stderr comes here
 	MaxFileSize   int
+
+	// MaxTotalSize, if positive, enables rotation: instead of
+	// discarding the oldest pending logs when the file being written
+	// reaches MaxFileSize, its contents are moved to a new segment
+	// file, and the oldest segments are discarded only once all of
+	// the Filch's files together exceed MaxTotalSize.
+	MaxTotalSize int64
+
+	// MaxAge, if positive and rotation is enabled, is how long
+	// rotated segments are kept before being discarded.
+	MaxAge time.Duration
+
+	// Compress is whether rotated segments are gzip-compressed.
+	Compress bool
+
+	// Priority, if non-nil and rotation is enabled, returns the
+	// priority of a line. When the rotated segments don't fit in
+	// MaxTotalSize, lines with priorities below ShedBelow are
+	// removed from them, lowest priority and oldest segment first,
+	// before any whole segments are discarded.
+	Priority func(line []byte) int
+
+	// ShedBelow is the priority below which lines may be shed.
+	// See Priority.
+	ShedBelow int
 }
 
 // A Filch uses two alternating files as a simplistic ring buffer.
+//
+// If rotation is enabled (see Options.MaxTotalSize), logs that don't
+// fit are additionally queued in segment files, which are read back
+// in order before the files being written.
 type Filch struct {
 	OrigStderr *os.File
 
@@ -32,11 +74,22 @@ type Filch struct {
 	cur       *os.File
 	alt       *os.File
 	altscan   *bufio.Scanner
+	altRead   int // lines read from alt since it was last filled
 	recovered int64
 
 	maxFileSize  int64
 	writeCounter int
 
+	filePrefix   string
+	maxTotalSize int64
+	maxAge       time.Duration
+	compress     bool
+	priority     func([]byte) int // or nil
+	shedBelow    int
+	segs         []segment // oldest first
+	nextSeq      int
+	dropped      int64 // lines discarded
+
 	// buf is an initial buffer for altscan.
 	// As of August 2021, 99.96% of all log lines
 	// are below 4096 bytes in length.
@@ -45,7 +98,41 @@ type Filch struct {
 	// so that the whole struct takes 4096 bytes
 	// (less on 32 bit platforms).
 	// This reduces allocation waste.
-	buf [4096 - 64]byte
+	buf [4096 - 192]byte
+}
+
+// segment is a rotated segment file.
+type segment struct {
+	path  string
+	seq   int
+	lines int
+	size  int64 // on disk
+	mtime time.Time
+
+	// shedBelow is the priority below which lines have been shed
+	// from the segment, or zero if none have been.
+	shedBelow int
+}
+
+// segmentGlobSuffix is appended to the file prefix to glob for
+// segment files, which are named "<prefix>.seg-<seq>-<lines>.txt",
+// with a ".gz" suffix if compressed.
+const segmentGlobSuffix = ".seg-*.txt*"
+
+// Dropped returns the number of log lines that f has discarded,
+// because they didn't fit or were too old, since it was created.
+func (f *Filch) Dropped() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dropped
+}
+
+func (f *Filch) noteDroppedLocked(lines int) {
+	if lines <= 0 {
+		return
+	}
+	f.dropped += int64(lines)
+	metricDroppedLines.Add(int64(lines))
 }
 
 // TryReadline implements the logtail.Buffer interface.
@@ -59,6 +146,15 @@ func (f *Filch) TryReadLine() ([]byte, error) {
 		}
 	}
 
+	if len(f.segs) > 0 {
+		// Segments hold older logs than cur; read them first.
+		if err := f.loadOldestSegmentLocked(); err != nil {
+			return nil, err
+		}
+		f.startScanLocked()
+		return f.scan()
+	}
+
 	f.cur, f.alt = f.alt, f.cur
 	if f.OrigStderr != nil {
 		if err := dup2Stderr(f.cur); err != nil {
@@ -68,14 +164,20 @@ func (f *Filch) TryReadLine() ([]byte, error) {
 	if _, err := f.alt.Seek(0, io.SeekStart); err != nil {
 		return nil, err
 	}
+	f.startScanLocked()
+	return f.scan()
+}
+
+func (f *Filch) startScanLocked() {
 	f.altscan = bufio.NewScanner(f.alt)
 	f.altscan.Buffer(f.buf[:], bufio.MaxScanTokenSize)
 	f.altscan.Split(splitLines)
-	return f.scan()
+	f.altRead = 0
 }
 
 func (f *Filch) scan() ([]byte, error) {
 	if f.altscan.Scan() {
+		f.altRead++
 		return f.altscan.Bytes(), nil
 	}
 	err := f.altscan.Err()
@@ -107,9 +209,24 @@ func (f *Filch) Write(b []byte) (int, error) {
 		}
 		if fi.Size() >= f.maxFileSize {
 			// This most likely means we are not draining.
-			// To limit the amount of space we use, throw away the old logs.
-			if err := moveContents(f.alt, f.cur); err != nil {
-				return 0, err
+			if f.maxTotalSize > 0 {
+				if err := f.rotateLocked(); err != nil {
+					return 0, err
+				}
+			} else {
+				// To limit the amount of space we use, throw away the old logs.
+				if f.altscan != nil {
+					// Count what's left unread in alt.
+					if n, err := countLines(f.alt); err == nil {
+						f.noteDroppedLocked(n - f.altRead)
+					}
+				} else if n, err := countLines(f.alt); err == nil {
+					f.noteDroppedLocked(n)
+				}
+				if err := moveContents(f.alt, f.cur); err != nil {
+					return 0, err
+				}
+				f.altRead = 0
 			}
 		}
 	}
@@ -146,6 +263,261 @@ func (f *Filch) Close() (err error) {
 	return err
 }
 
+// rotateLocked moves the contents of f.cur to a new segment file and
+// then discards segments as needed to respect f's limits.
+func (f *Filch) rotateLocked() error {
+	seq := f.nextSeq
+	f.nextSeq++
+	lines, err := countLines(f.cur)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s.seg-%d-%d.txt", f.filePrefix, seq, lines)
+	if f.compress {
+		name += ".gz"
+	}
+	if _, err := f.cur.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeSegment(name, f.cur, f.compress); err != nil {
+		os.Remove(name)
+		// Fall back to discarding the oldest logs, as without rotation.
+		f.noteDroppedLocked(lines)
+	} else {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		f.segs = append(f.segs, segment{
+			path:  name,
+			seq:   seq,
+			lines: lines,
+			size:  fi.Size(),
+			mtime: fi.ModTime(),
+		})
+		metricRotatedSegments.Add(1)
+	}
+	if _, err := f.cur.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.cur.Truncate(0); err != nil {
+		return err
+	}
+	f.pruneSegmentsLocked()
+	return nil
+}
+
+// pruneSegmentsLocked removes segments older than f.maxAge, then
+// sheds low-priority lines from segments (see Options.Priority), and
+// then removes the oldest segments, until f's files fit within
+// f.maxTotalSize.
+func (f *Filch) pruneSegmentsLocked() {
+	var total int64
+	for _, fl := range []*os.File{f.cur, f.alt} {
+		if fi, err := fl.Stat(); err == nil {
+			total += fi.Size()
+		}
+	}
+	for _, sg := range f.segs {
+		total += sg.size
+	}
+	now := time.Now()
+	for len(f.segs) > 0 && f.maxAge > 0 && now.Sub(f.segs[0].mtime) > f.maxAge {
+		total -= f.removeOldestSegmentLocked()
+	}
+	if f.priority != nil {
+		for below := 1; below <= f.shedBelow && total > f.maxTotalSize; below++ {
+			for i := range f.segs {
+				if total <= f.maxTotalSize {
+					break
+				}
+				sg := &f.segs[i]
+				if sg.shedBelow >= below {
+					continue
+				}
+				oldSize := sg.size
+				if err := f.shedSegmentLocked(sg, below); err != nil {
+					continue
+				}
+				total -= oldSize - sg.size
+			}
+		}
+	}
+	for len(f.segs) > 0 && total > f.maxTotalSize {
+		total -= f.removeOldestSegmentLocked()
+	}
+}
+
+// removeOldestSegmentLocked removes the oldest segment and returns its
+// size.
+func (f *Filch) removeOldestSegmentLocked() int64 {
+	sg := f.segs[0]
+	os.Remove(sg.path)
+	f.noteDroppedLocked(sg.lines)
+	f.segs = f.segs[1:]
+	return sg.size
+}
+
+// shedSegmentLocked rewrites sg without its lines whose priority is
+// below the given one.
+func (f *Filch) shedSegmentLocked(sg *segment, below int) error {
+	r, err := openSegment(sg.path)
+	if err != nil {
+		return err
+	}
+	var kept bytes.Buffer
+	lines := 0
+	bs := bufio.NewScanner(r)
+	bs.Buffer(nil, bufio.MaxScanTokenSize)
+	bs.Split(splitLines)
+	for bs.Scan() {
+		if f.priority(bs.Bytes()) >= below {
+			kept.Write(bs.Bytes())
+			lines++
+		}
+	}
+	r.Close()
+	if err := bs.Err(); err != nil {
+		return err
+	}
+	sg.shedBelow = below
+	shed := sg.lines - lines
+	if shed <= 0 {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s.seg-%d-%d.txt", f.filePrefix, sg.seq, lines)
+	if strings.HasSuffix(sg.path, ".gz") {
+		name += ".gz"
+	}
+	if err := writeSegment(name, bytes.NewReader(kept.Bytes()), strings.HasSuffix(name, ".gz")); err != nil {
+		os.Remove(name)
+		return err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	os.Remove(sg.path)
+	sg.path, sg.lines, sg.size = name, lines, fi.Size()
+	f.noteDroppedLocked(shed)
+	metricShedLines.Add(int64(shed))
+	return nil
+}
+
+// openSegment opens the segment file at path for reading,
+// decompressing it if needed.
+func openSegment(path string) (io.ReadCloser, error) {
+	sf, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return sf, nil
+	}
+	zr, err := gzip.NewReader(sf)
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, sf}, nil
+}
+
+// loadOldestSegmentLocked replaces the contents of f.alt, which must
+// have been fully read, with those of the oldest segment, and removes
+// that segment.
+func (f *Filch) loadOldestSegmentLocked() error {
+	sg := f.segs[0]
+	f.segs = f.segs[1:]
+	defer os.Remove(sg.path)
+
+	if _, err := f.alt.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.alt.Truncate(0); err != nil {
+		return err
+	}
+	r, err := openSegment(sg.path)
+	if err != nil {
+		f.noteDroppedLocked(sg.lines)
+		return nil
+	}
+	defer r.Close()
+	if _, err := io.Copy(f.alt, r); err != nil {
+		// Keep whatever was decoded.
+		fmt.Fprintf(f.alt, "filch: reading segment: %v\n", err)
+	}
+	_, err = f.alt.Seek(0, io.SeekStart)
+	return err
+}
+
+// writeSegment writes the contents of src to a new file named name.
+func writeSegment(name string, src io.Reader, compress bool) (err error) {
+	df, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := df.Close(); err == nil {
+			err = err2
+		}
+	}()
+	if !compress {
+		_, err = io.Copy(df, src)
+		return err
+	}
+	zw := gzip.NewWriter(df)
+	if _, err := io.Copy(zw, src); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// countLines returns the number of lines in fl, leaving its offset at
+// the end of the file.
+func countLines(fl *os.File) (int, error) {
+	if _, err := fl.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n := 0
+	buf := make([]byte, 32<<10)
+	for {
+		c, err := fl.Read(buf)
+		n += bytes.Count(buf[:c], []byte{'\n'})
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// findSegments returns the segment files left behind by a previous
+// Filch with the given filePrefix, oldest first.
+func findSegments(filePrefix string) []segment {
+	matches, _ := filepath.Glob(filePrefix + segmentGlobSuffix)
+	var segs []segment
+	for _, m := range matches {
+		var sg segment
+		rest := strings.TrimSuffix(strings.TrimSuffix(m[len(filePrefix):], ".gz"), ".txt")
+		if _, err := fmt.Sscanf(rest, ".seg-%d-%d", &sg.seq, &sg.lines); err != nil {
+			continue
+		}
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		sg.path, sg.size, sg.mtime = m, fi.Size(), fi.ModTime()
+		segs = append(segs, sg)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+	return segs
+}
+
 // New creates a new filch around two log files, each starting with filePrefix.
 func New(filePrefix string, opts Options) (f *Filch, err error) {
 	var f1, f2 *os.File
@@ -187,8 +559,20 @@ func New(filePrefix string, opts Options) (f *Filch, err error) {
 		mfs = opts.MaxFileSize
 	}
 	f = &Filch{
-		OrigStderr:  os.Stderr, // temporary, for past logs recovery
-		maxFileSize: int64(mfs),
+		OrigStderr:   os.Stderr, // temporary, for past logs recovery
+		maxFileSize:  int64(mfs),
+		filePrefix:   filePrefix,
+		maxTotalSize: opts.MaxTotalSize,
+		maxAge:       opts.MaxAge,
+		compress:     opts.Compress,
+		priority:     opts.Priority,
+		shedBelow:    opts.ShedBelow,
+	}
+	if f.maxTotalSize > 0 {
+		f.segs = findSegments(filePrefix)
+		if n := len(f.segs); n > 0 {
+			f.nextSeq = f.segs[n-1].seq + 1
+		}
 	}
 
 	// Neither, either, or both files may exist and contain logs from
@@ -225,9 +609,10 @@ func New(filePrefix string, opts Options) (f *Filch, err error) {
 		f.cur, f.alt = f1, f2 // does not matter
 	}
 	if f.recovered > 0 {
-		f.altscan = bufio.NewScanner(f.alt)
-		f.altscan.Buffer(f.buf[:], bufio.MaxScanTokenSize)
-		f.altscan.Split(splitLines)
+		f.startScanLocked()
+	}
+	if len(f.segs) > 0 {
+		f.pruneSegmentsLocked()
 	}
 
 	f.OrigStderr = nil
@@ -8,6 +8,7 @@
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -210,3 +211,131 @@ func TestSizeOf(t *testing.T) {
 		t.Fatalf("Filch{} has size %d on %v, decrease size of buf field", s, runtime.GOARCH)
 	}
 }
+
+func TestRotation(t *testing.T) {
+	const line1 = "123456789" // 10 bytes (9+newline)
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			filePrefix := filepath.Join(t.TempDir(), "test")
+			opts := Options{
+				MaxFileSize:  1000,
+				MaxTotalSize: 1 << 20,
+				Compress:     compress,
+			}
+			f := newFilchTest(t, filePrefix, opts)
+			// Write enough to rotate several times; unlike without
+			// rotation, nothing is lost.
+			for i := 0; i < 500; i++ {
+				f.write(t, line1)
+			}
+			if n := len(f.segs); n == 0 {
+				t.Fatal("no segments after writing 5000 bytes")
+			}
+			f.close(t)
+
+			// The segments survive a restart.
+			f = newFilchTest(t, filePrefix, opts)
+			defer f.close(t)
+			for i := 0; i < 500; i++ {
+				f.read(t, line1)
+				if t.Failed() {
+					t.Fatalf("could only read %d lines", i)
+				}
+			}
+			f.readEOF(t)
+			if d := f.Dropped(); d != 0 {
+				t.Errorf("Dropped = %d; want 0", d)
+			}
+			if m, _ := filepath.Glob(filePrefix + segmentGlobSuffix); len(m) != 0 {
+				t.Errorf("segments left after reading: %q", m)
+			}
+		})
+	}
+}
+
+func TestRotationMaxTotalSize(t *testing.T) {
+	const line1 = "123456789" // 10 bytes (9+newline)
+	filePrefix := filepath.Join(t.TempDir(), "test")
+	f := newFilchTest(t, filePrefix, Options{
+		MaxFileSize:  1000,
+		MaxTotalSize: 3000,
+	})
+	defer f.close(t)
+	for i := 0; i < 1000; i++ {
+		f.write(t, line1)
+	}
+	dropped := f.Dropped()
+	if dropped == 0 {
+		t.Fatal("nothing dropped after writing 10000 bytes with a 3000 byte limit")
+	}
+	var read int64
+	for {
+		b, err := f.TryReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == nil {
+			break
+		}
+		read++
+	}
+	if read+dropped != 1000 {
+		t.Errorf("read %d + dropped %d lines; want 1000 total", read, dropped)
+	}
+}
+
+func TestRotationShedsByPriority(t *testing.T) {
+	// Lines starting with "v" are low priority, "n" normal, and "e" high.
+	priority := func(line []byte) int {
+		switch line[0] {
+		case 'v':
+			return 0
+		case 'n':
+			return 1
+		}
+		return 2
+	}
+	filePrefix := filepath.Join(t.TempDir(), "test")
+	f := newFilchTest(t, filePrefix, Options{
+		MaxFileSize:  1000,
+		MaxTotalSize: 4000,
+		Priority:     priority,
+		ShedBelow:    2,
+	})
+	defer f.close(t)
+	const numLines = 1500
+	for i := 0; i < numLines; i++ {
+		switch {
+		case i%10 == 0:
+			f.write(t, "e23456789")
+		case i%10 < 4:
+			f.write(t, "n23456789")
+		default:
+			f.write(t, "v23456789")
+		}
+	}
+	dropped := f.Dropped()
+	if dropped == 0 {
+		t.Fatal("nothing dropped after writing 15000 bytes with a 4000 byte limit")
+	}
+	counts := map[byte]int{}
+	for {
+		b, err := f.TryReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == nil {
+			break
+		}
+		counts[b[0]]++
+	}
+	if got := int64(counts['e'] + counts['n'] + counts['v']); got+dropped != numLines {
+		t.Errorf("read %d + dropped %d lines; want %d total", got, dropped, numLines)
+	}
+	if counts['e'] != numLines/10 {
+		t.Errorf("read %d high priority lines; want all %d", counts['e'], numLines/10)
+	}
+	if counts['n'] == 0 {
+		t.Errorf("read no normal priority lines; want some kept")
+	}
+}
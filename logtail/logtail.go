@@ -75,6 +75,16 @@ type Config struct {
 	// being included in the logs. The sequence number is incremented for each
 	// log message sent, but is not peristed across process restarts.
 	IncludeProcSequence bool
+
+	// Redactors are run over the text and string fields of each log
+	// entry before it's buffered for upload. More can be added later
+	// with Logger.AddRedactor.
+	Redactors []Redactor
+
+	// LocalSink, if non-nil, is where logs are written, one JSON
+	// object per line, instead of being uploaded while local-only
+	// mode is enabled. See SetLocalOnly.
+	LocalSink io.Writer
 }
 
 func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
@@ -123,6 +133,8 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		timeNow:        cfg.TimeNow,
 		bo:             backoff.NewBackoff("logtail", logf, 30*time.Second),
 		metricsDelta:   cfg.MetricsDelta,
+		localSink:      cfg.LocalSink,
+		redactors:      append([]Redactor(nil), cfg.Redactors...),
 
 		procID:              procID,
 		includeProcSequence: cfg.IncludeProcSequence,
@@ -162,13 +174,15 @@ type Logger struct {
 	uploadCancel   func()
 	explainedRaw   bool
 	metricsDelta   func() string // or nil
+	localSink      io.Writer     // or nil
 	privateID      PrivateID
 
 	procID              uint32
 	includeProcSequence bool
 
-	writeLock    sync.Mutex // guards increments of procSequence
+	writeLock    sync.Mutex // guards increments of procSequence, and redactors
 	procSequence uint64
+	redactors    []Redactor
 
 	shutdownStart chan struct{} // closed when shutdown begins
 	shutdownDone  chan struct{} // closed when shutdown complete
@@ -321,6 +335,14 @@ func (l *Logger) uploading(ctx context.Context) {
 	scratch := make([]byte, 4096) // reusable buffer to write into
 	for {
 		body := l.drainPending(scratch)
+		if LocalOnly() {
+			l.writeLocal(body)
+			if l.isShuttingDown() {
+				return
+			}
+			continue
+		}
+		raw := body
 		origlen := -1 // sentinel value: uncompressed
 		// Don't attempt to compress tiny bodies; not worth the CPU cycles.
 		if l.zstdEncoder != nil && len(body) > 256 {
@@ -340,6 +362,12 @@ func (l *Logger) uploading(ctx context.Context) {
 				return
 			default:
 			}
+			if LocalOnly() {
+				// Local-only mode was enabled while we were
+				// trying to upload; don't.
+				l.writeLocal(raw)
+				break
+			}
 			uploaded, err := l.upload(ctx, body, origlen)
 			if err != nil {
 				if !l.internetUp() {
@@ -355,14 +383,42 @@ func (l *Logger) uploading(ctx context.Context) {
 			}
 		}
 
-		select {
-		case <-l.shutdownStart:
+		if l.isShuttingDown() {
 			return
-		default:
 		}
 	}
 }
 
+func (l *Logger) isShuttingDown() bool {
+	select {
+	case <-l.shutdownStart:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeLocal writes body, a JSON array of log entries as returned by
+// drainPending, to l's local sink, one entry per line.
+func (l *Logger) writeLocal(body []byte) {
+	if l.localSink == nil || len(body) == 0 {
+		return
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(body, &entries); err != nil {
+		fmt.Fprintf(l.stderr, "logtail: local sink: %v\n", err)
+		return
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.Write(e)
+		buf.WriteByte('\n')
+	}
+	if _, err := l.localSink.Write(buf.Bytes()); err != nil {
+		fmt.Fprintf(l.stderr, "logtail: local sink: %v\n", err)
+	}
+}
+
 func (l *Logger) internetUp() bool {
 	if l.linkMonitor == nil {
 		// No way to tell, so assume it is.
@@ -446,6 +502,24 @@ func (l *Logger) Flush() error {
 	return nil
 }
 
+// localOnly is whether logtail is in local-only mode.
+var localOnly atomic.Bool
+
+// SetLocalOnly sets whether logtail is in local-only mode. In
+// local-only mode, Loggers never upload logs; they write them to their
+// Config.LocalSink instead (or discard them, if there's none).
+//
+// Unlike Disable, local-only mode can be turned off again.
+func SetLocalOnly(v bool) {
+	localOnly.Store(v)
+}
+
+// LocalOnly reports whether logtail is in local-only mode.
+// See SetLocalOnly.
+func LocalOnly() bool {
+	return localOnly.Load()
+}
+
 // logtailDisabled is whether logtail uploads to logcatcher are disabled.
 var logtailDisabled atomic.Bool
 
@@ -583,6 +657,9 @@ func (l *Logger) encodeLocked(buf []byte, level int) []byte {
 		l.procSequence++
 	}
 	if buf[0] != '{' {
+		if len(l.redactors) > 0 {
+			buf = []byte(l.redactLocked(string(buf)))
+		}
 		return l.encodeText(buf, l.skipClientTime, l.procID, l.procSequence, level) // text fast-path
 	}
 
@@ -595,6 +672,9 @@ func (l *Logger) encodeLocked(buf []byte, level int) []byte {
 		}
 		obj["text"] = string(buf)
 	}
+	if len(l.redactors) > 0 {
+		l.redactValueLocked(obj)
+	}
 	if txt, isStr := obj["text"].(string); l.lowMem && isStr && len(txt) > 254 {
 		// TODO(crawshaw): trim to unicode code point
 		obj["text"] = txt[:254] + "…"
@@ -12,7 +12,9 @@
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -36,6 +38,60 @@ func(w http.ResponseWriter, r *http.Request) {}))
 	}
 }
 
+// lockedBuffer is a bytes.Buffer that's safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLocalOnly(t *testing.T) {
+	SetLocalOnly(true)
+	defer SetLocalOnly(false)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected upload in local-only mode")
+		}))
+	defer testServ.Close()
+
+	sink := new(lockedBuffer)
+	l := NewLogger(Config{
+		BaseURL:   testServ.URL,
+		LocalSink: sink,
+	}, t.Logf)
+	l.Write([]byte("log line"))
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+	want := []string{"logtail started", "log line", "logger closing down"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines in local sink; want %d:\n%s", len(lines), len(want), sink.String())
+	}
+	for i, line := range lines {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if got := strings.TrimSpace(m["text"].(string)); got != want[i] {
+			t.Errorf("line %d text = %q; want %q", i, got, want[i])
+		}
+	}
+}
+
 // maximum number of times a test will call l.Write()
 const logLines = 3
 
@@ -402,3 +458,59 @@ func TestEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestEntryPriority(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Priority
+	}{
+		{"normal", PriorityNormal},
+		{"[v1] some verbose one", PriorityVerbose},
+		{"[v2] verbose error details", PriorityHigh},
+		{"dial failed: Error: timeout", PriorityHigh},
+		{`health("overall"): ok`, PriorityHigh},
+		{`says "v":1 in the text`, PriorityNormal},
+		{`{"foo":"bar"}`, PriorityNormal},
+		{"foo: [v\x00JSON]2{\"foo\":1}", PriorityVerbose},
+	}
+	for _, tt := range tests {
+		buf := new(simpleMemBuf)
+		lg := &Logger{
+			timeNow: func() time.Time { return time.Unix(123, 456).UTC() },
+			buffer:  buf,
+		}
+		io.WriteString(lg, tt.in)
+		if got := EntryPriority(buf.buf.Bytes()); got != tt.want {
+			t.Errorf("EntryPriority(%#q) = %v; want %v", buf.buf.String(), got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			"dialing 10.1.2.3 for alice",
+			`{"logtail": {"client_time": "1970-01-01T00:02:03.000000456Z"}, "text": "dialing [ip] for [user]"}` + "\n",
+		},
+		{
+			`{"peer":"10.1.2.3","users":["alice","bob"],"alice":1}`,
+			`{"[user]":1,"logtail":{"client_time":"1970-01-01T00:02:03.000000456Z"},"peer":"[ip]","users":["[user]","bob"]}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		buf := new(simpleMemBuf)
+		lg := &Logger{
+			timeNow: func() time.Time { return time.Unix(123, 456).UTC() },
+			buffer:  buf,
+		}
+		lg.AddRedactor(RedactRegexp(regexp.MustCompile(`\b\d+\.\d+\.\d+\.\d+\b`), "[ip]"))
+		lg.AddRedactor(func(s string) string { return strings.ReplaceAll(s, "alice", "[user]") })
+		io.WriteString(lg, tt.in)
+		if got := buf.buf.String(); got != tt.want {
+			t.Errorf("for %q,\n got: %#q\nwant: %#q\n", tt.in, got, tt.want)
+		}
+	}
+}
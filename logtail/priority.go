@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logtail
+
+import "bytes"
+
+// Priority is the importance of a log entry, used to decide which
+// entries to keep when buffered logs exceed their disk budget.
+type Priority int
+
+const (
+	// PriorityVerbose is for verbose ("[v1]", "[v2]") debug entries,
+	// which are shed first.
+	PriorityVerbose Priority = iota
+	// PriorityNormal is for all other entries not covered by
+	// PriorityHigh.
+	PriorityNormal
+	// PriorityHigh is for errors, panics and health state
+	// transitions, which are kept for as long as possible.
+	PriorityHigh
+)
+
+var (
+	verboseKey = []byte(`"v":`)
+	textKey    = []byte(`"text": "`)
+)
+
+// highPriorityMarkers are substrings that make an entry PriorityHigh.
+var highPriorityMarkers = [][]byte{
+	[]byte("error"),
+	[]byte("Error"),
+	[]byte("ERROR"),
+	[]byte("panic"),
+	[]byte("health("),
+}
+
+// EntryPriority returns the priority of line, a log entry as
+// encoded by Logger for its Buffer.
+func EntryPriority(line []byte) Priority {
+	header := line
+	if i := bytes.Index(line, textKey); i != -1 {
+		// Text entries have their metadata before the text, which
+		// might itself contain anything.
+		header = line[:i]
+	}
+	for _, m := range highPriorityMarkers {
+		if bytes.Contains(line, m) {
+			return PriorityHigh
+		}
+	}
+	if bytes.Contains(header, verboseKey) {
+		return PriorityVerbose
+	}
+	return PriorityNormal
+}
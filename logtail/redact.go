@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logtail
+
+import "regexp"
+
+// A Redactor rewrites the text of a log entry, or of one string field
+// of a structured (JSON) log entry, before it's buffered for upload.
+// It returns s unchanged if there's nothing to redact.
+//
+// Logs written to the Logger's local stderr are not redacted.
+//
+// Redactors are called with the Logger's write lock held, so they must
+// not log to the same Logger.
+type Redactor func(s string) string
+
+// RedactRegexp returns a Redactor that replaces all matches of re with
+// repl, which may contain $1-style references as in
+// regexp.Regexp.ReplaceAllString.
+func RedactRegexp(re *regexp.Regexp, repl string) Redactor {
+	return func(s string) string {
+		return re.ReplaceAllString(s, repl)
+	}
+}
+
+// AddRedactor adds r to the redactors that l runs over each log entry
+// before buffering it. Redactors run in the order they were added.
+func (l *Logger) AddRedactor(r Redactor) {
+	l.writeLock.Lock()
+	defer l.writeLock.Unlock()
+	l.redactors = append(l.redactors, r)
+}
+
+// redactLocked runs l's redactors over s.
+//
+// l.writeLock must be held.
+func (l *Logger) redactLocked(s string) string {
+	for _, r := range l.redactors {
+		s = r(s)
+	}
+	return s
+}
+
+// redactValueLocked returns v, a value decoded by encoding/json, with
+// l's redactors run over all its strings, including map keys.
+//
+// l.writeLock must be held.
+func (l *Logger) redactValueLocked(v any) any {
+	switch v := v.(type) {
+	case string:
+		return l.redactLocked(v)
+	case []any:
+		for i, e := range v {
+			v[i] = l.redactValueLocked(e)
+		}
+		return v
+	case map[string]any:
+		var renamed map[string]any
+		for k, e := range v {
+			e = l.redactValueLocked(e)
+			if rk := l.redactLocked(k); rk != k {
+				delete(v, k)
+				if renamed == nil {
+					renamed = map[string]any{}
+				}
+				renamed[rk] = e
+				continue
+			}
+			v[k] = e
+		}
+		for k, e := range renamed {
+			v[k] = e
+		}
+		return v
+	}
+	return v
+}
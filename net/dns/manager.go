@@ -96,7 +96,7 @@ func NewManager(logf logger.Logf, oscfg OSConfigurator, linkMon *monitor.Mon, di
 	if dialer == nil {
 		panic("nil Dialer")
 	}
-	logf = logger.WithPrefix(logf, "dns: ")
+	logf = logger.ComponentLogf(logger.WithPrefix(logf, "dns: "), "dns")
 	m := &Manager{
 		logf:      logf,
 		resolver:  resolver.New(logf, linkMon, linkSel, dialer),
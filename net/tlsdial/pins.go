@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tlsdial
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Pins is a set of pinned CA certificates and public keys that a
+// server's certificate chain must match.
+type Pins struct {
+	roots *x509.CertPool    // or nil to use the usual roots
+	spki  map[[32]byte]bool // or empty to accept any key
+}
+
+// spkiPrefix is the prefix of a public key pin, as used by HPKP.
+const spkiPrefix = "sha256/"
+
+// ParsePins parses a set of pins. Each is either a PEM-encoded CA
+// certificate, or "sha256/" followed by the standard base64 encoding
+// of the SHA-256 hash of a certificate's DER-encoded
+// SubjectPublicKeyInfo.
+//
+// If there are any CA certificates, a server's chain must verify
+// against them instead of the system's roots. If there are any public
+// keys, one of the certificates presented by a server must have one
+// of them. It returns nil, nil if pins is empty.
+func ParsePins(pins []string) (*Pins, error) {
+	if len(pins) == 0 {
+		return nil, nil
+	}
+	p := &Pins{spki: map[[32]byte]bool{}}
+	for _, s := range pins {
+		s = strings.TrimSpace(s)
+		if strings.HasPrefix(s, spkiPrefix) {
+			h, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, spkiPrefix))
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("invalid public key pin %q", s)
+			}
+			p.spki[*(*[32]byte)(h)] = true
+			continue
+		}
+		block, _ := pem.Decode([]byte(s))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("pin is neither a public key hash nor a PEM certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned certificate: %w", err)
+		}
+		if p.roots == nil {
+			p.roots = x509.NewCertPool()
+		}
+		p.roots.AddCert(cert)
+	}
+	return p, nil
+}
+
+// verify verifies that the server certificate chain certs, for
+// dnsName, matches p. If p has no CA certificates, the chain must
+// already have been verified against the usual roots.
+func (p *Pins) verify(certs []*x509.Certificate, dnsName string) error {
+	if len(certs) == 0 {
+		return errors.New("no certs presented")
+	}
+	if p.roots != nil {
+		opts := x509.VerifyOptions{
+			DNSName:       dnsName,
+			Roots:         p.roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return fmt.Errorf("tlsdial: verifying against pinned CAs: %w", err)
+		}
+	}
+	if len(p.spki) == 0 {
+		return nil
+	}
+	for _, cert := range certs {
+		if p.spki[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return errors.New("tlsdial: no certificate matches the pinned public keys")
+}
+
+var controlPins atomic.Pointer[Pins]
+
+// SetControlPins sets the pins that connections made with
+// ControlConfig must match, or removes them if p is nil.
+// It affects subsequent handshakes only.
+func SetControlPins(p *Pins) {
+	controlPins.Store(p)
+}
+
+// ControlConfig is like Config, but for connecting to the control or
+// DERP servers, so also enforces any pins set by SetControlPins.
+func ControlConfig(host string, base *tls.Config) *tls.Config {
+	conf := Config(host, base)
+	verifyUsual := conf.VerifyConnection
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		p := controlPins.Load()
+		if p == nil {
+			return verifyUsual(cs)
+		}
+		if p.roots == nil {
+			if err := verifyUsual(cs); err != nil {
+				return err
+			}
+		}
+		return p.verify(cs.PeerCertificates, cs.ServerName)
+	}
+	return conf
+}
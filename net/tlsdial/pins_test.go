@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tlsdial
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlPins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	cert := srv.Certificate()
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	keyPin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+	otherPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	dial := func(t *testing.T) error {
+		t.Helper()
+		// httptest's certificate is valid for example.com.
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), ControlConfig("example.com", nil))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	defer SetControlPins(nil)
+
+	tests := []struct {
+		name   string
+		pins   []string
+		wantOK bool
+	}{
+		{"none", nil, false}, // not signed by a system root
+		{"ca", []string{certPEM}, true},
+		{"ca-and-key", []string{certPEM, keyPin}, true},
+		{"ca-and-other-key", []string{certPEM, otherPin}, false},
+		{"ca-and-keys", []string{certPEM, otherPin, keyPin}, true},
+		{"key-only", []string{keyPin}, false}, // chain still needs a system root
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePins(tt.pins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetControlPins(p)
+			if err := dial(t); (err == nil) != tt.wantOK {
+				t.Errorf("dial error = %v; want ok=%v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParsePinsErrors(t *testing.T) {
+	for _, pin := range []string{
+		"sha256/not-base64!",
+		"sha256/AAAA",
+		"not a pin",
+		"-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n",
+	} {
+		if _, err := ParsePins([]string{pin}); err == nil {
+			t.Errorf("ParsePins(%q) succeeded; want error", pin)
+		}
+	}
+}
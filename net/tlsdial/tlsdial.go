@@ -104,7 +104,8 @@ func Config(host string, base *tls.Config) *tls.Config {
 // a certificate for the provided certDNSName.
 //
 // This is for user-configurable client-side domain fronting support,
-// where we send one SNI value but validate a different cert.
+// where we send one SNI value but validate a different cert. As that's
+// only done for DERP servers, any pins set by SetControlPins apply.
 func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 	if c.ServerName == certDNSName {
 		return
@@ -133,6 +134,10 @@ func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 			}
 			certs[i] = cert
 		}
+		p := controlPins.Load()
+		if p != nil && p.roots != nil {
+			return p.verify(certs, certDNSName)
+		}
 		opts := x509.VerifyOptions{
 			CurrentTime:   time.Now(),
 			DNSName:       certDNSName,
@@ -145,18 +150,20 @@ func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 		if debug {
 			log.Printf("tlsdial(sys %q/%q): %v", c.ServerName, certDNSName, errSys)
 		}
-		if errSys == nil {
-			return nil
-		}
-		opts.Roots = bakedInRoots()
-		_, err := certs[0].Verify(opts)
-		if debug {
-			log.Printf("tlsdial(bake %q/%q): %v", c.ServerName, certDNSName, err)
+		if errSys != nil {
+			opts.Roots = bakedInRoots()
+			_, err := certs[0].Verify(opts)
+			if debug {
+				log.Printf("tlsdial(bake %q/%q): %v", c.ServerName, certDNSName, err)
+			}
+			if err != nil {
+				return errSys
+			}
 		}
-		if err == nil {
-			return nil
+		if p != nil {
+			return p.verify(certs, certDNSName)
 		}
-		return errSys
+		return nil
 	}
 }
 
@@ -7,7 +7,9 @@
 package tshttpproxy
 
 import (
+	"fmt"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"sync"
@@ -26,8 +28,52 @@ func InvalidateCache() {
 var (
 	mu           sync.Mutex
 	noProxyUntil time.Time // if non-zero, time at which ProxyFromEnvironment should check again
+	override     *url.URL  // if non-nil, the proxy set by SetProxy
 )
 
+// SetProxy sets the proxy that ProxyFromEnvironment returns, taking
+// precedence over the environment and any system proxy settings.
+// The proxy may be an HTTP CONNECT proxy ("http" or "https" scheme) or
+// a SOCKS5 proxy ("socks5" scheme), optionally with credentials in
+// the URL's user info. A nil u removes the override.
+//
+// It takes effect for new connections; existing connections are left
+// alone.
+func SetProxy(u *url.URL) {
+	mu.Lock()
+	defer mu.Unlock()
+	override = u
+}
+
+// ValidateProxyURL reports whether s is a proxy URL that can be used
+// with SetProxy.
+func ValidateProxyURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q; want http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy URL %q has no host", u.Redacted())
+	}
+	return nil
+}
+
+// isLoopbackRequest reports whether req is to localhost, which is
+// never proxied.
+func isLoopbackRequest(req *http.Request) bool {
+	host := req.URL.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
 func setNoProxyUntil(d time.Duration) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -41,10 +87,17 @@ func setNoProxyUntil(d time.Duration) {
 // For example, WPAD PAC files on Windows.
 var sysProxyFromEnv func(*http.Request) (*url.URL, error)
 
+// ProxyFromEnvironment returns the proxy to use for req: the one set by
+// SetProxy, if any, or else the one configured in the environment or
+// system settings.
 func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
 	mu.Lock()
 	noProxyTime := noProxyUntil
+	ou := override
 	mu.Unlock()
+	if ou != nil && !isLoopbackRequest(req) {
+		return ou, nil
+	}
 	if time.Now().Before(noProxyTime) {
 		return nil, nil
 	}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+
+	"tailscale.com/tailcfg"
+)
+
+// This file contains the code for sessions that run in a local container
+// (per SSHAction.Container) rather than on the host. Such sessions run the
+// container runtime's docker-compatible CLI as tailscaled's own user, which
+// then runs the session's command in the container as the local user.
+
+// containerCLIs maps the supported SSHAction.ContainerRuntime values to the
+// docker-compatible CLI used to exec into their containers.
+var containerCLIs = map[string]string{
+	"":        "docker",
+	"docker":  "docker",
+	"nerdctl": "nerdctl", // containerd
+}
+
+// validContainerName matches container names and IDs as docker and nerdctl
+// allow them. In particular, they can't be mistaken for flags.
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// containerShellCmd starts a login shell in a container, preferring bash as
+// the container user's login shell isn't known.
+const containerShellCmd = `if command -v bash >/dev/null; then exec bash -l; fi; exec sh -l`
+
+// isContainerAction reports whether a runs sessions in a container.
+func isContainerAction(a *tailcfg.SSHAction) bool {
+	return a != nil && a.Container != ""
+}
+
+// containerUser returns the local user for sessions in a container, where
+// username is a user in the container, not necessarily on the host.
+func containerUser(username string) *user.User {
+	return &user.User{Username: username, Name: username}
+}
+
+// containerExecArgs returns the command line that runs a session in a's
+// container as username, with the environment variables ("key=value") in env.
+// If rawCmd is empty, it starts a login shell.
+func containerExecArgs(a *tailcfg.SSHAction, username string, env []string, tty bool, rawCmd string) ([]string, error) {
+	cli, ok := containerCLIs[a.ContainerRuntime]
+	if !ok {
+		return nil, fmt.Errorf("unsupported container runtime %q", a.ContainerRuntime)
+	}
+	if !validContainerName.MatchString(a.Container) {
+		return nil, fmt.Errorf("invalid container name %q", a.Container)
+	}
+	if username == "" {
+		return nil, fmt.Errorf("no user for container %q", a.Container)
+	}
+	args := []string{cli, "exec", "--interactive", "--user=" + username}
+	if tty {
+		args = append(args, "--tty")
+	}
+	for _, kv := range env {
+		args = append(args, "--env="+kv)
+	}
+	if rawCmd == "" {
+		rawCmd = containerShellCmd
+	}
+	return append(args, a.Container, "sh", "-c", rawCmd), nil
+}
+
+// newContainerCommand returns the command that runs ss in the container from
+// its SSH action.
+func (ss *sshSession) newContainerCommand() (*exec.Cmd, error) {
+	ci := ss.conn.info
+	env := []string{
+		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.Addr(), ci.src.Port(), ci.dst.Port()),
+		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.Addr(), ci.src.Port(), ci.dst.Addr(), ci.dst.Port()),
+	}
+	for _, kv := range ss.Environ() {
+		if acceptEnvPair(kv) {
+			env = append(env, kv)
+		}
+	}
+	ptyReq, _, isPty := ss.Pty()
+	if isPty && ptyReq.Term != "" {
+		env = append(env, "TERM="+ptyReq.Term)
+	}
+	args, err := containerExecArgs(ss.conn.finalAction, ss.conn.localUser.Username, env, isPty, ss.RawCommand())
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ss.ctx, args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	return cmd, nil
+}
@@ -66,6 +66,7 @@ func (ss *sshSession) newIncubatorCommand() *exec.Cmd {
 		args    []string
 		isSFTP  bool
 		isShell bool
+		scpArgs []string // non-nil to serve scp in-process
 	)
 	switch ss.Subsystem() {
 	case "sftp":
@@ -74,6 +75,11 @@ func (ss *sshSession) newIncubatorCommand() *exec.Cmd {
 		name = loginShell(ss.conn.localUser.Uid)
 		if rawCmd := ss.RawCommand(); rawCmd != "" {
 			args = append(args, "-c", rawCmd)
+			if isSCPCommand(rawCmd) {
+				if _, err := exec.LookPath("scp"); err != nil {
+					scpArgs = strings.Fields(rawCmd)[1:]
+				}
+			}
 		} else {
 			isShell = true
 			args = append(args, "-l") // login shell
@@ -111,6 +117,9 @@ func (ss *sshSession) newIncubatorCommand() *exec.Cmd {
 
 	if isSFTP {
 		incubatorArgs = append(incubatorArgs, "--sftp")
+	} else if scpArgs != nil {
+		incubatorArgs = append(incubatorArgs, "--scp", "--")
+		incubatorArgs = append(incubatorArgs, scpArgs...)
 	} else {
 		if isShell {
 			incubatorArgs = append(incubatorArgs, "--shell")
@@ -130,6 +139,13 @@ func (ss *sshSession) newIncubatorCommand() *exec.Cmd {
 
 const debugIncubator = false
 
+// x11AuthEnv is the environment variable in which the incubator is passed the
+// xauth entry ("<display> <protocol> <cookie>") for a session with X11
+// forwarding. The cookie is the session's fake one (see
+// sshSession.handleX11Forwarding), not the client's. The incubator removes it
+// from the environment of the command.
+const x11AuthEnv = "TS_SSH_X11_AUTH"
+
 type stdRWC struct{}
 
 func (stdRWC) Read(p []byte) (n int, err error) {
@@ -156,6 +172,7 @@ type incubatorArgs struct {
 	hasTTY       bool
 	cmdName      string
 	isSFTP       bool
+	isSCP        bool
 	isShell      bool
 	loginCmdPath string
 	cmdArgs      []string
@@ -174,6 +191,7 @@ func parseIncubatorArgs(args []string) (a incubatorArgs) {
 	flags.StringVar(&a.cmdName, "cmd", "", "the cmd to launch (ignored in sftp mode)")
 	flags.BoolVar(&a.isShell, "shell", false, "is launching a shell (with no cmds)")
 	flags.BoolVar(&a.isSFTP, "sftp", false, "run sftp server (cmd is ignored)")
+	flags.BoolVar(&a.isSCP, "scp", false, "run scp server with the remaining args (cmd is ignored)")
 	flags.StringVar(&a.loginCmdPath, "login-cmd", "", "the path to `login` cmd")
 	flags.Parse(args)
 	a.cmdArgs = flags.Args()
@@ -194,6 +212,9 @@ func beIncubator(args []string) error {
 	if ia.isSFTP && ia.isShell {
 		return fmt.Errorf("--sftp and --shell are mutually exclusive")
 	}
+	if ia.isSCP && (ia.isSFTP || ia.isShell) {
+		return fmt.Errorf("--scp is mutually exclusive with --sftp and --shell")
+	}
 
 	logf := logger.Discard
 	if debugIncubator {
@@ -203,12 +224,16 @@ func beIncubator(args []string) error {
 		}
 	}
 
+	x11Auth := os.Getenv(x11AuthEnv)
+	os.Unsetenv(x11AuthEnv)
+
 	euid := uint64(os.Geteuid())
 	runningAsRoot := euid == 0
-	if runningAsRoot && ia.isShell && ia.loginCmdPath != "" && ia.hasTTY {
+	if runningAsRoot && ia.isShell && ia.loginCmdPath != "" && ia.hasTTY && x11Auth == "" {
 		// If we are trying to launch a login shell, just exec into login
 		// instead. We can only do this if a TTY was requested, otherwise login
 		// exits immediately, which breaks things likes mosh and VSCode.
+		// Nor with X11 forwarding, as login resets DISPLAY.
 		return unix.Exec(ia.loginCmdPath, ia.loginArgs(), os.Environ())
 	}
 
@@ -245,6 +270,11 @@ func beIncubator(args []string) error {
 			os.Exit(1)
 		}
 	}
+	if x11Auth != "" {
+		if err := addX11Auth(x11Auth); err != nil {
+			logf("xauth: %v", err)
+		}
+	}
 	if ia.isSFTP {
 		logf("handling sftp")
 
@@ -254,6 +284,10 @@ func beIncubator(args []string) error {
 		}
 		return server.Serve()
 	}
+	if ia.isSCP {
+		logf("handling scp")
+		return serveSCP(ia.cmdArgs, os.Stdin, os.Stdout)
+	}
 
 	cmd := exec.Command(ia.cmdName, ia.cmdArgs...)
 	cmd.Stdin = os.Stdin
@@ -276,12 +310,33 @@ func beIncubator(args []string) error {
 	return cmd.Run()
 }
 
+// addX11Auth adds entry, the xauth entry from x11AuthEnv, to the current user's
+// X authority file, replacing any old entry for its display. It's best effort:
+// X11 clients without a matching entry fail to connect but the session works.
+func addX11Auth(entry string) error {
+	display, _, _ := strings.Cut(entry, " ")
+	cmd := exec.Command("xauth", "-q", "-")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("remove %s\nadd %s\n", display, entry))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, out)
+	}
+	return nil
+}
+
 // launchProcess launches an incubator process for the provided session.
 // It is responsible for configuring the process execution environment.
 // The caller can wait for the process to exit by calling cmd.Wait().
 //
 // It sets ss.cmd, stdin, stdout, and stderr.
 func (ss *sshSession) launchProcess() error {
+	if isContainerAction(ss.conn.finalAction) {
+		cmd, err := ss.newContainerCommand()
+		if err != nil {
+			return err
+		}
+		ss.cmd = cmd
+		return ss.startProcess()
+	}
 	ss.cmd = ss.newIncubatorCommand()
 
 	cmd := ss.cmd
@@ -302,7 +357,22 @@ func (ss *sshSession) launchProcess() error {
 	if ss.agentListener != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
 	}
+	if ss.x11Listener != nil {
+		cmd.Env = append(cmd.Env, "DISPLAY=localhost:"+ss.x11Display)
+		if x11, ok := ss.X11(); ok {
+			// Passed in the environment rather than as a flag so that the
+			// cookie isn't visible to other users in the process list.
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=unix:%s %s %s", x11AuthEnv, ss.x11Display, x11.AuthProtocol, ss.x11FakeCookie))
+		}
+	}
+	return ss.startProcess()
+}
 
+// startProcess starts ss.cmd, with a PTY if one was requested.
+//
+// It sets stdin, stdout, and stderr.
+func (ss *sshSession) startProcess() error {
+	cmd := ss.cmd
 	ptyReq, winCh, isPty := ss.Pty()
 	if !isPty {
 		ss.logf("starting non-pty command: %+v", cmd.Args)
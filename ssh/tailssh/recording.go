@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+)
+
+// Limits on the session recordings kept on local disk. The defaults
+// can be overridden by environment variables for now.
+var (
+	// recordingMaxBytes is the maximum size of one recording.
+	// Once reached, the rest of the session isn't recorded.
+	recordingMaxBytes = envInt64("TS_SSH_RECORDING_MAX_BYTES", 64<<20)
+
+	// recordingMaxTotalBytes is the maximum total size of all
+	// recordings. The oldest ones are removed to stay under it.
+	recordingMaxTotalBytes = envInt64("TS_SSH_RECORDING_MAX_TOTAL_BYTES", 1<<30)
+
+	// recordingMaxAge is how long recordings are kept after
+	// they were last written.
+	recordingMaxAge = envDuration("TS_SSH_RECORDING_MAX_AGE", 30*24*time.Hour)
+)
+
+func envInt64(envVar string, def int64) int64 {
+	if v, ok := envknob.LookupInt(envVar); ok && v > 0 {
+		return int64(v)
+	}
+	return def
+}
+
+func envDuration(envVar string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(envknob.String(envVar)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// recordingIndexName is the name of the index of the recordings, in
+// the recordings directory. Each line is a JSON apitype.SSHRecording,
+// without its Size and LastWrite, which come from the file itself.
+const recordingIndexName = "index.jsonl"
+
+// recordingsMu serializes changes to the recordings directory and
+// its index.
+var recordingsMu sync.Mutex
+
+// recordingsDir returns the directory that recordings are kept in.
+func recordingsDir(varRoot string) string {
+	return filepath.Join(varRoot, "ssh-sessions")
+}
+
+// Recordings returns the session recordings on local disk, newest
+// first.
+func (srv *server) Recordings() ([]apitype.SSHRecording, error) {
+	varRoot := srv.lb.TailscaleVarRoot()
+	if varRoot == "" {
+		return nil, errors.New("no var root for recording storage")
+	}
+	recordingsMu.Lock()
+	defer recordingsMu.Unlock()
+	recs, err := listRecordingsLocked(recordingsDir(varRoot))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Start.After(recs[j].Start) })
+	return recs, nil
+}
+
+// addRecording adds rec, a recording that has just started, to the
+// index of dir, first removing any recordings beyond the retention
+// limits.
+func addRecording(dir string, rec apitype.SSHRecording) error {
+	recordingsMu.Lock()
+	defer recordingsMu.Unlock()
+	if err := pruneRecordingsLocked(dir, time.Now()); err != nil {
+		return err
+	}
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, recordingIndexName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(j, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// listRecordingsLocked returns the recordings in dir's index whose
+// files still exist, in index order, with their Size and LastWrite.
+func listRecordingsLocked(dir string) ([]apitype.SSHRecording, error) {
+	b, err := os.ReadFile(filepath.Join(dir, recordingIndexName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []apitype.SSHRecording
+	bs := bufio.NewScanner(bytes.NewReader(b))
+	for bs.Scan() {
+		var rec apitype.SSHRecording
+		if err := json.Unmarshal(bs.Bytes(), &rec); err != nil || filepath.Base(rec.ID) != rec.ID {
+			continue // skip corrupt lines, such as from a crash mid-write
+		}
+		fi, err := os.Stat(filepath.Join(dir, rec.ID))
+		if err != nil {
+			continue
+		}
+		rec.Size = fi.Size()
+		rec.LastWrite = fi.ModTime()
+		recs = append(recs, rec)
+	}
+	return recs, bs.Err()
+}
+
+// pruneRecordingsLocked removes the recordings in dir that are older
+// than recordingMaxAge, and then the oldest ones until the rest fit
+// in recordingMaxTotalBytes, and rewrites the index to match.
+func pruneRecordingsLocked(dir string, now time.Time) error {
+	recs, err := listRecordingsLocked(dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, rec := range recs {
+		total += rec.Size
+	}
+	keep := make([]apitype.SSHRecording, 0, len(recs))
+	for _, rec := range recs { // oldest first
+		if now.Sub(rec.LastWrite) > recordingMaxAge || total > recordingMaxTotalBytes {
+			if err := os.Remove(filepath.Join(dir, rec.ID)); err == nil || errors.Is(err, fs.ErrNotExist) {
+				total -= rec.Size
+				continue
+			}
+		}
+		keep = append(keep, rec)
+	}
+	var buf bytes.Buffer
+	for _, rec := range keep {
+		rec.Size, rec.LastWrite = 0, time.Time{}
+		j, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(j)
+		buf.WriteByte('\n')
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, recordingIndexName), buf.Bytes(), 0600)
+}
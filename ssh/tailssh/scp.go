@@ -0,0 +1,312 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements the server side of the legacy scp protocol
+// (as run by "scp -t" and "scp -f" on the remote host), for hosts
+// without an scp binary. Newer scp clients use SFTP instead.
+
+// scpArgs are the parsed arguments of a remote scp command.
+type scpArgs struct {
+	sink      bool // -t: receive files from the client
+	source    bool // -f: send files to the client
+	recursive bool // -r
+	preserve  bool // -p: send or apply modification times
+	targetDir bool // -d: the target must be a directory
+	paths     []string
+}
+
+// parseSCPCommand parses rawCmd, a command run in an SSH session, as
+// the remote end of an scp transfer. It reports false if rawCmd isn't
+// one, or uses shell syntax (such as quoting) that it doesn't handle.
+func parseSCPCommand(rawCmd string) (a scpArgs, ok bool) {
+	if strings.ContainsAny(rawCmd, "'\"\\$`;&|<>*?") {
+		return a, false
+	}
+	f := strings.Fields(rawCmd)
+	if len(f) < 2 || f[0] != "scp" {
+		return a, false
+	}
+	args := f[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 't':
+				a.sink = true
+			case 'f':
+				a.source = true
+			case 'r':
+				a.recursive = true
+			case 'p':
+				a.preserve = true
+			case 'd':
+				a.targetDir = true
+			case 'v':
+			default:
+				return a, false
+			}
+		}
+	}
+	a.paths = args
+	if a.sink == a.source || len(a.paths) == 0 || (a.sink && len(a.paths) != 1) {
+		return a, false
+	}
+	return a, true
+}
+
+// isSCPCommand reports whether rawCmd is the remote end of an scp
+// transfer.
+func isSCPCommand(rawCmd string) bool {
+	_, ok := parseSCPCommand(rawCmd)
+	return ok
+}
+
+// scpServer serves one scp transfer over r and w.
+type scpServer struct {
+	scpArgs
+	r *bufio.Reader
+	w io.Writer
+}
+
+// serveSCP runs the scp transfer described by the scp command line
+// args (without "scp") over r and w.
+func serveSCP(args []string, r io.Reader, w io.Writer) error {
+	a, ok := parseSCPCommand("scp " + strings.Join(args, " "))
+	if !ok {
+		return fmt.Errorf("unsupported scp arguments %q", args)
+	}
+	s := &scpServer{scpArgs: a, r: bufio.NewReader(r), w: w}
+	var err error
+	if a.sink {
+		err = s.sink(a.paths[0])
+	} else {
+		err = s.source(a.paths)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "\x02scp: %v\n", err)
+	}
+	return err
+}
+
+func (s *scpServer) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// readAck reads the client's response to a message.
+func (s *scpServer) readAck() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := s.r.ReadString('\n')
+	return fmt.Errorf("client error: %s", strings.TrimSpace(msg))
+}
+
+// sink receives files from the client into target.
+func (s *scpServer) sink(target string) error {
+	fi, err := os.Stat(target)
+	isDir := err == nil && fi.IsDir()
+	if s.targetDir && !isDir {
+		return fmt.Errorf("%s: not a directory", target)
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	dirs := []string{target} // stack of directories being received into
+	var mtime time.Time
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("empty message")
+		}
+		dir := dirs[len(dirs)-1]
+		switch line[0] {
+		case 1, 2:
+			return fmt.Errorf("client error: %s", line[1:])
+		case 'T':
+			var sec int64
+			if _, err := fmt.Sscanf(line[1:], "%d", &sec); err != nil {
+				return fmt.Errorf("bad time message %q", line)
+			}
+			mtime = time.Unix(sec, 0)
+		case 'E':
+			if len(dirs) == 1 {
+				return errors.New("unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case 'C', 'D':
+			mode, size, name, err := parseSCPEntry(line[1:])
+			if err != nil {
+				return err
+			}
+			path := dir
+			if len(dirs) > 1 || isDir {
+				path = filepath.Join(dir, name)
+			}
+			if line[0] == 'D' {
+				if !s.recursive {
+					return errors.New("received directory without -r")
+				}
+				if err := os.Mkdir(path, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+					return err
+				}
+				dirs = append(dirs, path)
+			} else if err := s.receiveFile(path, mode, size); err != nil {
+				return err
+			}
+			if !mtime.IsZero() && s.preserve {
+				os.Chtimes(path, mtime, mtime)
+			}
+		default:
+			return fmt.Errorf("unknown message %q", line)
+		}
+		if line[0] != 'T' {
+			mtime = time.Time{}
+		}
+		if err := s.ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseSCPEntry parses the rest of a "C" or "D" message:
+// "<octal mode> <size> <name>".
+func parseSCPEntry(msg string) (mode fs.FileMode, size int64, name string, err error) {
+	f := strings.SplitN(msg, " ", 3)
+	if len(f) != 3 {
+		return 0, 0, "", fmt.Errorf("bad entry message %q", msg)
+	}
+	m, err := strconv.ParseUint(f[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad mode in %q", msg)
+	}
+	size, err = strconv.ParseInt(f[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("bad size in %q", msg)
+	}
+	name = f[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("bad name in %q", msg)
+	}
+	return fs.FileMode(m) & fs.ModePerm, size, name, nil
+}
+
+func (s *scpServer) receiveFile(path string, mode fs.FileMode, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.CopyN(f, s.r, size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+// source sends the files at paths to the client.
+func (s *scpServer) source(paths []string) error {
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := s.send(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *scpServer) send(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if s.preserve {
+		fmt.Fprintf(s.w, "T%d 0 %d 0\n", fi.ModTime().Unix(), fi.ModTime().Unix())
+		if err := s.readAck(); err != nil {
+			return err
+		}
+	}
+	name := filepath.Base(path)
+	mode := fi.Mode() & fs.ModePerm
+	if fi.IsDir() {
+		if !s.recursive {
+			return fmt.Errorf("%s: is a directory", path)
+		}
+		fmt.Fprintf(s.w, "D%04o 0 %s\n", mode, name)
+		if err := s.readAck(); err != nil {
+			return err
+		}
+		ents, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			if err := s.send(filepath.Join(path, ent.Name())); err != nil {
+				return err
+			}
+		}
+		io.WriteString(s.w, "E\n")
+		return s.readAck()
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(s.w, "C%04o %d %s\n", mode, fi.Size(), name)
+	if err := s.readAck(); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(s.w, f, fi.Size()); err != nil {
+		return err
+	}
+	if err := s.ack(); err != nil {
+		return err
+	}
+	return s.readAck()
+}
@@ -13,6 +13,8 @@
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +29,7 @@
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,7 +37,9 @@
 	"time"
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/tsaddr"
@@ -43,6 +48,7 @@
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/mak"
+	"tailscale.com/util/multierr"
 )
 
 var (
@@ -66,6 +72,45 @@ type server struct {
 	activeConns          map[*conn]bool              // set; value is always true
 	fetchPublicKeysCache map[string]pubKeyCacheEntry // by https URL
 	shutdownCalled       bool
+	stuckSessions        map[*sshSession]bool // terminated but not yet exited
+
+	healthMu   sync.Mutex
+	healthErrs map[sshProblem]error // current problems, reported to health as SysSSH
+}
+
+// sshProblem is a kind of problem the SSH server reports to health.
+type sshProblem string
+
+const (
+	problemHostKeys     sshProblem = "host keys"
+	problemFetchAction  sshProblem = "fetching SSH action"
+	problemStartSession sshProblem = "starting session"
+	problemStuck        sshProblem = "stuck sessions"
+)
+
+// stuckSessionTimeout is how long a terminated session's process can
+// take to exit before the session is considered stuck.
+const stuckSessionTimeout = 30 * time.Second
+
+// setHealth sets (or clears, if err is nil) the problem p, and reports
+// the server's problems to health.
+func (srv *server) setHealth(p sshProblem, err error) {
+	srv.healthMu.Lock()
+	defer srv.healthMu.Unlock()
+	if err == nil {
+		if _, ok := srv.healthErrs[p]; !ok {
+			return
+		}
+		delete(srv.healthErrs, p)
+	} else {
+		mak.Set(&srv.healthErrs, p, err)
+	}
+	var errs []error
+	for p, err := range srv.healthErrs {
+		errs = append(errs, fmt.Errorf("%s: %w", p, err))
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	health.SetSSHHealth(multierr.New(errs...))
 }
 
 func (srv *server) now() time.Time {
@@ -133,6 +178,11 @@ func (srv *server) Shutdown() {
 	}
 	srv.mu.Unlock()
 	srv.sessionWaitGroup.Wait()
+
+	srv.healthMu.Lock()
+	defer srv.healthMu.Unlock()
+	srv.healthErrs = nil
+	health.SetSSHHealth(nil)
 }
 
 // OnPolicyChange terminates any active sessions that no longer match
@@ -235,6 +285,12 @@ func (c *conn) checkAuth(pubKey ssh.PublicKey) error {
 		return fmt.Errorf("%w: %v", gossh.ErrDenied, err)
 	}
 	c.action0 = a
+	if isContainerAction(a) && a.Accept {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.localUser = containerUser(localUser)
+		return nil
+	}
 	if a.Accept || a.HoldAndDelegate != "" {
 		lu, err := user.Lookup(localUser)
 		if err != nil {
@@ -291,21 +347,27 @@ func (srv *server) newConn() (*conn, error) {
 	c := &conn{srv: srv}
 	now := srv.now()
 	c.connID = fmt.Sprintf("ssh-conn-%s-%02x", now.UTC().Format("20060102T150405"), randBytes(5))
+	fwd := new(ssh.ForwardedTCPHandler)
 	c.Server = &ssh.Server{
-		Version:         "Tailscale",
-		Handler:         c.handleSessionPostSSHAuth,
-		RequestHandlers: map[string]ssh.RequestHandler{},
+		Version: "Tailscale",
+		Handler: c.handleSessionPostSSHAuth,
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        fwd.HandleSSHRequest,
+			"cancel-tcpip-forward": fwd.HandleSSHRequest,
+		},
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			"sftp": c.handleSessionPostSSHAuth,
 		},
 
 		// Note: the direct-tcpip channel handler and LocalPortForwardingCallback
-		// only adds support for forwarding ports from the local machine.
-		// TODO(maisem/bradfitz): add remote port forwarding support.
+		// add support for forwarding ports from the local machine, and the
+		// tcpip-forward request handlers and ReversePortForwardingCallback
+		// for forwarding ports on the local machine to the client.
 		ChannelHandlers: map[string]ssh.ChannelHandler{
 			"direct-tcpip": ssh.DirectTCPIPHandler,
 		},
-		LocalPortForwardingCallback: c.mayForwardLocalPortTo,
+		LocalPortForwardingCallback:   c.mayForwardLocalPortTo,
+		ReversePortForwardingCallback: c.mayReversePortForwardTo,
 
 		PublicKeyHandler:     c.PublicKeyHandler,
 		ServerConfigCallback: c.ServerConfig,
@@ -321,6 +383,7 @@ func (srv *server) newConn() (*conn, error) {
 		ss.SubsystemHandlers[k] = v
 	}
 	keys, err := srv.lb.GetSSH_HostKeys()
+	srv.setHealth(problemHostKeys, err)
 	if err != nil {
 		return nil, err
 	}
@@ -334,13 +397,46 @@ func (srv *server) newConn() (*conn, error) {
 // to the specified host and port.
 // TODO(bradfitz/maisem): should we have more checks on host/port?
 func (c *conn) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
-	if c.finalAction != nil && c.finalAction.AllowLocalPortForwarding {
+	if c.finalAction != nil && c.finalAction.AllowLocalPortForwarding && !isContainerAction(c.finalAction) {
 		metricLocalPortForward.Add(1)
 		return true
 	}
 	return false
 }
 
+// mayReversePortForwardTo reports whether the ctx should be allowed to listen
+// on the specified host and port for remote port forwarding. As with
+// OpenSSH's default of "GatewayPorts no", only loopback addresses are allowed,
+// and only root may listen on privileged ports.
+func (c *conn) mayReversePortForwardTo(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	if c.finalAction == nil || !c.finalAction.AllowRemotePortForwarding || isContainerAction(c.finalAction) {
+		return false
+	}
+	if !isLoopbackHost(bindHost) {
+		c.logf("ssh: denied remote port forwarding on non-loopback host %q", bindHost)
+		return false
+	}
+	c.mu.Lock()
+	isRoot := c.localUser != nil && c.localUser.Uid == "0"
+	c.mu.Unlock()
+	if bindPort != 0 && bindPort < 1024 && !isRoot {
+		c.logf("ssh: denied remote port forwarding on privileged port %d", bindPort)
+		return false
+	}
+	metricRemotePortForward.Add(1)
+	return true
+}
+
+// isLoopbackHost reports whether host, a bind address from a remote port
+// forwarding request, refers only to the loopback interface.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
 // havePubKeyPolicy reports whether any policy rule may provide access by means
 // of a ssh.PublicKey.
 func (c *conn) havePubKeyPolicy() bool {
@@ -601,14 +697,31 @@ func (c *conn) handleSessionPostSSHAuth(s ssh.Session) {
 	}
 
 	// Do this check after auth, but before starting the session.
+	var isFileTransfer bool
 	switch s.Subsystem() {
-	case "sftp", "":
+	case "sftp":
+		isFileTransfer = true
 		metricSFTP.Add(1)
+	case "":
+		if isSCPCommand(s.RawCommand()) {
+			isFileTransfer = true
+			metricSCP.Add(1)
+		}
 	default:
 		fmt.Fprintf(s.Stderr(), "Unsupported subsystem %q\r\n", s.Subsystem())
 		s.Exit(1)
 		return
 	}
+	if s.Subsystem() == "sftp" && isContainerAction(c.finalAction) {
+		fmt.Fprintf(s.Stderr(), "SFTP is not supported in containers\r\n")
+		s.Exit(1)
+		return
+	}
+	if isFileTransfer && !c.finalAction.AllowFileTransfer {
+		fmt.Fprintf(s.Stderr(), "File transfer is not allowed by the Tailscale SSH policy\r\n")
+		s.Exit(1)
+		return
+	}
 
 	ss := c.newSSHSession(s)
 	c.mu.Lock()
@@ -755,6 +868,9 @@ type sshSession struct {
 	ctx           *sshContext // implements context.Context
 	conn          *conn
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	x11Listener   net.Listener // non-nil if X11 forwarding requested+allowed
+	x11Display    string       // DISPLAY for the session if x11Listener is non-nil
+	x11FakeCookie string       // hex cookie local X11 clients use in place of the real one
 
 	// initialized by launchProcess:
 	cmd    *exec.Cmd
@@ -766,6 +882,8 @@ type sshSession struct {
 	// We use this sync.Once to ensure that we only terminate the process once,
 	// either it exits itself or is terminated
 	exitOnce sync.Once
+
+	ended bool // set by endSession; guarded by conn.srv.mu
 }
 
 func (ss *sshSession) vlogf(format string, args ...interface{}) {
@@ -830,6 +948,7 @@ func (c *conn) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHActi
 		}
 		res, err := c.srv.lb.DoNoiseRequest(req)
 		if err != nil {
+			c.srv.setHealth(problemFetchAction, err)
 			bo.BackOff(ctx, err)
 			continue
 		}
@@ -840,7 +959,9 @@ func (c *conn) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHActi
 				body = body[:1<<10]
 			}
 			c.logf("fetch of %v: %s, %s", url, res.Status, body)
-			bo.BackOff(ctx, fmt.Errorf("unexpected status: %v", res.Status))
+			err := fmt.Errorf("unexpected status: %v", res.Status)
+			c.srv.setHealth(problemFetchAction, err)
+			bo.BackOff(ctx, err)
 			continue
 		}
 		a := new(tailcfg.SSHAction)
@@ -848,9 +969,11 @@ func (c *conn) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHActi
 		res.Body.Close()
 		if err != nil {
 			c.logf("invalid next SSHAction JSON from %v: %v", url, err)
+			c.srv.setHealth(problemFetchAction, err)
 			bo.BackOff(ctx, err)
 			continue
 		}
+		c.srv.setHealth(problemFetchAction, nil)
 		return a, nil
 	}
 }
@@ -875,9 +998,31 @@ func (ss *sshSession) killProcessOnContextDone() {
 
 		// TODO(maisem): should this be a SIGTERM followed by a SIGKILL?
 		ss.cmd.Process.Kill()
+
+		srv := ss.conn.srv
+		time.AfterFunc(stuckSessionTimeout, func() {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if ss.ended {
+				return
+			}
+			ss.logf("process still running %v after termination", stuckSessionTimeout)
+			mak.Set(&srv.stuckSessions, ss, true)
+			srv.reportStuckSessionsLocked()
+		})
 	})
 }
 
+// reportStuckSessionsLocked reports the number of stuck sessions to
+// health. It must be called with srv.mu held.
+func (srv *server) reportStuckSessionsLocked() {
+	var err error
+	if n := len(srv.stuckSessions); n > 0 {
+		err = fmt.Errorf("%d terminated session(s) haven't exited", n)
+	}
+	srv.setHealth(problemStuck, err)
+}
+
 // startSessionLocked registers ss as an active session.
 // It must be called with srv.mu held.
 func (c *conn) startSessionLocked(ss *sshSession) {
@@ -893,6 +1038,11 @@ func (c *conn) endSession(ss *sshSession) {
 	defer c.srv.sessionWaitGroup.Done()
 	c.srv.mu.Lock()
 	defer c.srv.mu.Unlock()
+	ss.ended = true
+	if c.srv.stuckSessions[ss] {
+		delete(c.srv.stuckSessions, ss)
+		c.srv.reportStuckSessionsLocked()
+	}
 	for i, s := range c.sessions {
 		if s == ss {
 			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
@@ -907,47 +1057,246 @@ func (c *conn) endSession(ss *sshSession) {
 // forwards agent connections between the listener and the ssh.Session.
 // On success, it assigns ss.agentListener.
 func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *user.User) error {
-	if !ssh.AgentRequested(ss) || !ss.conn.finalAction.AllowAgentForwarding {
+	if !ssh.AgentRequested(ss) || isContainerAction(ss.conn.finalAction) {
+		// Not requested, or the socket would be on the host rather than in
+		// the container.
+		return nil
+	}
+	if !ss.conn.finalAction.AllowAgentForwarding {
+		ss.logf("ssh: agent forwarding requested but not allowed by policy")
+		metricAgentForwardingDenied.Add(1)
 		return nil
 	}
 	ss.logf("ssh: agent forwarding requested")
-	ln, err := ssh.NewAgentListener()
+	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err != nil && ln != nil {
-			ln.Close()
-		}
-	}()
-
-	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
+	gid, err := strconv.ParseUint(lu.Gid, 10, 32)
 	if err != nil {
 		return err
 	}
-	gid, err := strconv.ParseUint(lu.Gid, 10, 32)
+	ln, err := newAgentListener(int(uid), int(gid))
 	if err != nil {
 		return err
 	}
+	metricAgentForwarding.Add(1)
+	go ssh.ForwardAgentConnections(ln, s)
+	ss.agentListener = ln
+	return nil
+}
+
+// newAgentListener returns a listener for the agent socket of a
+// session for the user with the given uid and gid. The socket and its
+// directory are owned by and only accessible to the user, and the
+// directory is removed when the listener is closed.
+func newAgentListener(uid, gid int) (_ net.Listener, err error) {
+	ln, err := ssh.NewAgentListener()
+	if err != nil {
+		return nil, err
+	}
 	socket := ln.Addr().String()
 	dir := filepath.Dir(socket)
-	// Make sure the socket is accessible only by the user.
-	if err := os.Chmod(socket, 0600); err != nil {
-		return err
+	al := &agentListener{ln, dir}
+	defer func() {
+		if err != nil {
+			al.Close()
+		}
+	}()
+	for _, path := range []string{socket, dir} {
+		mode := os.FileMode(0600)
+		if path == dir {
+			mode = 0700
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return nil, err
+		}
 	}
-	if err := os.Chown(socket, int(uid), int(gid)); err != nil {
+	return al, nil
+}
+
+// agentListener is an agent socket listener that removes its
+// directory when closed.
+type agentListener struct {
+	net.Listener
+	dir string
+}
+
+func (l *agentListener) Close() error {
+	err := l.Listener.Close()
+	os.RemoveAll(l.dir)
+	return err
+}
+
+// x11DisplayOffset is the first display number used for X11 forwarding, as in
+// OpenSSH, leaving the lower ones for local X servers.
+const x11DisplayOffset = 10
+
+// x11MaxDisplays is the number of display numbers tried for X11 forwarding.
+const x11MaxDisplays = 1000
+
+// handleX11Forwarding starts X11 forwarding for the session, if it was
+// requested and is allowed by policy. It listens on the loopback TCP port of
+// the first free display, and sets ss.x11Listener, ss.x11Display and
+// ss.x11FakeCookie.
+//
+// As in OpenSSH, local X11 clients are given a random fake cookie rather than
+// the client's real one, which is substituted as their connections are
+// forwarded. That way, the real cookie, which grants access to the client's
+// display, is never stored on this machine.
+func (ss *sshSession) handleX11Forwarding(s ssh.Session) error {
+	x11, ok := s.X11()
+	if !ok || isContainerAction(ss.conn.finalAction) {
+		return nil
+	}
+	if !ss.conn.finalAction.AllowX11Forwarding {
+		ss.logf("ssh: X11 forwarding requested but not allowed by policy")
+		metricX11ForwardingDenied.Add(1)
+		return nil
+	}
+	if !validX11AuthField(x11.AuthProtocol) || !validX11AuthField(x11.AuthCookie) {
+		return errors.New("invalid X11 authentication data")
+	}
+	realCookie, err := hex.DecodeString(x11.AuthCookie)
+	if err != nil || len(realCookie) == 0 {
+		return errors.New("invalid X11 authentication cookie")
+	}
+	fakeCookie := make([]byte, len(realCookie))
+	if _, err := rand.Read(fakeCookie); err != nil {
 		return err
 	}
-	// Make sure the dir is also accessible.
-	if err := os.Chmod(dir, 0755); err != nil {
+	ss.logf("ssh: X11 forwarding requested")
+	ln, display, err := listenX11()
+	if err != nil {
 		return err
 	}
+	metricX11Forwarding.Add(1)
+	go ssh.ForwardX11Connections(&x11AuthListener{
+		Listener: ln,
+		proto:    x11.AuthProtocol,
+		fake:     fakeCookie,
+		real:     realCookie,
+	}, s)
+	ss.x11Listener = ln
+	ss.x11Display = fmt.Sprintf("%d.%d", display, x11.ScreenNumber)
+	ss.x11FakeCookie = hex.EncodeToString(fakeCookie)
+	return nil
+}
 
-	go ssh.ForwardAgentConnections(ln, s)
-	ss.agentListener = ln
+// x11AuthListener is a net.Listener of local X11 client connections whose
+// setup requests authenticate with the fake cookie, and have the real one
+// substituted as they're read.
+type x11AuthListener struct {
+	net.Listener
+	proto      string // authentication protocol, such as "MIT-MAGIC-COOKIE-1"
+	fake, real []byte // same length
+}
+
+func (l *x11AuthListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &x11AuthConn{Conn: c, l: l}, nil
+}
+
+// x11AuthConn is a connection accepted by x11AuthListener. Its first Read
+// reads the X11 connection setup request, and returns it with the
+// authentication substituted.
+type x11AuthConn struct {
+	net.Conn
+	l *x11AuthListener
+
+	r io.Reader // nil until the setup request is read
+}
+
+func (c *x11AuthConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		setup, err := substituteX11Auth(c.Conn, c.l.proto, c.l.fake, c.l.real)
+		if err != nil {
+			return 0, err
+		}
+		c.r = io.MultiReader(bytes.NewReader(setup), c.Conn)
+	}
+	return c.r.Read(p)
+}
+
+// CloseWrite implements the half-close ssh.ForwardX11Connections uses.
+func (c *x11AuthConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
 	return nil
 }
 
+// substituteX11Auth reads an X11 connection setup request from r and returns
+// it with its authentication data, which must be fake under proto, replaced
+// by real, which is the same length.
+func substituteX11Auth(r io.Reader, proto string, fake, real []byte) ([]byte, error) {
+	// The request starts with a byte order, a pad byte, the protocol major
+	// and minor versions, the lengths of the authentication protocol name
+	// and data, and two pad bytes, before the name and data themselves,
+	// each padded to a multiple of four bytes.
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading X11 setup: %w", err)
+	}
+	var order binary.ByteOrder
+	switch hdr[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("X11 setup has unknown byte order %#x", hdr[0])
+	}
+	pad4 := func(n int) int { return (n + 3) &^ 3 }
+	nameLen, dataLen := int(order.Uint16(hdr[6:])), int(order.Uint16(hdr[8:]))
+	body := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading X11 setup: %w", err)
+	}
+	name := body[:nameLen]
+	data := body[pad4(nameLen) : pad4(nameLen)+dataLen]
+	if string(name) != proto || !bytes.Equal(data, fake) {
+		return nil, errors.New("X11 connection used the wrong authentication")
+	}
+	copy(data, real)
+	return append(hdr, body...), nil
+}
+
+// validX11AuthField reports whether s, the authentication protocol or cookie
+// of an X11 forwarding request, is safe to pass to xauth.
+func validX11AuthField(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// listenX11 listens on the TCP port of the first free X11 display on the
+// loopback interface, skipping displays with a local X server socket.
+func listenX11() (_ net.Listener, display int, err error) {
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		if _, err := os.Stat(fmt.Sprintf("/tmp/.X11-unix/X%d", display)); err == nil {
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(6000+display)))
+		if err == nil {
+			return ln, display, nil
+		}
+	}
+	return nil, 0, errors.New("no free X11 display")
+}
+
 // recordSSH is a temporary dev knob to test the SSH recording
 // functionality and support off-node streaming.
 //
@@ -991,7 +1340,8 @@ func (ss *sshSession) run() {
 
 	logf := ss.logf
 
-	if euid := os.Geteuid(); euid != 0 {
+	inContainer := isContainerAction(ss.conn.finalAction)
+	if euid := os.Geteuid(); euid != 0 && !inContainer {
 		if lu.Uid != fmt.Sprint(euid) {
 			ss.logf("can't switch to user %q from process euid %v", localUser, euid)
 			fmt.Fprintf(ss, "can't switch user\r\n")
@@ -1012,6 +1362,11 @@ func (ss *sshSession) run() {
 			// TODO(maisem/bradfitz): add a way to close all session resources
 			defer ss.agentListener.Close()
 		}
+		if err := ss.handleX11Forwarding(ss); err != nil {
+			ss.logf("X11 forwarding failed: %v", err)
+		} else if ss.x11Listener != nil {
+			defer ss.x11Listener.Close()
+		}
 
 		if ss.shouldRecord() {
 			var err error
@@ -1027,6 +1382,7 @@ func (ss *sshSession) run() {
 	}
 
 	err := ss.launchProcess()
+	srv.setHealth(problemStartSession, err)
 	if err != nil {
 		logf("start failed: %v", err.Error())
 		ss.Exit(1)
@@ -1089,10 +1445,9 @@ func (ss *sshSession) run() {
 
 func (ss *sshSession) shouldRecord() bool {
 	// for now only record pty sessions
-	// TODO(bradfitz,maisem): make configurable on SSHPolicy and
-	// support recording non-pty stuff too.
+	// TODO(bradfitz,maisem): support recording non-pty stuff too.
 	_, _, isPtyReq := ss.Pty()
-	return recordSSH && isPtyReq
+	return (recordSSH || ss.conn.finalAction.RecordSession) && isPtyReq
 }
 
 type sshConnInfo struct {
@@ -1282,7 +1637,8 @@ func randBytes(n int) []byte {
 // startNewRecording starts a new SSH session recording.
 //
 // It writes an asciinema file to
-// $TAILSCALE_VAR_ROOT/ssh-sessions/ssh-session-<unixtime>-*.cast.
+// $TAILSCALE_VAR_ROOT/ssh-sessions/ssh-session-<unixtime>-*.cast,
+// and adds it to the index of recordings.
 func (ss *sshSession) startNewRecording() (*recording, error) {
 	var w ssh.Window
 	if ptyReq, _, isPtyReq := ss.Pty(); isPtyReq {
@@ -1303,7 +1659,7 @@ func (ss *sshSession) startNewRecording() (*recording, error) {
 	if varRoot == "" {
 		return nil, errors.New("no var root for recording storage")
 	}
-	dir := filepath.Join(varRoot, "ssh-sessions")
+	dir := recordingsDir(varRoot)
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
@@ -1312,6 +1668,20 @@ func (ss *sshSession) startNewRecording() (*recording, error) {
 		return nil, err
 	}
 	rec.out = f
+	ci := ss.conn.info
+	if err := addRecording(dir, apitype.SSHRecording{
+		ID:        filepath.Base(f.Name()),
+		Start:     now,
+		SSHUser:   ci.sshUser,
+		LocalUser: ss.conn.localUser.Username,
+		SrcNode:   strings.TrimSuffix(ci.node.Name, "."),
+		SrcUser:   ci.uprof.LoginName,
+		SrcAddr:   ci.src.String(),
+	}); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("indexing recording: %w", err)
+	}
 
 	// {"version": 2, "width": 221, "height": 84, "timestamp": 1647146075, "env": {"SHELL": "/bin/bash", "TERM": "screen"}}
 	type CastHeader struct {
@@ -1348,6 +1718,7 @@ type CastHeader struct {
 		f.Close()
 		return nil, err
 	}
+	rec.written = int64(len(j))
 	return rec, nil
 }
 
@@ -1356,8 +1727,10 @@ type recording struct {
 	ss    *sshSession
 	start time.Time
 
-	mu  sync.Mutex // guards writes to, close of out
-	out *os.File   // nil if closed
+	mu      sync.Mutex // guards writes to, close of out
+	out     *os.File   // nil if closed
+	written int64      // bytes written to out
+	full    bool       // whether recordingMaxBytes was reached
 }
 
 func (r *recording) Close() error {
@@ -1413,7 +1786,15 @@ func (w loggingWriter) writeCastLine(j []byte) error {
 	if w.r.out == nil {
 		return errors.New("logger closed")
 	}
-	_, err := w.r.out.Write(j)
+	if w.r.written+int64(len(j)) > recordingMaxBytes {
+		if !w.r.full {
+			w.r.full = true
+			w.r.ss.logf("recording reached its size limit of %d bytes; not recording the rest of the session", recordingMaxBytes)
+		}
+		return nil
+	}
+	n, err := w.r.out.Write(j)
+	w.r.written += int64(n)
 	if err != nil {
 		return fmt.Errorf("logger Write: %w", err)
 	}
@@ -1439,17 +1820,23 @@ func envEq(a, b string) bool {
 }
 
 var (
-	metricActiveSessions       = clientmetric.NewGauge("ssh_active_sessions")
-	metricIncomingConnections  = clientmetric.NewCounter("ssh_incoming_connections")
-	metricPublicKeyConnections = clientmetric.NewCounter("ssh_publickey_connections") // total
-	metricPublicKeyAccepts     = clientmetric.NewCounter("ssh_publickey_accepts")     // accepted subset of ssh_publickey_connections
-	metricTerminalAccept       = clientmetric.NewCounter("ssh_terminalaction_accept")
-	metricTerminalReject       = clientmetric.NewCounter("ssh_terminalaction_reject")
-	metricTerminalInterrupt    = clientmetric.NewCounter("ssh_terminalaction_interrupt")
-	metricTerminalMalformed    = clientmetric.NewCounter("ssh_terminalaction_malformed")
-	metricTerminalFetchError   = clientmetric.NewCounter("ssh_terminalaction_fetch_error")
-	metricHolds                = clientmetric.NewCounter("ssh_holds")
-	metricPolicyChangeKick     = clientmetric.NewCounter("ssh_policy_change_kick")
-	metricSFTP                 = clientmetric.NewCounter("ssh_sftp_requests")
-	metricLocalPortForward     = clientmetric.NewCounter("ssh_local_port_forward_requests")
+	metricActiveSessions        = clientmetric.NewGauge("ssh_active_sessions")
+	metricIncomingConnections   = clientmetric.NewCounter("ssh_incoming_connections")
+	metricPublicKeyConnections  = clientmetric.NewCounter("ssh_publickey_connections") // total
+	metricPublicKeyAccepts      = clientmetric.NewCounter("ssh_publickey_accepts")     // accepted subset of ssh_publickey_connections
+	metricTerminalAccept        = clientmetric.NewCounter("ssh_terminalaction_accept")
+	metricTerminalReject        = clientmetric.NewCounter("ssh_terminalaction_reject")
+	metricTerminalInterrupt     = clientmetric.NewCounter("ssh_terminalaction_interrupt")
+	metricTerminalMalformed     = clientmetric.NewCounter("ssh_terminalaction_malformed")
+	metricTerminalFetchError    = clientmetric.NewCounter("ssh_terminalaction_fetch_error")
+	metricHolds                 = clientmetric.NewCounter("ssh_holds")
+	metricPolicyChangeKick      = clientmetric.NewCounter("ssh_policy_change_kick")
+	metricSFTP                  = clientmetric.NewCounter("ssh_sftp_requests")
+	metricSCP                   = clientmetric.NewCounter("ssh_scp_requests")
+	metricAgentForwarding       = clientmetric.NewCounter("ssh_agent_forwarding")
+	metricAgentForwardingDenied = clientmetric.NewCounter("ssh_agent_forwarding_denied")
+	metricX11Forwarding         = clientmetric.NewCounter("ssh_x11_forwarding")
+	metricX11ForwardingDenied   = clientmetric.NewCounter("ssh_x11_forwarding_denied")
+	metricRemotePortForward     = clientmetric.NewCounter("ssh_remote_port_forward_requests")
+	metricLocalPortForward      = clientmetric.NewCounter("ssh_local_port_forward_requests")
 )
@@ -10,6 +10,7 @@
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -20,12 +21,15 @@
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/tsdial"
@@ -466,3 +470,316 @@ func TestAcceptEnvPair(t *testing.T) {
 		}
 	}
 }
+
+func TestRecordingRetention(t *testing.T) {
+	dir := t.TempDir()
+	oldMaxTotal, oldMaxAge := recordingMaxTotalBytes, recordingMaxAge
+	defer func() { recordingMaxTotalBytes, recordingMaxAge = oldMaxTotal, oldMaxAge }()
+	recordingMaxTotalBytes = 25
+	recordingMaxAge = time.Hour
+
+	now := time.Now()
+	add := func(id string, size int, lastWrite time.Time) {
+		t.Helper()
+		path := filepath.Join(dir, id)
+		if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, lastWrite, lastWrite); err != nil {
+			t.Fatal(err)
+		}
+		if err := addRecording(dir, apitype.SSHRecording{ID: id, Start: lastWrite}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func() (ret []string) {
+		t.Helper()
+		recordingsMu.Lock()
+		defer recordingsMu.Unlock()
+		recs, err := listRecordingsLocked(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range recs {
+			ret = append(ret, rec.ID)
+		}
+		return ret
+	}
+
+	add("expired", 1, now.Add(-2*time.Hour))
+	add("a", 10, now.Add(-3*time.Minute))
+	add("b", 10, now.Add(-2*time.Minute))
+	if got, want := ids(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after expiry, recordings = %q; want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "expired")); !os.IsNotExist(err) {
+		t.Errorf("expired recording not removed: %v", err)
+	}
+	add("c", 10, now.Add(-1*time.Minute))
+	add("d", 10, now)
+	if got, want := ids(), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("over total size, recordings = %q; want %q", got, want)
+	}
+}
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		cmd    string
+		wantOK bool
+		want   scpArgs
+	}{
+		{"scp -t /tmp", true, scpArgs{sink: true, paths: []string{"/tmp"}}},
+		{"scp -r -p -f -- a b", true, scpArgs{source: true, recursive: true, preserve: true, paths: []string{"a", "b"}}},
+		{"scp -vdt dir", true, scpArgs{sink: true, targetDir: true, paths: []string{"dir"}}},
+		{"scp -t", false, scpArgs{}},
+		{"scp -t a b", false, scpArgs{}},
+		{"scp -t -f a", false, scpArgs{}},
+		{"scp -t 'a b'", false, scpArgs{}},
+		{"scp -x -t a", false, scpArgs{}},
+		{"ls -t a", false, scpArgs{}},
+	}
+	for _, tt := range tests {
+		got, ok := parseSCPCommand(tt.cmd)
+		if ok != tt.wantOK || (ok && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseSCPCommand(%q) = %+v, %v; want %+v, %v", tt.cmd, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestSCPServer(t *testing.T) {
+	dir := t.TempDir()
+
+	// Receive a file and a directory, as "scp -r" sends them.
+	in := "C0644 5 hello.txt\nhello\x00" +
+		"D0755 0 sub\n" +
+		"C0600 3 a\nabc\x00" +
+		"E\n"
+	var out bytes.Buffer
+	if err := serveSCP([]string{"-r", "-t", dir}, strings.NewReader(in), &out); err != nil {
+		t.Fatalf("sink: %v", err)
+	}
+	if got, want := out.String(), strings.Repeat("\x00", 7); got != want {
+		t.Errorf("sink acks = %q; want %q", got, want)
+	}
+	for path, want := range map[string]string{
+		"hello.txt": "hello",
+		"sub/a":     "abc",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+
+	// Send the file back.
+	out.Reset()
+	acks := strings.Repeat("\x00", 3)
+	if err := serveSCP([]string{"-f", filepath.Join(dir, "hello.txt")}, strings.NewReader(acks), &out); err != nil {
+		t.Fatalf("source: %v", err)
+	}
+	if got, want := out.String(), "C0644 5 hello.txt\nhello\x00"; got != want {
+		t.Errorf("source sent %q; want %q", got, want)
+	}
+
+	// Names can't escape the target directory.
+	out.Reset()
+	err := serveSCP([]string{"-t", dir}, strings.NewReader("C0644 1 ../x\nx\x00"), &out)
+	if err == nil {
+		t.Error("sink accepted a name with a slash")
+	}
+}
+
+func TestAgentListener(t *testing.T) {
+	ln, err := newAgentListener(os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := ln.Addr().String()
+	dir := filepath.Dir(socket)
+	for path, want := range map[string]os.FileMode{socket: 0600, dir: 0700} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("%s mode = %v; want %v", path, got, want)
+		}
+	}
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("agent socket dir still exists after Close: %v", err)
+	}
+}
+
+func TestMayReversePortForwardTo(t *testing.T) {
+	tests := []struct {
+		host   string
+		port   uint32
+		uid    string
+		policy bool
+		want   bool
+	}{
+		{"localhost", 8080, "1000", true, true},
+		{"127.0.0.1", 8080, "1000", true, true},
+		{"::1", 0, "1000", true, true},
+		{"localhost", 8080, "1000", false, false},
+		{"", 8080, "1000", true, false},
+		{"0.0.0.0", 8080, "1000", true, false},
+		{"100.64.0.1", 8080, "1000", true, false},
+		{"localhost", 80, "1000", true, false},
+		{"localhost", 80, "0", true, true},
+	}
+	for _, tt := range tests {
+		c := &conn{
+			srv:         &server{logf: t.Logf},
+			localUser:   &user.User{Uid: tt.uid},
+			finalAction: &tailcfg.SSHAction{Accept: true, AllowRemotePortForwarding: tt.policy},
+		}
+		if got := c.mayReversePortForwardTo(nil, tt.host, tt.port); got != tt.want {
+			t.Errorf("mayReversePortForwardTo(%q, %d) as uid %s, policy %v = %v; want %v", tt.host, tt.port, tt.uid, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestValidX11AuthField(t *testing.T) {
+	for s, want := range map[string]bool{
+		"MIT-MAGIC-COOKIE-1":               true,
+		"0123456789abcdef0123456789abcdef": true,
+		"":                                 false,
+		"abc def":                          false,
+		"abc\nadd unix:0 x y":              false,
+	} {
+		if got := validX11AuthField(s); got != want {
+			t.Errorf("validX11AuthField(%q) = %v; want %v", s, got, want)
+		}
+	}
+}
+
+func TestSubstituteX11Auth(t *testing.T) {
+	const proto = "MIT-MAGIC-COOKIE-1"
+	fake := []byte("fakefakefakefake")
+	real := []byte("realrealrealreal")
+	setup := func(order byte, proto string, cookie []byte) []byte {
+		b := []byte{order, 0, 0, 11, 0, 0, 0, 0, 0, 0, 0, 0}
+		bo := binary.ByteOrder(binary.BigEndian)
+		if order == 'l' {
+			bo = binary.LittleEndian
+			b[2], b[3] = 11, 0
+		}
+		bo.PutUint16(b[6:], uint16(len(proto)))
+		bo.PutUint16(b[8:], uint16(len(cookie)))
+		pad := func(b []byte) []byte { return append(b, make([]byte, (4-len(b)%4)%4)...) }
+		b = append(b, pad([]byte(proto))...)
+		return append(b, pad(append([]byte(nil), cookie...))...)
+	}
+
+	for _, order := range []byte{'B', 'l'} {
+		got, err := substituteX11Auth(bytes.NewReader(append(setup(order, proto, fake), "rest"...)), proto, fake, real)
+		if err != nil {
+			t.Fatalf("%c: %v", order, err)
+		}
+		if want := setup(order, proto, real); !bytes.Equal(got, want) {
+			t.Errorf("%c: got %q; want %q", order, got, want)
+		}
+	}
+	for name, in := range map[string][]byte{
+		"real cookie":  setup('B', proto, real),
+		"wrong proto":  setup('B', "XDM-AUTHORIZATION-1", fake),
+		"no cookie":    setup('B', "", nil),
+		"short cookie": setup('B', proto, fake[:8]),
+		"bad order":    setup('x', proto, fake),
+		"truncated":    setup('B', proto, fake)[:20],
+	} {
+		if _, err := substituteX11Auth(bytes.NewReader(in), proto, fake, real); err == nil {
+			t.Errorf("%s: succeeded", name)
+		}
+	}
+}
+
+func TestContainerExecArgs(t *testing.T) {
+	env := []string{"TERM=xterm"}
+	tests := []struct {
+		name    string
+		action  tailcfg.SSHAction
+		user    string
+		tty     bool
+		rawCmd  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "shell",
+			action: tailcfg.SSHAction{Container: "web"},
+			user:   "app",
+			tty:    true,
+			want:   []string{"docker", "exec", "--interactive", "--user=app", "--tty", "--env=TERM=xterm", "web", "sh", "-c", containerShellCmd},
+		},
+		{
+			name:   "command",
+			action: tailcfg.SSHAction{Container: "web", ContainerRuntime: "nerdctl"},
+			user:   "root",
+			rawCmd: "uptime",
+			want:   []string{"nerdctl", "exec", "--interactive", "--user=root", "--env=TERM=xterm", "web", "sh", "-c", "uptime"},
+		},
+		{
+			name:    "bad-runtime",
+			action:  tailcfg.SSHAction{Container: "web", ContainerRuntime: "lxc"},
+			user:    "root",
+			wantErr: true,
+		},
+		{
+			name:    "flag-name",
+			action:  tailcfg.SSHAction{Container: "--privileged"},
+			user:    "root",
+			wantErr: true,
+		},
+		{
+			name:    "no-user",
+			action:  tailcfg.SSHAction{Container: "web"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := containerExecArgs(&tt.action, tt.user, env, tt.tty, tt.rawCmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v; want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	srv := &server{logf: t.Logf}
+	t.Cleanup(func() { health.SetSSHHealth(nil) })
+
+	srv.setHealth(problemHostKeys, errors.New("disk full"))
+	srv.setHealth(problemStartSession, errors.New("pty.Open: no ptys"))
+	want := "host keys: disk full"
+	if err := health.SSHHealth(); err == nil || !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "starting session: pty.Open") {
+		t.Fatalf("SSHHealth = %v; want both problems", err)
+	}
+	srv.setHealth(problemStartSession, nil)
+	if err := health.SSHHealth(); err == nil || err.Error() != want {
+		t.Fatalf("SSHHealth = %v; want %q", err, want)
+	}
+
+	srv.mu.Lock()
+	ss := &sshSession{}
+	srv.stuckSessions = map[*sshSession]bool{ss: true}
+	srv.reportStuckSessionsLocked()
+	srv.mu.Unlock()
+	if err := health.SSHHealth(); err == nil || !strings.Contains(err.Error(), "stuck sessions: 1 terminated session(s) haven't exited") {
+		t.Fatalf("SSHHealth = %v; want stuck session", err)
+	}
+
+	srv.Shutdown()
+	if err := health.SSHHealth(); err != nil {
+		t.Errorf("SSHHealth after Shutdown = %v; want nil", err)
+	}
+}
@@ -19,6 +19,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/opt"
 	"tailscale.com/types/structs"
+	"tailscale.com/types/tkatype"
 	"tailscale.com/util/dnsname"
 )
 
@@ -74,7 +75,11 @@
 //	37: 2022-08-09: added Debug.{SetForceBackgroundSTUN,SetRandomizeClientPort}; Debug are sticky
 //	38: 2022-08-11: added PingRequest.URLIsNoise
 //	39: 2022-08-15: clients can talk Noise over arbitrary HTTPS port
-const CurrentCapabilityVersion CapabilityVersion = 39
+//	40: 2022-08-22: added SSHAction.RecordSession
+//	41: 2022-08-23: added SSHAction.AllowFileTransfer; SSH server supports scp without an scp binary
+//	42: 2022-08-24: added SSHAction.{AllowRemotePortForwarding,AllowX11Forwarding}
+//	43: 2022-08-25: added SSHAction.{Container,ContainerRuntime}
+const CurrentCapabilityVersion CapabilityVersion = 43
 
 type StableID string
 
@@ -479,6 +484,12 @@ type Hostinfo struct {
 	SSH_HostKeys  []string       `json:"sshHostKeys,omitempty"` // if advertised
 	Cloud         string         `json:",omitempty"`
 
+	// Health, if the node opts in to reporting it, is a summary of
+	// the node's current health problems: their health.IssueCode
+	// values, or subsystem names for subsystems that are unhealthy,
+	// sorted. It's updated at most once a minute.
+	Health []string `json:",omitempty"`
+
 	// NOTE: any new fields containing pointers in this type
 	//       require changes to Hostinfo.Equal.
 }
@@ -895,6 +906,12 @@ type MapRequest struct {
 	Stream      bool // if true, multiple MapResponse objects are returned
 	Hostinfo    *Hostinfo
 
+	// NodeKeySignature, if non-empty, is the tailnet key authority's
+	// signature of the node's key, as held by the node. Nodes re-sign
+	// their keys before the signatures expire, and send the new ones
+	// here so that control can distribute them to peers.
+	NodeKeySignature tkatype.MarshaledSignature `json:",omitempty"`
+
 	// Endpoints are the client's magicsock UDP ip:port endpoints (IPv4 or IPv6).
 	Endpoints []string
 	// EndpointTypes are the types of the corresponding endpoints in Endpoints.
@@ -1715,6 +1732,37 @@ type SSHAction struct {
 	// AllowLocalPortForwarding, if true, allows accepted connections
 	// to use local port forwarding if requested.
 	AllowLocalPortForwarding bool `json:"allowLocalPortForwarding,omitempty"`
+
+	// AllowRemotePortForwarding, if true, allows accepted connections
+	// to use remote port forwarding if requested, listening on the
+	// destination node's loopback interface only.
+	AllowRemotePortForwarding bool `json:"allowRemotePortForwarding,omitempty"`
+
+	// AllowX11Forwarding, if true, allows accepted connections to
+	// forward X11 if requested.
+	AllowX11Forwarding bool `json:"allowX11Forwarding,omitempty"`
+
+	// Container, if non-empty, is the name or ID of a container on the
+	// destination node to run accepted sessions in, instead of on the
+	// host. The local user from SSHRule.SSHUsers is then a user in the
+	// container. Port, agent and X11 forwarding and SFTP aren't
+	// supported in containers.
+	Container string `json:"container,omitempty"`
+
+	// ContainerRuntime is the runtime of Container: "docker" (the
+	// default) or "nerdctl" (for containerd).
+	ContainerRuntime string `json:"containerRuntime,omitempty"`
+
+	// RecordSession, if true, records accepted sessions that have a
+	// PTY to the destination node's local disk, in asciinema v2
+	// format, subject to the node's size and retention limits.
+	RecordSession bool `json:"recordSession,omitempty"`
+
+	// AllowFileTransfer, if true, allows accepted connections to use
+	// SFTP and scp. As users with a shell can still copy files by
+	// other means, denying it is only meaningful with other
+	// restrictions on what users can run.
+	AllowFileTransfer bool `json:"allowFileTransfer,omitempty"`
 }
 
 // OverTLSPublicKeyResponse is the JSON response to /key?v=<n>
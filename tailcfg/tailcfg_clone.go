@@ -107,6 +107,7 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	dst.Services = append(src.Services[:0:0], src.Services...)
 	dst.NetInfo = src.NetInfo.Clone()
 	dst.SSH_HostKeys = append(src.SSH_HostKeys[:0:0], src.SSH_HostKeys...)
+	dst.Health = append(src.Health[:0:0], src.Health...)
 	return dst
 }
 
@@ -130,6 +131,7 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	NetInfo       *NetInfo
 	SSH_HostKeys  []string
 	Cloud         string
+	Health        []string
 }{})
 
 // Clone makes a deep copy of NetInfo.
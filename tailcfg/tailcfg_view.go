@@ -266,6 +266,7 @@ func (v HostinfoView) Services() views.Slice[Service]    { return views.SliceOf(
 func (v HostinfoView) NetInfo() NetInfoView              { return v.ж.NetInfo.View() }
 func (v HostinfoView) SSH_HostKeys() views.Slice[string] { return views.SliceOf(v.ж.SSH_HostKeys) }
 func (v HostinfoView) Cloud() string                     { return v.ж.Cloud }
+func (v HostinfoView) Health() views.Slice[string]       { return views.SliceOf(v.ж.Health) }
 func (v HostinfoView) Equal(v2 HostinfoView) bool        { return v.ж.Equal(v2.ж) }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
@@ -288,6 +289,7 @@ func (v HostinfoView) Equal(v2 HostinfoView) bool        { return v.ж.Equal(v2.
 	NetInfo       *NetInfo
 	SSH_HostKeys  []string
 	Cloud         string
+	Health        []string
 }{})
 
 // View returns a readonly view of NetInfo.
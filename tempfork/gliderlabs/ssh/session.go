@@ -84,6 +84,10 @@ type Session interface {
 	// During the time that no channel is registered, breaks are ignored.
 	Break(c chan<- bool)
 
+	// X11 returns the X11 forwarding request, and whether one was accepted
+	// for this session.
+	X11() (X11, bool)
+
 	// DisablePTYEmulation disables the session's default minimal PTY emulation.
 	// If you're setting the pty's termios settings from the Pty request, use
 	// this method to avoid corruption.
@@ -133,6 +137,7 @@ type session struct {
 	sigCh               chan<- Signal
 	sigBuf              []Signal
 	breakCh             chan<- bool
+	x11                 *X11
 	disablePtyEmulation bool
 }
 
@@ -227,6 +232,13 @@ func (sess *session) Pty() (Pty, <-chan Window, bool) {
 	return Pty{}, sess.winch, false
 }
 
+func (sess *session) X11() (X11, bool) {
+	if sess.x11 != nil {
+		return *sess.x11, true
+	}
+	return X11{}, false
+}
+
 func (sess *session) Signals(c chan<- Signal) {
 	sess.Lock()
 	defer sess.Unlock()
@@ -365,6 +377,18 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 				sess.winch <- win
 			}
 			req.Reply(ok, nil)
+		case "x11-req":
+			if sess.handled || sess.x11 != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			var x11 X11
+			if err := gossh.Unmarshal(req.Payload, &x11); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			sess.x11 = &x11
+			req.Reply(true, nil)
 		case agentRequestType:
 			// TODO: option/callback to allow agent forwarding
 			SetAgentRequested(sess.ctx)
@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+)
+
+const x11ChannelType = "x11"
+
+// X11 represents an X11 forwarding request.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4254#section-6.3.1
+type X11 struct {
+	SingleConnection bool   // forward only one connection
+	AuthProtocol     string // such as "MIT-MAGIC-COOKIE-1"
+	AuthCookie       string // hex-encoded
+	ScreenNumber     uint32
+}
+
+// x11ChannelData is the payload of an x11 channel open request, as
+// specified in RFC4254, Section 6.3.2.
+type x11ChannelData struct {
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ForwardX11Connections takes connections from a listener to proxy into the
+// session on X11 channels. It blocks and services connections until the
+// listener stops accepting, or until the first connection if the session's X11
+// request was for a single connection.
+func ForwardX11Connections(l net.Listener, s Session) {
+	x11, _ := s.X11()
+	sshConn := s.Context().Value(ContextKeyConn).(gossh.Conn)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var d x11ChannelData
+			if host, port, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+				p, _ := strconv.ParseUint(port, 10, 16)
+				d = x11ChannelData{host, uint32(p)}
+			}
+			channel, reqs, err := sshConn.OpenChannel(x11ChannelType, gossh.Marshal(&d))
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+			go gossh.DiscardRequests(reqs)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				io.Copy(conn, channel)
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				wg.Done()
+			}()
+			go func() {
+				io.Copy(channel, conn)
+				channel.CloseWrite()
+				wg.Done()
+			}()
+			wg.Wait()
+		}(conn)
+		if x11.SingleConnection {
+			l.Close()
+			return
+		}
+	}
+}
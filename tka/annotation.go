@@ -0,0 +1,37 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// maxAnnotationBytes is the most an annotation's fields may total, so
+// that annotations stay notes rather than documents.
+const maxAnnotationBytes = 1024
+
+// Annotation is an operator-supplied note carried by an Annotate AUM,
+// recording why changes were made next to the changes themselves.
+type Annotation struct {
+	// Ticket identifies the ticket or change request, if any.
+	Ticket string `cbor:"1,keyasint,omitempty"`
+	// Reason is free text.
+	Reason string `cbor:"2,keyasint,omitempty"`
+}
+
+func (a *Annotation) staticValidate() error {
+	if a.Ticket == "" && a.Reason == "" {
+		return errors.New("empty annotation")
+	}
+	if n := len(a.Ticket) + len(a.Reason); n > maxAnnotationBytes {
+		return fmt.Errorf("annotation too big (%d > %d)", n, maxAnnotationBytes)
+	}
+	if !utf8.ValidString(a.Ticket) || !utf8.ValidString(a.Reason) {
+		return errors.New("annotation is not valid UTF-8")
+	}
+	return nil
+}
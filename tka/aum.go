@@ -74,6 +74,16 @@ func (h AUMHash) MarshalText() ([]byte, error) {
 	//
 	// Only the State optional field may be set.
 	AUMCheckpoint
+	// A RevokeKey AUM removes a key trusted by TKA, recording why so
+	// that it can't be trusted again.
+	//
+	// Only the Revocation optional field may be set.
+	AUMRevokeKey
+	// An Annotate AUM changes nothing, but records an operator-supplied
+	// annotation, such as why nearby updates were made, in the chain.
+	//
+	// Only the Annotation optional field may be set.
+	AUMAnnotate
 )
 
 func (k AUMKind) String() string {
@@ -92,6 +102,10 @@ func (k AUMKind) String() string {
 		return "checkpoint"
 	case AUMUpdateKey:
 		return "update-key"
+	case AUMRevokeKey:
+		return "revoke-key"
+	case AUMAnnotate:
+		return "annotate"
 	default:
 		return fmt.Sprintf("AUM?<%d>", int(k))
 	}
@@ -140,6 +154,14 @@ type AUM struct {
 	Votes *uint             `cbor:"7,keyasint,omitempty"`
 	Meta  map[string]string `cbor:"8,keyasint,omitempty"`
 
+	// Revocation describes the revocation of a key.
+	// This field is used for RevokeKey AUMs.
+	Revocation *Revocation `cbor:"9,keyasint,omitempty"`
+
+	// Annotation is an operator-supplied note about the chain.
+	// This field is used for Annotate AUMs.
+	Annotation *Annotation `cbor:"10,keyasint,omitempty"`
+
 	// Signatures lists the signatures over this AUM.
 	// CBOR key 23 is the last key which can be encoded as a single byte.
 	Signatures []tkatype.Signature `cbor:"23,keyasint,omitempty"`
@@ -156,11 +178,22 @@ func (a *AUM) StaticValidate() error {
 		return errors.New("absent parent must be represented by a nil slice")
 	}
 	for i, sig := range a.Signatures {
+		// P256 signatures are the same size as Ed25519 ones.
 		if len(sig.KeyID) == 0 || len(sig.Signature) != ed25519.SignatureSize {
 			return fmt.Errorf("signature %d has missing keyID or malformed signature", i)
 		}
 	}
 
+	if a.Revocation != nil {
+		if err := a.Revocation.staticValidate(); err != nil {
+			return fmt.Errorf("revocation: %v", err)
+		}
+	}
+	if a.Annotation != nil {
+		if err := a.Annotation.staticValidate(); err != nil {
+			return fmt.Errorf("annotation: %v", err)
+		}
+	}
 	if a.State != nil {
 		if err := a.State.staticValidateCheckpoint(); err != nil {
 			return fmt.Errorf("checkpoint state: %v", err)
@@ -172,14 +205,14 @@ func (a *AUM) StaticValidate() error {
 		if a.Key == nil {
 			return errors.New("AddKey AUMs must contain a key")
 		}
-		if a.KeyID != nil || a.DisablementSecret != nil || a.State != nil || a.Votes != nil || a.Meta != nil {
+		if a.KeyID != nil || a.DisablementSecret != nil || a.State != nil || a.Votes != nil || a.Meta != nil || a.Revocation != nil || a.Annotation != nil {
 			return errors.New("AddKey AUMs may only specify a Key")
 		}
 	case AUMRemoveKey:
 		if len(a.KeyID) == 0 {
 			return errors.New("RemoveKey AUMs must specify a key ID")
 		}
-		if a.Key != nil || a.DisablementSecret != nil || a.State != nil || a.Votes != nil || a.Meta != nil {
+		if a.Key != nil || a.DisablementSecret != nil || a.State != nil || a.Votes != nil || a.Meta != nil || a.Revocation != nil || a.Annotation != nil {
 			return errors.New("RemoveKey AUMs may only specify a KeyID")
 		}
 	case AUMUpdateKey:
@@ -189,21 +222,38 @@ func (a *AUM) StaticValidate() error {
 		if a.Meta == nil && a.Votes == nil {
 			return errors.New("UpdateKey AUMs must contain an update to votes or key metadata")
 		}
-		if a.Key != nil || a.DisablementSecret != nil || a.State != nil {
+		if a.Key != nil || a.DisablementSecret != nil || a.State != nil || a.Revocation != nil || a.Annotation != nil {
 			return errors.New("UpdateKey AUMs may only specify KeyID, Votes, and Meta")
 		}
+		if err := validateMeta(a.Meta); err != nil {
+			return err
+		}
 	case AUMCheckpoint:
 		if a.State == nil {
 			return errors.New("Checkpoint AUMs must specify the state")
 		}
-		if a.KeyID != nil || a.DisablementSecret != nil || a.Key != nil || a.Votes != nil || a.Meta != nil {
+		if a.KeyID != nil || a.DisablementSecret != nil || a.Key != nil || a.Votes != nil || a.Meta != nil || a.Revocation != nil || a.Annotation != nil {
 			return errors.New("Checkpoint AUMs may only specify State")
 		}
+	case AUMRevokeKey:
+		if a.Revocation == nil {
+			return errors.New("RevokeKey AUMs must contain a revocation")
+		}
+		if a.KeyID != nil || a.DisablementSecret != nil || a.State != nil || a.Key != nil || a.Votes != nil || a.Meta != nil || a.Annotation != nil {
+			return errors.New("RevokeKey AUMs may only specify a Revocation")
+		}
+	case AUMAnnotate:
+		if a.Annotation == nil {
+			return errors.New("Annotate AUMs must contain an annotation")
+		}
+		if a.KeyID != nil || a.DisablementSecret != nil || a.State != nil || a.Key != nil || a.Votes != nil || a.Meta != nil || a.Revocation != nil {
+			return errors.New("Annotate AUMs may only specify an Annotation")
+		}
 	case AUMDisableNL:
 		if len(a.DisablementSecret) == 0 {
 			return errors.New("DisableNL AUMs must specify a disablement secret")
 		}
-		if a.KeyID != nil || a.State != nil || a.Key != nil || a.Votes != nil || a.Meta != nil {
+		if a.KeyID != nil || a.State != nil || a.Key != nil || a.Votes != nil || a.Meta != nil || a.Revocation != nil || a.Annotation != nil {
 			return errors.New("DisableNL AUMs may only specify a disablement secret")
 		}
 	}
@@ -294,6 +344,38 @@ func (a *AUM) sign25519(priv ed25519.PrivateKey) {
 	})
 }
 
+// numSigners returns how many distinct keys in state signed the AUM. The
+// caller must ensure that all signatures are valid.
+func (a *AUM) numSigners(state State) uint {
+	seenKeys := make(map[string]bool, len(a.Signatures))
+	for _, sig := range a.Signatures {
+		if _, err := state.GetKey(sig.KeyID); err == nil {
+			seenKeys[string(sig.KeyID)] = true
+		}
+	}
+	return uint(len(seenKeys))
+}
+
+// AddSignatures signs the AUM with signer, in addition to any signatures
+// it already has, such as to collect the signatures of several keys for
+// an authority with a SignatureThreshold above one.
+//
+// Signing changes the AUM's hash, so it must not yet have any children.
+func (a *AUM) AddSignatures(signer Signer) error {
+	sigs, err := sign(signer, *a)
+	if err != nil {
+		return fmt.Errorf("signing failed: %v", err)
+	}
+	a.Signatures = append(a.Signatures, sigs...)
+	return nil
+}
+
+// removesKey reports whether the AUM removes a key from the state,
+// as RemoveKey and RevokeKey AUMs do.
+func (a *AUM) removesKey() bool {
+	return a.MessageKind == AUMRemoveKey || a.MessageKind == AUMRevokeKey
+}
+
 // Weight computes the 'signature weight' of the AUM
 // based on keys in the state machine. The caller must
 // ensure that all signatures are valid.
@@ -135,6 +135,22 @@ func TestSerialization(t *testing.T) {
 					0x06, //             |- major type 0 (int), value 6 (byte 6)
 				}...),
 		},
+		{
+			"Annotate",
+			AUM{MessageKind: AUMAnnotate, Annotation: &Annotation{Ticket: "T"}},
+			[]byte{
+				0xa3, // major type 5 (map), 3 items
+				0x01, // |- major type 0 (int), value 1 (first key, MessageKind)
+				0x08, // |- major type 0 (int), value 8 (first value, AUMAnnotate)
+				0x02, // |- major type 0 (int), value 2 (second key, PrevAUMHash)
+				0xf6, // |- major type 7 (val), value null (second value, nil)
+				0x0a, // |- major type 0 (int), value 10 (third key, Annotation)
+				0xa1, // |- major type 5 (map), 1 item (third value, Annotation type)
+				0x01, //    |- major type 0 (int), value 1 (first key, Ticket)
+				0x61, //    |- major type 3 (text string), 1 byte
+				0x54, //       |- "T"
+			},
+		},
 		{
 			"Signature",
 			AUM{MessageKind: AUMAddKey, Signatures: []tkatype.Signature{{KeyID: []byte{1}}}},
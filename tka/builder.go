@@ -5,7 +5,9 @@
 package tka
 
 import (
+	"bytes"
 	"fmt"
+	"time"
 
 	"tailscale.com/types/tkatype"
 )
@@ -15,6 +17,22 @@ type Signer interface {
 	SignAUM(tkatype.AUMSigHash) ([]tkatype.Signature, error)
 }
 
+// AUMSigner is implemented by Signers that need the whole update message,
+// not just its signature hash, such as to show or validate it before
+// signing. SignFullAUM is used in preference to SignAUM.
+type AUMSigner interface {
+	Signer
+	SignFullAUM(AUM) ([]tkatype.Signature, error)
+}
+
+// sign returns signer's signatures over aum.
+func sign(signer Signer, aum AUM) ([]tkatype.Signature, error) {
+	if s, ok := signer.(AUMSigner); ok {
+		return s.SignFullAUM(aum)
+	}
+	return signer.SignAUM(aum.SigHash())
+}
+
 // UpdateBuilder implements a builder for changes to the tailnet
 // key authority.
 //
@@ -28,6 +46,85 @@ type UpdateBuilder struct {
 	parent AUMHash
 
 	out []AUM
+
+	// partial is whether any update in out lacks the signatures its
+	// preceding state's SignatureThreshold requires.
+	partial bool
+
+	hooks []SignHook
+
+	metaLimits *MetaLimits // or nil for DefaultMetaLimits
+}
+
+// SetMetaLimits sets the limits on the key metadata in later updates,
+// which are checked before the updates are signed, in place of
+// DefaultMetaLimits. Whatever the limits, a key's metadata can't exceed
+// 512 bytes in total, as other nodes would reject the update.
+func (b *UpdateBuilder) SetMetaLimits(l MetaLimits) {
+	b.metaLimits = &l
+}
+
+// checkMeta returns an error if meta, to be stored against keyID, is
+// invalid or exceeds the builder's limits.
+func (b *UpdateBuilder) checkMeta(keyID tkatype.KeyID, meta map[string]string) error {
+	if err := validateMeta(meta); err != nil {
+		return fmt.Errorf("invalid metadata for key %x: %v", keyID, err)
+	}
+	if n := metaBytes(meta); n > maxMetaBytes {
+		return fmt.Errorf("invalid metadata for key %x: too big (%d > %d)", keyID, n, maxMetaBytes)
+	}
+	limits := DefaultMetaLimits()
+	if b.metaLimits != nil {
+		limits = *b.metaLimits
+	}
+	if err := limits.Validate(meta); err != nil {
+		return fmt.Errorf("invalid metadata for key %x: %v", keyID, err)
+	}
+	return nil
+}
+
+// A SignHook is called with each update before it's signed, along with
+// the authority's state before and after the update, and vetoes signing
+// it by returning an error. Hooks can enforce policy, or block while
+// approval is sought out of band.
+type SignHook func(update AUM, before, after State) error
+
+// AddSignHook adds h to the hooks called before signing each later update.
+// Updates that aren't signed by the builder (see FinalizeDetached) don't
+// go through hooks.
+func (b *UpdateBuilder) AddSignHook(h SignHook) {
+	b.hooks = append(b.hooks, h)
+}
+
+func (b *UpdateBuilder) runSignHooks(update AUM) error {
+	if len(b.hooks) == 0 {
+		return nil
+	}
+	after, err := b.state.applyVerifiedAUM(update)
+	if err != nil {
+		return fmt.Errorf("update cannot be applied: %v", err)
+	}
+	for _, h := range b.hooks {
+		if err := h(update, b.state.Clone(), after); err != nil {
+			return fmt.Errorf("%v update rejected: %w", update.MessageKind, err)
+		}
+	}
+	return nil
+}
+
+// MinTotalVotes returns a SignHook that vetoes updates leaving the
+// authority's keys with fewer than n votes in total.
+func MinTotalVotes(n uint) SignHook {
+	return func(_ AUM, _, after State) error {
+		var total uint
+		for _, k := range after.Keys {
+			total += k.Votes
+		}
+		if total < n {
+			return fmt.Errorf("keys would have %d votes in total, fewer than %d", total, n)
+		}
+		return nil
+	}
 }
 
 func (b *UpdateBuilder) mkUpdate(update AUM) error {
@@ -36,10 +133,20 @@ func (b *UpdateBuilder) mkUpdate(update AUM) error {
 	update.PrevAUMHash = prevHash
 
 	if b.signer != nil {
-		sigs, err := b.signer.SignAUM(update.SigHash())
+		// Catch invalid updates before asking for signatures.
+		if err := update.StaticValidate(); err != nil {
+			return fmt.Errorf("generated update was invalid: %v", err)
+		}
+		if err := b.runSignHooks(update); err != nil {
+			return err
+		}
+		sigs, err := sign(b.signer, update)
 		if err != nil {
 			return fmt.Errorf("signing failed: %v", err)
 		}
+		if err := checkSignersNotExpired(sigs, b.state, timeNow()); err != nil {
+			return err
+		}
 		update.Signatures = append(update.Signatures, sigs...)
 	}
 	if err := update.StaticValidate(); err != nil {
@@ -50,6 +157,9 @@ func (b *UpdateBuilder) mkUpdate(update AUM) error {
 		return fmt.Errorf("update cannot be applied: %v", err)
 	}
 
+	if update.numSigners(b.state) < b.state.signatureThreshold() {
+		b.partial = true
+	}
 	b.state = state
 	b.parent = update.Hash()
 	b.out = append(b.out, update)
@@ -61,6 +171,9 @@ func (b *UpdateBuilder) AddKey(key Key) error {
 	if _, err := b.state.GetKey(key.ID()); err == nil {
 		return fmt.Errorf("cannot add key %v: already exists", key)
 	}
+	if err := b.checkMeta(key.ID(), key.Meta); err != nil {
+		return err
+	}
 	return b.mkUpdate(AUM{MessageKind: AUMAddKey, Key: &key})
 }
 
@@ -72,6 +185,93 @@ func (b *UpdateBuilder) RemoveKey(keyID tkatype.KeyID) error {
 	return b.mkUpdate(AUM{MessageKind: AUMRemoveKey, KeyID: keyID})
 }
 
+// RevokeKey removes a key from the authority, recording that it was
+// revoked for reason, so it can't be trusted again.
+func (b *UpdateBuilder) RevokeKey(keyID tkatype.KeyID, reason RevocationReason) error {
+	if _, err := b.state.GetKey(keyID); err != nil {
+		return fmt.Errorf("failed reading key %x: %v", keyID, err)
+	}
+	return b.mkUpdate(AUM{MessageKind: AUMRevokeKey, Revocation: &Revocation{
+		KeyID:  keyID,
+		Reason: reason,
+	}})
+}
+
+// Annotate records a, such as the ticket and reason for the updates
+// around it, in the chain. It changes nothing else.
+func (b *UpdateBuilder) Annotate(a Annotation) error {
+	if err := a.staticValidate(); err != nil {
+		return err
+	}
+	return b.mkUpdate(AUM{MessageKind: AUMAnnotate, Annotation: &a})
+}
+
+// RotateKey replaces the existing key oldID with newKey, which takes on
+// the old key's votes and metadata. It adds newKey before removing the
+// old key, so the authority's keys never lose those votes, and makes no
+// update at all unless both steps apply to the pending state.
+func (b *UpdateBuilder) RotateKey(oldID tkatype.KeyID, newKey Key) error {
+	old, err := b.state.GetKey(oldID)
+	if err != nil {
+		return fmt.Errorf("failed reading key %x: %v", oldID, err)
+	}
+	if _, err := b.state.GetKey(newKey.ID()); err == nil {
+		return fmt.Errorf("cannot rotate to key %v: already exists", newKey)
+	}
+	old = old.Clone()
+	newKey.Votes = old.Votes
+	newKey.Meta = old.Meta
+
+	// The metadata is carried over as it is, so it's not checked against
+	// the builder's limits, which may be newer than it.
+	state, parent, nOut := b.state, b.parent, len(b.out)
+	if err := b.mkUpdate(AUM{MessageKind: AUMAddKey, Key: &newKey}); err != nil {
+		return err
+	}
+	if err := b.RemoveKey(oldID); err != nil {
+		b.state, b.parent, b.out = state, parent, b.out[:nOut]
+		return err
+	}
+	return nil
+}
+
+// SetSignatureThreshold sets how many distinct trusted keys must sign
+// each later update, by adding a checkpoint.
+func (b *UpdateBuilder) SetSignatureThreshold(n uint) error {
+	if n > uint(len(b.state.Keys)) {
+		return fmt.Errorf("signature threshold %d exceeds the number of keys (%d)", n, len(b.state.Keys))
+	}
+	state := b.state.Clone()
+	state.LastAUMHash = nil
+	state.SignatureThreshold = n
+	return b.mkUpdate(AUM{MessageKind: AUMCheckpoint, State: &state})
+}
+
+// RotateDisablementSecrets adds the disablement secrets add, and retires
+// those whose values (see DisablementValue) are retire, by adding a
+// checkpoint. At least one disablement secret must remain.
+func (b *UpdateBuilder) RotateDisablementSecrets(add, retire [][]byte) error {
+	state := b.state.Clone()
+	state.LastAUMHash = nil
+	for _, r := range retire {
+		idx := -1
+		for i, v := range state.DisablementSecrets {
+			if bytes.Equal(v, r) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("no disablement secret with value %x", r)
+		}
+		state.DisablementSecrets = append(state.DisablementSecrets[:idx], state.DisablementSecrets[idx+1:]...)
+	}
+	for _, secret := range add {
+		state.DisablementSecrets = append(state.DisablementSecrets, disablementKDF(secret))
+	}
+	return b.mkUpdate(AUM{MessageKind: AUMCheckpoint, State: &state})
+}
+
 // SetKeyVote updates the number of votes of an existing key.
 func (b *UpdateBuilder) SetKeyVote(keyID tkatype.KeyID, votes uint) error {
 	if _, err := b.state.GetKey(keyID); err != nil {
@@ -80,32 +280,170 @@ func (b *UpdateBuilder) SetKeyVote(keyID tkatype.KeyID, votes uint) error {
 	return b.mkUpdate(AUM{MessageKind: AUMUpdateKey, Votes: &votes, KeyID: keyID})
 }
 
-// SetKeyMeta updates key-value metadata stored against an existing key.
-//
-// TODO(tom): Provide an API to update specific values rather than the whole
-// map.
+// SetKeyMeta replaces the key-value metadata stored against an existing
+// key. Use SetKeyMetaValue or DeleteKeyMetaValue to change a single value
+// without clobbering the others.
 func (b *UpdateBuilder) SetKeyMeta(keyID tkatype.KeyID, meta map[string]string) error {
 	if _, err := b.state.GetKey(keyID); err != nil {
 		return fmt.Errorf("failed reading key %x: %v", keyID, err)
 	}
+	if err := b.checkMeta(keyID, meta); err != nil {
+		return err
+	}
 	return b.mkUpdate(AUM{MessageKind: AUMUpdateKey, Meta: meta, KeyID: keyID})
 }
 
+// SetKeyExpiry sets when an existing key expires, after which it can no
+// longer sign new updates or node keys. A zero t removes its expiry.
+func (b *UpdateBuilder) SetKeyExpiry(keyID tkatype.KeyID, t time.Time) error {
+	if !t.IsZero() {
+		return b.SetKeyMetaValue(keyID, MetaExpiry, t.UTC().Format(time.RFC3339))
+	}
+	key, err := b.state.GetKey(keyID)
+	if err != nil {
+		return fmt.Errorf("failed reading key %x: %v", keyID, err)
+	}
+	if _, ok := key.Meta[MetaExpiry]; !ok || len(key.Meta) > 1 {
+		return b.DeleteKeyMetaValue(keyID, MetaExpiry)
+	}
+	// An UpdateKey AUM can't clear the last metadata value, so
+	// checkpoint the state without it instead.
+	state := b.state.Clone()
+	state.LastAUMHash = nil
+	for i := range state.Keys {
+		if bytes.Equal(state.Keys[i].ID(), keyID) {
+			state.Keys[i].Meta = nil
+		}
+	}
+	return b.mkUpdate(AUM{MessageKind: AUMCheckpoint, State: &state})
+}
+
+// SetKeyMetaValue sets the metadata value k to v for an existing key,
+// keeping its other metadata.
+func (b *UpdateBuilder) SetKeyMetaValue(keyID tkatype.KeyID, k, v string) error {
+	key, err := b.state.GetKey(keyID)
+	if err != nil {
+		return fmt.Errorf("failed reading key %x: %v", keyID, err)
+	}
+	meta := key.Clone().Meta
+	if meta == nil {
+		meta = make(map[string]string, 1)
+	}
+	meta[k] = v
+	if err := b.checkMeta(keyID, meta); err != nil {
+		return err
+	}
+	return b.mkUpdate(AUM{MessageKind: AUMUpdateKey, Meta: meta, KeyID: keyID})
+}
+
+// DeleteKeyMetaValue removes the metadata value k from an existing key,
+// keeping its other metadata.
+//
+// The last value can't be removed, as an update with empty metadata is
+// indistinguishable from one that doesn't change it once serialized.
+func (b *UpdateBuilder) DeleteKeyMetaValue(keyID tkatype.KeyID, k string) error {
+	key, err := b.state.GetKey(keyID)
+	if err != nil {
+		return fmt.Errorf("failed reading key %x: %v", keyID, err)
+	}
+	if _, ok := key.Meta[k]; !ok {
+		return fmt.Errorf("key %x has no metadata value %q", keyID, k)
+	}
+	if len(key.Meta) == 1 {
+		return fmt.Errorf("cannot delete %q: the last metadata value of key %x", k, keyID)
+	}
+	meta := key.Clone().Meta
+	delete(meta, k)
+	return b.mkUpdate(AUM{MessageKind: AUMUpdateKey, Meta: meta, KeyID: keyID})
+}
+
+// checkpointEvery is how many updates there may be since the last
+// checkpoint before Finalize adds another, so that computing the state
+// needn't replay long chains and older updates can be compacted away.
+const checkpointEvery = 50
+
+// Checkpoint adds a checkpoint update, which snapshots the state as of
+// the preceding updates.
+func (b *UpdateBuilder) Checkpoint() error {
+	state := b.state.Clone()
+	state.LastAUMHash = nil // checkpoints are parented by their AUM instead
+	return b.mkUpdate(AUM{MessageKind: AUMCheckpoint, State: &state})
+}
+
 // Finalize returns the set of update message to actuate the update.
+//
+// If there are then checkpointEvery or more updates since the last
+// checkpoint, a checkpoint is added to the end.
+//
+// If the authority's SignatureThreshold requires more signatures than the
+// builder's signer provides, the update is partially signed: the other
+// signatures must be added with AUM.AddSignatures before it's valid. As
+// adding signatures changes an AUM's hash, which its successor depends
+// on, such an update must be a single AUM.
 func (b *UpdateBuilder) Finalize() ([]AUM, error) {
-	if len(b.out) > 0 {
-		if parent, _ := b.out[0].Parent(); parent != b.a.Head() {
-			return nil, fmt.Errorf("updates no longer apply to head: based on %x but head is %x", parent, b.a.Head())
+	if len(b.out) == 0 {
+		return b.out, nil
+	}
+	if parent, _ := b.out[0].Parent(); parent != b.a.Head() {
+		return nil, fmt.Errorf("updates no longer apply to head: based on %x but head is %x", parent, b.a.Head())
+	}
+	if b.partial {
+		if len(b.out) > 1 {
+			return nil, fmt.Errorf("%d updates need further signatures; they must be made one at a time", len(b.out))
+		}
+		// Another checkpoint would need co-signing after this one.
+		return b.out, nil
+	}
+
+	pending := 0 // updates in b.out since its last checkpoint
+	for i := len(b.out) - 1; i >= 0 && b.out[i].MessageKind != AUMCheckpoint; i-- {
+		pending++
+	}
+	if pending > 0 {
+		since := 0
+		if pending == len(b.out) {
+			var err error
+			if since, err = b.a.updatesSinceCheckpoint(checkpointEvery); err != nil {
+				return nil, fmt.Errorf("counting updates since checkpoint: %v", err)
+			}
+		}
+		if since+pending >= checkpointEvery {
+			state, parent, nOut := b.state, b.parent, len(b.out)
+			if err := b.Checkpoint(); err != nil {
+				return nil, fmt.Errorf("checkpoint: %v", err)
+			}
+			if b.partial {
+				// The updates raised the threshold beyond the
+				// signer; checkpoint another time.
+				b.state, b.parent, b.out, b.partial = state, parent, b.out[:nOut], false
+			}
 		}
 	}
 	return b.out, nil
 }
 
+// FinalizeDetached is like Finalize, but also returns the SigHash of each
+// update, for signing elsewhere, such as on an air-gapped machine. The
+// signatures are then bound to the updates with Authority.AttachSignatures
+// before they're applied with Inform.
+func (b *UpdateBuilder) FinalizeDetached() ([]AUM, []tkatype.AUMSigHash, error) {
+	updates, err := b.Finalize()
+	if err != nil {
+		return nil, nil, err
+	}
+	sigHashes := make([]tkatype.AUMSigHash, len(updates))
+	for i, u := range updates {
+		sigHashes[i] = u.SigHash()
+	}
+	return updates, sigHashes, nil
+}
+
 // NewUpdater returns a builder you can use to make changes to
 // the tailnet key authority.
 //
 // The provided signer function, if non-nil, is called with each update
-// to compute and apply signatures.
+// to compute and apply signatures. If nil, the update is left unsigned,
+// to be signed elsewhere (see FinalizeDetached).
 //
 // Updates are specified by calling methods on the returned UpdatedBuilder.
 // Call Finalize() when you are done to obtain the specific update messages
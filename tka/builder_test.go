@@ -5,8 +5,11 @@
 package tka
 
 import (
+	"bytes"
 	"crypto/ed25519"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"tailscale.com/types/tkatype"
@@ -91,6 +94,113 @@ func TestAuthorityBuilderRemoveKey(t *testing.T) {
 	}
 }
 
+func TestAuthorityBuilderAnnotate(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.Annotate(Annotation{}); err == nil {
+		t.Error("Annotate() of an empty annotation succeeded")
+	}
+	if err := b.Annotate(Annotation{Reason: strings.Repeat("x", maxAnnotationBytes+1)}); err == nil {
+		t.Error("Annotate() of an oversized annotation succeeded")
+	}
+	note := Annotation{Ticket: "SEC-123", Reason: "key2 left the company"}
+	if err := b.Annotate(note); err != nil {
+		t.Fatalf("Annotate() failed: %v", err)
+	}
+	if err := b.RemoveKey(key2.ID()); err != nil {
+		t.Fatalf("RemoveKey(%v) failed: %v", key2, err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	entries, _, err := a.History(nil, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d history entries, want 3", len(entries))
+	}
+	if got := entries[1]; got.Kind != AUMAnnotate || *got.AUM.Annotation != note {
+		t.Errorf("history entry 1 = %v %+v, want annotation %+v", got.Kind, got.AUM.Annotation, note)
+	}
+
+	// Annotations must be signed like any other update.
+	head := a.Head()
+	forged := AUM{MessageKind: AUMAnnotate, PrevAUMHash: head[:], Annotation: &Annotation{Reason: "forged"}}
+	if err := a.Inform([]AUM{forged}); err == nil {
+		t.Error("unsigned annotation was applied")
+	}
+}
+
+func TestAuthorityBuilderRotateKey(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 3, Meta: map[string]string{"a": "b"}}
+	pub3, _ := testingKey25519(t, 3)
+	key3 := Key{Kind: Key25519, Public: pub3, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.RotateKey(key2.ID(), key); err == nil {
+		t.Error("RotateKey() to an existing key succeeded")
+	}
+	if err := b.RotateKey(key3.ID(), key3); err == nil {
+		t.Error("RotateKey() of a missing key succeeded")
+	}
+	if err := b.RotateKey(key2.ID(), key3); err != nil {
+		t.Fatalf("RotateKey() failed: %v", err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if len(updates) != 2 || updates[0].MessageKind != AUMAddKey || updates[1].MessageKind != AUMRemoveKey {
+		t.Fatalf("updates = %+v; want AddKey then RemoveKey", updates)
+	}
+
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+	if _, err := a.state.GetKey(key2.ID()); err != ErrNoSuchKey {
+		t.Errorf("GetKey(key2).err = %v, want %v", err, ErrNoSuchKey)
+	}
+	k, err := a.state.GetKey(key3.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Votes != 3 {
+		t.Errorf("rotated key votes = %d, want 3", k.Votes)
+	}
+	if diff := cmp.Diff(map[string]string{"a": "b"}, k.Meta); diff != "" {
+		t.Errorf("rotated key meta differs (-want, +got):\n%s", diff)
+	}
+}
+
 func TestAuthorityBuilderSetKeyVote(t *testing.T) {
 	pub, priv := testingKey25519(t, 1)
 	key := Key{Kind: Key25519, Public: pub, Votes: 2}
@@ -161,6 +271,98 @@ func TestAuthorityBuilderSetKeyMeta(t *testing.T) {
 	}
 }
 
+func TestAuthorityBuilderMetaLimits(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	var signed int
+	b := a.NewUpdater(RemoteSigner{Sign: func(serializedAUM []byte) ([]tkatype.Signature, error) {
+		signed++
+		var aum AUM
+		if err := aum.Unserialize(serializedAUM); err != nil {
+			return nil, err
+		}
+		return signer25519(priv).SignAUM(aum.SigHash())
+	}})
+
+	// Oversized metadata is caught before signing.
+	if err := b.SetKeyMeta(key.ID(), map[string]string{"k": strings.Repeat("v", 1000)}); err == nil {
+		t.Error("SetKeyMeta() with an oversized value succeeded")
+	}
+	if err := b.SetKeyMetaValue(key.ID(), "bad key", "v"); err == nil {
+		t.Error("SetKeyMetaValue() with an invalid key succeeded")
+	}
+	if signed != 0 {
+		t.Errorf("signer called %d times for invalid updates", signed)
+	}
+
+	// Stricter limits apply to later updates.
+	b.SetMetaLimits(MetaLimits{MaxEntries: 1})
+	if err := b.SetKeyMetaValue(key.ID(), "a", "1"); err != nil {
+		t.Fatalf("SetKeyMetaValue() failed: %v", err)
+	}
+	if err := b.SetKeyMetaValue(key.ID(), "b", "2"); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Errorf("SetKeyMetaValue() beyond the builder's limits = %v, want too many", err)
+	}
+	if signed != 1 {
+		t.Errorf("signer called %d times, want 1", signed)
+	}
+}
+
+func TestAuthorityBuilderSetKeyMetaValue(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2, Meta: map[string]string{"a": "b", "c": "d"}}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyMetaValue(key.ID(), "e", "f"); err != nil {
+		t.Fatalf("SetKeyMetaValue() failed: %v", err)
+	}
+	if err := b.DeleteKeyMetaValue(key.ID(), "a"); err != nil {
+		t.Fatalf("DeleteKeyMetaValue() failed: %v", err)
+	}
+	if err := b.DeleteKeyMetaValue(key.ID(), "a"); err == nil {
+		t.Error("DeleteKeyMetaValue() of a missing value succeeded")
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+	k, err := a.state.GetKey(key.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"c": "d", "e": "f"}, k.Meta); diff != "" {
+		t.Errorf("updated meta differs (-want, +got):\n%s", diff)
+	}
+
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.DeleteKeyMetaValue(key.ID(), "c"); err != nil {
+		t.Fatalf("DeleteKeyMetaValue() failed: %v", err)
+	}
+	if err := b.DeleteKeyMetaValue(key.ID(), "e"); err == nil {
+		t.Error("DeleteKeyMetaValue() of the last value succeeded")
+	}
+}
+
 func TestAuthorityBuilderMultiple(t *testing.T) {
 	pub, priv := testingKey25519(t, 1)
 	key := Key{Kind: Key25519, Public: pub, Votes: 2}
@@ -207,3 +409,462 @@ func TestAuthorityBuilderMultiple(t *testing.T) {
 		t.Errorf("GetKey(key).err = %v, want %v", err, ErrNoSuchKey)
 	}
 }
+
+func TestAuthorityBuilderCheckpoint(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	for i := 0; i < checkpointEvery-1; i++ {
+		if err := b.SetKeyVote(key.ID(), uint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if len(updates) != checkpointEvery-1 {
+		t.Fatalf("got %d updates; want %d without a checkpoint", len(updates), checkpointEvery-1)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyVote(key.ID(), 7); err != nil {
+		t.Fatal(err)
+	}
+	updates, err = b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if len(updates) != 2 || updates[1].MessageKind != AUMCheckpoint {
+		t.Fatalf("updates = %+v; want the update then a checkpoint", updates)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+	if k, _ := a.state.GetKey(key.ID()); k.Votes != 7 {
+		t.Errorf("key.Votes = %d, want 7", k.Votes)
+	}
+}
+
+func TestAuthorityBuilderSignatureThreshold(t *testing.T) {
+	pub1, priv1 := testingKey25519(t, 1)
+	key1 := Key{Kind: Key25519, Public: pub1, Votes: 1}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key1, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv1))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv1))
+	if err := b.SetSignatureThreshold(3); err == nil {
+		t.Error("SetSignatureThreshold(3) with 2 keys succeeded")
+	}
+	if err := b.SetSignatureThreshold(2); err != nil {
+		t.Fatalf("SetSignatureThreshold() failed: %v", err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	// Now updates need signatures from both keys.
+	b = a.NewUpdater(signer25519(priv1))
+	if err := b.SetKeyVote(key1.ID(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key2.ID(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Finalize(); err == nil {
+		t.Error("Finalize() of several partially-signed updates succeeded")
+	}
+
+	b = a.NewUpdater(signer25519(priv1))
+	if err := b.RemoveKey(key2.ID()); err == nil {
+		t.Error("RemoveKey() below the signature threshold succeeded")
+	}
+	if err := b.SetKeyVote(key1.ID(), 2); err != nil {
+		t.Fatal(err)
+	}
+	updates, err = b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if len(updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(updates))
+	}
+	if got := a.SignaturesNeeded(updates[0]); got != 1 {
+		t.Errorf("SignaturesNeeded() = %d, want 1", got)
+	}
+	if err := a.Inform(updates); err == nil {
+		t.Fatal("Inform() of a partially-signed update succeeded")
+	}
+
+	if err := updates[0].AddSignatures(signer25519(priv2)); err != nil {
+		t.Fatalf("AddSignatures() failed: %v", err)
+	}
+	if got := a.SignaturesNeeded(updates[0]); got != 0 {
+		t.Errorf("after AddSignatures, SignaturesNeeded() = %d, want 0", got)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply co-signed updates: %v", err)
+	}
+	if k, _ := a.state.GetKey(key1.ID()); k.Votes != 2 {
+		t.Errorf("key1.Votes = %d, want 2", k.Votes)
+	}
+}
+
+func TestAuthorityBuilderDetached(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	_, otherPriv := testingKey25519(t, 2)
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(nil)
+	if err := b.SetKeyVote(key.ID(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key.ID(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.FinalizeDetached(); err == nil {
+		t.Error("FinalizeDetached() of several unsigned updates succeeded")
+	}
+
+	b = a.NewUpdater(nil)
+	if err := b.SetKeyVote(key.ID(), 5); err != nil {
+		t.Fatal(err)
+	}
+	updates, sigHashes, err := b.FinalizeDetached()
+	if err != nil {
+		t.Fatalf("FinalizeDetached() failed: %v", err)
+	}
+	if len(updates) != 1 || len(sigHashes) != 1 || len(updates[0].Signatures) != 0 {
+		t.Fatalf("got %d updates, %d sig hashes; want one of each, unsigned", len(updates), len(sigHashes))
+	}
+	if err := a.Inform(updates); err == nil {
+		t.Fatal("Inform() of an unsigned update succeeded")
+	}
+
+	// Sign "offline".
+	badSigs, _ := signer25519(otherPriv).SignAUM(sigHashes[0])
+	if err := a.AttachSignatures(&updates[0], badSigs); err == nil {
+		t.Error("AttachSignatures() with an untrusted key succeeded")
+	}
+	sigs, _ := signer25519(priv).SignAUM(sigHashes[0])
+	if err := a.AttachSignatures(&updates[0], sigs); err != nil {
+		t.Fatalf("AttachSignatures() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply detached-signed updates: %v", err)
+	}
+	if k, _ := a.state.GetKey(key.ID()); k.Votes != 5 {
+		t.Errorf("key.Votes = %d, want 5", k.Votes)
+	}
+}
+
+func TestAuthorityBuilderSetKeyExpiry(t *testing.T) {
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, genesis, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	expiry := now.Add(time.Hour)
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyExpiry(key2.ID(), expiry); err != nil {
+		t.Fatalf("SetKeyExpiry() failed: %v", err)
+	}
+	firstUpdates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	updates := firstUpdates
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+	k, _ := a.state.GetKey(key2.ID())
+	if got, ok := k.Expiry(); !ok || !got.Equal(expiry) {
+		t.Errorf("key2.Expiry() = %v, %v; want %v", got, ok, expiry)
+	}
+	if got := a.KeysExpiringBefore(now.Add(2 * time.Hour)); len(got) != 1 || !bytes.Equal(got[0].ID(), key2.ID()) {
+		t.Errorf("KeysExpiringBefore() = %v; want key2", got)
+	}
+
+	// Before expiry, key2 can sign.
+	b = a.NewUpdater(signer25519(priv2))
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	signedBefore, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if w := signedBefore[0].Weight(a.state); w != 1 {
+		t.Errorf("Weight() before expiry = %d; want 1", w)
+	}
+
+	// After, it can't sign new updates.
+	now = expiry
+	b = a.NewUpdater(signer25519(priv2))
+	if err := b.SetKeyVote(key.ID(), 4); err == nil {
+		t.Error("update signed by an expired key was built")
+	}
+
+	// But what it signed before stays valid, with the same weight, so
+	// nodes agree on the chain whatever their clocks say.
+	if w := signedBefore[0].Weight(a.state); w != 1 {
+		t.Errorf("Weight() after expiry = %d; want 1", w)
+	}
+	if err := a.Inform(signedBefore); err != nil {
+		t.Errorf("Inform() of an update signed before expiry failed: %v", err)
+	}
+	fresh, err := Bootstrap(&Mem{}, genesis)
+	if err != nil {
+		t.Fatalf("Bootstrap() after expiry failed: %v", err)
+	}
+	if err := fresh.Inform(append(firstUpdates, signedBefore...)); err != nil {
+		t.Errorf("fresh node Inform() after expiry failed: %v", err)
+	}
+	if fresh.Head() != a.Head() {
+		t.Errorf("fresh node head = %x; want %x", fresh.Head(), a.Head())
+	}
+
+	// Removing the expiry revives it. As it's key2's only metadata,
+	// that takes a checkpoint.
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyExpiry(key2.ID(), time.Time{}); err != nil {
+		t.Fatalf("SetKeyExpiry(zero) failed: %v", err)
+	}
+	updates, err = b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if updates[0].MessageKind != AUMCheckpoint {
+		t.Errorf("clearing the expiry gave a %v update; want a checkpoint", updates[0].MessageKind)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+	if k, _ := a.state.GetKey(key2.ID()); k.expired(now) {
+		t.Error("key2 still expired after clearing its expiry")
+	}
+}
+
+func TestAuthorityBuilderRevokeKey(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// Before revocation, key2 signs an update which isn't applied yet,
+	// as though on a fork.
+	b := a.NewUpdater(signer25519(priv2))
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	forked, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.RevokeKey(key2.ID(), RevocationCompromised); err != nil {
+		t.Fatalf("RevokeKey() failed: %v", err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	if a.KeyTrusted(key2.ID()) {
+		t.Error("revoked key still trusted")
+	}
+	if !a.WasKeyRevoked(key2.ID()) || a.WasKeyRevoked(key.ID()) {
+		t.Error("WasKeyRevoked() wrong")
+	}
+	r, ok := a.RevocationInfo(key2.ID())
+	if !ok || r.Reason != RevocationCompromised {
+		t.Errorf("RevocationInfo() = %+v, %v", r, ok)
+	}
+
+	// An update the key signed on a branch from before it was revoked
+	// is valid there, but fork resolution keeps the revocation.
+	head := a.Head()
+	if err := a.Inform(forked); err != nil {
+		t.Errorf("Inform() of an update signed before revocation failed: %v", err)
+	}
+	if a.Head() != head || a.KeyTrusted(key2.ID()) {
+		t.Error("fork resolution chose the revoked key's branch")
+	}
+
+	// After the revocation, updates it signs are rejected.
+	b = a.NewUpdater(signer25519(priv2))
+	if err := b.SetKeyVote(key.ID(), 4); err != nil {
+		t.Fatal(err)
+	}
+	afterRevocation, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(afterRevocation); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Inform() of an update signed after revocation = %v, want revoked error", err)
+	}
+	// And it can't be trusted again.
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.AddKey(key2); err == nil {
+		t.Error("AddKey() of a revoked key succeeded")
+	}
+	if err := b.RevokeKey(key2.ID(), RevocationRetired); err == nil {
+		t.Error("RevokeKey() of a revoked key succeeded")
+	}
+
+	// The revocation is in the state after a restart.
+	a, err = Open(storage)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if !a.WasKeyRevoked(key2.ID()) {
+		t.Error("revocation lost on reopening")
+	}
+}
+
+func TestAuthorityBuilderRotateDisablementSecrets(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	oldSecret, newSecret := []byte{1, 2, 3}, []byte{4, 5, 6}
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{DisablementValue(oldSecret)},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.RotateDisablementSecrets(nil, [][]byte{DisablementValue(oldSecret)}); err == nil {
+		t.Error("retiring the only disablement secret succeeded")
+	}
+	if err := b.RotateDisablementSecrets(nil, [][]byte{DisablementValue(newSecret)}); err == nil {
+		t.Error("retiring an unknown disablement secret succeeded")
+	}
+	if err := b.RotateDisablementSecrets([][]byte{newSecret}, a.DisablementValues()); err != nil {
+		t.Fatalf("RotateDisablementSecrets() failed: %v", err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	if a.state.checkDisablement(oldSecret) {
+		t.Error("retired disablement secret still valid")
+	}
+	if !a.state.checkDisablement(newSecret) {
+		t.Error("new disablement secret not valid")
+	}
+}
+
+func TestAuthorityBuilderSignHooks(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 2}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	var signed int
+	b := a.NewUpdater(signer25519(priv))
+	b.AddSignHook(MinTotalVotes(2))
+	b.AddSignHook(func(update AUM, before, after State) error {
+		signed++
+		if len(update.Signatures) != 0 {
+			t.Error("sign hook called with a signed update")
+		}
+		return nil
+	})
+
+	if err := b.RemoveKey(key2.ID()); err != nil {
+		t.Fatalf("RemoveKey() failed: %v", err)
+	}
+	if err := b.SetKeyVote(key.ID(), 1); err == nil {
+		t.Error("SetKeyVote() below the minimum total votes succeeded")
+	}
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatalf("SetKeyVote() failed: %v", err)
+	}
+	if signed != 2 {
+		t.Errorf("second hook called %d times, want 2", signed)
+	}
+
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if len(updates) != 2 {
+		t.Errorf("got %d updates, want 2", len(updates))
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/blake2s"
+	"tailscale.com/types/tkatype"
+)
+
+// DelegationScope describes the operations a delegated key may sign.
+//
+// Delegated keys are never in the authority's state, so they can't sign
+// AUMs: only keys trusted by the authority can change it.
+type DelegationScope uint16
+
+const (
+	// DelegateNodeKeys allows the delegated key to sign node keys.
+	DelegateNodeKeys DelegationScope = 1 << iota
+
+	// allDelegationScopes are the scopes this version recognizes.
+	allDelegationScopes = DelegateNodeKeys
+)
+
+func (s DelegationScope) String() string {
+	if s == DelegateNodeKeys {
+		return "node-keys"
+	}
+	return fmt.Sprintf("Scope?<%#x>", uint16(s))
+}
+
+// Delegation is a record, signed by a key the authority trusts,
+// authorizing a subordinate key to sign certain operations. This lets,
+// say, a CI system sign node keys without holding a key that can change
+// the authority.
+//
+// A delegation is only valid while its issuer is trusted and hasn't
+// expired, so removing or revoking the issuer revokes its delegations.
+type Delegation struct {
+	// Issuer identifies the trusted key that made the delegation.
+	Issuer tkatype.KeyID `cbor:"1,keyasint"`
+
+	// Key is the delegated key. It has no votes.
+	Key Key `cbor:"2,keyasint"`
+
+	Scope DelegationScope `cbor:"3,keyasint"`
+
+	// Expiry is when the delegation expires, in seconds since the Unix
+	// epoch, or zero if it lasts as long as the issuer does.
+	Expiry int64 `cbor:"4,keyasint,omitempty"`
+
+	// Signature is the issuer's signature over the rest of the
+	// structure.
+	Signature []byte `cbor:"5,keyasint,omitempty"`
+}
+
+// sigHash returns the digest the issuer signs, a hash of the serialized
+// structure sans the signature.
+func (d Delegation) sigHash() [blake2s.Size]byte {
+	dupe := d
+	dupe.Signature = nil
+	return blake2s.Sum256(dupe.Serialize())
+}
+
+// Serialize returns the given delegation in a serialized format.
+func (d *Delegation) Serialize() []byte {
+	encoder, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		// Deterministic validation of encoding options, should
+		// never fail.
+		panic(err)
+	}
+	out, err := encoder.Marshal(d)
+	if err != nil {
+		// Encoding to bytes should never fail.
+		panic(err)
+	}
+	return out
+}
+
+// Unserialize decodes bytes representing a serialized delegation.
+func (d *Delegation) Unserialize(data []byte) error {
+	dec, _ := cborDecOpts.DecMode()
+	return dec.Unmarshal(data, d)
+}
+
+// expiry returns when the delegation expires, or the zero time if it
+// doesn't.
+func (d Delegation) expiry() time.Time {
+	if d.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(d.Expiry, 0)
+}
+
+func (d *Delegation) staticValidate() error {
+	if len(d.Issuer) == 0 {
+		return errors.New("missing issuer")
+	}
+	if err := d.Key.StaticValidate(); err != nil {
+		return fmt.Errorf("delegated key: %v", err)
+	}
+	if d.Key.Votes != 0 {
+		return errors.New("delegated key has votes")
+	}
+	if d.Scope == 0 || d.Scope&^allDelegationScopes != 0 {
+		return fmt.Errorf("invalid scope: %v", d.Scope)
+	}
+	if d.Expiry < 0 {
+		return errors.New("invalid expiry")
+	}
+	return nil
+}
+
+// verifyDelegation returns an error unless delegation is well-formed,
+// signed by a key trusted in s that hasn't expired, hasn't expired
+// itself, delegates a key that wasn't revoked, and allows scope.
+func (s State) verifyDelegation(d Delegation, scope DelegationScope) error {
+	if err := d.staticValidate(); err != nil {
+		return err
+	}
+	issuer, err := s.GetKey(d.Issuer)
+	if err != nil {
+		return fmt.Errorf("issuer: %v", err)
+	}
+	now := timeNow()
+	if issuer.expired(now) {
+		return fmt.Errorf("issuer %x has expired", d.Issuer)
+	}
+	sigHash := d.sigHash()
+	if err := signatureVerify(&tkatype.Signature{KeyID: d.Issuer, Signature: d.Signature}, tkatype.AUMSigHash(sigHash), issuer); err != nil {
+		return fmt.Errorf("issuer signature: %v", err)
+	}
+	if exp := d.expiry(); !exp.IsZero() && !now.Before(exp) {
+		return errors.New("delegation has expired")
+	}
+	if r, ok := s.revocation(d.Key.ID()); ok {
+		return fmt.Errorf("delegated key %x was revoked (%v)", d.Key.ID(), r.Reason)
+	}
+	if d.Scope&scope != scope {
+		return fmt.Errorf("delegation does not allow %v", scope)
+	}
+	return nil
+}
+
+// Delegate returns a serialized Delegation, made by issuer with a key
+// the authority trusts, authorizing key to sign the operations in scope
+// until expiry, or for as long as issuer is trusted if expiry is zero.
+func (a *Authority) Delegate(key Key, scope DelegationScope, expiry time.Time, issuer Signer) ([]byte, error) {
+	d := Delegation{
+		Key:   key.Clone(),
+		Scope: scope,
+	}
+	if !expiry.IsZero() {
+		d.Expiry = expiry.Unix()
+	}
+	issuerID, signature, err := signDigest(issuer, func(keyID tkatype.KeyID) tkatype.AUMSigHash {
+		d.Issuer = keyID
+		return tkatype.AUMSigHash(d.sigHash())
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.Issuer, d.Signature = issuerID, signature
+	if err := a.state.verifyDelegation(d, scope); err != nil {
+		return nil, fmt.Errorf("new delegation is not valid: %v", err)
+	}
+	return d.Serialize(), nil
+}
+
+// SignNodeKeyDelegated returns a signature over nodeKey, made by signer
+// with the key delegation authorizes to sign node keys.
+func (a *Authority) SignNodeKeyDelegated(nodeKey, delegation []byte, signer Signer) (tkatype.MarshaledSignature, error) {
+	if len(nodeKey) == 0 {
+		return nil, errors.New("missing node key")
+	}
+	var d Delegation
+	if err := d.Unserialize(delegation); err != nil {
+		return nil, fmt.Errorf("delegation: %v", err)
+	}
+	sig := NodeKeySignature{
+		SigKind:    SigDelegated,
+		Pubkey:     nodeKey,
+		Delegation: delegation,
+	}
+	keyID, signature, err := signDigest(signer, func(keyID tkatype.KeyID) tkatype.AUMSigHash {
+		sig.KeyID = keyID
+		return tkatype.AUMSigHash(sig.sigHash())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keyID, d.Key.ID()) {
+		return nil, fmt.Errorf("signer key %x is not the delegated key %x", keyID, d.Key.ID())
+	}
+	sig.KeyID, sig.Signature = keyID, signature
+
+	out := sig.Serialize()
+	if err := a.VerifySignature(out); err != nil {
+		return nil, fmt.Errorf("new signature is not valid: %v", err)
+	}
+	return out, nil
+}
+
+// verifyDelegatedSignature checks a SigDelegated node-key signature,
+// returning the delegation it was made under.
+func (s State) verifyDelegatedSignature(sig *NodeKeySignature) (Delegation, error) {
+	var d Delegation
+	if err := d.Unserialize(sig.Delegation); err != nil {
+		return Delegation{}, fmt.Errorf("delegation: %v", err)
+	}
+	if err := s.verifyDelegation(d, DelegateNodeKeys); err != nil {
+		return Delegation{}, fmt.Errorf("delegation: %v", err)
+	}
+	if !bytes.Equal(sig.KeyID, d.Key.ID()) {
+		return Delegation{}, errors.New("signature is not by the delegated key")
+	}
+	return d, sig.verifySignature(d.Key)
+}
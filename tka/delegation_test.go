@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelegation(t *testing.T) {
+	nodeKeyPub := []byte{1, 2, 3, 4}
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+	ciPub, ciPriv := testingKey25519(t, 3)
+	ciKey := Key{Kind: Key25519, Public: ciPub}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	delegation, err := a.Delegate(ciKey, DelegateNodeKeys, expiry, signer25519(priv2))
+	if err != nil {
+		t.Fatalf("Delegate() failed: %v", err)
+	}
+	if _, err := a.Delegate(Key{Kind: Key25519, Public: ciPub, Votes: 1}, DelegateNodeKeys, expiry, signer25519(priv2)); err == nil {
+		t.Error("Delegate() of a key with votes succeeded")
+	}
+	if _, err := a.Delegate(ciKey, 0, expiry, signer25519(priv2)); err == nil {
+		t.Error("Delegate() with no scope succeeded")
+	}
+	if _, err := a.Delegate(ciKey, DelegateNodeKeys, expiry, signer25519(ciPriv)); err == nil {
+		t.Error("Delegate() by an untrusted key succeeded")
+	}
+
+	sig, err := a.SignNodeKeyDelegated(nodeKeyPub, delegation, signer25519(ciPriv))
+	if err != nil {
+		t.Fatalf("SignNodeKeyDelegated() failed: %v", err)
+	}
+	if err := a.VerifySignature(sig); err != nil {
+		t.Errorf("VerifySignature() failed: %v", err)
+	}
+	if exp, err := a.NodeKeySignatureExpiry(sig); err != nil || !exp.Equal(expiry) {
+		t.Errorf("NodeKeySignatureExpiry() = %v, %v, want %v", exp, err, expiry)
+	}
+	if _, err := a.SignNodeKeyDelegated(nodeKeyPub, delegation, signer25519(priv)); err == nil {
+		t.Error("SignNodeKeyDelegated() by a key other than the delegated one succeeded")
+	}
+
+	// The delegated key can't sign updates, as it isn't trusted.
+	b := a.NewUpdater(signer25519(ciPriv))
+	if err := b.SetKeyVote(key2.ID(), 2); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(updates); err == nil {
+		t.Error("update signed by a delegated key was applied")
+	}
+
+	// Nor can the scope be widened by tampering.
+	var d Delegation
+	if err := d.Unserialize(delegation); err != nil {
+		t.Fatal(err)
+	}
+	d.Scope = 0xff
+	if _, err := a.SignNodeKeyDelegated(nodeKeyPub, d.Serialize(), signer25519(ciPriv)); err == nil {
+		t.Error("SignNodeKeyDelegated() with a tampered delegation succeeded")
+	}
+
+	// Delegations expire.
+	timeNow = func() time.Time { return expiry }
+	defer func() { timeNow = time.Now }()
+	if err := a.VerifySignature(sig); err == nil {
+		t.Error("VerifySignature() under an expired delegation succeeded")
+	}
+	timeNow = time.Now
+
+	// Removing the issuer revokes its delegations.
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.RemoveKey(key2.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if updates, err = b.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	if err := a.VerifySignature(sig); err == nil {
+		t.Error("VerifySignature() under a removed issuer's delegation succeeded")
+	}
+}
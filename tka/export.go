@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// An export bundle is a copy of an authority's active chain, for
+// recovering it after losing the node state it was stored in. It's
+// encrypted with a key derived from a passphrase:
+//
+//	bundleMagic || salt || nonce || XChaCha20-Poly1305(exportBundle)
+const bundleMagic = "tkabndl1"
+
+const bundleSaltLength = 16
+
+// exportBundle is the plaintext of an export bundle.
+type exportBundle struct {
+	// AUMs are the serialized updates of the active chain, oldest
+	// first. The first is a checkpoint.
+	AUMs [][]byte `cbor:"1,keyasint"`
+
+	// Head is the hash of the last AUM, and State the state it results
+	// in, so that Import can check it reconstructed the same authority.
+	Head  AUMHash `cbor:"2,keyasint"`
+	State State   `cbor:"3,keyasint"`
+
+	// Disablement describes how disablement secrets are derived, so
+	// that a bundle isn't imported by a build that would derive them
+	// differently and so couldn't disable the authority.
+	Disablement disablementParams `cbor:"4,keyasint"`
+}
+
+// disablementParams are the parameters of disablementKDF.
+type disablementParams struct {
+	Salt    []byte `cbor:"1,keyasint"`
+	Time    uint32 `cbor:"2,keyasint"`
+	Memory  uint32 `cbor:"3,keyasint"` // KiB
+	Threads uint8  `cbor:"4,keyasint"`
+	KeyLen  uint32 `cbor:"5,keyasint"`
+}
+
+// currentDisablementParams returns the parameters disablementKDF uses.
+func currentDisablementParams() disablementParams {
+	return disablementParams{
+		Salt:    disablementSalt,
+		Time:    4,
+		Memory:  16 * 1024,
+		Threads: 4,
+		KeyLen:  disablementLength,
+	}
+}
+
+// bundleKey derives the key an export bundle is encrypted with from
+// passphrase.
+func bundleKey(passphrase, salt []byte) []byte {
+	return argon2.IDKey(passphrase, salt, 3, 64*1024, 4, chacha20poly1305.KeySize)
+}
+
+// Export returns a copy of the authority's active chain, from the
+// checkpoint at or before its oldest ancestor onwards, encrypted with
+// passphrase. Pass it to Import to recover the authority.
+func (a *Authority) Export(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+
+	// Walk back from head to the oldest ancestor, then on to the
+	// checkpoint the chain can be bootstrapped from.
+	var (
+		chain  []AUM
+		oldest = a.oldestAncestor.Hash()
+		cursor = a.Head()
+		passed bool // whether the walk has passed the oldest ancestor
+	)
+	for i := 0; ; i++ {
+		if i >= 2000 {
+			return nil, fmt.Errorf("iteration limit exceeded (%d)", 2000)
+		}
+		aum, err := a.storage.AUM(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("reading %x: %v", cursor, err)
+		}
+		chain = append(chain, aum)
+		passed = passed || cursor == oldest
+		if passed && aum.MessageKind == AUMCheckpoint {
+			break
+		}
+		parent, hasParent := aum.Parent()
+		if !hasParent {
+			return nil, errors.New("no checkpoint in active chain")
+		}
+		cursor = parent
+	}
+
+	b := exportBundle{
+		Head:        a.Head(),
+		State:       a.state.Clone(),
+		Disablement: currentDisablementParams(),
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		b.AUMs = append(b.AUMs, chain[i].Serialize())
+	}
+	plaintext, err := cbor.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(bundleMagic)+bundleSaltLength+chacha20poly1305.NonceSizeX, len(bundleMagic)+bundleSaltLength+chacha20poly1305.NonceSizeX+len(plaintext)+chacha20poly1305.Overhead)
+	copy(out, bundleMagic)
+	salt := out[len(bundleMagic) : len(bundleMagic)+bundleSaltLength]
+	nonce := out[len(bundleMagic)+bundleSaltLength:]
+	if _, err := rand.Read(out[len(bundleMagic):]); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(bundleKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, []byte(bundleMagic)), nil
+}
+
+// Import recovers an authority from bundle, as returned by Export with
+// the same passphrase, bootstrapping it in storage, which must be empty.
+// Like any other updates, the exported ones are verified as they're
+// applied.
+func Import(storage Chonk, bundle, passphrase []byte) (*Authority, error) {
+	headerLen := len(bundleMagic) + bundleSaltLength + chacha20poly1305.NonceSizeX
+	if len(bundle) < headerLen || !bytes.HasPrefix(bundle, []byte(bundleMagic)) {
+		return nil, errors.New("not an authority export bundle")
+	}
+	salt := bundle[len(bundleMagic) : len(bundleMagic)+bundleSaltLength]
+	nonce := bundle[len(bundleMagic)+bundleSaltLength : headerLen]
+	aead, err := chacha20poly1305.NewX(bundleKey(passphrase, salt))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, bundle[headerLen:], []byte(bundleMagic))
+	if err != nil {
+		return nil, errors.New("decrypting bundle: wrong passphrase or corrupt bundle")
+	}
+
+	dec, err := cborDecOpts.DecMode()
+	if err != nil {
+		return nil, err
+	}
+	var b exportBundle
+	if err := dec.Unmarshal(plaintext, &b); err != nil {
+		return nil, fmt.Errorf("decoding bundle: %v", err)
+	}
+	want := currentDisablementParams()
+	if got := b.Disablement; !bytes.Equal(got.Salt, want.Salt) || got.Time != want.Time || got.Memory != want.Memory || got.Threads != want.Threads || got.KeyLen != want.KeyLen {
+		return nil, errors.New("bundle uses incompatible disablement parameters")
+	}
+	if len(b.AUMs) == 0 {
+		return nil, errors.New("bundle has no updates")
+	}
+
+	updates := make([]AUM, len(b.AUMs))
+	for i, raw := range b.AUMs {
+		if err := updates[i].Unserialize(raw); err != nil {
+			return nil, fmt.Errorf("update %d: %v", i, err)
+		}
+	}
+	a, err := Bootstrap(storage, updates[0])
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap: %v", err)
+	}
+	if err := a.Inform(updates[1:]); err != nil {
+		return nil, fmt.Errorf("applying updates: %v", err)
+	}
+	if a.Head() != b.Head {
+		return nil, fmt.Errorf("imported head %x, but bundle head is %x", a.Head(), b.Head)
+	}
+	if !bytes.Equal(stateDigest(a.state), stateDigest(b.State)) {
+		return nil, errors.New("imported state differs from the bundle's")
+	}
+	return a, nil
+}
+
+// stateDigest returns the canonical encoding of s, for comparison.
+func stateDigest(s State) []byte {
+	enc, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	out, err := enc.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
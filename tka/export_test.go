@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.AddKey(key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key2.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	passphrase := []byte("correct horse battery staple")
+	bundle, err := a.Export(passphrase)
+	if err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+
+	if _, err := Import(&Mem{}, bundle, []byte("wrong")); err == nil {
+		t.Error("Import() with the wrong passphrase succeeded")
+	}
+	corrupt := append([]byte(nil), bundle...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err := Import(&Mem{}, corrupt, passphrase); err == nil {
+		t.Error("Import() of a corrupt bundle succeeded")
+	}
+
+	imported, err := Import(&Mem{}, bundle, passphrase)
+	if err != nil {
+		t.Fatalf("Import() failed: %v", err)
+	}
+	if imported.Head() != a.Head() {
+		t.Errorf("imported head = %x, want %x", imported.Head(), a.Head())
+	}
+	if k, err := imported.state.GetKey(key2.ID()); err != nil || k.Votes != 3 {
+		t.Errorf("imported key2 = %+v, %v", k, err)
+	}
+	entries, _, err := imported.History(nil, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("imported %d updates, want 3", len(entries))
+	}
+
+	// Storage must be empty.
+	if _, err := Import(imported.storage, bundle, passphrase); err == nil {
+		t.Error("Import() into non-empty storage succeeded")
+	}
+}
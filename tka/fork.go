@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"errors"
+	"fmt"
+
+	"tailscale.com/types/tkatype"
+)
+
+// ForkRule is the fork-resolution rule that decided between two
+// branches of a fork. See pickNextAUM.
+type ForkRule uint8
+
+const (
+	// ForkRuleWeight means the chosen branch's first update has the
+	// highest signature weight.
+	ForkRuleWeight ForkRule = iota + 1
+	// ForkRuleRemoveKey means the weights were equal, and the chosen
+	// branch's first update removes or revokes a key.
+	ForkRuleRemoveKey
+	// ForkRuleHash means neither of the above decided, and the chosen
+	// branch's first update has the lowest hash.
+	ForkRuleHash
+)
+
+func (r ForkRule) String() string {
+	switch r {
+	case ForkRuleWeight:
+		return "signature-weight"
+	case ForkRuleRemoveKey:
+		return "remove-key"
+	case ForkRuleHash:
+		return "lowest-hash"
+	default:
+		return fmt.Sprintf("ForkRule?<%d>", int(r))
+	}
+}
+
+// forkRule returns the rule by which fork resolution picks chosen over
+// other, both children of the AUM that state is at.
+func forkRule(state State, chosen, other AUM) ForkRule {
+	if chosen.Weight(state) != other.Weight(state) {
+		return ForkRuleWeight
+	}
+	if chosen.removesKey() != other.removesKey() {
+		return ForkRuleRemoveKey
+	}
+	return ForkRuleHash
+}
+
+// ForkBranch describes one branch of a fork.
+type ForkBranch struct {
+	// First is the hash of the branch's first update, a child of the
+	// fork point, and Kind is its kind.
+	First AUMHash
+	Kind  AUMKind
+
+	// Weight is the signature weight of the first update, as of the
+	// fork point.
+	Weight uint
+
+	// Head is the hash of the branch's last update, following fork
+	// resolution at any later forks, and Length how many updates it
+	// has up to and including Head.
+	Head   AUMHash
+	Length int
+
+	// Signers are the distinct IDs of the keys that signed the
+	// branch's updates.
+	Signers []tkatype.KeyID
+}
+
+// ForkReport describes a fork: an update with several children.
+type ForkReport struct {
+	// ForkPoint is the hash of the update the branches share.
+	ForkPoint AUMHash
+
+	// Branches are the branches of the fork, in the order fork
+	// resolution ranks them, so the first is the chosen branch.
+	Branches []ForkBranch
+
+	// Rule is the rule by which the chosen branch won over the next.
+	Rule ForkRule
+}
+
+// ErrForksTruncated is returned by Forks, along with the forks found so
+// far, if there are too many updates after the oldest ancestor to check
+// them all.
+var ErrForksTruncated = errors.New("too many updates to check them all for forks")
+
+// Forks returns reports of the forks after the oldest ancestor, in the
+// order they're found walking from it.
+func (a *Authority) Forks() ([]ForkReport, error) {
+	var (
+		out   []ForkReport
+		queue = []AUMHash{a.oldestAncestor.Hash()}
+	)
+	for i := 0; i < len(queue); i++ {
+		if i >= 2000 {
+			return out, ErrForksTruncated
+		}
+		children, err := a.storage.ChildAUMs(queue[i])
+		if err != nil {
+			return nil, fmt.Errorf("getting children of %x: %v", queue[i], err)
+		}
+		for _, c := range children {
+			queue = append(queue, c.Hash())
+		}
+		if len(children) < 2 {
+			continue
+		}
+		r, err := a.forkReport(queue[i], children)
+		if err != nil {
+			return nil, fmt.Errorf("fork at %x: %v", queue[i], err)
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (a *Authority) forkReport(forkPoint AUMHash, children []AUM) (ForkReport, error) {
+	state, err := computeStateAt(a.storage, 2000, forkPoint)
+	if err != nil {
+		return ForkReport{}, fmt.Errorf("computing state: %v", err)
+	}
+	sortForkCandidates(state, children)
+
+	r := ForkReport{
+		ForkPoint: forkPoint,
+		Rule:      forkRule(state, children[0], children[1]),
+	}
+	for _, first := range children {
+		b := ForkBranch{
+			First:  first.Hash(),
+			Kind:   first.MessageKind,
+			Weight: first.Weight(state),
+		}
+		seen := map[string]bool{}
+		branchState, err := state.applyVerifiedAUM(first)
+		if err != nil {
+			return ForkReport{}, fmt.Errorf("applying %x: %v", b.First, err)
+		}
+		head, _, err := fastForward(a.storage, 2000, branchState, func(cur AUM, _ State) bool {
+			b.Length++
+			for _, sig := range cur.Signatures {
+				if !seen[string(sig.KeyID)] {
+					seen[string(sig.KeyID)] = true
+					b.Signers = append(b.Signers, sig.KeyID)
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return ForkReport{}, fmt.Errorf("following %x: %v", b.First, err)
+		}
+		b.Head = head.Hash()
+		r.Branches = append(r.Branches, b)
+	}
+	return r, nil
+}
+
+// PruneForks removes from storage the branches that fork resolution
+// didn't choose, along with all their descendants, so that they no
+// longer appear in Forks. Updates that later arrive on a pruned branch
+// are rejected, as their parents are unknown.
+//
+// The storage must implement CompactableChonk.
+func (a *Authority) PruneForks() error {
+	storage, ok := a.storage.(CompactableChonk)
+	if !ok {
+		return fmt.Errorf("storage %T does not support compaction", a.storage)
+	}
+	reports, err := a.Forks()
+	if err != nil {
+		return err
+	}
+
+	var purge []AUMHash
+	for _, r := range reports {
+		for _, b := range r.Branches[1:] {
+			// Collect the losing branch and everything descended
+			// from it, not just the path fork resolution follows.
+			queue := []AUMHash{b.First}
+			for i := 0; i < len(queue); i++ {
+				if i >= 2000 {
+					return fmt.Errorf("iteration limit exceeded (%d)", 2000)
+				}
+				children, err := storage.ChildAUMs(queue[i])
+				if err != nil {
+					return fmt.Errorf("getting children of %x: %v", queue[i], err)
+				}
+				for _, c := range children {
+					queue = append(queue, c.Hash())
+				}
+			}
+			purge = append(purge, queue...)
+		}
+	}
+	if len(purge) == 0 {
+		return nil
+	}
+	for _, h := range purge {
+		if h == a.Head() {
+			return errors.New("refusing to prune the active head")
+		}
+	}
+	return storage.PurgeAUMs(purge)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestAuthorityForks(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	storage := &Mem{}
+	a, genesis, err := Create(storage, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// Two branches from genesis: a longer one signed by the lighter
+	// key, and a shorter one signed by the heavier key.
+	b := a.NewUpdater(signer25519(priv2))
+	if err := b.SetKeyVote(key2.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key2.ID(), 4); err != nil {
+		t.Fatal(err)
+	}
+	losing, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyVote(key.ID(), 5); err != nil {
+		t.Fatal(err)
+	}
+	winning, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(losing); err != nil {
+		t.Fatalf("Inform(losing) failed: %v", err)
+	}
+	if err := a.Inform(winning); err != nil {
+		t.Fatalf("Inform(winning) failed: %v", err)
+	}
+	if a.Head() != winning[0].Hash() {
+		t.Fatal("fork resolution didn't pick the heavier branch")
+	}
+
+	reports, err := a.Forks()
+	if err != nil {
+		t.Fatalf("Forks() failed: %v", err)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("got %d forks, want 1", len(reports))
+	}
+	r := reports[0]
+	if r.ForkPoint != genesis.Hash() {
+		t.Errorf("ForkPoint = %x, want genesis", r.ForkPoint)
+	}
+	if r.Rule != ForkRuleWeight {
+		t.Errorf("Rule = %v, want %v", r.Rule, ForkRuleWeight)
+	}
+	if len(r.Branches) != 2 {
+		t.Fatalf("got %d branches, want 2", len(r.Branches))
+	}
+	win, lose := r.Branches[0], r.Branches[1]
+	if win.First != winning[0].Hash() || win.Head != winning[0].Hash() || win.Length != 1 || win.Weight != 2 {
+		t.Errorf("chosen branch = %+v", win)
+	}
+	if lose.First != losing[0].Hash() || lose.Head != losing[1].Hash() || lose.Length != 2 || lose.Weight != 1 {
+		t.Errorf("other branch = %+v", lose)
+	}
+	if len(lose.Signers) != 1 || !bytes.Equal(lose.Signers[0], key2.ID()) {
+		t.Errorf("other branch signers = %x, want [%x]", lose.Signers, key2.ID())
+	}
+
+	if err := a.PruneForks(); err != nil {
+		t.Fatalf("PruneForks() failed: %v", err)
+	}
+	if reports, err := a.Forks(); err != nil || len(reports) != 0 {
+		t.Errorf("Forks() after pruning = %v, %v; want none", reports, err)
+	}
+	for _, u := range losing {
+		if _, err := storage.AUM(u.Hash()); err != os.ErrNotExist {
+			t.Errorf("pruned update still stored: %v", err)
+		}
+	}
+	if a, err = Open(storage); err != nil {
+		t.Fatalf("Open() after pruning failed: %v", err)
+	}
+	if a.Head() != winning[0].Hash() {
+		t.Error("head changed after pruning")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"errors"
+	"fmt"
+
+	"tailscale.com/types/tkatype"
+)
+
+// defaultHistoryLimit is the number of entries History returns if the
+// caller doesn't say.
+const defaultHistoryLimit = 100
+
+// HistoryOptions configures Authority.History.
+type HistoryOptions struct {
+	// Limit is the most entries to return. Zero means 100.
+	Limit int
+}
+
+// HistoryEntry describes an update in the active chain.
+type HistoryEntry struct {
+	Hash AUMHash
+	Kind AUMKind
+
+	// KeyID is the key the update affects, if any: the key added,
+	// removed, updated or revoked.
+	KeyID tkatype.KeyID
+
+	// Signers are the IDs of the keys that signed the update.
+	Signers []tkatype.KeyID
+
+	// AUM is the update itself, for details such as the added key or
+	// updated votes.
+	AUM AUM
+}
+
+// History returns entries describing the updates in the active chain,
+// oldest first, starting at from (or the oldest update still stored, if
+// nil). If there are more updates than opts.Limit, next is the hash to
+// pass as from to get the next page; otherwise it's nil.
+func (a *Authority) History(from *AUMHash, opts HistoryOptions) (entries []HistoryEntry, next *AUMHash, err error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	// Walk back from head, as only the parent links are unambiguous.
+	var (
+		chain  []AUM
+		oldest = a.oldestAncestor.Hash()
+		cursor = a.Head()
+	)
+	for i := 0; ; i++ {
+		if i >= 2000 {
+			return nil, nil, fmt.Errorf("iteration limit exceeded (%d)", 2000)
+		}
+		aum, err := a.storage.AUM(cursor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %x: %v", cursor, err)
+		}
+		chain = append(chain, aum)
+		if (from != nil && cursor == *from) || cursor == oldest {
+			break
+		}
+		parent, hasParent := aum.Parent()
+		if !hasParent {
+			break
+		}
+		cursor = parent
+	}
+	if from != nil && cursor != *from {
+		return nil, nil, errors.New("from is not in the active chain")
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if len(entries) == limit {
+			h := chain[i].Hash()
+			return entries, &h, nil
+		}
+		entries = append(entries, historyEntry(chain[i]))
+	}
+	return entries, nil, nil
+}
+
+// RecentHistory returns entries describing up to limit of the most
+// recent updates in the active chain (or 100, if limit is zero), newest
+// first. Unlike History, it only reads the updates it returns.
+func (a *Authority) RecentHistory(limit int) ([]HistoryEntry, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	var (
+		entries []HistoryEntry
+		oldest  = a.oldestAncestor.Hash()
+		cursor  = a.Head()
+	)
+	for len(entries) < limit {
+		aum, err := a.storage.AUM(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("reading %x: %v", cursor, err)
+		}
+		entries = append(entries, historyEntry(aum))
+		parent, hasParent := aum.Parent()
+		if cursor == oldest || !hasParent {
+			break
+		}
+		cursor = parent
+	}
+	return entries, nil
+}
+
+func historyEntry(aum AUM) HistoryEntry {
+	e := HistoryEntry{
+		Hash: aum.Hash(),
+		Kind: aum.MessageKind,
+		AUM:  aum,
+	}
+	switch {
+	case aum.Key != nil:
+		e.KeyID = aum.Key.ID()
+	case aum.Revocation != nil:
+		e.KeyID = aum.Revocation.KeyID
+	default:
+		e.KeyID = aum.KeyID
+	}
+	for _, sig := range aum.Signatures {
+		e.Signers = append(e.Signers, sig.KeyID)
+	}
+	return e
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAuthorityHistory(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, genesis, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.AddKey(key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key2.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RevokeKey(key2.ID(), RevocationRetired); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	entries, next, err := a.History(nil, HistoryOptions{})
+	if err != nil {
+		t.Fatalf("History() failed: %v", err)
+	}
+	if next != nil {
+		t.Errorf("History() returned a next page of everything")
+	}
+	wantKinds := []AUMKind{AUMCheckpoint, AUMAddKey, AUMUpdateKey, AUMRevokeKey}
+	if len(entries) != len(wantKinds) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(wantKinds))
+	}
+	for i, e := range entries {
+		if e.Kind != wantKinds[i] {
+			t.Errorf("entries[%d].Kind = %v, want %v", i, e.Kind, wantKinds[i])
+		}
+		if len(e.Signers) != 1 || !bytes.Equal(e.Signers[0], key.ID()) {
+			t.Errorf("entries[%d].Signers = %x, want [%x]", i, e.Signers, key.ID())
+		}
+		if i > 0 && !bytes.Equal(e.KeyID, key2.ID()) {
+			t.Errorf("entries[%d].KeyID = %x, want %x", i, e.KeyID, key2.ID())
+		}
+	}
+	if entries[0].Hash != genesis.Hash() {
+		t.Error("first entry is not the genesis AUM")
+	}
+
+	// Paginate.
+	var got []HistoryEntry
+	var from *AUMHash
+	for pages := 0; ; pages++ {
+		if pages > len(wantKinds) {
+			t.Fatal("too many pages")
+		}
+		page, next, err := a.History(from, HistoryOptions{Limit: 3})
+		if err != nil {
+			t.Fatalf("History() failed: %v", err)
+		}
+		got = append(got, page...)
+		if next == nil {
+			break
+		}
+		from = next
+	}
+	if len(got) != len(entries) || got[3].Hash != entries[3].Hash {
+		t.Errorf("paginated history differs: got %d entries", len(got))
+	}
+
+	if _, _, err := a.History(&AUMHash{1, 2, 3}, HistoryOptions{}); err == nil {
+		t.Error("History() from an unknown hash succeeded")
+	}
+
+	recent, err := a.RecentHistory(2)
+	if err != nil {
+		t.Fatalf("RecentHistory() failed: %v", err)
+	}
+	if len(recent) != 2 || recent[0].Hash != entries[3].Hash || recent[1].Hash != entries[2].Hash {
+		t.Errorf("RecentHistory(2) = %+v, want the last two entries, newest first", recent)
+	}
+	if recent, err = a.RecentHistory(10); err != nil || len(recent) != len(entries) {
+		t.Errorf("RecentHistory(10) = %d entries, %v; want %d", len(recent), err, len(entries))
+	}
+}
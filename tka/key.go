@@ -5,21 +5,38 @@
 package tka
 
 import (
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"errors"
 	"fmt"
+	"math/big"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/hdevalence/ed25519consensus"
+	"golang.org/x/crypto/blake2s"
 	"tailscale.com/types/tkatype"
 )
 
 // KeyKind describes the different varieties of a Key.
 type KeyKind uint8
 
-// Valid KeyKind values.
+// Valid KeyKind values. Do NOT reorder or reuse them.
+//
+// Nodes reject keys of kinds they don't know (see Key.StaticValidate),
+// so a key of a new kind must not be added to an authority until all its
+// nodes support the kind. A post-quantum or hybrid scheme would be added
+// the same way, as a new kind.
 const (
 	KeyInvalid KeyKind = iota
 	Key25519
+	// KeyP256 is an ECDSA key on the NIST P-256 curve, as supported by
+	// most HSMs and cloud KMSes. Its signatures are over the AUM's
+	// SigHash as the digest, encoded as r || s (32 bytes each) with s
+	// at most half the curve order, so that they aren't malleable.
+	KeyP256
 )
 
 func (k KeyKind) String() string {
@@ -28,6 +45,8 @@ func (k KeyKind) String() string {
 		return "invalid"
 	case Key25519:
 		return "25519"
+	case KeyP256:
+		return "p256"
 	default:
 		return fmt.Sprintf("Key?<%d>", int(k))
 	}
@@ -44,7 +63,7 @@ type Key struct {
 
 	// Public encodes the public key of the key. For 25519 keys,
 	// this is simply the point on the curve representing the public
-	// key.
+	// key. For P256 keys, it's the point in uncompressed form.
 	Public []byte `cbor:"3,keyasint"`
 
 	// Meta describes arbitrary metadata about the key. This could be
@@ -80,33 +99,160 @@ func (k Key) ID() tkatype.KeyID {
 	// public as their 'key ID'.
 	case Key25519:
 		return tkatype.KeyID(k.Public)
+	// P256 public keys are longer, so they're hashed to the same
+	// length as other key IDs.
+	case KeyP256:
+		h := blake2s.Sum256(k.Public)
+		return tkatype.KeyID(h[:])
 	default:
 		panic("unsupported key kind")
 	}
 }
 
+// MetaLimits bounds the metadata stored against a key. Zero fields mean
+// no limit.
+type MetaLimits struct {
+	MaxEntries  int // most key-value pairs
+	MaxKeyLen   int // longest key, in bytes
+	MaxValueLen int // longest value, in bytes
+	MaxBytes    int // most bytes in keys and values combined
+}
+
+// DefaultMetaLimits returns the limits UpdateBuilder checks key metadata
+// against before signing an update, unless others are set with
+// UpdateBuilder.SetMetaLimits.
+//
+// These limits aren't checked when verifying updates, as updates signed
+// before they existed must stay valid. Nodes only enforce that a key's
+// metadata is at most 512 bytes in total.
+func DefaultMetaLimits() MetaLimits {
+	return MetaLimits{
+		MaxEntries:  16,
+		MaxKeyLen:   64,
+		MaxValueLen: 256,
+		MaxBytes:    512,
+	}
+}
+
+// Validate returns an error if meta exceeds l, or has a malformed key
+// or value. Keys must be made of ASCII letters, digits, '.', '_' and
+// '-', and values must be printable UTF-8.
+func (l MetaLimits) Validate(meta map[string]string) error {
+	if l.MaxEntries > 0 && len(meta) > l.MaxEntries {
+		return fmt.Errorf("too many metadata values (%d > %d)", len(meta), l.MaxEntries)
+	}
+	var n int
+	for k, v := range meta {
+		if k == "" {
+			return errors.New("empty metadata key")
+		}
+		if l.MaxKeyLen > 0 && len(k) > l.MaxKeyLen {
+			return fmt.Errorf("metadata key too long (%d > %d)", len(k), l.MaxKeyLen)
+		}
+		for _, r := range k {
+			if !validMetaKeyRune(r) {
+				return fmt.Errorf("metadata key %q has invalid character %q", k, r)
+			}
+		}
+		if l.MaxValueLen > 0 && len(v) > l.MaxValueLen {
+			return fmt.Errorf("metadata value %q too long (%d > %d)", k, len(v), l.MaxValueLen)
+		}
+		if !utf8.ValidString(v) {
+			return fmt.Errorf("metadata value %q is not valid UTF-8", k)
+		}
+		for _, r := range v {
+			if !unicode.IsPrint(r) {
+				return fmt.Errorf("metadata value %q has unprintable character %q", k, r)
+			}
+		}
+		n += len(k) + len(v)
+	}
+	if l.MaxBytes > 0 && n > l.MaxBytes {
+		return fmt.Errorf("key metadata too big (%d > %d)", n, l.MaxBytes)
+	}
+	return nil
+}
+
+func validMetaKeyRune(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '_' || r == '-'
+}
+
+// MetaExpiry is the Meta key holding when a key expires, as an RFC 3339
+// timestamp. An expired key can't sign new updates, and node-key
+// signatures it made are no longer valid. Keys without it never expire.
+//
+// Expiry is judged by the local clock, so it's only applied to things
+// being signed or checked now. Updates an expired key signed before it
+// expired remain valid, and keep their weight in fork resolution, so
+// that every node replaying the chain reaches the same state.
+const MetaExpiry = "expiry"
+
+// Expiry returns when k expires, if it does.
+func (k Key) Expiry() (_ time.Time, ok bool) {
+	v, ok := k.Meta[MetaExpiry]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		// Rejected by StaticValidate, but if it slips through,
+		// treat the key as expired rather than valid forever.
+		return time.Time{}, true
+	}
+	return t, true
+}
+
+// expired reports whether k has expired at now.
+func (k Key) expired(now time.Time) bool {
+	exp, ok := k.Expiry()
+	return ok && !now.Before(exp)
+}
+
+// maxMetaBytes is the most bytes of metadata, in keys and values
+// combined, that a key may have.
+//
+// We have an arbitrary upper limit on the amount of metadata that can be
+// associated with a key, so people don't start using it as a key-value
+// store and causing pathological cases due to the number + size of AUMs.
 const maxMetaBytes = 512
 
+// metaBytes returns the size of meta, in keys and values combined.
+func metaBytes(meta map[string]string) int {
+	var n int
+	for k, v := range meta {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// validateMeta returns an error if meta has a malformed well-known value.
+func validateMeta(meta map[string]string) error {
+	if v, ok := meta[MetaExpiry]; ok {
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return fmt.Errorf("invalid key expiry %q: %v", v, err)
+		}
+	}
+	return nil
+}
+
 func (k Key) StaticValidate() error {
 	if k.Votes > 4096 {
 		return fmt.Errorf("excessive key weight: %d > 4096", k.Votes)
 	}
 
-	// We have an arbitrary upper limit on the amount
-	// of metadata that can be associated with a key, so
-	// people don't start using it as a key-value store and
-	// causing pathological cases due to the number + size of
-	// AUMs.
-	var metaBytes uint
-	for k, v := range k.Meta {
-		metaBytes += uint(len(k) + len(v))
+	if n := metaBytes(k.Meta); n > maxMetaBytes {
+		return fmt.Errorf("key metadata too big (%d > %d)", n, maxMetaBytes)
 	}
-	if metaBytes > maxMetaBytes {
-		return fmt.Errorf("key metadata too big (%d > %d)", metaBytes, maxMetaBytes)
+	if err := validateMeta(k.Meta); err != nil {
+		return err
 	}
 
 	switch k.Kind {
 	case Key25519:
+	case KeyP256:
+		if x, _ := elliptic.Unmarshal(elliptic.P256(), k.Public); x == nil {
+			return errors.New("invalid P256 public key")
+		}
 	default:
 		return fmt.Errorf("unrecognized key kind: %v", k.Kind)
 	}
@@ -125,8 +271,31 @@ func signatureVerify(s *tkatype.Signature, aumDigest tkatype.AUMSigHash, key Key
 			return nil
 		}
 		return errors.New("invalid signature")
+	case KeyP256:
+		if verifyP256(key.Public, aumDigest[:], s.Signature) {
+			return nil
+		}
+		return errors.New("invalid signature")
 
 	default:
 		return fmt.Errorf("unhandled key type: %v", key.Kind)
 	}
 }
+
+// p256HalfOrder is half the order of the P-256 curve, the largest s a
+// P256 key's signature may have.
+var p256HalfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+// verifyP256 reports whether sig is a valid signature over digest by the
+// P256 public key pub, in the form described at KeyP256.
+func verifyP256(pub, digest, sig []byte) bool {
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil || len(sig) != 64 {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(p256HalfOrder) > 0 {
+		return false
+	}
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest, r, s)
+}
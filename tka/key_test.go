@@ -9,6 +9,7 @@
 	"crypto/ed25519"
 	"encoding/binary"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"tailscale.com/types/tkatype"
@@ -64,3 +65,43 @@ func TestVerify25519(t *testing.T) {
 		t.Error("signature verification with different key did not fail")
 	}
 }
+
+func TestMetaLimitsValidate(t *testing.T) {
+	tcs := []struct {
+		name    string
+		limits  MetaLimits
+		meta    map[string]string
+		wantErr bool
+	}{
+		{"ok", DefaultMetaLimits(), map[string]string{"owner": "ops team", "expiry": "2030-01-01T00:00:00Z"}, false},
+		{"nil", DefaultMetaLimits(), nil, false},
+		{"too many", MetaLimits{MaxEntries: 1}, map[string]string{"a": "1", "b": "2"}, true},
+		{"long key", DefaultMetaLimits(), map[string]string{strings.Repeat("k", 65): "v"}, true},
+		{"long value", DefaultMetaLimits(), map[string]string{"k": strings.Repeat("v", 257)}, true},
+		{"too big", DefaultMetaLimits(), map[string]string{"a": strings.Repeat("v", 256), "b": strings.Repeat("v", 256)}, true},
+		{"empty key", DefaultMetaLimits(), map[string]string{"": "v"}, true},
+		{"bad key char", DefaultMetaLimits(), map[string]string{"a b": "v"}, true},
+		{"bad value char", DefaultMetaLimits(), map[string]string{"k": "a\nb"}, true},
+		{"bad utf8", DefaultMetaLimits(), map[string]string{"k": "\xff"}, true},
+		{"no limits", MetaLimits{}, map[string]string{"k": strings.Repeat("v", 1000)}, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.Validate(tc.meta)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	// Key.StaticValidate only enforces the total size, so keys made
+	// before the limits existed stay valid.
+	key := Key{Kind: Key25519, Public: make([]byte, 32), Votes: 1, Meta: map[string]string{"k": strings.Repeat("v", 257), "a b": "\n"}}
+	if err := key.StaticValidate(); err != nil {
+		t.Errorf("StaticValidate() of a key with legacy metadata failed: %v", err)
+	}
+	key.Meta = map[string]string{"a": strings.Repeat("v", 256), "b": strings.Repeat("v", 256)}
+	if err := key.StaticValidate(); err == nil {
+		t.Error("StaticValidate() of a key with oversized metadata succeeded")
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"tailscale.com/types/tkatype"
+)
+
+// StateDiff describes the changes between two States.
+type StateDiff struct {
+	AddedKeys   []Key
+	RemovedKeys []Key // including revoked ones
+	ChangedKeys []KeyChange
+	Revocations []Revocation
+
+	// OldSignatureThreshold and NewSignatureThreshold are the signature
+	// thresholds before and after, if it changed.
+	OldSignatureThreshold, NewSignatureThreshold uint
+
+	// AddedDisablementSecrets and RemovedDisablementSecrets count the
+	// disablement secrets added and removed.
+	AddedDisablementSecrets, RemovedDisablementSecrets int
+}
+
+// KeyChange describes the changes to a key that's in both States.
+type KeyChange struct {
+	KeyID tkatype.KeyID
+
+	// OldVotes and NewVotes are the key's votes before and after, which
+	// are equal if they didn't change.
+	OldVotes, NewVotes uint
+
+	// MetaSet are the metadata values added or changed, and
+	// MetaDeleted the keys of those removed.
+	MetaSet     map[string]string
+	MetaDeleted []string
+}
+
+// Empty reports whether d describes no changes.
+func (d StateDiff) Empty() bool {
+	return len(d.AddedKeys) == 0 && len(d.RemovedKeys) == 0 && len(d.ChangedKeys) == 0 &&
+		len(d.Revocations) == 0 && d.OldSignatureThreshold == d.NewSignatureThreshold &&
+		d.AddedDisablementSecrets == 0 && d.RemovedDisablementSecrets == 0
+}
+
+// String describes the changes for humans, one per line, such as to
+// confirm them before signing.
+func (d StateDiff) String() string {
+	var sb strings.Builder
+	for _, k := range d.AddedKeys {
+		fmt.Fprintf(&sb, "add key %x with %d votes\n", k.ID(), k.Votes)
+	}
+	for _, k := range d.RemovedKeys {
+		verb := "remove"
+		for _, r := range d.Revocations {
+			if bytes.Equal(r.KeyID, k.ID()) {
+				verb = fmt.Sprintf("revoke (%v)", r.Reason)
+			}
+		}
+		fmt.Fprintf(&sb, "%s key %x holding %d votes\n", verb, k.ID(), k.Votes)
+	}
+	for _, c := range d.ChangedKeys {
+		if c.OldVotes != c.NewVotes {
+			fmt.Fprintf(&sb, "change votes of key %x from %d to %d\n", c.KeyID, c.OldVotes, c.NewVotes)
+		}
+		for _, k := range sortedKeys(c.MetaSet) {
+			fmt.Fprintf(&sb, "set metadata %q of key %x to %q\n", k, c.KeyID, c.MetaSet[k])
+		}
+		for _, k := range c.MetaDeleted {
+			fmt.Fprintf(&sb, "delete metadata %q of key %x\n", k, c.KeyID)
+		}
+	}
+	if d.OldSignatureThreshold != d.NewSignatureThreshold {
+		fmt.Fprintf(&sb, "change signature threshold from %d to %d\n", d.OldSignatureThreshold, d.NewSignatureThreshold)
+	}
+	if d.AddedDisablementSecrets > 0 {
+		fmt.Fprintf(&sb, "add %d disablement secrets\n", d.AddedDisablementSecrets)
+	}
+	if d.RemovedDisablementSecrets > 0 {
+		fmt.Fprintf(&sb, "remove %d disablement secrets\n", d.RemovedDisablementSecrets)
+	}
+	return sb.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// diffStates returns the changes from old to new.
+func diffStates(old, new State) StateDiff {
+	d := StateDiff{
+		OldSignatureThreshold: old.signatureThreshold(),
+		NewSignatureThreshold: new.signatureThreshold(),
+	}
+	for _, k := range new.Keys {
+		before, err := old.GetKey(k.ID())
+		if err != nil {
+			d.AddedKeys = append(d.AddedKeys, k.Clone())
+			continue
+		}
+		c := KeyChange{KeyID: k.ID(), OldVotes: before.Votes, NewVotes: k.Votes}
+		for mk, v := range k.Meta {
+			if bv, ok := before.Meta[mk]; !ok || bv != v {
+				if c.MetaSet == nil {
+					c.MetaSet = map[string]string{}
+				}
+				c.MetaSet[mk] = v
+			}
+		}
+		for mk := range before.Meta {
+			if _, ok := k.Meta[mk]; !ok {
+				c.MetaDeleted = append(c.MetaDeleted, mk)
+			}
+		}
+		sort.Strings(c.MetaDeleted)
+		if c.OldVotes != c.NewVotes || len(c.MetaSet) > 0 || len(c.MetaDeleted) > 0 {
+			d.ChangedKeys = append(d.ChangedKeys, c)
+		}
+	}
+	for _, k := range old.Keys {
+		if _, err := new.GetKey(k.ID()); err != nil {
+			d.RemovedKeys = append(d.RemovedKeys, k.Clone())
+		}
+	}
+	for _, r := range new.Revocations {
+		if _, ok := old.revocation(r.KeyID); !ok {
+			d.Revocations = append(d.Revocations, r.Clone())
+		}
+	}
+	d.AddedDisablementSecrets = countMissing(new.DisablementSecrets, old.DisablementSecrets)
+	d.RemovedDisablementSecrets = countMissing(old.DisablementSecrets, new.DisablementSecrets)
+	return d
+}
+
+// countMissing returns how many of a aren't in b.
+func countMissing(a, b [][]byte) int {
+	n := 0
+outer:
+	for _, x := range a {
+		for _, y := range b {
+			if bytes.Equal(x, y) {
+				continue outer
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// Preview returns the changes the updates built so far would make to
+// the authority's current state, without finalizing them.
+func (b *UpdateBuilder) Preview() StateDiff {
+	return diffStates(b.a.state, b.state)
+}
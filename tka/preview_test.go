@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuthorityBuilderPreview(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2, Meta: map[string]string{"a": "1", "b": "2"}}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 2}
+	pub3, _ := testingKey25519(t, 3)
+	key3 := Key{Kind: Key25519, Public: pub3, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if d := b.Preview(); !d.Empty() {
+		t.Errorf("Preview() of no updates = %+v, want empty", d)
+	}
+	if err := b.AddKey(key3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key.ID(), 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyMeta(key.ID(), map[string]string{"a": "1", "b": "3", "c": "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteKeyMetaValue(key.ID(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RevokeKey(key2.ID(), RevocationLost); err != nil {
+		t.Fatal(err)
+	}
+
+	d := b.Preview()
+	if len(d.AddedKeys) != 1 || !bytes.Equal(d.AddedKeys[0].ID(), key3.ID()) {
+		t.Errorf("AddedKeys = %v, want key3", d.AddedKeys)
+	}
+	if len(d.RemovedKeys) != 1 || !bytes.Equal(d.RemovedKeys[0].ID(), key2.ID()) {
+		t.Errorf("RemovedKeys = %v, want key2", d.RemovedKeys)
+	}
+	if len(d.Revocations) != 1 || d.Revocations[0].Reason != RevocationLost {
+		t.Errorf("Revocations = %v", d.Revocations)
+	}
+	wantChange := []KeyChange{{
+		KeyID:       key.ID(),
+		OldVotes:    2,
+		NewVotes:    4,
+		MetaSet:     map[string]string{"b": "3", "c": "4"},
+		MetaDeleted: []string{"a"},
+	}}
+	if diff := cmp.Diff(wantChange, d.ChangedKeys); diff != "" {
+		t.Errorf("ChangedKeys differ (-want, +got):\n%s", diff)
+	}
+	if want := fmt.Sprintf("revoke (lost) key %x holding 2 votes\n", key2.ID()); !strings.Contains(d.String(), want) {
+		t.Errorf("String() = %q, want it to contain %q", d.String(), want)
+	}
+
+	// Previewing doesn't finalize.
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if len(updates) != 5 {
+		t.Errorf("got %d updates, want 5", len(updates))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+// maxInformUpdates is the most updates a single Inform call may carry,
+// bounding the work a peer can cause with one call.
+const maxInformUpdates = 2000
+
+// rejectedCacheSize is how many recently rejected updates an Authority
+// remembers, so that a peer sending the same malformed or badly signed
+// updates again doesn't cause them to be verified again.
+const rejectedCacheSize = 256
+
+// InformStats counts what became of the updates passed to Inform.
+type InformStats struct {
+	// Applied is how many updates were verified and committed.
+	Applied uint64
+	// Duplicate is how many updates were skipped as already known.
+	Duplicate uint64
+	// Rejected is how many updates failed verification or couldn't be
+	// applied.
+	Rejected uint64
+	// Replayed is how many updates were rejected without being verified
+	// again, as they'd been rejected recently.
+	Replayed uint64
+	// Oversized is how many Inform calls were rejected for carrying
+	// more than 2000 updates.
+	Oversized uint64
+}
+
+// InformStats returns counts of what became of the updates passed to
+// Inform since the Authority was opened.
+func (a *Authority) InformStats() InformStats {
+	return a.informStats
+}
+
+// rejectedCache remembers why recently rejected updates were rejected,
+// evicting the oldest once full. The zero value is ready to use.
+type rejectedCache struct {
+	errs  map[AUMHash]string
+	order []AUMHash // oldest first
+}
+
+// get returns why the update hash was rejected, if it was recently.
+func (c *rejectedCache) get(hash AUMHash) (reason string, ok bool) {
+	reason, ok = c.errs[hash]
+	return reason, ok
+}
+
+// add records that the update hash was rejected because of err.
+func (c *rejectedCache) add(hash AUMHash, err error) {
+	if c.errs == nil {
+		c.errs = make(map[AUMHash]string, rejectedCacheSize)
+	}
+	if _, ok := c.errs[hash]; ok {
+		return
+	}
+	if len(c.order) == rejectedCacheSize {
+		delete(c.errs, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.errs[hash] = err.Error()
+	c.order = append(c.order, hash)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"tailscale.com/types/tkatype"
+)
+
+// RevocationReason describes why a key was revoked.
+type RevocationReason uint8
+
+// Valid RevocationReason values. Do NOT reorder.
+const (
+	RevocationInvalid RevocationReason = iota
+	// The key's private half was, or may have been, exposed.
+	RevocationCompromised
+	// The key is no longer needed, such as after being rotated.
+	RevocationRetired
+	// The key's private half was lost, so it can't sign anymore.
+	RevocationLost
+)
+
+func (r RevocationReason) String() string {
+	switch r {
+	case RevocationInvalid:
+		return "invalid"
+	case RevocationCompromised:
+		return "compromised"
+	case RevocationRetired:
+		return "retired"
+	case RevocationLost:
+		return "lost"
+	default:
+		return fmt.Sprintf("Reason?<%d>", int(r))
+	}
+}
+
+// Revocation describes a key that was revoked. Revoked keys are no
+// longer trusted, and can't be added back.
+//
+// A revocation has no time: AUMs aren't timestamped, so there'd be no
+// way to tell which updates a key signed after it, and a compromised key
+// could backdate them anyway. Instead, updates the key signed on a
+// branch forked from before its revocation remain valid on that branch,
+// and fork resolution prefers the branch that revokes it (see
+// sortForkCandidates).
+type Revocation struct {
+	KeyID  tkatype.KeyID    `cbor:"1,keyasint"`
+	Reason RevocationReason `cbor:"2,keyasint"`
+}
+
+// Clone makes an independent copy of Revocation.
+func (r Revocation) Clone() Revocation {
+	out := r
+	if r.KeyID != nil {
+		out.KeyID = append(tkatype.KeyID(nil), r.KeyID...)
+	}
+	return out
+}
+
+func (r *Revocation) staticValidate() error {
+	if len(r.KeyID) == 0 {
+		return errors.New("missing key ID")
+	}
+	switch r.Reason {
+	case RevocationCompromised, RevocationRetired, RevocationLost:
+	default:
+		return fmt.Errorf("unrecognized reason: %v", r.Reason)
+	}
+	return nil
+}
+
+// revocation returns the revocation of keyID, if it was revoked.
+func (s State) revocation(keyID tkatype.KeyID) (Revocation, bool) {
+	for _, r := range s.Revocations {
+		if bytes.Equal(r.KeyID, keyID) {
+			return r, true
+		}
+	}
+	return Revocation{}, false
+}
+
+// WasKeyRevoked returns true if keyID was revoked.
+func (a *Authority) WasKeyRevoked(keyID tkatype.KeyID) bool {
+	_, ok := a.state.revocation(keyID)
+	return ok
+}
+
+// RevocationInfo returns the details of keyID's revocation, if it was
+// revoked.
+func (a *Authority) RevocationInfo(keyID tkatype.KeyID) (_ Revocation, ok bool) {
+	r, ok := a.state.revocation(keyID)
+	return r.Clone(), ok
+}
+
+// checkNotRevoked returns an error if update is signed by a key revoked
+// in state, the state of update's parent. Revocation removes a key, so
+// aumVerify would reject such an update anyway, but this says why.
+func checkNotRevoked(update AUM, state State) error {
+	for i, sig := range update.Signatures {
+		if r, ok := state.revocation(sig.KeyID); ok {
+			return fmt.Errorf("signature %d: key %x was revoked (%v)", i, sig.KeyID, r.Reason)
+		}
+	}
+	return nil
+}
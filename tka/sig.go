@@ -24,6 +24,10 @@
 	// SigDirect describes a signature over a specific node key, using
 	// the keyID specified.
 	SigDirect
+	// SigDelegated describes a signature over a specific node key, using
+	// a key that a trusted key delegated node-key signing to. The
+	// Delegation is included, and KeyID identifies the delegated key.
+	SigDelegated
 )
 
 func (s SigKind) String() string {
@@ -32,6 +36,8 @@ func (s SigKind) String() string {
 		return "invalid"
 	case SigDirect:
 		return "direct"
+	case SigDelegated:
+		return "delegated"
 	default:
 		return fmt.Sprintf("Sig?<%d>", int(s))
 	}
@@ -47,12 +53,17 @@ type NodeKeySignature struct {
 
 	// KeyID identifies which key in the tailnet key authority should
 	// be used to verify this signature. Only set for SigDirect and
-	// SigCredential signature kinds.
+	// SigCredential signature kinds. For SigDelegated signatures, it
+	// identifies the delegated key.
 	KeyID []byte `cbor:"3,keyasint,omitempty"`
 
-	// Signature is the packed (R, S) ed25519 signature over the rest
-	// of the structure.
+	// Signature is the packed (R, S) signature over the rest of the
+	// structure, by a key of a kind described at KeyKind.
 	Signature []byte `cbor:"4,keyasint,omitempty"`
+
+	// Delegation is the serialized Delegation authorizing the key that
+	// made the signature. Only set for SigDelegated signatures.
+	Delegation []byte `cbor:"5,keyasint,omitempty"`
 }
 
 // sigHash returns the cryptographic digest which a signature
@@ -107,6 +118,11 @@ func (s *NodeKeySignature) verifySignature(verificationKey Key) error {
 			return nil
 		}
 		return errors.New("invalid signature")
+	case KeyP256:
+		if verifyP256(verificationKey.Public, sigHash[:], s.Signature) {
+			return nil
+		}
+		return errors.New("invalid signature")
 
 	default:
 		return fmt.Errorf("unhandled key type: %v", verificationKey.Kind)
@@ -7,6 +7,7 @@
 import (
 	"crypto/ed25519"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -55,3 +56,55 @@ func TestSigSerializeUnserialize(t *testing.T) {
 		t.Errorf("unmarshalled version differs (-want, +got):\n%s", diff)
 	}
 }
+
+func TestAuthoritySignNodeKey(t *testing.T) {
+	nodeKeyPub := []byte{1, 2, 3, 4}
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	sig, err := a.SignNodeKey(nodeKeyPub, signer25519(priv2))
+	if err != nil {
+		t.Fatalf("SignNodeKey() failed: %v", err)
+	}
+	if err := a.VerifySignature(sig); err != nil {
+		t.Errorf("VerifySignature() failed: %v", err)
+	}
+	if exp, err := a.NodeKeySignatureExpiry(sig); err != nil || !exp.IsZero() {
+		t.Errorf("NodeKeySignatureExpiry() = %v, %v, want no expiry", exp, err)
+	}
+	if _, err := a.SignNodeKey(nodeKeyPub, signer25519(ed25519.NewKeyFromSeed(make([]byte, 32)))); err == nil {
+		t.Error("SignNodeKey() with an untrusted key succeeded")
+	}
+
+	// The signature expires with the key that made it.
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyExpiry(key2.ID(), expiry); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	if exp, err := a.NodeKeySignatureExpiry(sig); err != nil || !exp.Equal(expiry) {
+		t.Errorf("NodeKeySignatureExpiry() = %v, %v, want %v", exp, err, expiry)
+	}
+	timeNow = func() time.Time { return expiry }
+	defer func() { timeNow = time.Now }()
+	if err := a.VerifySignature(sig); err == nil {
+		t.Error("VerifySignature() of a signature by an expired key succeeded")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"tailscale.com/types/tkatype"
+)
+
+// CryptoSigner is a Signer that signs AUMs using a crypto.Signer with an
+// Ed25519 or ECDSA P-256 key, such as one backed by a PKCS#11 token, HSM
+// or cloud KMS, so that the private key never has to leave the device.
+type CryptoSigner struct {
+	signer crypto.Signer
+	key    Key // with zero votes
+}
+
+// NewCryptoSigner returns a CryptoSigner that signs using s, whose public
+// key must be an Ed25519 or ECDSA P-256 key.
+func NewCryptoSigner(s crypto.Signer) (*CryptoSigner, error) {
+	switch pub := s.Public().(type) {
+	case ed25519.PublicKey:
+		return &CryptoSigner{signer: s, key: Key{Kind: Key25519, Public: append([]byte(nil), pub...)}}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported ECDSA curve %v; must be P-256", pub.Curve.Params().Name)
+		}
+		return &CryptoSigner{signer: s, key: Key{Kind: KeyP256, Public: elliptic.Marshal(pub.Curve, pub.X, pub.Y)}}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T; must be ed25519 or ECDSA P-256", s.Public())
+}
+
+// Key returns the key that s signs with, as it would be trusted by an
+// authority with the given number of votes.
+func (s *CryptoSigner) Key(votes uint) Key {
+	k := s.key.Clone()
+	k.Votes = votes
+	return k
+}
+
+// SignAUM implements Signer.
+func (s *CryptoSigner) SignAUM(sigHash tkatype.AUMSigHash) ([]tkatype.Signature, error) {
+	var sig []byte
+	switch s.key.Kind {
+	case Key25519:
+		// Ed25519 signs the message itself, which crypto.Hash(0) signals.
+		var err error
+		if sig, err = s.signer.Sign(rand.Reader, sigHash[:], crypto.Hash(0)); err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
+		}
+	case KeyP256:
+		// The SigHash is the digest, which is the size of a SHA-256
+		// one, as devices that only sign digests expect.
+		der, err := s.signer.Sign(rand.Reader, sigHash[:], crypto.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
+		}
+		if sig, err = packP256Signature(der); err != nil {
+			return nil, err
+		}
+	}
+	// Check the device's work, as a bad signature is otherwise only
+	// noticed once other nodes reject the AUM.
+	if err := signatureVerify(&tkatype.Signature{Signature: sig}, sigHash, s.key); err != nil {
+		return nil, fmt.Errorf("signer %T produced an invalid signature", s.signer)
+	}
+	return []tkatype.Signature{{
+		KeyID:     s.key.ID(),
+		Signature: sig,
+	}}, nil
+}
+
+// packP256Signature converts an ASN.1 DER ECDSA P-256 signature to the
+// form described at KeyP256.
+func packP256Signature(der []byte) ([]byte, error) {
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(der, &rs); err != nil || len(rest) != 0 {
+		return nil, errors.New("malformed ECDSA signature")
+	}
+	if rs.S.Cmp(p256HalfOrder) > 0 {
+		// Both s and N-s are valid; use the lower.
+		rs.S.Sub(elliptic.P256().Params().N, rs.S)
+	}
+	if rs.R.BitLen() > 256 || rs.S.BitLen() > 256 {
+		return nil, errors.New("malformed ECDSA signature")
+	}
+	sig := make([]byte, 64)
+	rs.R.FillBytes(sig[:32])
+	rs.S.FillBytes(sig[32:])
+	return sig, nil
+}
+
+// RemoteSigner is an AUMSigner that has another node, which holds the
+// signing key, sign AUMs. This keeps signing keys off the machines that
+// build updates.
+type RemoteSigner struct {
+	// Sign sends a serialized AUM to the signing node, which
+	// validates it before signing, and returns its signatures. See
+	// the LocalAPI's tka-sign endpoint.
+	Sign func(serializedAUM []byte) ([]tkatype.Signature, error)
+}
+
+// SignAUM implements Signer. It always fails, as the remote node needs
+// the whole AUM; SignFullAUM is used instead.
+func (s RemoteSigner) SignAUM(tkatype.AUMSigHash) ([]tkatype.Signature, error) {
+	return nil, errors.New("remote signing requires the full AUM")
+}
+
+// SignFullAUM implements AUMSigner.
+func (s RemoteSigner) SignFullAUM(aum AUM) ([]tkatype.Signature, error) {
+	sigs, err := s.Sign(aum.Serialize())
+	if err != nil {
+		return nil, fmt.Errorf("remote signing: %w", err)
+	}
+	return sigs, nil
+}
+
+// signDigest has signer sign the digest digestFor returns, for
+// structures other than AUMs which include the ID of the key that
+// signed them. Signers don't say which key they sign with until they
+// sign, so signDigest signs twice: once to learn the key ID, and again
+// over the digest that includes it.
+//
+// The digests can't be mistaken for those of AUMs, as the structures
+// serialize differently.
+func signDigest(signer Signer, digestFor func(keyID tkatype.KeyID) tkatype.AUMSigHash) (tkatype.KeyID, []byte, error) {
+	sigs, err := signer.SignAUM(digestFor(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sigs) != 1 {
+		return nil, nil, fmt.Errorf("signer made %d signatures, want 1", len(sigs))
+	}
+	keyID := sigs[0].KeyID
+	sigs, err = signer.SignAUM(digestFor(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sigs) != 1 || !bytes.Equal(sigs[0].KeyID, keyID) {
+		return nil, nil, errors.New("signer changed keys between signatures")
+	}
+	return keyID, sigs[0].Signature, nil
+}
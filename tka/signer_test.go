@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"tailscale.com/types/tkatype"
+)
+
+func TestCryptoSigner(t *testing.T) {
+	_, priv := testingKey25519(t, 1)
+	s, err := NewCryptoSigner(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := s.Key(2)
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, s)
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(s)
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply updates signed by CryptoSigner: %v", err)
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCryptoSigner(ec); err == nil {
+		t.Error("NewCryptoSigner() with a P-384 key succeeded")
+	}
+}
+
+func TestCryptoSignerP256(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewCryptoSigner(ec)
+	if err != nil {
+		t.Fatalf("NewCryptoSigner() failed: %v", err)
+	}
+	p256Key := s.Key(1)
+	if err := p256Key.StaticValidate(); err != nil {
+		t.Fatalf("P256 key invalid: %v", err)
+	}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.AddKey(p256Key); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not add P256 key: %v", err)
+	}
+
+	// The P256 key signs an update.
+	b = a.NewUpdater(s)
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err = b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other s for the same r is also a valid ECDSA signature,
+	// but rejected so that signatures (and so AUM hashes) can't be
+	// altered without the key.
+	malleated := updates[0]
+	sig := append([]byte(nil), malleated.Signatures[0].Signature...)
+	sVal := new(big.Int).SetBytes(sig[32:])
+	new(big.Int).Sub(elliptic.P256().Params().N, sVal).FillBytes(sig[32:])
+	malleated.Signatures = []tkatype.Signature{{KeyID: malleated.Signatures[0].KeyID, Signature: sig}}
+	if err := a.Inform([]AUM{malleated}); err == nil {
+		t.Error("Inform() of a high-s P256 signature succeeded")
+	}
+
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply updates signed by P256 key: %v", err)
+	}
+
+	bad := Key{Kind: KeyP256, Public: []byte{4, 1, 2, 3}, Votes: 1}
+	if err := bad.StaticValidate(); err == nil {
+		t.Error("StaticValidate() of a malformed P256 key succeeded")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"time"
+
+	"tailscale.com/types/tkatype"
+)
+
+// Snapshot is an immutable view of an Authority's head and state at
+// the time Authority.Snapshot was called. Unlike an Authority, it's safe
+// for concurrent use, and doesn't change as updates are applied, so
+// readers such as those verifying node-key signatures can use it
+// without locking against Inform.
+type Snapshot struct {
+	head  AUMHash
+	state State
+}
+
+// Snapshot returns a Snapshot of the authority's current head and
+// state. The caller must ensure no updates are being applied to the
+// authority concurrently, but the Snapshot can then be used freely.
+func (a *Authority) Snapshot() *Snapshot {
+	return &Snapshot{
+		head:  a.Head(),
+		state: a.state.Clone(),
+	}
+}
+
+// Head returns the hash of the authority's head when the snapshot was
+// taken.
+func (s *Snapshot) Head() AUMHash {
+	return s.head
+}
+
+// Keys returns the keys trusted when the snapshot was taken.
+func (s *Snapshot) Keys() []Key {
+	out := make([]Key, len(s.state.Keys))
+	for i, k := range s.state.Keys {
+		out[i] = k.Clone()
+	}
+	return out
+}
+
+// KeyTrusted reports whether keyID was trusted when the snapshot was
+// taken.
+func (s *Snapshot) KeyTrusted(keyID tkatype.KeyID) bool {
+	_, err := s.state.GetKey(keyID)
+	return err == nil
+}
+
+// SignatureThreshold returns how many distinct trusted keys had to sign
+// each update when the snapshot was taken.
+func (s *Snapshot) SignatureThreshold() uint {
+	return s.state.signatureThreshold()
+}
+
+// WasKeyRevoked reports whether keyID had been revoked when the
+// snapshot was taken.
+func (s *Snapshot) WasKeyRevoked(keyID tkatype.KeyID) bool {
+	_, ok := s.state.revocation(keyID)
+	return ok
+}
+
+// VerifySignature is like Authority.VerifySignature, but verifies
+// against the keys trusted when the snapshot was taken.
+func (s *Snapshot) VerifySignature(nodeKeySignature tkatype.MarshaledSignature) error {
+	_, err := s.state.nodeKeySignatureExpiry(nodeKeySignature)
+	return err
+}
+
+// NodeKeySignatureExpiry is like Authority.NodeKeySignatureExpiry, but
+// verifies against the keys trusted when the snapshot was taken.
+func (s *Snapshot) NodeKeySignatureExpiry(nodeKeySignature tkatype.MarshaledSignature) (time.Time, error) {
+	return s.state.nodeKeySignatureExpiry(nodeKeySignature)
+}
+
+// SignNodeKey is like Authority.SignNodeKey, but requires signer's key
+// to have been trusted when the snapshot was taken. As the snapshot
+// doesn't change, it can be used to sign with a slow Signer, such as a
+// RemoteSigner, without locking against Inform.
+func (s *Snapshot) SignNodeKey(nodeKey []byte, signer Signer) (tkatype.MarshaledSignature, error) {
+	return s.state.signNodeKey(nodeKey, signer)
+}
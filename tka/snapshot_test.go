@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAuthoritySnapshot(t *testing.T) {
+	nodeKeyPub := []byte{1, 2, 3, 4}
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, priv2 := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	a, _, err := Create(&Mem{}, State{
+		Keys:               []Key{key, key2},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	sig, err := a.SignNodeKey(nodeKeyPub, signer25519(priv2))
+	if err != nil {
+		t.Fatalf("SignNodeKey() failed: %v", err)
+	}
+
+	snap := a.Snapshot()
+	if snap.Head() != a.Head() || !snap.KeyTrusted(key2.ID()) || len(snap.Keys()) != 2 {
+		t.Fatalf("snapshot doesn't match the authority")
+	}
+
+	// Readers use the snapshot while updates are applied.
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.RevokeKey(key2.ID(), RevocationRetired); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := snap.VerifySignature(sig); err != nil {
+					t.Errorf("Snapshot.VerifySignature() failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	wg.Wait()
+
+	// The snapshot is unchanged by the update; a new one reflects it.
+	if !snap.KeyTrusted(key2.ID()) || snap.WasKeyRevoked(key2.ID()) {
+		t.Error("snapshot changed after Inform()")
+	}
+	snap = a.Snapshot()
+	if snap.Head() != a.Head() || snap.KeyTrusted(key2.ID()) || !snap.WasKeyRevoked(key2.ID()) {
+		t.Error("new snapshot doesn't reflect the revocation")
+	}
+	if err := snap.VerifySignature(sig); err == nil {
+		t.Error("new snapshot verified a signature by a revoked key")
+	}
+	if _, err := snap.SignNodeKey(nodeKeyPub, signer25519(priv2)); err == nil {
+		t.Error("new snapshot signed with a revoked key")
+	}
+	if sig, err := snap.SignNodeKey(nodeKeyPub, signer25519(priv)); err != nil {
+		t.Errorf("Snapshot.SignNodeKey() failed: %v", err)
+	} else if err := a.VerifySignature(sig); err != nil {
+		t.Errorf("signature from Snapshot.SignNodeKey() invalid: %v", err)
+	}
+}
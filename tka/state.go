@@ -38,6 +38,23 @@ type State struct {
 
 	// Keys are the public keys currently trusted by the TKA.
 	Keys []Key `cbor:"3,keyasint"`
+
+	// SignatureThreshold is how many distinct trusted keys must sign
+	// each AUM for it to be valid. Zero means one, as does one.
+	SignatureThreshold uint `cbor:"4,keyasint,omitempty"`
+
+	// Revocations lists the keys that were revoked, which can't be
+	// trusted again.
+	Revocations []Revocation `cbor:"5,keyasint,omitempty"`
+}
+
+// signatureThreshold returns how many distinct trusted keys must sign
+// each AUM applied to s.
+func (s State) signatureThreshold() uint {
+	if s.SignatureThreshold < 1 {
+		return 1
+	}
+	return s.SignatureThreshold
 }
 
 // GetKey returns the trusted key with the specified KeyID.
@@ -79,6 +96,14 @@ func (s State) Clone() State {
 		}
 	}
 
+	if s.Revocations != nil {
+		out.Revocations = make([]Revocation, len(s.Revocations))
+		for i := range s.Revocations {
+			out.Revocations[i] = s.Revocations[i].Clone()
+		}
+	}
+
+	out.SignatureThreshold = s.SignatureThreshold
 	return out
 }
 
@@ -103,6 +128,12 @@ func disablementKDF(secret []byte) []byte {
 	return argon2.Key(secret, disablementSalt, 4, 16*1024, 4, disablementLength)
 }
 
+// DisablementValue returns the value kept in State.DisablementSecrets for
+// the disablement secret secret.
+func DisablementValue(secret []byte) []byte {
+	return disablementKDF(secret)
+}
+
 // checkDisablement returns true for a valid disablement secret.
 func (s State) checkDisablement(secret []byte) bool {
 	derived := disablementKDF(secret)
@@ -140,7 +171,7 @@ func (s State) applyVerifiedAUM(update AUM) (State, error) {
 	}
 
 	switch update.MessageKind {
-	case AUMNoOp:
+	case AUMNoOp, AUMAnnotate:
 		out := s.cloneForUpdate(&update)
 		return out, nil
 
@@ -154,6 +185,9 @@ func (s State) applyVerifiedAUM(update AUM) (State, error) {
 		if _, err := s.GetKey(update.Key.ID()); err == nil {
 			return State{}, errors.New("key already exists")
 		}
+		if _, revoked := s.revocation(update.Key.ID()); revoked {
+			return State{}, errors.New("key was revoked")
+		}
 		out := s.cloneForUpdate(&update)
 		out.Keys = append(out.Keys, *update.Key)
 		return out, nil
@@ -188,10 +222,38 @@ func (s State) applyVerifiedAUM(update AUM) (State, error) {
 		if idx < 0 {
 			return State{}, ErrNoSuchKey
 		}
+		if s.SignatureThreshold > 1 && uint(len(s.Keys)-1) < s.SignatureThreshold {
+			return State{}, fmt.Errorf("cannot remove key: %d keys would remain, fewer than the signature threshold of %d", len(s.Keys)-1, s.SignatureThreshold)
+		}
 		out := s.cloneForUpdate(&update)
 		out.Keys = append(out.Keys[:idx], out.Keys[idx+1:]...)
 		return out, nil
 
+	case AUMRevokeKey:
+		if update.Revocation == nil {
+			return State{}, errors.New("no revocation provided")
+		}
+		idx := -1
+		for i := range s.Keys {
+			if bytes.Equal(update.Revocation.KeyID, s.Keys[i].ID()) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return State{}, ErrNoSuchKey
+		}
+		if s.SignatureThreshold > 1 && uint(len(s.Keys)-1) < s.SignatureThreshold {
+			return State{}, fmt.Errorf("cannot revoke key: %d keys would remain, fewer than the signature threshold of %d", len(s.Keys)-1, s.SignatureThreshold)
+		}
+		if len(s.Revocations) >= maxRevocations {
+			return State{}, fmt.Errorf("too many revocations (max %d)", maxRevocations)
+		}
+		out := s.cloneForUpdate(&update)
+		out.Keys = append(out.Keys[:idx], out.Keys[idx+1:]...)
+		out.Revocations = append(out.Revocations, update.Revocation.Clone())
+		return out, nil
+
 	case AUMDisableNL:
 		// TODO(tom): We should handle this at a higher level than State.
 		if !s.checkDisablement(update.DisablementSecret) {
@@ -212,6 +274,7 @@ func (s State) applyVerifiedAUM(update AUM) (State, error) {
 const (
 	maxDisablementSecrets = 32
 	maxKeys               = 512
+	maxRevocations        = 512
 )
 
 // staticValidateCheckpoint validates that the state is well-formed for
@@ -246,10 +309,24 @@ func (s *State) staticValidateCheckpoint() error {
 	if numKeys := len(s.Keys); numKeys > maxKeys {
 		return fmt.Errorf("too many keys (%d, max %d)", numKeys, maxKeys)
 	}
+	if numRevocations := len(s.Revocations); numRevocations > maxRevocations {
+		return fmt.Errorf("too many revocations (%d, max %d)", numRevocations, maxRevocations)
+	}
+	for i := range s.Revocations {
+		if err := s.Revocations[i].staticValidate(); err != nil {
+			return fmt.Errorf("revocation[%d]: %v", i, err)
+		}
+	}
+	if s.SignatureThreshold > uint(len(s.Keys)) {
+		return fmt.Errorf("signature threshold (%d) exceeds the number of keys (%d)", s.SignatureThreshold, len(s.Keys))
+	}
 	for i, k := range s.Keys {
 		if err := k.StaticValidate(); err != nil {
 			return fmt.Errorf("key[%d]: %v", i, err)
 		}
+		if _, revoked := s.revocation(k.ID()); revoked {
+			return fmt.Errorf("key[%d]: was revoked", i)
+		}
 		for j, k2 := range s.Keys {
 			if i == j {
 				continue
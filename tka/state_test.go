@@ -44,6 +44,12 @@ func TestCloneState(t *testing.T) {
 				Keys: []Key{{Kind: Key25519, Votes: 2, Public: []byte{5, 6, 7, 8}, Meta: map[string]string{"a": "b"}}},
 			},
 		},
+		{
+			"Revocations",
+			State{
+				Revocations: []Revocation{{KeyID: []byte{1, 2, 3, 4}, Reason: RevocationLost}},
+			},
+		},
 		{
 			"DisablementSecrets",
 			State{
@@ -6,6 +6,7 @@
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,10 +56,22 @@ type Chonk interface {
 	LastActiveAncestor() (*AUMHash, error)
 }
 
+// CompactableChonk is a Chonk from which AUMs can be removed, so that
+// the chain of AUMs needn't be stored forever. See Authority.Compact.
+type CompactableChonk interface {
+	Chonk
+
+	// AllAUMs returns the hashes of all stored AUMs.
+	AllAUMs() ([]AUMHash, error)
+
+	// PurgeAUMs removes the specified AUMs from storage.
+	PurgeAUMs(hashes []AUMHash) error
+}
+
 // Mem implements in-memory storage of TKA state, suitable for
 // tests.
 //
-// Mem implements the Chonk interface.
+// Mem implements the CompactableChonk interface.
 type Mem struct {
 	l           sync.RWMutex
 	aums        map[AUMHash]AUM
@@ -164,9 +177,44 @@ func (c *Mem) CommitVerifiedAUMs(updates []AUM) error {
 	return nil
 }
 
+// AllAUMs returns the hashes of all stored AUMs.
+func (c *Mem) AllAUMs() ([]AUMHash, error) {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	out := make([]AUMHash, 0, len(c.aums))
+	for h := range c.aums {
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// PurgeAUMs removes the specified AUMs from storage.
+func (c *Mem) PurgeAUMs(hashes []AUMHash) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+	for _, h := range hashes {
+		aum, ok := c.aums[h]
+		if !ok {
+			continue
+		}
+		if parent, ok := aum.Parent(); ok {
+			siblings := c.parentIndex[parent][:0]
+			for _, s := range c.parentIndex[parent] {
+				if s != h {
+					siblings = append(siblings, s)
+				}
+			}
+			c.parentIndex[parent] = siblings
+		}
+		delete(c.aums, h)
+		delete(c.parentIndex, h)
+	}
+	return nil
+}
+
 // FS implements filesystem storage of TKA state.
 //
-// FS implements the Chonk interface.
+// FS implements the CompactableChonk interface.
 type FS struct {
 	base string
 	mu   sync.RWMutex
@@ -215,6 +263,9 @@ func (c *FS) AUM(hash AUMHash) (AUM, error) {
 
 	info, err := c.get(hash)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return AUM{}, os.ErrNotExist
+		}
 		return AUM{}, err
 	}
 	if info.AUM == nil {
@@ -325,6 +376,60 @@ func (c *FS) scanHashes(eachHashInfo func(*fsHashInfo)) error {
 	return nil
 }
 
+// AllAUMs returns the hashes of all stored AUMs.
+func (c *FS) AllAUMs() ([]AUMHash, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var out []AUMHash
+	err := c.scanHashes(func(info *fsHashInfo) {
+		if info.AUM != nil {
+			out = append(out, info.AUM.Hash())
+		}
+	})
+	return out, err
+}
+
+// PurgeAUMs removes the specified AUMs from storage.
+func (c *FS) PurgeAUMs(hashes []AUMHash) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, h := range hashes {
+		info, err := c.get(h)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("reading %x: %v", h, err)
+		}
+		// Forget h as a child of its parent, unless that's gone too.
+		if info.AUM != nil {
+			if parent, ok := info.AUM.Parent(); ok {
+				if _, err := c.get(parent); err == nil {
+					err := c.commit(parent, func(info *fsHashInfo) {
+						children := info.Children[:0]
+						for _, c := range info.Children {
+							if c != h {
+								children = append(children, c)
+							}
+						}
+						info.Children = children
+					})
+					if err != nil {
+						return fmt.Errorf("updating parent of %x: %v", h, err)
+					}
+				}
+			}
+		}
+		dir, base := c.aumDir(h)
+		if err := os.Remove(filepath.Join(dir, base)); err != nil {
+			return fmt.Errorf("removing %x: %v", h, err)
+		}
+	}
+	return nil
+}
+
 // SetLastActiveAncestor is called to record the oldest-known AUM
 // that contributed to the current state. This value is used as
 // a hint on next startup to determine which chain to pick when computing
@@ -436,3 +541,67 @@ func (c *FS) commit(h AUMHash, updater func(*fsHashInfo)) error {
 	}
 	return atomicfile.WriteFile(filepath.Join(dir, base), buff.Bytes(), 0644)
 }
+
+// Migrate copies all the AUMs and the last active ancestor stored in src
+// to dst, which must be empty, such as to move an authority to a
+// different kind of storage. Parents are committed before their
+// children.
+func Migrate(dst Chonk, src CompactableChonk) error {
+	heads, err := dst.Heads()
+	if err != nil {
+		return fmt.Errorf("reading heads: %v", err)
+	}
+	if len(heads) != 0 {
+		return errors.New("destination tailchonk is not empty")
+	}
+
+	hashes, err := src.AllAUMs()
+	if err != nil {
+		return fmt.Errorf("listing AUMs: %v", err)
+	}
+	aums := make(map[AUMHash]AUM, len(hashes))
+	for _, h := range hashes {
+		aum, err := src.AUM(h)
+		if err != nil {
+			return fmt.Errorf("reading %x: %v", h, err)
+		}
+		aums[h] = aum
+	}
+
+	// Order the AUMs breadth-first from the roots: those whose parent
+	// isn't stored, because it never existed or was compacted away.
+	var (
+		ordered  = make([]AUM, 0, len(aums))
+		children = make(map[AUMHash][]AUMHash, len(aums))
+	)
+	for h, aum := range aums {
+		parent, hasParent := aum.Parent()
+		if _, stored := aums[parent]; hasParent && stored {
+			children[parent] = append(children[parent], h)
+		} else {
+			ordered = append(ordered, aum)
+		}
+	}
+	for i := 0; i < len(ordered); i++ {
+		for _, h := range children[ordered[i].Hash()] {
+			ordered = append(ordered, aums[h])
+		}
+	}
+	if len(ordered) != len(aums) {
+		return fmt.Errorf("ordered %d of %d AUMs", len(ordered), len(aums))
+	}
+	if err := dst.CommitVerifiedAUMs(ordered); err != nil {
+		return fmt.Errorf("commit: %v", err)
+	}
+
+	ancestor, err := src.LastActiveAncestor()
+	if err != nil {
+		return fmt.Errorf("reading last ancestor: %v", err)
+	}
+	if ancestor != nil {
+		if err := dst.SetLastActiveAncestor(*ancestor); err != nil {
+			return fmt.Errorf("set ancestor: %v", err)
+		}
+	}
+	return nil
+}
@@ -25,6 +25,8 @@ func randHash(t *testing.T, seed int64) [blake2s.Size]byte {
 func TestImplementsChonk(t *testing.T) {
 	impls := []Chonk{&Mem{}, &FS{}}
 	t.Logf("chonks: %v", impls)
+	compactable := []CompactableChonk{&Mem{}, &FS{}}
+	t.Logf("compactable chonks: %v", compactable)
 }
 
 func TestTailchonk_ChildAUMs(t *testing.T) {
@@ -160,3 +162,53 @@ func TestTailchonkFS_Commit(t *testing.T) {
 		t.Errorf("stat of AUM parent failed: %v", err)
 	}
 }
+
+func TestMigrate(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+	src := &Mem{}
+	a, _, err := Create(src, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(signer25519(priv))
+	for i := uint(1); i <= 3; i++ {
+		if err := b.SetKeyVote(key.ID(), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	dst := &FS{base: t.TempDir()}
+	if err := Migrate(dst, src); err != nil {
+		t.Fatalf("Migrate() failed: %v", err)
+	}
+	migrated, err := Open(dst)
+	if err != nil {
+		t.Fatalf("Open() of migrated storage failed: %v", err)
+	}
+	if migrated.Head() != a.Head() {
+		t.Errorf("migrated head = %x, want %x", migrated.Head(), a.Head())
+	}
+	all, err := dst.AllAUMs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Errorf("migrated %d AUMs, want 4", len(all))
+	}
+
+	if err := Migrate(dst, src); err == nil {
+		t.Error("Migrate() into non-empty storage succeeded")
+	}
+}
@@ -7,15 +7,20 @@
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	"tailscale.com/types/tkatype"
 )
 
+// timeNow is time.Now, except in tests.
+var timeNow = time.Now
+
 // Strict settings for the CBOR decoder.
 var cborDecOpts = cbor.DecOptions{
 	DupMapKey:   cbor.DupMapKeyEnforcedAPF,
@@ -40,6 +45,9 @@ type Authority struct {
 	state          State
 
 	storage Chonk
+
+	informStats InformStats
+	rejected    rejectedCache // updates Inform recently rejected
 }
 
 // A chain describes a linear sequence of updates from Oldest to Head,
@@ -131,10 +139,18 @@ func pickNextAUM(state State, candidates []AUM) AUM {
 
 	// Oooof, we have some forks in the chain. We need to pick which
 	// one to use by applying the Fork Resolution Algorithm ✨
-	//
+	sortForkCandidates(state, candidates)
+	return candidates[0]
+}
+
+// sortForkCandidates sorts the children of a fork so that the one fork
+// resolution picks is first.
+func sortForkCandidates(state State, candidates []AUM) {
 	// The rules are this:
 	// 1. The child with the highest signature weight is chosen.
-	// 2. If equal, the child which is a RemoveKey AUM is chosen.
+	// 2. If equal, the child which is a RemoveKey or RevokeKey AUM is
+	//    chosen, so that a key can't avoid removal by signing a
+	//    competing update.
 	// 3. If equal, the child with the lowest AUM hash is chosen.
 	sort.Slice(candidates, func(j, i int) bool {
 		// Rule 1.
@@ -144,17 +160,14 @@ func pickNextAUM(state State, candidates []AUM) AUM {
 		}
 
 		// Rule 2.
-		if iKind, jKind := candidates[i].MessageKind, candidates[j].MessageKind; iKind != jKind &&
-			(iKind == AUMRemoveKey || jKind == AUMRemoveKey) {
-			return jKind == AUMRemoveKey
+		if iRemoves, jRemoves := candidates[i].removesKey(), candidates[j].removesKey(); iRemoves != jRemoves {
+			return jRemoves
 		}
 
 		// Rule 3.
 		iHash, jHash := candidates[i].Hash(), candidates[j].Hash()
 		return bytes.Compare(iHash[:], jHash[:]) > 0
 	})
-
-	return candidates[0]
 }
 
 // advanceByPrimary computes the next AUM to advance with based on
@@ -235,11 +248,10 @@ func fastForward(storage Chonk, maxIter int, startState State, done func(curAUM
 }
 
 // computeStateAt returns the State at wantHash.
+//
+// This is cheap so long as there are checkpoints every so often (see
+// checkpointEvery), as it only replays the updates since the last one.
 func computeStateAt(storage Chonk, maxIter int, wantHash AUMHash) (State, error) {
-	// TODO(tom): This is going to get expensive for really long
-	//            chains. We should make nodes emit a checkpoint every
-	//            X updates or something.
-
 	topAUM, err := storage.AUM(wantHash)
 	if err != nil {
 		return State{}, err
@@ -410,6 +422,11 @@ func computeActiveChain(storage Chonk, lastKnownOldest *AUMHash, maxIter int) (c
 
 // aumVerify verifies if an AUM is well-formed, correctly signed, and
 // can be accepted for storage.
+//
+// Key expiry isn't checked: whether an update is valid mustn't depend
+// on when it's verified, or nodes replaying the same chain could
+// disagree. Expired keys are instead kept from signing new updates (see
+// checkSignersNotExpired).
 func aumVerify(aum AUM, state State, isGenesisAUM bool) error {
 	if err := aum.StaticValidate(); err != nil {
 		return fmt.Errorf("invalid: %v", err)
@@ -430,7 +447,34 @@ func aumVerify(aum AUM, state State, isGenesisAUM bool) error {
 			return fmt.Errorf("bad keyID on signature %d: %v", i, err)
 		}
 		if err := signatureVerify(&sig, sigHash, key); err != nil {
-			return fmt.Errorf("signature %d: %v", i, err)
+			return badSignatureError{fmt.Errorf("signature %d: %v", i, err)}
+		}
+	}
+	if n, want := aum.numSigners(state), state.signatureThreshold(); n < want {
+		return fmt.Errorf("signed by %d distinct keys, need %d", n, want)
+	}
+	return nil
+}
+
+// badSignatureError is returned by aumVerify for a signature that
+// doesn't verify, which depends only on the AUM, so can't be fixed by
+// later updates.
+type badSignatureError struct {
+	error
+}
+
+// checkSignersNotExpired returns an error if any of sigs, to be added to
+// a new update based on state, is by a key that has expired at now.
+// Signatures by keys state doesn't trust are left for aumVerify to
+// reject.
+func checkSignersNotExpired(sigs []tkatype.Signature, state State, now time.Time) error {
+	for i, sig := range sigs {
+		key, err := state.GetKey(sig.KeyID)
+		if err != nil {
+			continue
+		}
+		if key.expired(now) {
+			return fmt.Errorf("signature %d: key %x has expired", i, sig.KeyID)
 		}
 	}
 	return nil
@@ -513,10 +557,9 @@ func Create(storage Chonk, state State, signer Signer) (*Authority, AUM, error)
 // Call this when setting up a new nodes' TKA, but other nodes
 // with initialized TKA's exist.
 //
-// Pass the returned genesis AUM from Create(), or a later checkpoint AUM.
-//
-// TODO(tom): We should test an authority bootstrapped from a later checkpoint
-// works fine with sync and everything.
+// Pass the returned genesis AUM from Create(), or a later checkpoint AUM
+// (such as from LatestCheckpoint), so that the new node needn't replay
+// all the updates before it.
 func Bootstrap(storage Chonk, bootstrap AUM) (*Authority, error) {
 	heads, err := storage.Heads()
 	if err != nil {
@@ -552,18 +595,90 @@ func Bootstrap(storage Chonk, bootstrap AUM) (*Authority, error) {
 // should be ordered oldest to newest. An error is returned if any
 // of the updates could not be processed.
 func (a *Authority) Inform(updates []AUM) error {
+	return a.InformWithProgress(context.Background(), updates, nil)
+}
+
+// informBatchSize is how many verified updates InformWithProgress
+// commits to storage at once.
+const informBatchSize = 200
+
+// InformWithProgress is like Inform, but stops early if ctx is done, and
+// calls progress (if non-nil) with how many of the updates have been
+// processed so far each time it commits a batch of them to storage.
+//
+// If it returns an error, the batches committed before it remain
+// committed, and the authority reflects them.
+func (a *Authority) InformWithProgress(ctx context.Context, updates []AUM, progress func(processed, total int)) (err error) {
+	if len(updates) > maxInformUpdates {
+		a.informStats.Oversized++
+		return fmt.Errorf("too many updates: %d > %d", len(updates), maxInformUpdates)
+	}
 	stateAt := make(map[AUMHash]State, len(updates)+1)
 	toCommit := make([]AUM, 0, len(updates))
 
+	var committed bool
+	defer func() {
+		if !committed {
+			return
+		}
+		// TODO(tom): Theres no need to recompute the state from scratch
+		//            in every case. We should detect when updates were
+		//            a linear, non-forking series applied to head, and
+		//            just use the last State we computed.
+		oldestAncestor := a.oldestAncestor.Hash()
+		c, cerr := computeActiveChain(a.storage, &oldestAncestor, 2000)
+		if cerr != nil {
+			if err == nil {
+				err = fmt.Errorf("recomputing active chain: %v", cerr)
+			}
+			return
+		}
+		a.head = c.Head
+		a.oldestAncestor = c.Oldest
+		a.state = c.state
+	}()
+	commit := func(processed int) error {
+		if err := a.storage.CommitVerifiedAUMs(toCommit); err != nil {
+			return fmt.Errorf("commit: %v", err)
+		}
+		committed = true
+		a.informStats.Applied += uint64(len(toCommit))
+		toCommit = toCommit[:0]
+		if progress != nil {
+			progress(processed, len(updates))
+		}
+		return nil
+	}
+
 	for i, update := range updates {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(toCommit) == informBatchSize {
+			if err := commit(i); err != nil {
+				return err
+			}
+		}
+
 		hash := update.Hash()
+		if _, ok := stateAt[hash]; ok {
+			// Repeated within this call.
+			a.informStats.Duplicate++
+			continue
+		}
 		if _, err := a.storage.AUM(hash); err == nil {
 			// Already have this AUM.
+			a.informStats.Duplicate++
 			continue
 		}
+		if reason, ok := a.rejected.get(hash); ok {
+			a.informStats.Replayed++
+			return fmt.Errorf("update %d was rejected recently: %v", i, reason)
+		}
 
 		parent, hasParent := update.Parent()
 		if !hasParent {
+			a.informStats.Rejected++
 			return fmt.Errorf("update %d: missing parent", i)
 		}
 
@@ -571,52 +686,343 @@ func (a *Authority) Inform(updates []AUM) error {
 		var err error
 		if !hasState {
 			if state, err = computeStateAt(a.storage, 2000, parent); err != nil {
+				// Not remembered as rejected: the parent may yet arrive.
+				a.informStats.Rejected++
 				return fmt.Errorf("update %d computing state: %v", i, err)
 			}
 			stateAt[parent] = state
 		}
 
+		// Only failures that depend on the update alone, a malformed
+		// update or a bad signature, are remembered. Others depend on
+		// the state the update is checked against, so they're checked
+		// afresh each time.
+		reject := func(err error, remember bool) error {
+			a.informStats.Rejected++
+			if remember {
+				a.rejected.add(hash, err)
+			}
+			return err
+		}
+		if err := update.StaticValidate(); err != nil {
+			return reject(fmt.Errorf("update %d invalid: %v", i, err), true)
+		}
+		if err := checkNotRevoked(update, state); err != nil {
+			return reject(fmt.Errorf("update %d invalid: %v", i, err), false)
+		}
 		if err := aumVerify(update, state, false); err != nil {
-			return fmt.Errorf("update %d invalid: %v", i, err)
+			return reject(fmt.Errorf("update %d invalid: %v", i, err), errors.As(err, new(badSignatureError)))
 		}
 		if stateAt[hash], err = state.applyVerifiedAUM(update); err != nil {
-			return fmt.Errorf("update %d cannot be applied: %v", i, err)
+			return reject(fmt.Errorf("update %d cannot be applied: %v", i, err), false)
 		}
 		toCommit = append(toCommit, update)
 	}
+	return commit(len(updates))
+}
 
-	if err := a.storage.CommitVerifiedAUMs(toCommit); err != nil {
-		return fmt.Errorf("commit: %v", err)
+// updatesSinceCheckpoint returns how many updates there are after the
+// last checkpoint (or genesis update) in the active chain, up to max.
+func (a *Authority) updatesSinceCheckpoint(max int) (int, error) {
+	cursor := a.Head()
+	for i := 0; i < max; i++ {
+		aum, err := a.storage.AUM(cursor)
+		if err != nil {
+			return 0, err
+		}
+		if aum.MessageKind == AUMCheckpoint {
+			return i, nil
+		}
+		parent, hasParent := aum.Parent()
+		if !hasParent {
+			return i, nil
+		}
+		cursor = parent
+	}
+	return max, nil
+}
+
+// LatestCheckpoint returns the most recent checkpoint AUM in the active
+// chain, which new nodes can Bootstrap from.
+func (a *Authority) LatestCheckpoint() (AUM, error) {
+	cursor := a.Head()
+	for i := 0; i < 2000; i++ {
+		aum, err := a.storage.AUM(cursor)
+		if err != nil {
+			return AUM{}, fmt.Errorf("reading %x: %v", cursor, err)
+		}
+		if aum.MessageKind == AUMCheckpoint {
+			return aum, nil
+		}
+		parent, hasParent := aum.Parent()
+		if !hasParent {
+			return AUM{}, errors.New("no checkpoint in active chain")
+		}
+		cursor = parent
+	}
+	return AUM{}, fmt.Errorf("iteration limit exceeded (%d)", 2000)
+}
+
+// Compact removes from storage the updates that precede the
+// keepCheckpoints'th most recent checkpoint in the active chain, along
+// with any forks of them, so that storage doesn't grow forever. That
+// checkpoint becomes the oldest ancestor. It does nothing if there
+// aren't that many checkpoints.
+//
+// The storage must implement CompactableChonk.
+func (a *Authority) Compact(keepCheckpoints int) error {
+	if keepCheckpoints < 1 {
+		return errors.New("must keep at least one checkpoint")
+	}
+	storage, ok := a.storage.(CompactableChonk)
+	if !ok {
+		return fmt.Errorf("storage %T does not support compaction", a.storage)
+	}
+
+	// Find the checkpoint to keep as the oldest ancestor.
+	var (
+		oldest AUM
+		seen   int
+		cursor = a.Head()
+	)
+	for i := 0; seen < keepCheckpoints; i++ {
+		if i >= 2000 {
+			return fmt.Errorf("iteration limit exceeded (%d)", 2000)
+		}
+		aum, err := storage.AUM(cursor)
+		if err != nil {
+			if err == os.ErrNotExist {
+				return nil // already compacted
+			}
+			return fmt.Errorf("reading %x: %v", cursor, err)
+		}
+		if aum.MessageKind == AUMCheckpoint {
+			oldest = aum
+			seen++
+		}
+		parent, hasParent := aum.Parent()
+		if !hasParent {
+			return nil // not enough checkpoints
+		}
+		cursor = parent
 	}
+	oldestHash := oldest.Hash()
 
-	// TODO(tom): Theres no need to recompute the state from scratch
-	//            in every case. We should detect when updates were
-	//            a linear, non-forking series applied to head, and
-	//            just use the last State we computed.
-	oldestAncestor := a.oldestAncestor.Hash()
-	c, err := computeActiveChain(a.storage, &oldestAncestor, 2000)
+	// Keep the oldest ancestor and all its descendants.
+	keep := map[AUMHash]bool{oldestHash: true}
+	queue := []AUMHash{oldestHash}
+	for len(queue) > 0 {
+		children, err := storage.ChildAUMs(queue[0])
+		if err != nil {
+			return fmt.Errorf("reading children of %x: %v", queue[0], err)
+		}
+		queue = queue[1:]
+		for _, c := range children {
+			if h := c.Hash(); !keep[h] {
+				keep[h] = true
+				queue = append(queue, h)
+			}
+		}
+	}
+	all, err := storage.AllAUMs()
 	if err != nil {
-		return fmt.Errorf("recomputing active chain: %v", err)
+		return fmt.Errorf("listing AUMs: %v", err)
 	}
-	a.head = c.Head
-	a.oldestAncestor = c.Oldest
-	a.state = c.state
+	var purge []AUMHash
+	for _, h := range all {
+		if !keep[h] {
+			purge = append(purge, h)
+		}
+	}
+	if len(purge) == 0 {
+		return nil
+	}
+
+	// Record the new ancestor before purging, so that if the purge is
+	// interrupted the leftovers can't be mistaken for the active chain.
+	if err := storage.SetLastActiveAncestor(oldestHash); err != nil {
+		return fmt.Errorf("set ancestor: %v", err)
+	}
+	if err := storage.PurgeAUMs(purge); err != nil {
+		return fmt.Errorf("purge: %v", err)
+	}
+	a.oldestAncestor = oldest
 	return nil
 }
 
 // VerifySignature returns true if the provided nodeKeySignature is signed
-// correctly by a trusted key.
+// correctly by a trusted key that hasn't expired, or by a key delegated
+// node-key signing by one.
 func (a *Authority) VerifySignature(nodeKeySignature tkatype.MarshaledSignature) error {
+	_, err := a.NodeKeySignatureExpiry(nodeKeySignature)
+	return err
+}
+
+// NodeKeySignatureExpiry returns when nodeKeySignature stops being
+// valid, which is when the key that made it (or the delegation that
+// authorized it) expires, or the zero time if it doesn't. It returns an
+// error if the signature is not valid now.
+func (a *Authority) NodeKeySignatureExpiry(nodeKeySignature tkatype.MarshaledSignature) (time.Time, error) {
+	return a.state.nodeKeySignatureExpiry(nodeKeySignature)
+}
+
+// nodeKeySignatureExpiry implements Authority.NodeKeySignatureExpiry
+// against s.
+func (s State) nodeKeySignatureExpiry(nodeKeySignature tkatype.MarshaledSignature) (time.Time, error) {
 	var decoded NodeKeySignature
 	if err := decoded.Unserialize(nodeKeySignature); err != nil {
-		return fmt.Errorf("unserialize: %v", err)
+		return time.Time{}, fmt.Errorf("unserialize: %v", err)
+	}
+
+	if decoded.SigKind == SigDelegated {
+		d, err := s.verifyDelegatedSignature(&decoded)
+		if err != nil {
+			return time.Time{}, err
+		}
+		issuer, err := s.GetKey(d.Issuer)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("issuer: %v", err)
+		}
+		exp, _ := issuer.Expiry()
+		if dexp := d.expiry(); !dexp.IsZero() && (exp.IsZero() || dexp.Before(exp)) {
+			exp = dexp
+		}
+		return exp, nil
 	}
-	key, err := a.state.GetKey(decoded.KeyID)
+
+	key, err := s.GetKey(decoded.KeyID)
 	if err != nil {
-		return fmt.Errorf("key: %v", err)
+		return time.Time{}, fmt.Errorf("key: %v", err)
+	}
+	if key.expired(timeNow()) {
+		return time.Time{}, fmt.Errorf("key %x has expired", decoded.KeyID)
 	}
+	if err := decoded.verifySignature(key); err != nil {
+		return time.Time{}, err
+	}
+	exp, _ := key.Expiry()
+	return exp, nil
+}
+
+// SignNodeKey returns a direct signature over nodeKey, made by signer
+// with a key the authority trusts.
+func (a *Authority) SignNodeKey(nodeKey []byte, signer Signer) (tkatype.MarshaledSignature, error) {
+	return a.state.signNodeKey(nodeKey, signer)
+}
+
+// signNodeKey implements Authority.SignNodeKey against s.
+func (s State) signNodeKey(nodeKey []byte, signer Signer) (tkatype.MarshaledSignature, error) {
+	if len(nodeKey) == 0 {
+		return nil, errors.New("missing node key")
+	}
+	sig := NodeKeySignature{
+		SigKind: SigDirect,
+		Pubkey:  nodeKey,
+	}
+	keyID, signature, err := signDigest(signer, func(keyID tkatype.KeyID) tkatype.AUMSigHash {
+		sig.KeyID = keyID
+		return tkatype.AUMSigHash(sig.sigHash())
+	})
+	if err != nil {
+		return nil, err
+	}
+	sig.KeyID, sig.Signature = keyID, signature
+
+	out := sig.Serialize()
+	if _, err := s.nodeKeySignatureExpiry(out); err != nil {
+		return nil, fmt.Errorf("new signature is not valid: %v", err)
+	}
+	return out, nil
+}
+
+// CheckUpdate returns an error if update, which needn't be signed yet,
+// is malformed or can't be applied to the current head. Nodes asked to
+// sign an update check it with this first.
+func (a *Authority) CheckUpdate(update AUM) error {
+	if err := update.StaticValidate(); err != nil {
+		return fmt.Errorf("invalid: %v", err)
+	}
+	if err := checkParent(update, a.state); err != nil {
+		return err
+	}
+	if _, err := a.state.applyVerifiedAUM(update); err != nil {
+		return fmt.Errorf("cannot be applied: %v", err)
+	}
+	return nil
+}
+
+// AttachSignatures verifies sigs, made elsewhere over update's SigHash
+// by keys the authority trusts, and adds them to update, which must be
+// based on the current head. No signatures are added if any are invalid.
+func (a *Authority) AttachSignatures(update *AUM, sigs []tkatype.Signature) error {
+	if err := checkParent(*update, a.state); err != nil {
+		return err
+	}
+	if err := checkSignersNotExpired(sigs, a.state, timeNow()); err != nil {
+		return err
+	}
+	sigHash := update.SigHash()
+	for i, sig := range sigs {
+		key, err := a.state.GetKey(sig.KeyID)
+		if err != nil {
+			return fmt.Errorf("bad keyID on signature %d: %v", i, err)
+		}
+		if err := signatureVerify(&sig, sigHash, key); err != nil {
+			return fmt.Errorf("signature %d: %v", i, err)
+		}
+	}
+	update.Signatures = append(update.Signatures, sigs...)
+	return nil
+}
+
+// SignaturesNeeded returns how many more distinct trusted keys must sign
+// update, which must be based on the current head, for it to be valid.
+// The caller must ensure that its signatures are valid.
+func (a *Authority) SignaturesNeeded(update AUM) uint {
+	n, want := update.numSigners(a.state), a.state.signatureThreshold()
+	if n >= want {
+		return 0
+	}
+	return want - n
+}
+
+// KeysExpiringBefore returns the trusted keys that expire before t,
+// including any that already have, soonest first.
+func (a *Authority) KeysExpiringBefore(t time.Time) []Key {
+	var out []Key
+	for _, k := range a.state.Keys {
+		if exp, ok := k.Expiry(); ok && exp.Before(t) {
+			out = append(out, k.Clone())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ei, _ := out[i].Expiry()
+		ej, _ := out[j].Expiry()
+		return ei.Before(ej)
+	})
+	return out
+}
+
+// DisablementValues returns the values of the authority's disablement
+// secrets (see DisablementValue), such as to choose ones to retire with
+// UpdateBuilder.RotateDisablementSecrets.
+func (a *Authority) DisablementValues() [][]byte {
+	return a.state.Clone().DisablementSecrets
+}
+
+// Keys returns the keys trusted by the authority.
+func (a *Authority) Keys() []Key {
+	out := make([]Key, len(a.state.Keys))
+	for i, k := range a.state.Keys {
+		out[i] = k.Clone()
+	}
+	return out
+}
 
-	return decoded.verifySignature(key)
+// SignatureThreshold returns how many distinct trusted keys must sign
+// each update.
+func (a *Authority) SignatureThreshold() uint {
+	return a.state.signatureThreshold()
 }
 
 // KeyTrusted returns true if the given keyID is trusted by the tailnet
@@ -6,6 +6,12 @@
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -371,3 +377,245 @@ func TestAuthorityInform(t *testing.T) {
 		t.Fatal("authority did not converge to correct AUM")
 	}
 }
+
+func TestAuthorityCompact(t *testing.T) {
+	fs, err := ChonkDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, storage := range []CompactableChonk{&Mem{}, fs} {
+		t.Run(fmt.Sprintf("%T", storage), func(t *testing.T) {
+			pub, priv := testingKey25519(t, 1)
+			key := Key{Kind: Key25519, Public: pub, Votes: 2}
+
+			a, _, err := Create(storage, State{
+				Keys:               []Key{key},
+				DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+			}, signer25519(priv))
+			if err != nil {
+				t.Fatalf("Create() failed: %v", err)
+			}
+			// Build genesis -> vote -> checkpoint, three times over.
+			var checkpoints []AUMHash
+			for i := 0; i < 3; i++ {
+				b := a.NewUpdater(signer25519(priv))
+				if err := b.SetKeyVote(key.ID(), uint(i+3)); err != nil {
+					t.Fatal(err)
+				}
+				if err := b.Checkpoint(); err != nil {
+					t.Fatal(err)
+				}
+				updates, err := b.Finalize()
+				if err != nil {
+					t.Fatalf("Finalize() failed: %v", err)
+				}
+				if err := a.Inform(updates); err != nil {
+					t.Fatalf("Inform() failed: %v", err)
+				}
+				checkpoints = append(checkpoints, a.Head())
+			}
+			head := a.Head()
+
+			if err := a.Compact(2); err != nil {
+				t.Fatalf("Compact() failed: %v", err)
+			}
+			all, err := storage.AllAUMs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 3 {
+				t.Errorf("after Compact, %d AUMs stored; want 3", len(all))
+			}
+			if _, err := storage.AUM(checkpoints[0]); err != os.ErrNotExist {
+				t.Errorf("first checkpoint not purged: %v", err)
+			}
+
+			a, err = Open(storage)
+			if err != nil {
+				t.Fatalf("Open() after Compact failed: %v", err)
+			}
+			if a.Head() != head || a.oldestAncestor.Hash() != checkpoints[1] {
+				t.Errorf("after Compact, head = %x, oldest = %x; want %x, %x", a.Head(), a.oldestAncestor.Hash(), head, checkpoints[1])
+			}
+			if k, err := a.state.GetKey(key.ID()); err != nil || k.Votes != 5 {
+				t.Errorf("after Compact, key = %+v, %v; want 5 votes", k, err)
+			}
+
+			// New nodes can bootstrap from the latest checkpoint and
+			// then follow along.
+			cp, err := a.LatestCheckpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			a2, err := Bootstrap(&Mem{}, cp)
+			if err != nil {
+				t.Fatalf("Bootstrap() failed: %v", err)
+			}
+			b := a.NewUpdater(signer25519(priv))
+			if err := b.SetKeyVote(key.ID(), 1); err != nil {
+				t.Fatal(err)
+			}
+			updates, err := b.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Inform(updates); err != nil {
+				t.Fatal(err)
+			}
+			if err := a2.Inform(updates); err != nil {
+				t.Fatalf("Inform() of bootstrapped authority failed: %v", err)
+			}
+			if a.Head() != a2.Head() {
+				t.Error("bootstrapped authority did not follow")
+			}
+		})
+	}
+}
+
+func TestAuthorityInformWithProgress(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	state := State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}
+
+	a, genesis, err := Create(&Mem{}, state, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(signer25519(priv))
+	for i := 0; i < 2*informBatchSize+50; i++ {
+		if err := b.SetKeyVote(key.ID(), uint(i%10)+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+
+	// Cancelled partway through: the batches committed so far stick.
+	storage := &Mem{}
+	fresh, err := Bootstrap(storage, genesis)
+	if err != nil {
+		t.Fatalf("Bootstrap() failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls [][2]int
+	err = fresh.InformWithProgress(ctx, updates, func(processed, total int) {
+		calls = append(calls, [2]int{processed, total})
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Fatalf("InformWithProgress() = %v, want %v", err, context.Canceled)
+	}
+	if want := [][2]int{{informBatchSize, len(updates)}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("progress calls = %v, want %v", calls, want)
+	}
+	if want := updates[informBatchSize-1].Hash(); fresh.Head() != want {
+		t.Errorf("head after cancellation = %x, want %x", fresh.Head(), want)
+	}
+
+	// Resuming processes the rest.
+	calls = nil
+	if err := fresh.InformWithProgress(context.Background(), updates, func(processed, total int) {
+		calls = append(calls, [2]int{processed, total})
+	}); err != nil {
+		t.Fatalf("InformWithProgress() failed: %v", err)
+	}
+	if fresh.Head() != updates[len(updates)-1].Hash() {
+		t.Errorf("head = %x, want %x", fresh.Head(), updates[len(updates)-1].Hash())
+	}
+	if last := calls[len(calls)-1]; last != [2]int{len(updates), len(updates)} {
+		t.Errorf("last progress call = %v, want all processed", last)
+	}
+}
+
+func TestAuthorityInformReplay(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	_, untrusted := testingKey25519(t, 2)
+
+	a, genesis, err := Create(&Mem{}, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyVote(key.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	good, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Inform(append([]AUM{genesis}, good...)); err != nil {
+		t.Fatalf("Inform() failed: %v", err)
+	}
+	if got, want := a.InformStats(), (InformStats{Applied: 1, Duplicate: 1}); got != want {
+		t.Errorf("InformStats() = %+v, want %+v", got, want)
+	}
+
+	b = a.NewUpdater(signer25519(priv))
+	if err := b.SetKeyVote(key.ID(), 4); err != nil {
+		t.Fatal(err)
+	}
+	bad, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad[0].Signatures[0].Signature[0] ^= 1
+	if err := a.Inform(bad); err == nil {
+		t.Fatal("Inform() of a badly signed update succeeded")
+	}
+	// Sending it again is rejected without verifying it again.
+	err = a.Inform(bad)
+	if err == nil || !strings.Contains(err.Error(), "rejected recently") {
+		t.Errorf("Inform() of a replayed update = %v, want rejected recently", err)
+	}
+
+	// Updates rejected for reasons that depend on the state, such as
+	// being signed by an untrusted key, are checked afresh each time.
+	b = a.NewUpdater(signer25519(untrusted))
+	if err := b.SetKeyVote(key.ID(), 5); err != nil {
+		t.Fatal(err)
+	}
+	untrustedUpdates, err := b.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err := a.Inform(untrustedUpdates)
+		if err == nil || strings.Contains(err.Error(), "rejected recently") {
+			t.Errorf("Inform() #%d of an untrusted update = %v, want verification error", i, err)
+		}
+	}
+
+	if err := a.Inform(make([]AUM, maxInformUpdates+1)); err == nil {
+		t.Error("Inform() of too many updates succeeded")
+	}
+	if got, want := a.InformStats(), (InformStats{Applied: 1, Duplicate: 1, Rejected: 3, Replayed: 1, Oversized: 1}); got != want {
+		t.Errorf("InformStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRejectedCache(t *testing.T) {
+	var c rejectedCache
+	for i := 0; i < rejectedCacheSize+1; i++ {
+		c.add(AUMHash{byte(i), byte(i >> 8)}, errors.New("bad"))
+	}
+	if _, ok := c.get(AUMHash{0}); ok {
+		t.Error("oldest entry was not evicted")
+	}
+	if reason, ok := c.get(AUMHash{1}); !ok || reason != "bad" {
+		t.Errorf("get() = %q, %v, want bad", reason, ok)
+	}
+	if len(c.errs) != rejectedCacheSize {
+		t.Errorf("cache has %d entries, want %d", len(c.errs), rejectedCacheSize)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tkatest provides utilities for testing code that uses the
+// tka package: deterministic keys, a scriptable Signer, and in-memory
+// authorities with canned update chains.
+package tkatest
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"tailscale.com/tka"
+	"tailscale.com/types/tkatype"
+)
+
+// DisablementSecret is the disablement secret of authorities made by
+// NewAuthority.
+var DisablementSecret = []byte("tkatest disablement secret")
+
+// Key returns a deterministic Ed25519 key derived from seed, with votes,
+// along with its private half.
+func Key(seed int64, votes uint) (tka.Key, ed25519.PrivateKey) {
+	var s [ed25519.SeedSize]byte
+	binary.LittleEndian.PutUint64(s[:], uint64(seed))
+	copy(s[8:], "tkatest")
+	priv := ed25519.NewKeyFromSeed(s[:])
+	return tka.Key{Kind: tka.Key25519, Public: priv.Public().(ed25519.PublicKey), Votes: votes}, priv
+}
+
+// Signer is a tka.Signer that signs with Ed25519 keys, and can be
+// scripted to fail. It's safe for concurrent use.
+type Signer struct {
+	keys []ed25519.PrivateKey
+
+	mu     sync.Mutex
+	script []error
+	signed []tkatype.AUMSigHash
+}
+
+// NewSigner returns a Signer that signs with each of keys.
+func NewSigner(keys ...ed25519.PrivateKey) *Signer {
+	return &Signer{keys: keys}
+}
+
+// FailNext makes the next calls to SignAUM, one per error, return errs
+// in order instead of signing. A nil error means to sign as usual.
+func (s *Signer) FailNext(errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, errs...)
+}
+
+// Signed returns the digests SignAUM has signed, in order.
+func (s *Signer) Signed() []tkatype.AUMSigHash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]tkatype.AUMSigHash(nil), s.signed...)
+}
+
+// SignAUM implements tka.Signer.
+func (s *Signer) SignAUM(sigHash tkatype.AUMSigHash) ([]tkatype.Signature, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.script) > 0 {
+		err := s.script[0]
+		s.script = s.script[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(s.keys) == 0 {
+		return nil, errors.New("tkatest: signer has no keys")
+	}
+	s.signed = append(s.signed, sigHash)
+	out := make([]tkatype.Signature, len(s.keys))
+	for i, priv := range s.keys {
+		key := tka.Key{Kind: tka.Key25519, Public: priv.Public().(ed25519.PublicKey)}
+		out[i] = tkatype.Signature{
+			KeyID:     key.ID(),
+			Signature: ed25519.Sign(priv, sigHash[:]),
+		}
+	}
+	return out, nil
+}
+
+// Authority is an in-memory authority, as made by NewAuthority.
+type Authority struct {
+	*tka.Authority
+
+	// Storage is where the authority's updates are stored.
+	Storage *tka.Mem
+
+	// Genesis is the authority's first update.
+	Genesis tka.AUM
+
+	// Keys are the keys the authority trusts, each with one vote, and
+	// Privs their private halves. Keys[i] is Key(i+1, 1).
+	Keys  []tka.Key
+	Privs []ed25519.PrivateKey
+
+	// Signer signs with the first key.
+	Signer *Signer
+}
+
+// NewAuthority returns an in-memory authority trusting nKeys keys,
+// whose genesis update is signed by the first.
+func NewAuthority(tb testing.TB, nKeys int) *Authority {
+	tb.Helper()
+	if nKeys < 1 {
+		tb.Fatalf("tkatest.NewAuthority: need at least one key, got %d", nKeys)
+	}
+	out := &Authority{Storage: &tka.Mem{}}
+	for i := 0; i < nKeys; i++ {
+		key, priv := Key(int64(i+1), 1)
+		out.Keys = append(out.Keys, key)
+		out.Privs = append(out.Privs, priv)
+	}
+	out.Signer = NewSigner(out.Privs[0])
+
+	var err error
+	out.Authority, out.Genesis, err = tka.Create(out.Storage, tka.State{
+		Keys:               out.Keys,
+		DisablementSecrets: [][]byte{tka.DisablementValue(DisablementSecret)},
+	}, out.Signer)
+	if err != nil {
+		tb.Fatalf("tkatest.NewAuthority: %v", err)
+	}
+	return out
+}
+
+// Extend applies n canned updates after the authority's head, each
+// signed by signer (or a.Signer, if nil), and returns them.
+//
+// The updates are Annotate AUMs, which change nothing but are each
+// distinct.
+func (a *Authority) Extend(tb testing.TB, signer tka.Signer, n int) []tka.AUM {
+	tb.Helper()
+	updates := a.chain(tb, signer, a.Head(), "extend", n)
+	if err := a.Inform(updates); err != nil {
+		tb.Fatalf("tkatest.Extend: %v", err)
+	}
+	return updates
+}
+
+// Fork applies a branch of canned updates after from for each of
+// lengths, each signed by signer (or a.Signer, if nil), and returns the
+// branches. The updates are as described at Extend. Fork resolution
+// decides which branch becomes the active one.
+func (a *Authority) Fork(tb testing.TB, signer tka.Signer, from tka.AUMHash, lengths ...int) [][]tka.AUM {
+	tb.Helper()
+	if len(lengths) < 2 {
+		tb.Fatalf("tkatest.Fork: need at least two branches, got %d", len(lengths))
+	}
+	var branches [][]tka.AUM
+	for i, n := range lengths {
+		if n < 1 {
+			tb.Fatalf("tkatest.Fork: branch %d is empty", i)
+		}
+		branch := a.chain(tb, signer, from, fmt.Sprintf("fork %x branch %d", from[:4], i), n)
+		if err := a.Inform(branch); err != nil {
+			tb.Fatalf("tkatest.Fork: branch %d: %v", i, err)
+		}
+		branches = append(branches, branch)
+	}
+	return branches
+}
+
+// chain returns n signed Annotate updates after parent, annotated with
+// label and their position.
+func (a *Authority) chain(tb testing.TB, signer tka.Signer, parent tka.AUMHash, label string, n int) []tka.AUM {
+	tb.Helper()
+	if signer == nil {
+		signer = a.Signer
+	}
+	out := make([]tka.AUM, 0, n)
+	for i := 0; i < n; i++ {
+		update := tka.AUM{
+			MessageKind: tka.AUMAnnotate,
+			PrevAUMHash: append([]byte(nil), parent[:]...),
+			Annotation:  &tka.Annotation{Reason: fmt.Sprintf("tkatest: %s update %d", label, i)},
+		}
+		sigs, err := signer.SignAUM(update.SigHash())
+		if err != nil {
+			tb.Fatalf("tkatest: signing update %d: %v", i, err)
+		}
+		update.Signatures = sigs
+		out = append(out, update)
+		parent = update.Hash()
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tkatest
+
+import (
+	"errors"
+	"testing"
+
+	"tailscale.com/tka"
+)
+
+func TestKeyDeterministic(t *testing.T) {
+	k1, _ := Key(1, 1)
+	k1again, _ := Key(1, 1)
+	k2, _ := Key(2, 1)
+	if string(k1.ID()) != string(k1again.ID()) {
+		t.Error("Key(1) differs between calls")
+	}
+	if string(k1.ID()) == string(k2.ID()) {
+		t.Error("Key(1) and Key(2) are the same")
+	}
+}
+
+func TestSignerScript(t *testing.T) {
+	_, priv := Key(1, 1)
+	s := NewSigner(priv)
+	errBoom := errors.New("boom")
+	s.FailNext(errBoom, nil)
+
+	if _, err := s.SignAUM([32]byte{1}); err != errBoom {
+		t.Errorf("first SignAUM() = %v, want %v", err, errBoom)
+	}
+	if sigs, err := s.SignAUM([32]byte{2}); err != nil || len(sigs) != 1 {
+		t.Errorf("second SignAUM() = %v, %v, want one signature", sigs, err)
+	}
+	if got := s.Signed(); len(got) != 1 || got[0] != [32]byte{2} {
+		t.Errorf("Signed() = %v, want just the second digest", got)
+	}
+}
+
+func TestAuthorityFork(t *testing.T) {
+	a := NewAuthority(t, 2)
+	a.Extend(t, nil, 2)
+	forkPoint := a.Head()
+	branches := a.Fork(t, nil, forkPoint, 1, 3)
+
+	forks, err := a.Forks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forks) != 1 || forks[0].ForkPoint != forkPoint {
+		t.Fatalf("Forks() = %+v, want one fork at %v", forks, forkPoint)
+	}
+	heads := map[tka.AUMHash]bool{}
+	for _, b := range branches {
+		heads[b[len(b)-1].Hash()] = true
+	}
+	if !heads[a.Head()] {
+		t.Errorf("head %v is not the end of either branch", a.Head())
+	}
+
+	// Updates signed by an untrusted key aren't applied.
+	_, untrusted := Key(100, 1)
+	if err := a.Inform(a.chain(t, NewSigner(untrusted), a.Head(), "untrusted", 1)); err == nil {
+		t.Error("update signed by an untrusted key was applied")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// VerifyReport describes the result of Authority.Verify.
+type VerifyReport struct {
+	// Checked is the number of updates that were checked.
+	Checked int
+
+	// Anomalies are the problems found, in chain order. Verify keeps
+	// going after most problems, so one corruption may cause several.
+	Anomalies []Anomaly
+}
+
+// OK reports whether no problems were found.
+func (r VerifyReport) OK() bool {
+	return len(r.Anomalies) == 0
+}
+
+func (r VerifyReport) String() string {
+	if r.OK() {
+		return fmt.Sprintf("checked %d updates, no problems found", r.Checked)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "checked %d updates, found %d problems:\n", r.Checked, len(r.Anomalies))
+	for _, a := range r.Anomalies {
+		fmt.Fprintf(&sb, "  %v\n", a)
+	}
+	return sb.String()
+}
+
+// Anomaly describes a problem with an update in the active chain.
+type Anomaly struct {
+	// Hash is the hash of the update, as its child refers to it (or,
+	// for the head, as the authority does).
+	Hash AUMHash
+
+	// Index is the position of the update in the chain checked, with
+	// zero being the oldest, or -1 if the problem stopped the chain
+	// being walked back that far.
+	Index int
+
+	Problem string
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("update %d (%x): %s", a.Index, a.Hash, a.Problem)
+}
+
+// Verify re-validates the authority's active chain as stored in
+// storage, which is normally the authority's own storage, from the
+// checkpoint at or before the oldest ancestor up to head. It checks
+// that:
+//
+//   - every update is present, and hashes to the hash it's stored under
+//   - every update refers to the one before it
+//   - every update is well-formed and correctly signed by keys trusted
+//     in the state before it
+//   - every update applies, and no checkpoint forgets a revocation
+//   - the chain results in the authority's current state
+//
+// Problems with the chain are reported as anomalies rather than errors,
+// which are only returned if the chain couldn't be walked at all.
+func (a *Authority) Verify(storage Chonk) (VerifyReport, error) {
+	var (
+		r      VerifyReport
+		chain  []AUM
+		hashes []AUMHash // the hash each element of chain was read by
+		oldest = a.oldestAncestor.Hash()
+		cursor = a.Head()
+		passed bool // whether the walk has passed the oldest ancestor
+		broken bool // whether the walk stopped before a checkpoint
+	)
+	for i := 0; ; i++ {
+		if i >= 2000 {
+			return VerifyReport{}, fmt.Errorf("iteration limit exceeded (%d)", 2000)
+		}
+		aum, err := storage.AUM(cursor)
+		if err != nil {
+			// Report the missing update at the start of what's left.
+			r.Anomalies = append(r.Anomalies, Anomaly{Hash: cursor, Problem: fmt.Sprintf("reading update: %v", err)})
+			broken = true
+			break
+		}
+		chain = append(chain, aum)
+		hashes = append(hashes, cursor)
+		passed = passed || cursor == oldest
+		if passed && aum.MessageKind == AUMCheckpoint {
+			break
+		}
+		parent, hasParent := aum.Parent()
+		if !hasParent {
+			if aum.MessageKind != AUMCheckpoint {
+				r.Anomalies = append(r.Anomalies, Anomaly{Hash: cursor, Problem: "chain does not start with a checkpoint"})
+				broken = true
+			}
+			break
+		}
+		cursor = parent
+	}
+	// Reverse, so the chain is oldest first.
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	// Anomalies found walking back are at the start of the chain.
+	for i := range r.Anomalies {
+		r.Anomalies[i].Index = -1
+	}
+	if broken {
+		// Without a checkpoint to start from, there's no state to
+		// check signatures against.
+		return r, nil
+	}
+
+	report := func(i int, format string, args ...any) {
+		r.Anomalies = append(r.Anomalies, Anomaly{Hash: hashes[i], Index: i, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	var state State
+	for i, aum := range chain {
+		r.Checked++
+		if got := aum.Hash(); got != hashes[i] {
+			report(i, "stored update hashes to %x", got)
+		}
+		if i == 0 {
+			// The first update is a checkpoint, which must be signed by
+			// the keys it trusts, as a genesis update would be.
+			if err := aumVerify(aum, *aum.State, true); err != nil {
+				report(i, "verification failed: %v", err)
+			}
+			state = aum.State.cloneForUpdate(&aum)
+			continue
+		}
+
+		if err := aumVerify(aum, state, false); err != nil {
+			report(i, "verification failed: %v", err)
+		}
+		next, err := state.applyVerifiedAUM(aum)
+		if err != nil {
+			// Without the state after this update, the rest of the
+			// chain can't be checked.
+			report(i, "applying update: %v", err)
+			return r, nil
+		}
+		if aum.MessageKind == AUMCheckpoint {
+			for _, rev := range state.Revocations {
+				if _, ok := next.revocation(rev.KeyID); !ok {
+					report(i, "checkpoint drops revocation of key %x", rev.KeyID)
+				}
+			}
+		}
+		state = next
+	}
+
+	if !bytes.Equal(stateDigest(state), stateDigest(a.state)) {
+		r.Anomalies = append(r.Anomalies, Anomaly{
+			Hash:    a.Head(),
+			Index:   len(chain) - 1,
+			Problem: "chain results in a different state than the authority's",
+		})
+	}
+	return r, nil
+}
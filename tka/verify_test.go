@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthorityVerify(t *testing.T) {
+	pub, priv := testingKey25519(t, 1)
+	key := Key{Kind: Key25519, Public: pub, Votes: 2}
+	pub2, _ := testingKey25519(t, 2)
+	key2 := Key{Kind: Key25519, Public: pub2, Votes: 1}
+
+	storage := &Mem{}
+	a, _, err := Create(storage, State{
+		Keys:               []Key{key},
+		DisablementSecrets: [][]byte{disablementKDF([]byte{1, 2, 3})},
+	}, signer25519(priv))
+	if err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+	b := a.NewUpdater(signer25519(priv))
+	if err := b.AddKey(key2); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyVote(key2.ID(), 3); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := b.Finalize()
+	if err != nil {
+		t.Fatalf("Finalize() failed: %v", err)
+	}
+	if err := a.Inform(updates); err != nil {
+		t.Fatalf("could not apply generated updates: %v", err)
+	}
+
+	r, err := a.Verify(storage)
+	if err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+	if !r.OK() || r.Checked != 3 {
+		t.Fatalf("Verify() = %v, want 3 updates with no problems", r)
+	}
+
+	// Tamper with the stored update that adds key2.
+	addHash := updates[0].Hash()
+	tampered := updates[0]
+	tampered.Key = &Key{Kind: Key25519, Public: pub2, Votes: 2}
+	storage.aums[addHash] = tampered
+
+	r, err = a.Verify(storage)
+	if err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+	if r.OK() {
+		t.Fatal("Verify() found no problems with tampered storage")
+	}
+	if got := r.Anomalies[0]; got.Index != 1 || got.Hash != addHash || !strings.Contains(got.Problem, "hashes to") {
+		t.Errorf("first anomaly = %v, want hash mismatch of update 1", got)
+	}
+	var sigFailed bool
+	for _, an := range r.Anomalies {
+		if an.Index == 1 && strings.Contains(an.Problem, "verification failed") {
+			sigFailed = true
+		}
+	}
+	if !sigFailed {
+		t.Errorf("anomalies %v don't include a failed signature", r.Anomalies)
+	}
+
+	// A missing update stops the walk.
+	delete(storage.aums, addHash)
+	r, err = a.Verify(storage)
+	if err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+	if len(r.Anomalies) != 1 || r.Anomalies[0].Index != -1 || r.Anomalies[0].Hash != addHash {
+		t.Errorf("Verify() = %v, want a single missing update", r)
+	}
+}
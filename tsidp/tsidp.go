@@ -0,0 +1,431 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tsidp is an OpenID Connect identity provider that identifies
+// users by their tailnet identity, so web apps on a tailnet can offer
+// "log in with Tailscale" without a separate identity service.
+//
+// It implements the authorization code flow. Users are identified by
+// looking up the source address of their connection to the provider
+// (as with LocalClient.WhoIs), so the provider must be served on the
+// tailnet, such as from a tsnet.Server, and not from behind a proxy.
+package tsidp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// codeLifetime is how long an authorization code may be
+	// exchanged for tokens.
+	codeLifetime = 5 * time.Minute
+
+	// tokenLifetime is how long ID and access tokens are valid.
+	tokenLifetime = time.Hour
+)
+
+// Client is a web app (an OIDC "relying party") that may use the
+// provider.
+type Client struct {
+	ID     string
+	Secret string
+
+	// RedirectURIs are the URIs that users may be sent back to
+	// with an authorization code. Each must match exactly.
+	RedirectURIs []string
+}
+
+// Options are the options for New.
+type Options struct {
+	// Issuer is the provider's base URL, such as
+	// "https://idp.example.ts.net". It's required.
+	Issuer string
+
+	// WhoIs looks up the tailnet identity of the connection from
+	// remoteAddr. It's required; LocalClient.WhoIs is typical.
+	WhoIs func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+
+	// Clients are the web apps that may use the provider.
+	Clients []Client
+
+	// Key, if non-nil, is the P-256 key that tokens are signed
+	// with. If nil, a new key is generated, so tokens don't
+	// survive a restart of the provider.
+	Key *ecdsa.PrivateKey
+
+	// Logf, if non-nil, is where the provider logs.
+	// The default is log.Printf.
+	Logf logger.Logf
+}
+
+// Server is an OpenID Connect provider. It's an http.Handler serving
+// the provider's endpoints under its issuer URL's path.
+type Server struct {
+	issuer  string
+	whoIs   func(context.Context, string) (*apitype.WhoIsResponse, error)
+	clients map[string]Client // by ID
+	key     *ecdsa.PrivateKey
+	keyID   string
+	logf    logger.Logf
+	mux     *http.ServeMux
+
+	mu     sync.Mutex
+	codes  map[string]*authRequest // by authorization code
+	tokens map[string]*authRequest // by access token
+}
+
+// authRequest is an authorization by a user for a client.
+type authRequest struct {
+	who         *apitype.WhoIsResponse
+	clientID    string
+	redirectURI string
+	nonce       string
+	expires     time.Time
+}
+
+// New returns a new provider.
+func New(opts Options) (*Server, error) {
+	if opts.Issuer == "" {
+		return nil, errors.New("tsidp: missing Issuer")
+	}
+	if opts.WhoIs == nil {
+		return nil, errors.New("tsidp: missing WhoIs")
+	}
+	u, err := url.Parse(opts.Issuer)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("tsidp: invalid Issuer %q", opts.Issuer)
+	}
+	s := &Server{
+		issuer:  strings.TrimSuffix(opts.Issuer, "/"),
+		whoIs:   opts.WhoIs,
+		clients: map[string]Client{},
+		key:     opts.Key,
+		logf:    opts.Logf,
+		codes:   map[string]*authRequest{},
+		tokens:  map[string]*authRequest{},
+	}
+	if s.logf == nil {
+		s.logf = log.Printf
+	}
+	for _, c := range opts.Clients {
+		if c.ID == "" || c.Secret == "" || len(c.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("tsidp: client %q needs an ID, Secret and RedirectURIs", c.ID)
+		}
+		s.clients[c.ID] = c
+	}
+	if s.key == nil {
+		if s.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+	} else if s.key.Curve != elliptic.P256() {
+		return nil, errors.New("tsidp: Key must be a P-256 key")
+	}
+	pub := elliptic.Marshal(elliptic.P256(), s.key.X, s.key.Y)
+	h := sha256.Sum256(pub)
+	s.keyID = hex.EncodeToString(h[:8])
+
+	base := strings.TrimSuffix(u.Path, "/")
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc(base+"/.well-known/openid-configuration", s.serveDiscovery)
+	s.mux.HandleFunc(base+"/.well-known/jwks.json", s.serveJWKS)
+	s.mux.HandleFunc(base+"/authorize", s.serveAuthorize)
+	s.mux.HandleFunc(base+"/token", s.serveToken)
+	s.mux.HandleFunc(base+"/userinfo", s.serveUserInfo)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"userinfo_endpoint":                     s.issuer + "/userinfo",
+		"jwks_uri":                              s.issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"claims_supported":                      []string{"sub", "email", "name", "picture", "preferred_username", "node"},
+	})
+}
+
+func (s *Server) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   b64(padTo32(s.key.X)),
+			"y":   b64(padTo32(s.key.Y)),
+			"use": "sig",
+			"alg": "ES256",
+			"kid": s.keyID,
+		}},
+	})
+}
+
+// serveAuthorize identifies the user from their connection and sends
+// them back to the client with an authorization code.
+func (s *Server) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	c, ok := s.clients[q.Get("client_id")]
+	if !ok {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !containsString(c.RedirectURIs, redirectURI) {
+		// Don't redirect to an unregistered URI, even with an error.
+		http.Error(w, "unregistered redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" {
+		redirectWithError(w, r, redirectURI, q.Get("state"), "unsupported_response_type")
+		return
+	}
+	if !containsString(strings.Fields(q.Get("scope")), "openid") {
+		redirectWithError(w, r, redirectURI, q.Get("state"), "invalid_scope")
+		return
+	}
+	who, err := s.whoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		s.logf("tsidp: whois %v: %v", r.RemoteAddr, err)
+		http.Error(w, "not connecting from the tailnet", http.StatusForbidden)
+		return
+	}
+	if len(who.Node.Tags) > 0 {
+		http.Error(w, "tagged nodes can't log in", http.StatusForbidden)
+		return
+	}
+	code := randHex()
+	s.mu.Lock()
+	s.expireLocked(time.Now())
+	s.codes[code] = &authRequest{
+		who:         who,
+		clientID:    c.ID,
+		redirectURI: redirectURI,
+		nonce:       q.Get("nonce"),
+		expires:     time.Now().Add(codeLifetime),
+	}
+	s.mu.Unlock()
+
+	v := url.Values{"code": {code}}
+	if st := q.Get("state"); st != "" {
+		v.Set("state", st)
+	}
+	http.Redirect(w, r, addQuery(redirectURI, v), http.StatusFound)
+}
+
+// serveToken exchanges an authorization code for ID and access tokens.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	c, ok := s.clients[clientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	s.expireLocked(now)
+	ar, ok := s.codes[r.FormValue("code")]
+	delete(s.codes, r.FormValue("code")) // codes are single-use
+	s.mu.Unlock()
+	if !ok || ar.clientID != c.ID || ar.redirectURI != r.FormValue("redirect_uri") {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	claims := s.claims(ar.who)
+	claims["iss"] = s.issuer
+	claims["aud"] = c.ID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(tokenLifetime).Unix()
+	if ar.nonce != "" {
+		claims["nonce"] = ar.nonce
+	}
+	idToken, err := s.signJWT(claims)
+	if err != nil {
+		s.logf("tsidp: signing token: %v", err)
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	accessToken := randHex()
+	s.mu.Lock()
+	s.tokens[accessToken] = &authRequest{
+		who:      ar.who,
+		clientID: c.ID,
+		expires:  now.Add(tokenLifetime),
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenLifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// serveUserInfo returns the claims about the user of an access token.
+func (s *Server) serveUserInfo(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing access token", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	s.expireLocked(time.Now())
+	ar, ok := s.tokens[strings.TrimPrefix(auth, "Bearer ")]
+	s.mu.Unlock()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid access token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, s.claims(ar.who))
+}
+
+// claims returns the claims identifying the user of who.
+func (s *Server) claims(who *apitype.WhoIsResponse) map[string]any {
+	up := who.UserProfile
+	username, _, _ := strings.Cut(up.LoginName, "@")
+	return map[string]any{
+		"sub":                fmt.Sprintf("userid:%d", up.ID),
+		"email":              up.LoginName,
+		"name":               up.DisplayName,
+		"picture":            up.ProfilePicURL,
+		"preferred_username": username,
+		"node":               strings.TrimSuffix(who.Node.Name, "."),
+	}
+}
+
+// expireLocked removes the codes and tokens that expired before now.
+func (s *Server) expireLocked(now time.Time) {
+	for k, ar := range s.codes {
+		if now.After(ar.expires) {
+			delete(s.codes, k)
+		}
+	}
+	for k, ar := range s.tokens {
+		if now.After(ar.expires) {
+			delete(s.tokens, k)
+		}
+	}
+}
+
+// signJWT returns claims as a JWT signed with ES256.
+func (s *Server) signJWT(claims map[string]any) (string, error) {
+	hdr, err := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := b64(hdr) + "." + b64(body)
+	h := sha256.Sum256([]byte(signed))
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, h[:])
+	if err != nil {
+		return "", err
+	}
+	sig := append(padTo32(r), padTo32(ss)...)
+	return signed + "." + b64(sig), nil
+}
+
+// Public returns the public key that tokens are signed with.
+func (s *Server) Public() crypto.PublicKey { return s.key.Public() }
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func tokenError(w http.ResponseWriter, code int, errCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": errCode})
+}
+
+func redirectWithError(w http.ResponseWriter, r *http.Request, redirectURI, state, errCode string) {
+	v := url.Values{"error": {errCode}}
+	if state != "" {
+		v.Set("state", state)
+	}
+	http.Redirect(w, r, addQuery(redirectURI, v), http.StatusFound)
+}
+
+// addQuery returns u with v added to its query.
+func addQuery(u string, v url.Values) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + v.Encode()
+	}
+	return u + "?" + v.Encode()
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func randHex() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// padTo32 returns n as a 32 byte big-endian number, as P-256
+// coordinates and signature halves are encoded.
+func padTo32(n *big.Int) []byte {
+	b := make([]byte, 32)
+	return n.FillBytes(b)
+}
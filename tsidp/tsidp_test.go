@@ -0,0 +1,170 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsidp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	const redirectURI = "https://app.example.ts.net/callback"
+	s, err := New(Options{
+		Issuer: "https://idp.example.ts.net",
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			return &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Name: "laptop.example.ts.net."},
+				UserProfile: &tailcfg.UserProfile{ID: 42, LoginName: "alice@example.com", DisplayName: "Alice"},
+			}, nil
+		},
+		Clients: []Client{{ID: "app", Secret: "sekrit", RedirectURIs: []string{redirectURI}}},
+		Logf:    t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Authorize.
+	q := url.Values{
+		"client_id":     {"app"},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+		"state":         {"st"},
+		"nonce":         {"n0nce"},
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("authorize: got %d: %s", rec.Code, rec.Body)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loc.Query().Get("state"); got != "st" {
+		t.Errorf("state = %q; want st", got)
+	}
+	code := loc.Query().Get("code")
+
+	exchange := func(secret string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {redirectURI},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("app", secret)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := exchange("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token with wrong secret: got %d", rec.Code)
+	}
+	rec = exchange("sekrit")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token: got %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if rec := exchange("sekrit"); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused code: got %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	claims := verifyJWT(t, s.Public().(*ecdsa.PublicKey), res.IDToken)
+	for k, want := range map[string]any{
+		"iss":   "https://idp.example.ts.net",
+		"aud":   "app",
+		"sub":   "userid:42",
+		"email": "alice@example.com",
+		"nonce": "n0nce",
+		"node":  "laptop.example.ts.net",
+	} {
+		if claims[k] != want {
+			t.Errorf("claim %q = %v; want %v", k, claims[k], want)
+		}
+	}
+
+	// UserInfo.
+	req := httptest.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"email":"alice@example.com"`) {
+		t.Errorf("userinfo: got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAuthorizeUnregisteredRedirect(t *testing.T) {
+	s, err := New(Options{
+		Issuer: "https://idp.example.ts.net",
+		WhoIs: func(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+			t.Fatal("unexpected WhoIs")
+			return nil, nil
+		},
+		Clients: []Client{{ID: "app", Secret: "sekrit", RedirectURIs: []string{"https://app.example.ts.net/callback"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{
+		"client_id":     {"app"},
+		"redirect_uri":  {"https://evil.example.com/"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/authorize?"+q.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// verifyJWT verifies the ES256 signature of tok with pub and returns its
+// claims.
+func verifyJWT(t *testing.T, pub *ecdsa.PublicKey, tok string) map[string]any {
+	t.Helper()
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT %q", tok)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("bad signature encoding: %v", err)
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, h[:], r, s) {
+		t.Fatal("JWT signature doesn't verify")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(body, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
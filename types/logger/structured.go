@@ -0,0 +1,293 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"tailscale.com/envknob"
+)
+
+// structuredJSON is whether Structured loggers write JSON-structured
+// records (which logtail preserves as structured fields) instead of
+// "key=value" text.
+var structuredJSON = envknob.Bool("TS_LOG_JSON")
+
+// Level is the importance of a log record. Higher levels are more
+// important. The values match those of the log/slog package, so that
+// levels can be written the same way ("DEBUG", "DEBUG-4", "INFO").
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	str := func(base string, off Level) string {
+		if off == 0 {
+			return base
+		}
+		return fmt.Sprintf("%s%+d", base, off)
+	}
+	switch {
+	case l < LevelInfo:
+		return str("DEBUG", l-LevelDebug)
+	case l < LevelWarn:
+		return str("INFO", l-LevelInfo)
+	case l < LevelError:
+		return str("WARN", l-LevelWarn)
+	default:
+		return str("ERROR", l-LevelError)
+	}
+}
+
+// UnmarshalText parses a level as written by String, such as "DEBUG",
+// "debug-4" or "INFO+2".
+func (l *Level) UnmarshalText(text []byte) error {
+	s := string(text)
+	name, off := s, 0
+	if i := strings.IndexAny(s, "+-"); i >= 0 {
+		name = s[:i]
+		var err error
+		if off, err = strconv.Atoi(s[i:]); err != nil {
+			return fmt.Errorf("invalid level %q: bad offset", s)
+		}
+	}
+	switch strings.ToUpper(name) {
+	case "DEBUG":
+		*l = LevelDebug
+	case "INFO":
+		*l = LevelInfo
+	case "WARN":
+		*l = LevelWarn
+	case "ERROR":
+		*l = LevelError
+	default:
+		return fmt.Errorf("invalid level %q", s)
+	}
+	*l += Level(off)
+	return nil
+}
+
+// LevelVar is a Level that can be changed while in use. Its zero value
+// is LevelInfo. It's safe for concurrent use.
+type LevelVar struct {
+	v atomic.Int64
+}
+
+// Level returns the current level.
+func (v *LevelVar) Level() Level { return Level(v.v.Load()) }
+
+// Set sets the level.
+func (v *LevelVar) Set(l Level) { v.v.Store(int64(l)) }
+
+// componentLevels maps a component name to its *LevelVar.
+var componentLevels sync.Map
+
+// ComponentLevel returns the level variable for the named component,
+// creating it (at LevelInfo) if needed.
+//
+// Structured records and verbose Logf lines from the component at or
+// above the returned level are logged as non-verbose, and so are shown
+// on stderr even when tailscaled isn't run with --verbose.
+func ComponentLevel(component string) *LevelVar {
+	if v, ok := componentLevels.Load(component); ok {
+		return v.(*LevelVar)
+	}
+	v, _ := componentLevels.LoadOrStore(component, new(LevelVar))
+	return v.(*LevelVar)
+}
+
+// SetComponentLevel sets the log level of the named component.
+func SetComponentLevel(component string, level Level) {
+	ComponentLevel(component).Set(level)
+}
+
+// ComponentLevels returns the current level of each component known
+// to the process, keyed by component name.
+func ComponentLevels() map[string]Level {
+	ret := map[string]Level{}
+	componentLevels.Range(func(k, v any) bool {
+		ret[k.(string)] = v.(*LevelVar).Level()
+		return true
+	})
+	return ret
+}
+
+// verbosity returns the Logf verbosity level (as in the "[v1] " prefix)
+// for a record at level from a component whose configured level is min.
+func verbosity(level, min Level) int {
+	switch {
+	case level >= LevelInfo || level >= min:
+		return 0
+	case level >= LevelDebug:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// levelOfVerbosity is the inverse of verbosity.
+func levelOfVerbosity(v int) Level {
+	switch v {
+	case 0:
+		return LevelInfo
+	case 1:
+		return LevelDebug
+	default:
+		return LevelDebug - 4
+	}
+}
+
+// ComponentLogf returns a Logf that writes to logf, removing the
+// "[v1] " or "[v2] " verbosity prefix from lines whose verbosity is
+// within the named component's level (see ComponentLevel).
+func ComponentLogf(logf Logf, component string) Logf {
+	lv := ComponentLevel(component)
+	return func(format string, args ...any) {
+		if strings.HasPrefix(format, "[v") {
+			min := lv.Level()
+			if min < LevelInfo {
+				for v := 1; v <= 2; v++ {
+					p := "[v" + strconv.Itoa(v) + "] "
+					if strings.HasPrefix(format, p) && verbosity(levelOfVerbosity(v), min) == 0 {
+						format = format[len(p):]
+						break
+					}
+				}
+			}
+		}
+		logf(format, args...)
+	}
+}
+
+// Structured is a logger of records made of a message and key-value
+// attributes, for a named component. It writes to a Logf, so
+// structured and printf-style logs end up in the same place (normally
+// logtail).
+//
+// Records below LevelInfo are written with the same "[v1] " or "[v2] "
+// verbosity prefix as verbose Logf lines, unless the component's level
+// (see ComponentLevel) has been turned up to include them. If the
+// TS_LOG_JSON envknob is set, records are written with Logf.JSON, which
+// logtail keeps as structured fields; otherwise they're written as
+// "component: msg key=value ..." text.
+type Structured struct {
+	logf      Logf
+	component string
+	level     *LevelVar
+	json      bool
+	attrs     []any // alternating keys and values
+}
+
+// NewStructured returns a structured logger for the named component
+// that writes to logf.
+func NewStructured(logf Logf, component string) *Structured {
+	return &Structured{
+		logf:      logf,
+		component: component,
+		level:     ComponentLevel(component),
+		json:      structuredJSON,
+	}
+}
+
+// With returns a logger that adds the given alternating keys and
+// values to each record.
+func (s *Structured) With(kv ...any) *Structured {
+	s2 := *s
+	s2.attrs = append(s.attrs[:len(s.attrs):len(s.attrs)], kv...)
+	return &s2
+}
+
+// Debug logs msg at LevelDebug. See Log.
+func (s *Structured) Debug(msg string, kv ...any) { s.Log(LevelDebug, msg, kv...) }
+
+// Info logs msg at LevelInfo. See Log.
+func (s *Structured) Info(msg string, kv ...any) { s.Log(LevelInfo, msg, kv...) }
+
+// Warn logs msg at LevelWarn. See Log.
+func (s *Structured) Warn(msg string, kv ...any) { s.Log(LevelWarn, msg, kv...) }
+
+// Error logs msg at LevelError. See Log.
+func (s *Structured) Error(msg string, kv ...any) { s.Log(LevelError, msg, kv...) }
+
+// Log logs msg at level, with kv as alternating string keys and
+// values. A value with no key is logged with the key "!BADKEY".
+func (s *Structured) Log(level Level, msg string, kv ...any) {
+	attrs := s.attrs
+	if len(kv) > 0 {
+		attrs = append(attrs[:len(attrs):len(attrs)], kv...)
+	}
+	v := verbosity(level, s.level.Level())
+	if s.json {
+		rec := map[string]any{
+			"level": level.String(),
+			"msg":   msg,
+		}
+		forEachAttr(attrs, func(k string, val any) {
+			rec[k] = jsonValue(val)
+		})
+		s.logf.JSON(v, s.component, rec)
+		return
+	}
+
+	var sb strings.Builder
+	if v > 0 {
+		fmt.Fprintf(&sb, "[v%d] ", v)
+	}
+	sb.WriteString(s.component)
+	sb.WriteString(": ")
+	if level >= LevelWarn {
+		sb.WriteString(level.String())
+		sb.WriteString(": ")
+	}
+	sb.WriteString(msg)
+	forEachAttr(attrs, func(k string, val any) {
+		sb.WriteByte(' ')
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		str := fmt.Sprint(val)
+		if str == "" || strings.ContainsAny(str, " \t\n\"=") {
+			str = strconv.Quote(str)
+		}
+		sb.WriteString(str)
+	})
+	s.logf("%s", sb.String())
+}
+
+// forEachAttr calls f with each key and value in kv, which alternates
+// keys and values.
+func forEachAttr(kv []any, f func(k string, v any)) {
+	for len(kv) > 0 {
+		k, ok := kv[0].(string)
+		if !ok || len(kv) == 1 {
+			f("!BADKEY", kv[0])
+			kv = kv[1:]
+			continue
+		}
+		f(k, kv[1])
+		kv = kv[2:]
+	}
+}
+
+// jsonValue returns v in the form it should be encoded in JSON: as is
+// for plain data, or as its string form for values (like durations,
+// times and errors) whose JSON encodings are unhelpful or empty.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStructured(t *testing.T) {
+	var got []string
+	logf := func(format string, args ...any) {
+		got = append(got, fmt.Sprintf(format, args...))
+	}
+	const component = "test-structured"
+	defer SetComponentLevel(component, LevelInfo)
+
+	l := NewStructured(logf, component).With("peer", "abc")
+	l.Info("hello", "n", 1, "s", "two words")
+	l.Debug("details")
+	l.Warn("uh oh", "err", errors.New("boom"))
+	l.Info("odd", "dangling")
+
+	SetComponentLevel(component, LevelDebug)
+	l.Debug("details")
+
+	want := []string{
+		`test-structured: hello peer=abc n=1 s="two words"`,
+		`[v1] test-structured: details peer=abc`,
+		`test-structured: WARN: uh oh peer=abc err=boom`,
+		`test-structured: odd peer=abc !BADKEY=dangling`,
+		`test-structured: details peer=abc`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestStructuredJSON(t *testing.T) {
+	var got string
+	logf := func(format string, args ...any) {
+		got = fmt.Sprintf(format, args...)
+	}
+	l := &Structured{
+		logf:      logf,
+		component: "c",
+		level:     new(LevelVar),
+		json:      true,
+	}
+	l.Debug("m", "k", 1, "err", errors.New("boom"))
+	want := "[v\x00JSON]1" + `{"c":{"err":"boom","k":1,"level":"DEBUG","msg":"m"}}`
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestLevelText(t *testing.T) {
+	for _, l := range []Level{LevelDebug - 4, LevelDebug, LevelInfo, LevelInfo + 2, LevelWarn, LevelError, LevelError + 1} {
+		var got Level
+		if err := got.UnmarshalText([]byte(l.String())); err != nil || got != l {
+			t.Errorf("UnmarshalText(%q) = %v, %v; want %v", l.String(), int(got), err, int(l))
+		}
+	}
+	var l Level
+	if err := l.UnmarshalText([]byte("debug-4")); err != nil || l != LevelDebug-4 {
+		t.Errorf("UnmarshalText(debug-4) = %v, %v", l, err)
+	}
+	for _, bad := range []string{"", "LOUD", "INFO+x"} {
+		if err := l.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalText(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestComponentLogf(t *testing.T) {
+	var got []string
+	logf := func(format string, args ...any) {
+		got = append(got, fmt.Sprintf(format, args...))
+	}
+	const component = "test-componentlogf"
+	defer SetComponentLevel(component, LevelInfo)
+
+	cl := ComponentLogf(logf, component)
+	cl("[v1] a")
+	SetComponentLevel(component, LevelDebug)
+	cl("[v1] b")
+	cl("[v2] c")
+	SetComponentLevel(component, LevelDebug-4)
+	cl("[v2] d")
+
+	want := []string{"[v1] a", "b", "[v2] c", "d"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
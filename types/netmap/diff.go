@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netmap
+
+import (
+	"reflect"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+// Diff describes how a NetworkMap differs from an earlier one.
+//
+// It lets consumers of successive NetworkMaps skip work for the parts
+// that didn't change.
+type Diff struct {
+	// Full is whether there was no earlier NetworkMap to compare
+	// against, in which case everything is considered changed.
+	Full bool
+
+	PeersAdded   []tailcfg.NodeID
+	PeersRemoved []tailcfg.NodeID
+	PeersChanged []tailcfg.NodeID
+
+	SelfChanged         bool // SelfNode or any of the fields derived from it
+	DNSChanged          bool
+	DERPMapChanged      bool
+	PacketFilterChanged bool
+	SSHPolicyChanged    bool
+}
+
+// PeersModified reports whether any peer was added, removed or changed.
+func (d *Diff) PeersModified() bool {
+	return d.Full || len(d.PeersAdded) > 0 || len(d.PeersRemoved) > 0 || len(d.PeersChanged) > 0
+}
+
+// IsEmpty reports whether d describes no changes at all.
+//
+// Fields not covered by Diff (such as Debug or ControlHealth) may
+// still differ.
+func (d *Diff) IsEmpty() bool {
+	return !d.PeersModified() &&
+		!d.SelfChanged &&
+		!d.DNSChanged &&
+		!d.DERPMapChanged &&
+		!d.PacketFilterChanged &&
+		!d.SSHPolicyChanged
+}
+
+// DiffFrom returns a description of how nm differs from old.
+// If old is nil, the returned Diff has Full set.
+//
+// Unchanged parts of successive NetworkMaps from the same control
+// session are shared (including the *tailcfg.Node values of unchanged
+// peers), so DiffFrom is cheap for them: only values that aren't
+// identical are compared in depth.
+func (nm *NetworkMap) DiffFrom(old *NetworkMap) *Diff {
+	if old == nil {
+		return &Diff{
+			Full:                true,
+			SelfChanged:         true,
+			DNSChanged:          true,
+			DERPMapChanged:      true,
+			PacketFilterChanged: true,
+			SSHPolicyChanged:    true,
+		}
+	}
+	d := &Diff{
+		SelfChanged: !(old.SelfNode == nm.SelfNode || old.SelfNode.Equal(nm.SelfNode)) ||
+			old.NodeKey != nm.NodeKey ||
+			old.Expiry != nm.Expiry ||
+			old.Name != nm.Name ||
+			old.MachineStatus != nm.MachineStatus ||
+			old.User != nm.User ||
+			!eqCIDRsIgnoreNil(old.Addresses, nm.Addresses),
+		DNSChanged:          !reflect.DeepEqual(old.DNS, nm.DNS),
+		DERPMapChanged:      old.DERPMap != nm.DERPMap && !reflect.DeepEqual(old.DERPMap, nm.DERPMap),
+		PacketFilterChanged: !sameMatches(old.PacketFilter, nm.PacketFilter) && !reflect.DeepEqual(old.PacketFilter, nm.PacketFilter),
+		SSHPolicyChanged:    old.SSHPolicy != nm.SSHPolicy && !reflect.DeepEqual(old.SSHPolicy, nm.SSHPolicy),
+	}
+
+	// Both peer lists are sorted by Node.ID.
+	aps, bps := old.Peers, nm.Peers
+	for len(aps) > 0 && len(bps) > 0 {
+		pa, pb := aps[0], bps[0]
+		switch {
+		case pa.ID == pb.ID:
+			if pa != pb && !pa.Equal(pb) {
+				d.PeersChanged = append(d.PeersChanged, pb.ID)
+			}
+			aps, bps = aps[1:], bps[1:]
+		case pa.ID > pb.ID:
+			d.PeersAdded = append(d.PeersAdded, pb.ID)
+			bps = bps[1:]
+		case pb.ID > pa.ID:
+			d.PeersRemoved = append(d.PeersRemoved, pa.ID)
+			aps = aps[1:]
+		}
+	}
+	for _, pa := range aps {
+		d.PeersRemoved = append(d.PeersRemoved, pa.ID)
+	}
+	for _, pb := range bps {
+		d.PeersAdded = append(d.PeersAdded, pb.ID)
+	}
+	return d
+}
+
+// sameMatches reports whether a and b are the same slice.
+func sameMatches(a, b []filter.Match) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
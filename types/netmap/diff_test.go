@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netmap
+
+import (
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestDiffFrom(t *testing.T) {
+	p1 := &tailcfg.Node{ID: 1, Name: "one"}
+	p2 := &tailcfg.Node{ID: 2, Name: "two"}
+	p3 := &tailcfg.Node{ID: 3, Name: "three"}
+	derpMap := &tailcfg.DERPMap{}
+	pf := []filter.Match{{}}
+
+	base := &NetworkMap{
+		SelfNode:     &tailcfg.Node{ID: 10},
+		Peers:        []*tailcfg.Node{p1, p2},
+		DERPMap:      derpMap,
+		PacketFilter: pf,
+	}
+	tests := []struct {
+		name string
+		nm   *NetworkMap
+		want *Diff
+	}{
+		{
+			name: "identical",
+			nm:   base,
+			want: &Diff{},
+		},
+		{
+			name: "equal_copies",
+			nm: &NetworkMap{
+				SelfNode:     base.SelfNode.Clone(),
+				Peers:        []*tailcfg.Node{p1.Clone(), p2.Clone()},
+				DERPMap:      &tailcfg.DERPMap{},
+				PacketFilter: []filter.Match{{}},
+			},
+			want: &Diff{},
+		},
+		{
+			name: "peers",
+			nm: &NetworkMap{
+				SelfNode:     base.SelfNode,
+				Peers:        []*tailcfg.Node{{ID: 2, Name: "two-renamed"}, p3},
+				DERPMap:      derpMap,
+				PacketFilter: pf,
+			},
+			want: &Diff{
+				PeersAdded:   []tailcfg.NodeID{3},
+				PeersRemoved: []tailcfg.NodeID{1},
+				PeersChanged: []tailcfg.NodeID{2},
+			},
+		},
+		{
+			name: "non_peers",
+			nm: &NetworkMap{
+				SelfNode:     &tailcfg.Node{ID: 10, Name: "renamed"},
+				Peers:        base.Peers,
+				DNS:          tailcfg.DNSConfig{Domains: []string{"foo"}},
+				DERPMap:      &tailcfg.DERPMap{OmitDefaultRegions: true},
+				PacketFilter: nil,
+				SSHPolicy:    &tailcfg.SSHPolicy{},
+			},
+			want: &Diff{
+				SelfChanged:         true,
+				DNSChanged:          true,
+				DERPMapChanged:      true,
+				PacketFilterChanged: true,
+				SSHPolicyChanged:    true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.nm.DiffFrom(base)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+			if got.IsEmpty() != reflect.DeepEqual(tt.want, &Diff{}) {
+				t.Errorf("IsEmpty = %v", got.IsEmpty())
+			}
+		})
+	}
+
+	if d := base.DiffFrom(nil); !d.Full || !d.PeersModified() || d.IsEmpty() {
+		t.Errorf("DiffFrom(nil) = %+v; want Full", d)
+	}
+}
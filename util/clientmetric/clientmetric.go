@@ -35,6 +35,10 @@
 	// They're contiguous to reduce cache churn during diff scans.
 	// When out of length, a new backing array is made.
 	valFreeList []int64
+
+	// encodeEvery is the minimum interval between deltas returned
+	// by EncodeLogTailMetricsDelta. If negative, none are returned.
+	encodeEvery = minMetricEncodeInterval
 )
 
 // scanEntry contains the minimal data needed for quickly scanning
@@ -60,6 +64,7 @@ type Metric struct {
 	regIdx int    // index into lastLogVal and unsorted
 	name   string
 	typ    Type
+	help   string // or empty; set for metrics created by a Group
 
 	// The following fields are owned by the package-level 'mu':
 
@@ -72,12 +77,19 @@ type Metric struct {
 	// lastNamed is the last time the name of this metric was
 	// written on the wire.
 	lastNamed time.Time
+
+	// lastSnap is the value of the metric at the last call to
+	// SnapshotAndReset.
+	lastSnap int64
 }
 
 func (m *Metric) Name() string { return m.name }
 func (m *Metric) Value() int64 { return atomic.LoadInt64(m.v) }
 func (m *Metric) Type() Type   { return m.typ }
 
+// Help returns m's help text, or the empty string if it has none.
+func (m *Metric) Help() string { return m.help }
+
 // Add increments m's value by n.
 //
 // If m is of type counter, n should not be negative.
@@ -184,14 +196,78 @@ func NewGauge(name string) *Metric {
 // See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md
 func WritePrometheusExpositionFormat(w io.Writer) {
 	for _, m := range Metrics() {
-		switch m.Type() {
-		case TypeGauge:
-			fmt.Fprintf(w, "# TYPE %s gauge\n", m.Name())
-		case TypeCounter:
-			fmt.Fprintf(w, "# TYPE %s counter\n", m.Name())
+		if h := m.Help(); h != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.Name(), helpEscaper.Replace(h))
 		}
-		fmt.Fprintf(w, "%s %v\n", m.Name(), m.Value())
+		writePrometheus(w, m.Name(), m.Type(), m.Value())
+	}
+}
+
+// helpEscaper escapes help text per the Prometheus exposition format.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func writePrometheus(w io.Writer, name string, typ Type, v int64) {
+	switch typ {
+	case TypeGauge:
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	case TypeCounter:
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
 	}
+	fmt.Fprintf(w, "%s %v\n", name, v)
+}
+
+// Snapshot is the value of a metric as returned by SnapshotAndReset.
+type Snapshot struct {
+	Name string
+	Type Type
+
+	// Value is the value of a gauge, or the amount a counter has
+	// increased since the previous call to SnapshotAndReset.
+	Value int64
+}
+
+// SnapshotAndReset returns the values of all metrics, sorted by
+// name, and resets counters so the next call reports only their
+// increase since this one.
+//
+// The reset only affects the values returned by SnapshotAndReset.
+// The metric values themselves, and the deltas encoded by
+// EncodeLogTailMetricsDelta, are unaffected.
+func SnapshotAndReset() []Snapshot {
+	ms := Metrics()
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make([]Snapshot, 0, len(ms))
+	for _, m := range ms {
+		s := Snapshot{Name: m.name, Type: m.typ, Value: m.Value()}
+		if m.typ == TypeCounter {
+			s.Value, m.lastSnap = s.Value-m.lastSnap, s.Value
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// WritePrometheusSnapshot writes snaps to w in the Prometheus
+// text-based exposition format.
+func WritePrometheusSnapshot(w io.Writer, snaps []Snapshot) {
+	for _, s := range snaps {
+		writePrometheus(w, s.Name, s.Type, s.Value)
+	}
+}
+
+// SetEncodeInterval sets the minimum interval between the metric
+// deltas returned by EncodeLogTailMetricsDelta, and thus how often
+// metrics are uploaded with logs. If d is zero, the default of 15
+// seconds is used. If d is negative, metrics are not encoded at all,
+// so they're only available locally.
+func SetEncodeInterval(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	if d == 0 {
+		d = minMetricEncodeInterval
+	}
+	encodeEvery = d
 }
 
 const (
@@ -202,9 +278,9 @@ func WritePrometheusExpositionFormat(w io.Writer) {
 	// in time.
 	metricLogNameFrequency = 4 * time.Hour
 
-	// minMetricEncodeInterval is the minimum interval that the
-	// metrics will be scanned for changes before being encoded
-	// for logtail.
+	// minMetricEncodeInterval is the default minimum interval
+	// that the metrics will be scanned for changes before being
+	// encoded for logtail. See SetEncodeInterval.
 	minMetricEncodeInterval = 15 * time.Second
 )
 
@@ -226,8 +302,11 @@ func EncodeLogTailMetricsDelta() string {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if encodeEvery < 0 {
+		return ""
+	}
 	now := time.Now()
-	if !lastDelta.IsZero() && now.Sub(lastDelta) < minMetricEncodeInterval {
+	if !lastDelta.IsZero() && now.Sub(lastDelta) < encodeEvery {
 		return ""
 	}
 	lastDelta = now
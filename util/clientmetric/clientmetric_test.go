@@ -5,6 +5,7 @@
 package clientmetric
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
@@ -34,6 +35,8 @@ func clearMetrics() {
 	metrics = map[string]*Metric{}
 	numWireID = 0
 	lastDelta = time.Time{}
+	encodeEvery = minMetricEncodeInterval
+	sortedDirty = true
 	sorted = nil
 	lastLogVal = nil
 	unsorted = nil
@@ -73,3 +76,46 @@ func TestEncodeLogTailMetricsDelta(t *testing.T) {
 		t.Errorf("with increments = %q; want %q", got, want)
 	}
 }
+
+func TestSetEncodeInterval(t *testing.T) {
+	clearMetrics()
+	defer SetEncodeInterval(0)
+
+	c := NewCounter("foo")
+	c.Add(1)
+	SetEncodeInterval(-1)
+	if got := EncodeLogTailMetricsDelta(); got != "" {
+		t.Errorf("disabled = %q; want empty", got)
+	}
+
+	SetEncodeInterval(time.Hour)
+	if got, want := EncodeLogTailMetricsDelta(), "N06fooS0202"; got != want {
+		t.Errorf("re-enabled = %q; want %q", got, want)
+	}
+	c.Add(1)
+	if got := EncodeLogTailMetricsDelta(); got != "" {
+		t.Errorf("within interval = %q; want empty", got)
+	}
+}
+
+func TestSnapshotAndReset(t *testing.T) {
+	clearMetrics()
+
+	c := NewCounter("foo")
+	g := NewGauge("bar")
+	c.Add(5)
+	g.Set(7)
+	want := []Snapshot{{"bar", TypeGauge, 7}, {"foo", TypeCounter, 5}}
+	if got := SnapshotAndReset(); !reflect.DeepEqual(got, want) {
+		t.Errorf("first = %+v; want %+v", got, want)
+	}
+
+	c.Add(2)
+	want = []Snapshot{{"bar", TypeGauge, 7}, {"foo", TypeCounter, 2}}
+	if got := SnapshotAndReset(); !reflect.DeepEqual(got, want) {
+		t.Errorf("second = %+v; want %+v", got, want)
+	}
+	if got := c.Value(); got != 7 {
+		t.Errorf("counter value = %v; want 7", got)
+	}
+}
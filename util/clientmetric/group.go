@@ -0,0 +1,112 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientmetric
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	tsmetrics "tailscale.com/metrics"
+)
+
+// groups are the registered groups, keyed by name. Guarded by mu.
+var groups = map[string]*Group{}
+
+// Group is a set of related metrics registered by one feature or
+// subsystem, such as "magicsock" or "dns". The names of its metrics
+// all have the group's name and an underscore as a prefix.
+//
+// Like all metrics, a group's metrics are exposed in the Prometheus
+// format by WritePrometheusExpositionFormat (and thus the LocalAPI)
+// and uploaded with logs. Each group is also published as an expvar
+// of the same name.
+type Group struct {
+	name string
+	help string
+	vars tsmetrics.Set // see ExpVar
+
+	mu      sync.Mutex
+	metrics []*Metric
+}
+
+// NewGroup registers and returns a new metric group with the given
+// name and help text.
+//
+// It panics if the name is used by another group or expvar, or
+// isn't a valid metric name.
+func NewGroup(name, help string) *Group {
+	if i := strings.IndexFunc(name, isIllegalMetricRune); name == "" || i != -1 {
+		panic(fmt.Sprintf("illegal metric group name %q (index %v)", name, i))
+	}
+	g := &Group{name: name, help: help}
+	mu.Lock()
+	if _, dup := groups[name]; dup {
+		mu.Unlock()
+		panic("duplicate metric group " + name)
+	}
+	groups[name] = g
+	mu.Unlock()
+	expvar.Publish(name, g.ExpVar())
+	return g
+}
+
+// Groups returns all registered metric groups, sorted by name.
+func Groups() []*Group {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		ret = append(ret, g)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].name < ret[j].name })
+	return ret
+}
+
+func (g *Group) Name() string { return g.name }
+func (g *Group) Help() string { return g.help }
+
+// NewCounter returns a new counter named name within g, with the
+// given help text. Its full name is g.Name() + "_" + name.
+func (g *Group) NewCounter(name, help string) *Metric {
+	return g.newMetric(name, help, TypeCounter)
+}
+
+// NewGauge returns a new gauge named name within g, with the given
+// help text. Its full name is g.Name() + "_" + name.
+func (g *Group) NewGauge(name, help string) *Metric {
+	return g.newMetric(name, help, TypeGauge)
+}
+
+func (g *Group) newMetric(name, help string, typ Type) *Metric {
+	m := NewUnpublished(g.name+"_"+name, typ)
+	m.help = help
+	m.Publish()
+	prefix := "counter_"
+	if typ == TypeGauge {
+		prefix = "gauge_"
+	}
+	g.vars.Set(prefix+name, expvar.Func(func() any { return m.Value() }))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.metrics = append(g.metrics, m)
+	return m
+}
+
+// Metrics returns g's metrics, in registration order.
+func (g *Group) Metrics() []*Metric {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*Metric(nil), g.metrics...)
+}
+
+// ExpVar returns an expvar variable for g's metrics, keyed by their
+// names within g with a "counter_" or "gauge_" prefix, as tsweb's
+// Prometheus exporter expects.
+func (g *Group) ExpVar() expvar.Var {
+	return &g.vars
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientmetric
+
+import (
+	"bytes"
+	"expvar"
+	"strings"
+	"testing"
+
+	tsmetrics "tailscale.com/metrics"
+)
+
+func TestGroup(t *testing.T) {
+	clearMetrics()
+
+	g := NewGroup("testgroup", "metrics for testing")
+	c := g.NewCounter("things", "number of things")
+	gg := g.NewGauge("widgets", "current widgets")
+	c.Add(3)
+	gg.Set(2)
+
+	if got, want := c.Name(), "testgroup_things"; got != want {
+		t.Errorf("counter name = %q; want %q", got, want)
+	}
+	if got := len(g.Metrics()); got != 2 {
+		t.Errorf("len(Metrics) = %d; want 2", got)
+	}
+	found := false
+	for _, g2 := range Groups() {
+		found = found || g2 == g
+	}
+	if !found {
+		t.Errorf("group not in Groups()")
+	}
+
+	var buf bytes.Buffer
+	WritePrometheusExpositionFormat(&buf)
+	for _, want := range []string{
+		"# HELP testgroup_things number of things\n# TYPE testgroup_things counter\ntestgroup_things 3\n",
+		"# HELP testgroup_widgets current widgets\n# TYPE testgroup_widgets gauge\ntestgroup_widgets 2\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Prometheus output missing %q; got:\n%s", want, buf.String())
+		}
+	}
+
+	set, ok := expvar.Get("testgroup").(*tsmetrics.Set)
+	if !ok {
+		t.Fatalf("expvar testgroup = %T; want *metrics.Set", expvar.Get("testgroup"))
+	}
+	got := map[string]any{}
+	set.Do(func(kv expvar.KeyValue) {
+		got[kv.Key] = kv.Value.(expvar.Func)()
+	})
+	if got["counter_things"] != int64(3) || got["gauge_widgets"] != int64(2) {
+		t.Errorf("expvar values = %v", got)
+	}
+}
+
+func TestGroupDuplicate(t *testing.T) {
+	NewGroup("testdupgroup", "")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic on duplicate group")
+		}
+	}()
+	NewGroup("testdupgroup", "")
+}
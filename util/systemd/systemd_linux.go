@@ -11,7 +11,9 @@
 	"errors"
 	"log"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mdlayher/sdnotify"
 )
@@ -32,8 +34,9 @@ func (l *logOnce) logf(format string, args ...any) {
 }
 
 var (
-	readyOnce  = &logOnce{}
-	statusOnce = &logOnce{}
+	readyOnce    = &logOnce{}
+	statusOnce   = &logOnce{}
+	watchdogOnce = &logOnce{}
 )
 
 func notifier() *sdnotify.Notifier {
@@ -77,3 +80,27 @@ func Status(format string, args ...any) {
 		statusOnce.logf("systemd: error notifying: %v", err)
 	}
 }
+
+// WatchdogInterval returns how often the unit's WatchdogSec setting
+// requires Watchdog to be called for systemd not to consider the
+// service hung, or ok=false if it doesn't.
+func WatchdogInterval() (d time.Duration, ok bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// It's meant for some other process.
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// Watchdog tells systemd that the service is alive, resetting its
+// watchdog timer.
+func Watchdog() {
+	err := notifier().Notify("WATCHDOG=1")
+	if err != nil {
+		watchdogOnce.logf("systemd: error notifying: %v", err)
+	}
+}
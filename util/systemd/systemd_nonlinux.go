@@ -7,5 +7,9 @@
 
 package systemd
 
-func Ready()                {}
-func Status(string, ...any) {}
+import "time"
+
+func Ready()                                  {}
+func Status(string, ...any)                   {}
+func WatchdogInterval() (time.Duration, bool) { return 0, false }
+func Watchdog()                               {}
@@ -14,6 +14,7 @@
 	"strings"
 	"time"
 
+	"tailscale.com/health"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
@@ -60,10 +61,15 @@ type D struct {
 			if e.regionID == c.myDerp {
 				home = "🏠"
 			}
-			fmt.Fprintf(w, "<li>%s %d - %v: created %v ago, write %v ago</li>\n",
+			latency := ""
+			if d, ok := health.DERPRegionLatency(e.regionID); ok {
+				latency = fmt.Sprintf(", latency %v", d.Round(time.Millisecond))
+			}
+			fmt.Fprintf(w, "<li>%s %d - %v: created %v ago, write %v ago%s</li>\n",
 				home, e.regionID, html.EscapeString(r.RegionCode),
 				now.Sub(e.createTime).Round(time.Second),
 				now.Sub(e.lastWrite).Round(time.Second),
+				latency,
 			)
 		}
 
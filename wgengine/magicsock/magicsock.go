@@ -25,6 +25,7 @@
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"go4.org/mem"
@@ -244,6 +245,8 @@ type Conn struct {
 	// they're static after construction, or are wholly owned by a
 	// single goroutine.
 
+	slog *logger.Structured // structured logger for the "magicsock" component
+
 	connCtx       context.Context // closed on Conn.Close
 	connCtxCancel func()          // closes connCtx
 	donec         <-chan struct{} // connCtx.Done()'s to avoid context.cancelCtx.Done()'s mutex per call
@@ -543,7 +546,8 @@ func newConn() *Conn {
 func NewConn(opts Options) (*Conn, error) {
 	c := newConn()
 	c.port.Store(uint32(opts.Port))
-	c.logf = opts.logf()
+	c.logf = logger.ComponentLogf(opts.logf(), "magicsock")
+	c.slog = logger.NewStructured(opts.logf(), "magicsock")
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
 	c.idleFunc = opts.IdleFunc
@@ -807,7 +811,20 @@ func (c *Conn) pickDERPFallback() int {
 	// We used to do the above for legacy clients, but never updated
 	// it for disco.
 
-	if c.myDerp != 0 {
+	// Stay on a region with a known problem only if all of them
+	// have problems.
+	if c.myDerp != 0 && !derpRegionHasProblem(c.myDerp) {
+		return c.myDerp
+	}
+	var healthy []int
+	for _, id := range ids {
+		if !derpRegionHasProblem(id) {
+			healthy = append(healthy, id)
+		}
+	}
+	if len(healthy) > 0 {
+		ids = healthy
+	} else if c.myDerp != 0 {
 		return c.myDerp
 	}
 
@@ -816,6 +833,13 @@ func (c *Conn) pickDERPFallback() int {
 	return ids[rand.New(rand.NewSource(int64(h.Sum64()))).Intn(len(ids))]
 }
 
+// derpRegionHasProblem reports whether the health package has a problem
+// recorded for the DERP region.
+func derpRegionHasProblem(region int) bool {
+	st, ok := health.DERPRegionStatus(region)
+	return ok && st.Problem != ""
+}
+
 // callNetInfoCallback calls the NetInfo callback (if previously
 // registered with SetNetInfoCallback) if ni has substantially changed
 // since the last state.
@@ -1408,6 +1432,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netip.AddrPort, peer key.NodePublic) cha
 
 	go c.runDerpReader(ctx, addr, dc, wg, startGate)
 	go c.runDerpWriter(ctx, dc, ch, wg, startGate)
+	go c.runDerpLatencyProbe(ctx, regionID, dc, startGate)
 	go c.derpActiveFunc()
 
 	return ad.writeCh
@@ -1607,6 +1632,49 @@ type derpWriteRequest struct {
 
 // runDerpWriter runs in a goroutine for the life of a DERP
 // connection, handling received packets.
+// derpLatencyProbeInterval is how often the home DERP region is pinged,
+// to measure its latency for the health package.
+const derpLatencyProbeInterval = time.Minute
+
+// runDerpLatencyProbe pings dc every derpLatencyProbeInterval while
+// regionID is the home DERP region, noting the round trip times with
+// the health package, until ctx is done.
+func (c *Conn) runDerpLatencyProbe(ctx context.Context, regionID int, dc *derphttp.Client, startGate <-chan struct{}) {
+	select {
+	case <-startGate:
+	case <-ctx.Done():
+		return
+	}
+	t := time.NewTicker(derpLatencyProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		home := c.myDerp == regionID
+		c.mu.Unlock()
+		if home {
+			c.pingDERPForLatency(ctx, regionID, dc)
+		}
+	}
+}
+
+// pingDERPForLatency pings dc, noting the round trip time with the
+// health package if it replies. It reports whether it did.
+func (c *Conn) pingDERPForLatency(ctx context.Context, regionID int, dc *derphttp.Client) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := dc.Ping(ctx); err != nil {
+		return false
+	}
+	health.NoteDERPRegionLatency(regionID, time.Since(start))
+	return true
+}
+
 func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan derpWriteRequest, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
 	defer wg.Decr()
 	select {
@@ -2292,7 +2360,9 @@ func nodesEqual(x, y []*tailcfg.Node) bool {
 		return false
 	}
 	for i := range x {
-		if !x[i].Equal(y[i]) {
+		// Unchanged nodes are usually shared between successive
+		// netmaps, so check for that first.
+		if x[i] != y[i] && !x[i].Equal(y[i]) {
 			return false
 		}
 	}
@@ -2444,7 +2514,7 @@ func (c *Conn) maybeCloseDERPsOnRebind(okayLocalIPs []netip.Prefix) {
 		go func() {
 			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 			defer cancel()
-			if err := dc.Ping(ctx); err != nil {
+			if !c.pingDERPForLatency(ctx, regionID, dc) {
 				c.mu.Lock()
 				defer c.mu.Unlock()
 				c.closeOrReconectDERPLocked(regionID, "rebind-ping-fail")
@@ -2848,6 +2918,7 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	uniq.ModifySlice(&ports, func(i, j int) bool { return ports[i] == ports[j] })
 
 	var pconn nettype.PacketConn
+	var lastErr error
 	for _, port := range ports {
 		// Close the existing conn, in case it is sitting on the port we want.
 		err := ruc.closeLocked()
@@ -2858,13 +2929,12 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 		pconn, err = c.listenPacket(network, port)
 		if err != nil {
 			c.logf("magicsock: unable to bind %v port %d: %v", network, port, err)
+			lastErr = err
 			continue
 		}
 		// Success.
 		ruc.setConnLocked(pconn)
-		if network == "udp4" {
-			health.SetUDP4Unbound(false)
-		}
+		setUDPUnbound(network, false)
 		return nil
 	}
 
@@ -2873,12 +2943,23 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	// This keeps the receive funcs alive for a future in which
 	// we get a link change and we can try binding again.
 	ruc.setConnLocked(newBlockForeverConn())
-	if network == "udp4" {
-		health.SetUDP4Unbound(true)
-	}
+	// A host without IPv6 support at all isn't unhealthy for lacking
+	// a udp6 socket.
+	setUDPUnbound(network, !errors.Is(lastErr, syscall.EAFNOSUPPORT))
 	return fmt.Errorf("failed to bind any ports (tried %v)", ports)
 }
 
+// setUDPUnbound tells the health package whether network's socket
+// ("udp4" or "udp6") failed to bind.
+func setUDPUnbound(network string, unbound bool) {
+	switch network {
+	case "udp4":
+		health.SetUDP4Unbound(unbound)
+	case "udp6":
+		health.SetUDP6Unbound(unbound)
+	}
+}
+
 type currentPortFate uint8
 
 const (
@@ -3888,7 +3969,11 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netip
 	if !isDerp {
 		thisPong := addrLatency{sp.to, latency}
 		if betterAddr(thisPong, de.bestAddr) {
-			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+			de.c.slog.Info("disco: node now using new path",
+				"node", de.publicKey.ShortString(),
+				"disco", de.discoShort,
+				"addr", sp.to,
+				"latency", latency.Round(time.Millisecond))
 			de.bestAddr = thisPong
 		}
 		if de.bestAddr.AddrPort == thisPong.AddrPort {
@@ -4147,49 +4232,51 @@ func (s derpAddrFamSelector) PreferIPv6() bool {
 }
 
 var (
-	metricNumPeers     = clientmetric.NewGauge("magicsock_netmap_num_peers")
-	metricNumDERPConns = clientmetric.NewGauge("magicsock_num_derp_conns")
+	metricGroup = clientmetric.NewGroup("magicsock", "peer-to-peer and DERP packet transport")
+
+	metricNumPeers     = metricGroup.NewGauge("netmap_num_peers", "peers in the current network map")
+	metricNumDERPConns = metricGroup.NewGauge("num_derp_conns", "open DERP connections")
 
-	metricRebindCalls     = clientmetric.NewCounter("magicsock_rebind_calls")
-	metricReSTUNCalls     = clientmetric.NewCounter("magicsock_restun_calls")
-	metricUpdateEndpoints = clientmetric.NewCounter("magicsock_update_endpoints")
+	metricRebindCalls     = metricGroup.NewCounter("rebind_calls", "times the UDP sockets were rebound")
+	metricReSTUNCalls     = metricGroup.NewCounter("restun_calls", "times a STUN re-query was requested")
+	metricUpdateEndpoints = metricGroup.NewCounter("update_endpoints", "times local endpoints were updated")
 
 	// Sends (data or disco)
-	metricSendDERPQueued      = clientmetric.NewCounter("magicsock_send_derp_queued")
-	metricSendDERPErrorChan   = clientmetric.NewCounter("magicsock_send_derp_error_chan")
-	metricSendDERPErrorClosed = clientmetric.NewCounter("magicsock_send_derp_error_closed")
-	metricSendDERPErrorQueue  = clientmetric.NewCounter("magicsock_send_derp_error_queue")
-	metricSendUDP             = clientmetric.NewCounter("magicsock_send_udp")
-	metricSendUDPError        = clientmetric.NewCounter("magicsock_send_udp_error")
-	metricSendDERP            = clientmetric.NewCounter("magicsock_send_derp")
-	metricSendDERPError       = clientmetric.NewCounter("magicsock_send_derp_error")
+	metricSendDERPQueued      = metricGroup.NewCounter("send_derp_queued", "packets queued for sending via DERP")
+	metricSendDERPErrorChan   = metricGroup.NewCounter("send_derp_error_chan", "DERP sends dropped because the write channel was full")
+	metricSendDERPErrorClosed = metricGroup.NewCounter("send_derp_error_closed", "DERP sends dropped because the connection was closed")
+	metricSendDERPErrorQueue  = metricGroup.NewCounter("send_derp_error_queue", "DERP sends dropped because the queue was full")
+	metricSendUDP             = metricGroup.NewCounter("send_udp", "packets sent over UDP")
+	metricSendUDPError        = metricGroup.NewCounter("send_udp_error", "UDP sends that failed")
+	metricSendDERP            = metricGroup.NewCounter("send_derp", "packets sent via DERP")
+	metricSendDERPError       = metricGroup.NewCounter("send_derp_error", "DERP sends that failed")
 
 	// Data packets (non-disco)
-	metricSendData            = clientmetric.NewCounter("magicsock_send_data")
-	metricSendDataNetworkDown = clientmetric.NewCounter("magicsock_send_data_network_down")
-	metricRecvDataDERP        = clientmetric.NewCounter("magicsock_recv_data_derp")
-	metricRecvDataIPv4        = clientmetric.NewCounter("magicsock_recv_data_ipv4")
-	metricRecvDataIPv6        = clientmetric.NewCounter("magicsock_recv_data_ipv6")
+	metricSendData            = metricGroup.NewCounter("send_data", "data packets sent")
+	metricSendDataNetworkDown = metricGroup.NewCounter("send_data_network_down", "data packets dropped because the network was down")
+	metricRecvDataDERP        = metricGroup.NewCounter("recv_data_derp", "data packets received via DERP")
+	metricRecvDataIPv4        = metricGroup.NewCounter("recv_data_ipv4", "data packets received over IPv4 UDP")
+	metricRecvDataIPv6        = metricGroup.NewCounter("recv_data_ipv6", "data packets received over IPv6 UDP")
 
 	// Disco packets
-	metricSendDiscoUDP         = clientmetric.NewCounter("magicsock_disco_send_udp")
-	metricSendDiscoDERP        = clientmetric.NewCounter("magicsock_disco_send_derp")
-	metricSentDiscoUDP         = clientmetric.NewCounter("magicsock_disco_sent_udp")
-	metricSentDiscoDERP        = clientmetric.NewCounter("magicsock_disco_sent_derp")
-	metricSentDiscoPing        = clientmetric.NewCounter("magicsock_disco_sent_ping")
-	metricSentDiscoPong        = clientmetric.NewCounter("magicsock_disco_sent_pong")
-	metricSentDiscoCallMeMaybe = clientmetric.NewCounter("magicsock_disco_sent_callmemaybe")
-	metricRecvDiscoBadPeer     = clientmetric.NewCounter("magicsock_disco_recv_bad_peer")
-	metricRecvDiscoBadKey      = clientmetric.NewCounter("magicsock_disco_recv_bad_key")
-	metricRecvDiscoBadParse    = clientmetric.NewCounter("magicsock_disco_recv_bad_parse")
-
-	metricRecvDiscoUDP                 = clientmetric.NewCounter("magicsock_disco_recv_udp")
-	metricRecvDiscoDERP                = clientmetric.NewCounter("magicsock_disco_recv_derp")
-	metricRecvDiscoPing                = clientmetric.NewCounter("magicsock_disco_recv_ping")
-	metricRecvDiscoPong                = clientmetric.NewCounter("magicsock_disco_recv_pong")
-	metricRecvDiscoCallMeMaybe         = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe")
-	metricRecvDiscoCallMeMaybeBadNode  = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_node")
-	metricRecvDiscoCallMeMaybeBadDisco = clientmetric.NewCounter("magicsock_disco_recv_callmemaybe_bad_disco")
+	metricSendDiscoUDP         = metricGroup.NewCounter("disco_send_udp", "disco messages attempted over UDP")
+	metricSendDiscoDERP        = metricGroup.NewCounter("disco_send_derp", "disco messages attempted via DERP")
+	metricSentDiscoUDP         = metricGroup.NewCounter("disco_sent_udp", "disco messages sent over UDP")
+	metricSentDiscoDERP        = metricGroup.NewCounter("disco_sent_derp", "disco messages sent via DERP")
+	metricSentDiscoPing        = metricGroup.NewCounter("disco_sent_ping", "disco pings sent")
+	metricSentDiscoPong        = metricGroup.NewCounter("disco_sent_pong", "disco pongs sent")
+	metricSentDiscoCallMeMaybe = metricGroup.NewCounter("disco_sent_callmemaybe", "disco call-me-maybe messages sent")
+	metricRecvDiscoBadPeer     = metricGroup.NewCounter("disco_recv_bad_peer", "disco messages received from unknown peers")
+	metricRecvDiscoBadKey      = metricGroup.NewCounter("disco_recv_bad_key", "disco messages received with undecryptable boxes")
+	metricRecvDiscoBadParse    = metricGroup.NewCounter("disco_recv_bad_parse", "disco messages received that failed to parse")
+
+	metricRecvDiscoUDP                 = metricGroup.NewCounter("disco_recv_udp", "disco messages received over UDP")
+	metricRecvDiscoDERP                = metricGroup.NewCounter("disco_recv_derp", "disco messages received via DERP")
+	metricRecvDiscoPing                = metricGroup.NewCounter("disco_recv_ping", "disco pings received")
+	metricRecvDiscoPong                = metricGroup.NewCounter("disco_recv_pong", "disco pongs received")
+	metricRecvDiscoCallMeMaybe         = metricGroup.NewCounter("disco_recv_callmemaybe", "disco call-me-maybe messages received")
+	metricRecvDiscoCallMeMaybeBadNode  = metricGroup.NewCounter("disco_recv_callmemaybe_bad_node", "call-me-maybe messages received from unknown nodes")
+	metricRecvDiscoCallMeMaybeBadDisco = metricGroup.NewCounter("disco_recv_callmemaybe_bad_disco", "call-me-maybe messages received with mismatched disco keys")
 
 	// metricDERPHomeChange is how many times our DERP home region DI has
 	// changed from non-zero to a different non-zero.
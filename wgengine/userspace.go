@@ -100,6 +100,7 @@ type userspaceEngine struct {
 	linkMon           *monitor.Mon
 	linkMonOwned      bool       // whether we created linkMon (and thus need to close it)
 	linkMonUnregister func()     // unsubscribes from changes; used regardless of linkMonOwned
+	unregisterFixes   []func()   // unregisters the health remediations
 	birdClient        BIRDClient // or nil
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
@@ -119,6 +120,7 @@ type userspaceEngine struct {
 	lastRouterSig       deephash.Sum // of router.Config
 	lastEngineSigFull   deephash.Sum // of full wireguard config
 	lastEngineSigTrim   deephash.Sum // of trimmed wireguard config
+	lastRouterConfig    *router.Config
 	lastDNSConfig       *dns.Config
 	lastIsSubnetRouter  bool // was the node a primary subnet router in the last run.
 	recvActivityAt      map[key.NodePublic]mono.Time
@@ -297,7 +299,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 
 	e := &userspaceEngine{
 		timeNow:        mono.Now,
-		logf:           logf,
+		logf:           logger.ComponentLogf(logf, "wgengine"),
 		reqCh:          make(chan struct{}, 1),
 		waitCh:         make(chan struct{}),
 		tundev:         tsTUNDev,
@@ -456,10 +458,43 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 
 	go e.pollResolver()
 
+	e.unregisterFixes = []func(){
+		health.RegisterRemediation(health.SysRouter, e.reapplyRouterConfig),
+		health.RegisterRemediation(health.SysDNS, e.reapplyDNSConfig),
+	}
+
 	e.logf("Engine created.")
 	return e, nil
 }
 
+// reapplyRouterConfig is the health remediation for the router: it sets
+// the last router config again.
+func (e *userspaceEngine) reapplyRouterConfig(error) error {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if e.lastRouterConfig == nil {
+		return errors.New("no router config to reapply")
+	}
+	e.logf("wgengine: reapplying router config to recover")
+	err := e.router.Set(e.lastRouterConfig)
+	health.SetRouterHealth(err)
+	return err
+}
+
+// reapplyDNSConfig is the health remediation for DNS: it sets the last
+// DNS config again.
+func (e *userspaceEngine) reapplyDNSConfig(error) error {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if e.lastDNSConfig == nil {
+		return errors.New("no DNS config to reapply")
+	}
+	e.logf("wgengine: reapplying DNS config to recover")
+	err := e.dns.Set(*e.lastDNSConfig)
+	health.SetDNSHealth(err)
+	return err
+}
+
 // echoRespondToAll is an inbound post-filter responding to all echo requests.
 func echoRespondToAll(p *packet.Parsed, t *tstun.Wrapper) filter.Response {
 	if p.IsEchoRequest() {
@@ -837,6 +872,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	e.wgLock.Lock()
 	defer e.wgLock.Unlock()
 	e.lastDNSConfig = dnsCfg
+	e.lastRouterConfig = routerCfg
 
 	peerSet := make(map[key.NodePublic]struct{}, len(cfg.Peers))
 	e.mu.Lock()
@@ -1162,6 +1198,9 @@ func (e *userspaceEngine) Close() {
 	e.wgdev.IpcSetOperation(r)
 	e.magicConn.Close()
 	e.linkMonUnregister()
+	for _, unregister := range e.unregisterFixes {
+		unregister()
+	}
 	if e.linkMonOwned {
 		e.linkMon.Close()
 	}